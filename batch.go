@@ -0,0 +1,245 @@
+package juggler
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+)
+
+// connBatch collects the responses to the requests of a batch while
+// it is processed, and the contiguous calls and publications deferred
+// so that they can be sent to the brokers at once. The results of the
+// calls of the batch are held until the Back is sent, so that the
+// client receives the Ack of a call before its result.
+type connBatch struct {
+	mu    sync.Mutex
+	index map[string]int // request UUID to index in resps
+	resps []message.Msg
+	held  []message.Msg // results sent after the Back
+	done  bool          // set once the Back is sent
+
+	// the deferred calls and publications, only accessed by the
+	// goroutine that processes the batch.
+	calls []*message.Call
+	cps   []*message.CallPayload
+	pubs  []*message.Pub
+	pps   []*message.PubPayload
+}
+
+func newConnBatch(reqs []message.Msg) *connBatch {
+	b := &connBatch{
+		index: make(map[string]int, len(reqs)),
+		resps: make([]message.Msg, len(reqs)),
+	}
+	for i, m := range reqs {
+		b.index[m.UUID().String()] = i
+	}
+	return b
+}
+
+// setResponse records m as the response to its request if m is an
+// Ack or Nack for a request of the batch. It returns true if it was
+// recorded, in which case it must not be sent to the client.
+func (b *connBatch) setResponse(m message.Msg) bool {
+	var key string
+	switch m := m.(type) {
+	case *message.Ack:
+		key = m.Payload.For.String()
+	case *message.Nack:
+		key = m.Payload.For.String()
+	default:
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i, ok := b.index[key]
+	if !ok || b.done || b.resps[i] != nil {
+		return false
+	}
+	b.resps[i] = m
+	return true
+}
+
+// holdResult holds m until the Back is sent if m is a Res or Prog for
+// a call of the batch. It returns true if it was held, in which case
+// it must not be sent to the client yet.
+func (b *connBatch) holdResult(m message.Msg) bool {
+	var key string
+	switch m := m.(type) {
+	case *message.Res:
+		key = m.Payload.For.String()
+	case *message.Prog:
+		key = m.Payload.For.String()
+	default:
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.index[key]; !ok || b.done {
+		return false
+	}
+	b.held = append(b.held, m)
+	return true
+}
+
+// release returns the held results, in the order they were received.
+// Once there are none left, the Back is marked as sent and the results
+// are not held anymore.
+func (b *connBatch) release() []message.Msg {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	held := b.held
+	b.held = nil
+	b.done = len(held) == 0
+	return held
+}
+
+// responses returns the recorded responses, in the order of the
+// requests.
+func (b *connBatch) responses() []message.Msg {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	resps := make([]message.Msg, 0, len(b.resps))
+	for _, m := range b.resps {
+		if m != nil {
+			resps = append(resps, m)
+		}
+	}
+	return resps
+}
+
+// deferCall defers the registration of the call request cp of m
+// until the next flush, if the caller broker of c supports it. It returns true if the call is deferred.
+func (b *connBatch) deferCall(c *Conn, m *message.Call, cp *message.CallPayload) bool {
+	if _, ok := c.cb.(broker.BatchCaller); !ok {
+		return false
+	}
+	b.calls = append(b.calls, m)
+	b.cps = append(b.cps, cp)
+	return true
+}
+
+// deferPub defers the publication of the event pp of m until the next
+// flush, if the pub-sub broker of c supports it. It returns
+// true if the publication is deferred.
+func (b *connBatch) deferPub(c *Conn, m *message.Pub, pp *message.PubPayload) bool {
+	if _, ok := c.psb.(broker.BatchPublisher); !ok {
+		return false
+	}
+	b.pubs = append(b.pubs, m)
+	b.pps = append(b.pps, pp)
+	return true
+}
+
+// flush sends the deferred calls and publications to the brokers,
+// and sends the Ack or Nack of each one.
+func (b *connBatch) flush(c *Conn, addFn func(string, int64)) {
+	defer func() {
+		b.calls, b.cps, b.pubs, b.pps = nil, nil, nil, nil
+	}()
+
+	if len(b.calls) > 0 {
+		tos := make([]time.Duration, len(b.calls))
+		for i, m := range b.calls {
+			tos[i] = m.Payload.Timeout
+		}
+		errs := c.cb.(broker.BatchCaller).CallBatch(b.cps, tos)
+		addFn("BatchedCalls", int64(len(b.calls)))
+		for i, m := range b.calls {
+			if err := errs[i]; err != nil {
+				c.Send(newNack(m, err))
+				continue
+			}
+			c.Send(message.NewAck(m))
+		}
+	}
+
+	if len(b.pubs) > 0 {
+		chans := make([]string, len(b.pubs))
+		for i, m := range b.pubs {
+			chans[i] = m.Payload.Channel
+		}
+		errs := c.psb.(broker.BatchPublisher).PublishBatch(chans, b.pps)
+		addFn("BatchedPubs", int64(len(b.pubs)))
+		for i, m := range b.pubs {
+			if err := errs[i]; err != nil {
+				c.Send(newNack(m, err))
+				continue
+			}
+			c.Send(message.NewAck(m))
+		}
+	}
+}
+
+// currentBatch returns the batch being processed on the connection,
+// or nil.
+func (c *Conn) currentBatch() *connBatch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batch
+}
+
+func (c *Conn) setBatch(b *connBatch) {
+	c.mu.Lock()
+	c.batch = b
+	c.mu.Unlock()
+}
+
+// processBatch processes the requests of the batch m in order, each
+// one going through the server's Handler as if it was received on
+// its own, and sends a single Back with the Ack and Nack responses,
+// followed by the results of the calls that were received meanwhile.
+// Contiguous calls and publications are sent to the brokers at once
+// if they support it, so that the underlying commands can be
+// pipelined. They are sent before any other request is processed, so
+// that the requests take effect in the order of the batch.
+func processBatch(c *Conn, m *message.Btch, addFn func(string, int64)) {
+	reqs, err := m.Requests(c.codec, c.allowedMsgs...)
+	if err != nil {
+		// same as an invalid message received on the connection
+		c.Close(err)
+		return
+	}
+
+	b := newConnBatch(reqs)
+	c.setBatch(b)
+	for _, req := range reqs {
+		if t := req.Type(); t != message.CallMsg && t != message.PubMsg {
+			b.flush(c, addFn)
+		}
+		if h := c.srv.Handler; h != nil {
+			h.Handle(context.Background(), c, req)
+		} else {
+			ProcessMsg(c, req)
+		}
+	}
+	b.flush(c, addFn)
+
+	// the held results already went through the Handler, they are
+	// written once the Back is sent.
+	defer func() {
+		for held := b.release(); len(held) > 0; held = b.release() {
+			for _, res := range held {
+				doWrite(c, res, addFn)
+			}
+		}
+		c.setBatch(nil)
+	}()
+
+	back, err := message.NewBack(c.codec, m, b.responses()...)
+	if err != nil {
+		c.Send(newNack(m, err))
+		return
+	}
+	c.Send(back)
+}
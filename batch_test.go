@@ -0,0 +1,249 @@
+package juggler
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/client"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBatchBroker struct {
+	fakeBroker
+
+	mu    sync.Mutex
+	calls []string
+	pubs  []string
+	ops   []string // the batched commands and the other requests, in order
+}
+
+func (f *fakeBatchBroker) CallBatch(cps []*message.CallPayload, timeouts []time.Duration) []error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	errs := make([]error, len(cps))
+	for i, cp := range cps {
+		f.calls = append(f.calls, cp.URI)
+		f.ops = append(f.ops, "call "+cp.URI)
+		if cp.URI == "ko" {
+			errs[i] = broker.ErrCapacityExceeded
+		}
+	}
+	return errs
+}
+
+func (f *fakeBatchBroker) PublishBatch(channels []string, pps []*message.PubPayload) []error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pubs = append(f.pubs, channels...)
+	for _, ch := range channels {
+		f.ops = append(f.ops, "pub "+ch)
+	}
+	return make([]error, len(pps))
+}
+
+func TestBatch(t *testing.T) {
+	brk := &fakeBatchBroker{}
+	vars := new(expvar.Map).Init()
+
+	var mu sync.Mutex
+	var handled []message.Type
+	server := &Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		Metrics:      metrics.NewExpvar(vars),
+		Handler: HandlerFunc(func(ctx context.Context, c *Conn, m message.Msg) {
+			if m.Type().IsRead() {
+				mu.Lock()
+				handled = append(handled, m.Type())
+				mu.Unlock()
+			}
+			ProcessMsg(c, m)
+		}),
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	recv := make(map[string]message.Msg)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		defer wg.Done()
+
+		var key string
+		switch m := m.(type) {
+		case *message.Ack:
+			key = m.Payload.For.String()
+		case *message.Nack:
+			key = m.Payload.For.String()
+		default:
+			t.Errorf("unexpected message type: %T", m)
+			return
+		}
+		mu.Lock()
+		recv[key] = m
+		mu.Unlock()
+	})
+
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: Subprotocols}, srv.URL, nil, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	b := cli.NewBatch()
+	uidA, err := b.Call("a", 1, time.Minute)
+	require.NoError(t, err, "Call a")
+	uidB := b.Sub("b", false)
+	uidKO, err := b.Call("ko", 2, time.Minute)
+	require.NoError(t, err, "Call ko")
+	uidC, err := b.Pub("c", 3)
+	require.NoError(t, err, "Pub c")
+
+	wg.Add(b.Len())
+	_, err = b.Send()
+	require.NoError(t, err, "Send")
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []message.Type{message.HelloMsg, message.BtchMsg, message.CallMsg, message.SubMsg, message.CallMsg, message.PubMsg}, handled, "requests go through the handler")
+	if assert.Equal(t, 4, len(recv), "received responses") {
+		assert.Equal(t, message.AckMsg, recv[uidA.String()].Type(), "call a")
+		assert.Equal(t, message.AckMsg, recv[uidB.String()].Type(), "sub b")
+		assert.Equal(t, message.AckMsg, recv[uidC.String()].Type(), "pub c")
+		if assert.Equal(t, message.NackMsg, recv[uidKO.String()].Type(), "call ko") {
+			assert.Equal(t, 503, recv[uidKO.String()].(*message.Nack).Payload.Code, "NACK code")
+		}
+	}
+
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+	assert.Equal(t, []string{"a", "ko"}, brk.calls, "batched calls")
+	assert.Equal(t, []string{"c"}, brk.pubs, "batched pubs")
+	assert.Equal(t, "2", vars.Get("BatchedCalls").String(), "BatchedCalls")
+	assert.Equal(t, "1", vars.Get("MsgsBACK").String(), "MsgsBACK")
+}
+
+func TestBatchOrder(t *testing.T) {
+	brk := &fakeBatchBroker{}
+	server := &Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		Handler: HandlerFunc(func(ctx context.Context, c *Conn, m message.Msg) {
+			switch m := m.(type) {
+			case *message.Sub:
+				brk.mu.Lock()
+				brk.ops = append(brk.ops, "sub "+m.Payload.Channel)
+				brk.mu.Unlock()
+			case *message.Unsb:
+				brk.mu.Lock()
+				brk.ops = append(brk.ops, "unsb "+m.Payload.Channel)
+				brk.mu.Unlock()
+			}
+			ProcessMsg(c, m)
+		}),
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		wg.Done()
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: Subprotocols}, srv.URL, nil, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	b := cli.NewBatch()
+	_, err = b.Pub("x", 1)
+	require.NoError(t, err, "Pub x")
+	b.Sub("x", false)
+	_, err = b.Call("a", 2, time.Minute)
+	require.NoError(t, err, "Call a")
+	_, err = b.Pub("y", 3)
+	require.NoError(t, err, "Pub y")
+	b.Unsb("x", false)
+	_, err = b.Call("b", 4, time.Minute)
+	require.NoError(t, err, "Call b")
+
+	wg.Add(b.Len())
+	_, err = b.Send()
+	require.NoError(t, err, "Send")
+	wg.Wait()
+
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+
+	// contiguous calls and publications are batched, and sent before
+	// the next request of another type is processed.
+	assert.Equal(t, []string{"pub x", "sub x", "call a", "pub y", "unsb x", "call b"}, brk.ops, "order of the requests")
+}
+
+type fakeCacheBatchBroker struct {
+	fakeBatchBroker
+}
+
+func (f *fakeCacheBatchBroker) CachedResult(cp *message.CallPayload) (json.RawMessage, error) {
+	if cp.URI == "cached" {
+		return json.RawMessage(`"ok"`), nil
+	}
+	return nil, nil
+}
+
+func TestBatchResultAfterBack(t *testing.T) {
+	brk := &fakeCacheBatchBroker{}
+	server := &Server{CallerBroker: brk, PubSubBroker: brk}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(srv.URL, http.Header{"Sec-WebSocket-Protocol": {"juggler.0"}})
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+
+	read := func() message.Msg {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, r, err := conn.NextReader()
+		require.NoError(t, err, "NextReader")
+		m, err := message.Decode(message.JSONCodec, r)
+		require.NoError(t, err, "Decode")
+		return m
+	}
+
+	// the cached result is synthesized while the call is processed,
+	// it is sent after the BACK that holds the ACK of the call.
+	call, err := message.NewCall("cached", nil, time.Minute)
+	require.NoError(t, err, "NewCall")
+	btch, err := message.NewBtch(message.JSONCodec, call)
+	require.NoError(t, err, "NewBtch")
+	require.NoError(t, conn.WriteJSON(btch), "write BTCH")
+
+	if m := read(); assert.Equal(t, message.BackMsg, m.Type(), "BACK first") {
+		resps, err := m.(*message.Back).Responses(message.JSONCodec)
+		require.NoError(t, err, "Responses")
+		if assert.Equal(t, 1, len(resps), "responses") {
+			assert.Equal(t, message.AckMsg, resps[0].Type(), "ACK of the call")
+		}
+	}
+	if m := read(); assert.Equal(t, message.ResMsg, m.Type(), "RES second") {
+		assert.Equal(t, call.UUID(), m.(*message.Res).Payload.For, "RES of the call")
+	}
+}
@@ -4,6 +4,11 @@
 package broker
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/mna/juggler/message"
@@ -17,6 +22,10 @@ import (
 // on the message. It should not be set to less than 1ms.
 var DefaultCallTimeout = time.Minute
 
+// ErrCapacityExceeded is returned when a call request or a result
+// cannot be registered because the capacity of its queue is exceeded.
+var ErrCapacityExceeded = errors.New("broker: list capacity exceeded")
+
 // CallerBroker defines the methods for a broker in the caller role.
 type CallerBroker interface {
 	// NewResultsConn returns a new ResultsConn that can be used
@@ -50,6 +59,161 @@ type PubSubBroker interface {
 	Publish(channel string, pp *message.PubPayload) error
 }
 
+// CallScheduler is implemented by CallerBrokers that can delay call
+// requests until a given time.
+type CallScheduler interface {
+	// ScheduleCall registers a call request in the broker that is made
+	// available to callees at notBefore. The timeout starts counting
+	// from notBefore.
+	ScheduleCall(cp *message.CallPayload, timeout time.Duration, notBefore time.Time) error
+}
+
+// CallBroadcaster is implemented by CallerBrokers that can send a
+// call request to all the callees listening on its URI, instead of
+// only one of them.
+type CallBroadcaster interface {
+	// BroadcastCall sends the call request to all callees listening
+	// on its URI. Each callee stores its own result for the call. It
+	// returns the number of callees that received the call.
+	BroadcastCall(cp *message.CallPayload, timeout time.Duration) (int, error)
+}
+
+// BatchCaller is implemented by CallerBrokers that can register many
+// call requests at once, e.g. in a single round-trip to the backend.
+type BatchCaller interface {
+	// CallBatch registers the call requests cps in order, using the
+	// timeout at the same index in timeouts. It returns the error of
+	// each call request, at the same index, nil if it was registered.
+	CallBatch(cps []*message.CallPayload, timeouts []time.Duration) []error
+}
+
+// BatchPublisher is implemented by PubSubBrokers that can publish
+// many events at once, e.g. in a single round-trip to the backend.
+type BatchPublisher interface {
+	// PublishBatch publishes the events pps in order, each on the
+	// channel at the same index in channels. It returns the error of
+	// each event, at the same index, nil if it was published.
+	PublishBatch(channels []string, pps []*message.PubPayload) []error
+}
+
+// ResultCache is implemented by CallerBrokers that can serve the
+// results of calls from a cache, so that identical calls do not
+// need to be processed by a callee.
+type ResultCache interface {
+	// CachedResult returns the cached result of the call request cp,
+	// or nil if there is no such result.
+	CachedResult(cp *message.CallPayload) (json.RawMessage, error)
+}
+
+// CacheInvalidator is implemented by CalleeBrokers that can remove
+// cached results.
+type CacheInvalidator interface {
+	// InvalidateCache removes the cached result of the calls to uri
+	// with the arguments args.
+	InvalidateCache(uri string, args json.RawMessage) error
+}
+
+// CacheKey returns the key that identifies the arguments of a call
+// in a result cache. The arguments are canonicalized first, so that
+// equivalent JSON values, e.g. objects with the same keys in a
+// different order, have the same key.
+func CacheKey(args json.RawMessage) (string, error) {
+	if len(args) == 0 {
+		args = json.RawMessage("null")
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(args))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+
+	// objects are encoded with sorted keys and no whitespace
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CallerNamespacer is implemented by CallerBrokers that can isolate
+// their keys in a namespace, e.g. to serve multiple tenants.
+type CallerNamespacer interface {
+	// CallerWithNamespace returns a CallerBroker that uses the
+	// namespace ns.
+	CallerWithNamespace(ns string) CallerBroker
+}
+
+// PubSubNamespacer is implemented by PubSubBrokers that can isolate
+// their channels in a namespace, e.g. to serve multiple tenants.
+type PubSubNamespacer interface {
+	// PubSubWithNamespace returns a PubSubBroker that uses the
+	// namespace ns.
+	PubSubWithNamespace(ns string) PubSubBroker
+}
+
+// ServiceRegistry is implemented by brokers that track the callee
+// instances that serve each URI. Callees register their URIs, and
+// callers can check if any callee is available for a URI.
+type ServiceRegistry interface {
+	// RegisterService records or refreshes the registration of the
+	// callee instance described by sp, for the duration ttl.
+	RegisterService(sp *message.ServicePayload, ttl time.Duration) error
+
+	// DeregisterService removes the registration of the callee
+	// instance for uri.
+	DeregisterService(uri, instance string) error
+
+	// Services returns the callee instances currently registered for
+	// uri, or for all URIs if uri is empty.
+	Services(uri string) ([]*message.ServicePayload, error)
+}
+
+// SessionStore is implemented by CallerBrokers that can store the
+// sessions of connections, so that a client can resume the session of
+// a closed connection when it reconnects.
+type SessionStore interface {
+	// SaveSession stores the session sp for the duration ttl,
+	// replacing the session of the same connection UUID, if any.
+	SaveSession(sp *message.SessionPayload, ttl time.Duration) error
+
+	// ResumeSession removes and returns the session of the connection
+	// connUUID if its token hash is tokenHash, so that a session can
+	// only be resumed once. It returns nil if there is no such session,
+	// e.g. because it has expired.
+	ResumeSession(connUUID uuid.UUID, tokenHash string) (*message.SessionPayload, error)
+}
+
+// PresenceChannelPrefix is the prefix of the companion channel on
+// which join and leave events are published for a pub-sub channel.
+// Subscriptions to those companion channels are not tracked.
+const PresenceChannelPrefix = "juggler:presence:"
+
+// PresenceChannel returns the name of the companion channel on which
+// join and leave events are published for channel.
+func PresenceChannel(channel string) string {
+	return PresenceChannelPrefix + channel
+}
+
+// PresenceBroker defines the methods for a broker that tracks the
+// presence of connections on pub-sub channels.
+type PresenceBroker interface {
+	// Presence returns the list of connections currently subscribed
+	// to the channel.
+	Presence(channel string) ([]*message.PresencePayload, error)
+}
+
+// PresenceConn is implemented by PubSubConn values that can record
+// the presence of their connection on the channels it subscribes to.
+type PresenceConn interface {
+	// SetPresence sets the connection UUID and the optional identity
+	// metadata recorded for each subscription made on the PubSubConn.
+	// It may be called again to update the identity.
+	SetPresence(connUUID uuid.UUID, identity json.RawMessage) error
+}
+
 // ResultsConn defines the methods to list the results from calls
 // made on the ResultsConn connection UUID.
 type ResultsConn interface {
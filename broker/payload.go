@@ -0,0 +1,151 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/mna/juggler/message"
+)
+
+// PayloadCodec defines the methods required to encode and decode the
+// payloads stored in a broker, such as message.CallPayload,
+// message.ResPayload and message.PubPayload. The first byte of an
+// encoded payload is the version of its codec, so that payloads
+// encoded with different codecs can coexist in the broker, e.g. while
+// callers and callees are being upgraded. UnmarshalPayload decodes
+// payloads of any registered version.
+type PayloadCodec interface {
+	// Version returns the version byte of the codec. It is the first
+	// byte of the payloads encoded by the codec.
+	Version() byte
+
+	// Marshal returns the encoding of v, starting with the version byte.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes the payload b, including its version byte,
+	// into v.
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// The payload codecs supported by this package.
+var (
+	// JSONPayloadCodec encodes payloads as JSON objects. Its version
+	// byte is the opening brace of the object, so that payloads stored
+	// before versions were introduced are decoded with this codec. It
+	// is the default codec.
+	JSONPayloadCodec PayloadCodec = jsonPayloadCodec{}
+
+	// BinaryPayloadCodec encodes payloads as a MessagePack envelope,
+	// with the version byte 1. It is more compact than JSON, and the
+	// Args of the payloads are stored as raw bytes instead of being
+	// validated and copied as embedded JSON.
+	BinaryPayloadCodec PayloadCodec = binaryPayloadCodec{}
+)
+
+var (
+	payloadCodecsMu sync.RWMutex
+	payloadCodecs   = map[byte]PayloadCodec{
+		JSONPayloadCodec.Version():   JSONPayloadCodec,
+		BinaryPayloadCodec.Version(): BinaryPayloadCodec,
+	}
+)
+
+// RegisterPayloadCodec registers a custom payload codec so that its
+// payloads can be decoded by UnmarshalPayload. It panics if a codec
+// is already registered for its version byte.
+func RegisterPayloadCodec(c PayloadCodec) {
+	payloadCodecsMu.Lock()
+	defer payloadCodecsMu.Unlock()
+
+	if _, ok := payloadCodecs[c.Version()]; ok {
+		panic(fmt.Sprintf("RegisterPayloadCodec called twice for version %d", c.Version()))
+	}
+	payloadCodecs[c.Version()] = c
+}
+
+// MarshalPayload encodes v using the codec c, or JSONPayloadCodec if
+// c is nil. If the codec is JSONPayloadCodec and the Args of v are not
+// valid JSON, e.g. because they were sent by a client using a binary
+// wire codec (see message.Codecs), BinaryPayloadCodec is used instead
+// so that the Args are stored as opaque bytes.
+func MarshalPayload(c PayloadCodec, v interface{}) ([]byte, error) {
+	if c == nil {
+		c = JSONPayloadCodec
+	}
+	if c == JSONPayloadCodec {
+		if args := payloadArgs(v); len(args) > 0 && !validJSON(args) {
+			c = BinaryPayloadCodec
+		}
+	}
+	return c.Marshal(v)
+}
+
+// validJSON returns true if b is a valid JSON value.
+func validJSON(b []byte) bool {
+	var raw json.RawMessage
+	return json.Unmarshal(b, &raw) == nil
+}
+
+// payloadArgs returns the Args of the payload v, if it has any.
+func payloadArgs(v interface{}) json.RawMessage {
+	switch v := v.(type) {
+	case *message.CallPayload:
+		return v.Args
+	case *message.ResPayload:
+		return v.Args
+	case *message.PubPayload:
+		return v.Args
+	case *message.EvntPayload:
+		return v.Args
+	}
+	return nil
+}
+
+// UnmarshalPayload decodes the payload b into v, using the registered
+// codec identified by its version byte.
+func UnmarshalPayload(b []byte, v interface{}) error {
+	if len(b) == 0 {
+		return errors.New("broker: empty payload")
+	}
+
+	payloadCodecsMu.RLock()
+	c := payloadCodecs[b[0]]
+	payloadCodecsMu.RUnlock()
+
+	if c == nil {
+		return fmt.Errorf("broker: unknown payload version %d", b[0])
+	}
+	return c.Unmarshal(b, v)
+}
+
+type jsonPayloadCodec struct{}
+
+func (jsonPayloadCodec) Version() byte { return '{' }
+
+func (jsonPayloadCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonPayloadCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+type binaryPayloadCodec struct{}
+
+func (binaryPayloadCodec) Version() byte { return 1 }
+
+func (c binaryPayloadCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(c.Version())
+	if err := message.MsgpackCodec.Encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (binaryPayloadCodec) Unmarshal(b []byte, v interface{}) error {
+	return message.MsgpackCodec.Decode(b[1:], v)
+}
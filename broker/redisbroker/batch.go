@@ -0,0 +1,126 @@
+package redisbroker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/tracing"
+	"github.com/garyburd/redigo/redis"
+)
+
+// CallBatch registers the call requests cps in the broker, in order.
+// The commands are pipelined on a single connection, except for calls
+// with an idempotency key, which are registered individually, and
+// when running in a redis cluster, where the keys of the calls may be
+// in different slots, in which case each call is registered as if
+// Call was called.
+func (b *Broker) CallBatch(cps []*message.CallPayload, timeouts []time.Duration) []error {
+	errs := make([]error, len(cps))
+
+	rc := b.Pool.Get()
+	_, cluster := rc.(binder)
+	rc.Close()
+
+	var run []int
+	for i, cp := range cps {
+		if cluster || (cp.IdempotencyKey != "" && b.IdempotencyWindow >= 0) {
+			// register the pending pipelined calls first, to keep the order
+			b.pipelineCalls(run, cps, timeouts, errs)
+			run = run[:0]
+			errs[i] = b.Call(cp, timeouts[i])
+			continue
+		}
+		run = append(run, i)
+	}
+	b.pipelineCalls(run, cps, timeouts, errs)
+	return errs
+}
+
+// pipelineCalls registers the call requests of cps at the indices
+// in run, storing their error at the same index in errs.
+func (b *Broker) pipelineCalls(run []int, cps []*message.CallPayload, timeouts []time.Duration, errs []error) {
+	if len(run) == 0 {
+		return
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	spans := make([]tracing.Span, len(cps))
+	sent := make([]int, 0, len(run))
+	for _, i := range run {
+		cp := cps[i]
+		spans[i] = traceCall(b.Tracer, cp, "redisbroker.enqueue")
+		if cp.Timestamp.IsZero() {
+			cp.Timestamp = time.Now().UTC()
+		}
+		k1 := nsKey(b.Namespace, fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID))
+		k2 := nsKey(b.Namespace, callListKey(cp.URI, clampPriority(cp.Priority, b.PriorityLevels)))
+		_, args, err := callOrResArgs(b.PayloadCodec, cp, timeouts[i], b.CallCap, k1, k2, nil)
+		if err == nil {
+			err = callOrResScript.Send(rc, args...)
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		sent = append(sent, i)
+	}
+	receiveAll(rc, sent, errs)
+
+	for _, i := range run {
+		spans[i].End(errs[i])
+	}
+}
+
+// PublishBatch publishes the events pps in order, each on the channel
+// at the same index in channels. The commands are pipelined on a
+// single connection.
+func (b *Broker) PublishBatch(channels []string, pps []*message.PubPayload) []error {
+	errs := make([]error, len(pps))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	// force selection of a random node, as in Publish.
+	if bc, ok := rc.(binder); ok {
+		bc.Bind()
+	}
+
+	sent := make([]int, 0, len(pps))
+	for i, pp := range pps {
+		p, err := broker.MarshalPayload(b.PayloadCodec, pp)
+		if err == nil {
+			err = rc.Send("PUBLISH", nsKey(b.Namespace, channels[i]), p)
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		sent = append(sent, i)
+	}
+	receiveAll(rc, sent, errs)
+	return errs
+}
+
+// receiveAll flushes the pipelined commands on rc and receives their
+// replies, storing the error of each command at the index in errs
+// stored at the same position in sent.
+func receiveAll(rc redis.Conn, sent []int, errs []error) {
+	if len(sent) == 0 {
+		return
+	}
+
+	if err := rc.Flush(); err != nil {
+		for _, i := range sent {
+			errs[i] = err
+		}
+		return
+	}
+	for _, i := range sent {
+		_, err := rc.Receive()
+		errs[i] = capacityErr(err)
+	}
+}
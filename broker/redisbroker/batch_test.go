@@ -0,0 +1,85 @@
+package redisbroker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallBatch(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Logger:  verboseLog,
+		CallCap: 2,
+	}
+
+	connUUID := uuid.NewRandom()
+	var cps []*message.CallPayload
+	var tos []time.Duration
+	for _, uri := range []string{"a", "a", "b", "a"} {
+		cps = append(cps, &message.CallPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: uri})
+		tos = append(tos, time.Second)
+	}
+	// an idempotent call in the middle of the batch
+	cps[2].IdempotencyKey = "k"
+
+	errs := brk.CallBatch(cps, tos)
+	require.Equal(t, len(cps), len(errs), "number of errors")
+	assert.NoError(t, errs[0], "call 0")
+	assert.NoError(t, errs[1], "call 1")
+	assert.NoError(t, errs[2], "call 2")
+	assert.Equal(t, broker.ErrCapacityExceeded, errs[3], "call 3")
+
+	// the calls are registered in order
+	expectUUIDs(t, pool.Get(), fmt.Sprintf(callKey, "a"), cps[1].MsgUUID, cps[0].MsgUUID)
+	expectUUIDs(t, pool.Get(), fmt.Sprintf(callKey, "b"), cps[2].MsgUUID)
+}
+
+func TestPublishBatch(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Logger: verboseLog,
+	}
+
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn")
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe")
+	evs := psc.Events()
+	time.Sleep(10 * time.Millisecond) // ensure the subscription is active
+
+	pps := []*message.PubPayload{
+		{MsgUUID: uuid.NewRandom(), Args: []byte(`1`)},
+		{MsgUUID: uuid.NewRandom(), Args: []byte(`2`)},
+		{MsgUUID: uuid.NewRandom(), Args: []byte(`3`)},
+	}
+	errs := brk.PublishBatch([]string{"a", "b", "a"}, pps)
+	for i, err := range errs {
+		assert.NoError(t, err, "publish %d", i)
+	}
+
+	for _, exp := range []*message.PubPayload{pps[0], pps[2]} {
+		select {
+		case ep := <-evs:
+			assert.Equal(t, exp.MsgUUID, ep.MsgUUID, "event")
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+		}
+	}
+	require.NoError(t, psc.Close(), "Close")
+}
@@ -0,0 +1,146 @@
+package redisbroker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
+	"github.com/mna/juggler/message"
+)
+
+const (
+	// redis cluster-compliant key, in the same slot as the CALL queues
+	broadcastCallTimeoutKey = "juggler:calls:broadcast:timeout:{%s}:%s" // 1: URI, 2: mUUID
+
+	// pub-sub channel of the broadcast calls of a URI
+	broadcastCallChannel = "juggler:calls:broadcast:%s" // 1: URI
+)
+
+// script to store the expiration information of a broadcast call and
+// publish the call request. It returns the number of receivers.
+var broadcastCallScript = redis.NewScript(1, `
+	redis.call("SET", KEYS[1], ARGV[1], "PX", tonumber(ARGV[1]))
+	return redis.call("PUBLISH", ARGV[2], ARGV[3])
+`)
+
+// BroadcastCall sends the call request to all callees listening on
+// its URI with BroadcastCalls set. It returns the number of callees
+// that received the call. In a redis cluster, only the callees
+// connected to the same node as the caller are counted, although
+// all callees receive the call.
+func (b *Broker) BroadcastCall(cp *message.CallPayload, timeout time.Duration) (int, error) {
+	span := traceCall(b.Tracer, cp, "redisbroker.broadcast")
+	n, err := b.broadcastCall(cp, timeout)
+	span.SetAttribute("juggler.callees", n)
+	span.End(err)
+	return n, err
+}
+
+func (b *Broker) broadcastCall(cp *message.CallPayload, timeout time.Duration) (int, error) {
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	if cp.Timestamp.IsZero() {
+		cp.Timestamp = time.Now().UTC()
+	}
+
+	p, err := broker.MarshalPayload(b.PayloadCodec, cp)
+	if err != nil {
+		return 0, err
+	}
+
+	k := nsKey(b.Namespace, fmt.Sprintf(broadcastCallTimeoutKey, cp.URI, cp.MsgUUID))
+	ch := nsKey(b.Namespace, fmt.Sprintf(broadcastCallChannel, cp.URI))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	return redis.Int(broadcastCallScript.Do(rc,
+		k,                             // key[1] : the SET key with expiration
+		int(timeout/time.Millisecond), // argv[1] : the timeout in milliseconds
+		ch,                            // argv[2] : the broadcast channel
+		p,                             // argv[3] : the call payload
+	))
+}
+
+// subscribeBroadcastCalls subscribes psc to the broadcast channels of
+// the uris.
+func subscribeBroadcastCalls(psc redis.PubSubConn, ns string, uris []string) error {
+	chans := make([]interface{}, 0, len(uris))
+	for _, uri := range uris {
+		chans = append(chans, nsKey(ns, fmt.Sprintf(broadcastCallChannel, uri)))
+	}
+	return psc.Subscribe(chans...)
+}
+
+// listenBroadcastCalls receives the broadcast calls on psc until it
+// fails or is closed.
+func (c *callsConn) listenBroadcastCalls(psc redis.PubSubConn) {
+	defer c.bwg.Done()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			c.bwg.Add(1)
+			go c.sendBroadcastCall(v.Data)
+
+		case error:
+			// possibly a closed connection, broadcast calls are no longer
+			// received but the CALL queues are still polled.
+			if !c.conn.isClosing() {
+				c.logger.Log(logging.Error, "Calls: broadcast calls connection failed", logging.Err(v))
+			}
+			return
+		}
+	}
+}
+
+// receives the raw payload of a broadcast call.
+func (c *callsConn) sendBroadcastCall(p []byte) {
+	defer c.bwg.Done()
+
+	var cp message.CallPayload
+	if err := broker.UnmarshalPayload(p, &cp); err != nil {
+		if c.metrics != nil {
+			c.metrics.Add("FailedCallPayloadUnmarshals", 1)
+		}
+		c.logger.Log(logging.Error, "Calls: failed to unmarshal broadcast call payload", logging.Err(err))
+		return
+	}
+
+	// check if call is expired, the key is shared by all callees so it
+	// is not deleted.
+	k := nsKey(c.ns, fmt.Sprintf(broadcastCallTimeoutKey, cp.URI, cp.MsgUUID))
+
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	pttl, err := redis.Int(rc.Do("PTTL", k))
+	if err != nil {
+		if c.metrics != nil {
+			c.metrics.Add("FailedPTTLCalls", 1)
+		}
+		c.logger.Log(logging.Error, "Calls: PTTL failed", logging.MsgUUID(cp.MsgUUID), logging.URI(cp.URI), logging.Err(err))
+		return
+	}
+	if pttl <= 0 {
+		if c.metrics != nil {
+			c.metrics.Add("ExpiredCalls", 1)
+		}
+		c.logger.Log(logging.Debug, "Calls: message expired, dropping broadcast call", logging.MsgUUID(cp.MsgUUID), logging.URI(cp.URI))
+		return
+	}
+
+	cp.ReadTimestamp = time.Now().UTC()
+	cp.TTLAfterRead = time.Duration(pttl) * time.Millisecond
+	traceCall(c.tracer, &cp, "redisbroker.dequeue").End(nil)
+	c.observeQueueWait(&cp)
+	c.ch <- &cp
+	if c.metrics != nil {
+		c.metrics.Add("BroadcastCalls", 1)
+	}
+}
@@ -0,0 +1,81 @@
+package redisbroker
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroadcastCall(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	vars := expvar.NewMap(uuid.NewRandom().String())
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		BroadcastCalls:  true,
+		Logger:          verboseLog,
+		Metrics:         metrics.NewExpvar(vars),
+	}
+
+	// two callees listening on the same URI
+	cc1, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection 1")
+	cc2, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection 2")
+	calls1, calls2 := cc1.Calls(), cc2.Calls()
+
+	// wait for the subscriptions to be active
+	time.Sleep(100 * time.Millisecond)
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Broadcast: true}
+	n, err := brk.BroadcastCall(cp, time.Second)
+	require.NoError(t, err, "BroadcastCall")
+	assert.Equal(t, 2, n, "number of callees")
+
+	for i, ch := range []<-chan *message.CallPayload{calls1, calls2} {
+		select {
+		case got := <-ch:
+			assert.Equal(t, cp.MsgUUID, got.MsgUUID, "%d: broadcast call", i)
+			assert.True(t, got.Broadcast, "%d: broadcast flag", i)
+			assert.True(t, got.TTLAfterRead > 0 && got.TTLAfterRead <= time.Second, "%d: TTL %s", i, got.TTLAfterRead)
+		case <-time.After(time.Second):
+			t.Fatalf("%d: no call received", i)
+		}
+	}
+
+	// both results are sent to the caller
+	rc, err := brk.NewResultsConn(cp.ConnUUID)
+	require.NoError(t, err, "get Results connection")
+	for i := 0; i < 2; i++ {
+		rp := &message.ResPayload{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: "a", Broadcast: true}
+		require.NoError(t, brk.Result(rp, time.Second), "Result %d", i)
+	}
+	results := rc.Results()
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-results:
+			assert.Equal(t, cp.MsgUUID, got.MsgUUID, "%d: result", i)
+		case <-time.After(time.Second):
+			t.Fatalf("%d: no result received", i)
+		}
+	}
+
+	require.NoError(t, cc1.Close(), "close calls connection 1")
+	require.NoError(t, cc2.Close(), "close calls connection 2")
+	require.NoError(t, rc.Close(), "close results connection")
+	assert.Equal(t, "2", vars.Get("BroadcastCalls").String(), "BroadcastCalls metric")
+	if qw, ok := vars.Get("QueueWait:a").(*expvar.Map); assert.True(t, ok, "QueueWait metric") {
+		assert.Equal(t, "2", qw.Get("Count").String(), "QueueWait count")
+	}
+}
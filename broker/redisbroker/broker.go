@@ -20,17 +20,22 @@
 // nodes, or a server handler can alter the URI to achieve
 // that result without impacting clients.
 //
+// For high availability without a redis cluster, a Sentinel
+// can be used as Pool, and its Dial method as Dial, so that
+// the broker connects to the current master and follows
+// failovers (see Broker.ReconnectAttempts).
 package redisbroker
 
 import (
-	"encoding/json"
-	"expvar"
 	"fmt"
-	"log"
+	"strings"
 	"time"
 
 	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/mna/juggler/tracing"
 	"github.com/mna/redisc"
 	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
@@ -38,13 +43,28 @@ import (
 
 var (
 	// static check that *Broker implements all the broker interfaces
-	_ broker.CallerBroker = (*Broker)(nil)
-	_ broker.CalleeBroker = (*Broker)(nil)
-	_ broker.PubSubBroker = (*Broker)(nil)
+	_ broker.CallerBroker   = (*Broker)(nil)
+	_ broker.CalleeBroker   = (*Broker)(nil)
+	_ broker.PubSubBroker   = (*Broker)(nil)
+	_ broker.PresenceBroker = (*Broker)(nil)
+	_ broker.CallScheduler  = (*Broker)(nil)
+
+	_ broker.CallBroadcaster  = (*Broker)(nil)
+	_ broker.BatchCaller      = (*Broker)(nil)
+	_ broker.BatchPublisher   = (*Broker)(nil)
+	_ broker.ResultCache      = (*Broker)(nil)
+	_ broker.CacheInvalidator = (*Broker)(nil)
+	_ broker.ServiceRegistry  = (*Broker)(nil)
+	_ broker.SessionStore     = (*Broker)(nil)
+
+	_ broker.CallerNamespacer = (*Broker)(nil)
+	_ broker.PubSubNamespacer = (*Broker)(nil)
 )
 
 // DiscardLog is a no-op logging function that can be used as Broker.LogFunc
 // to disable logging.
+//
+// Deprecated: set Broker.Logger to logging.Discard instead.
 var DiscardLog = func(_ string, _ ...interface{}) {}
 
 // Pool defines the methods required for a redis pool that provides
@@ -76,8 +96,16 @@ type Broker struct {
 	// BRPOP before trying again. The default of 0 means no timeout.
 	BlockingTimeout time.Duration
 
-	// LogFunc is the logging function to use. If nil, log.Printf
-	// is used. It can be set to DiscardLog to disable logging.
+	// Logger is the logger to use. If nil, the messages are logged
+	// to the standard logger of the log package, at the Info level and
+	// above. It can be set to logging.Discard to disable logging.
+	Logger logging.Logger
+
+	// LogFunc is the logging function to use if Logger is nil, it
+	// receives the messages of all levels formatted as logging.Printf
+	// does.
+	//
+	// Deprecated: set Logger instead, e.g. to logging.Printf(fn).
 	LogFunc func(string, ...interface{})
 
 	// CallCap is the capacity of the CALL queue per URI. If it is
@@ -85,27 +113,170 @@ type Broker struct {
 	// URI will fail with an error. The default of 0 means no limit.
 	CallCap int
 
+	// PriorityLevels is the number of priority bands of call requests.
+	// Each band has its own CALL queue per URI, and callees poll the
+	// queues from the highest priority to the lowest. The priority of
+	// a call is clamped to the range [0, PriorityLevels-1]. The default
+	// of 0 (or 1) disables priorities, all calls use the same queue.
+	// Callers and callees must use the same number of levels.
+	PriorityLevels int
+
+	// DelayedCallsInterval is the interval at which callees move the
+	// scheduled call requests that are due to the CALL queues of their
+	// URIs. Scheduled calls may run up to that interval late. The
+	// default of 0 uses 100ms, and a negative value disables the
+	// mover on that callee, in which case another callee listening
+	// on the same URIs must run it.
+	DelayedCallsInterval time.Duration
+
+	// IdempotencyWindow is the duration during which the result of a
+	// call with an idempotency key is kept, so that duplicate calls
+	// with the same key on the same URI receive that result instead
+	// of running the call again. Duplicates received while the first
+	// call is in progress receive its result when it is available.
+	// The default of 0 uses 5 minutes, and a negative value disables
+	// deduplication. The window is applied by the callees when they
+	// store the result.
+	IdempotencyWindow time.Duration
+
+	// BroadcastCalls indicates if calls connections also listen for
+	// the broadcast calls on their URIs (see Broker.BroadcastCall),
+	// using an additional pub-sub connection. A broadcast call is
+	// received by all callees listening on its URI at the time it is
+	// made. Broadcast calls are not received again if that connection
+	// fails. The default is false.
+	BroadcastCalls bool
+
+	// ResultCacheTTL is the time-to-live of the cached results of calls,
+	// per URI. Callers look up the cache only for the URIs in the map,
+	// and a result stored with a cache key (see callee.Callee.CacheResults)
+	// is cached only if its URI is in the map. A cached result is sent
+	// to identical calls - same URI and equivalent arguments - without
+	// running the call. Callers and callees must use the same map.
+	ResultCacheTTL map[string]time.Duration
+
+	// PayloadCodec is the codec used to encode the payloads stored in
+	// redis. Payloads are decoded using the codec identified by their
+	// version byte (see broker.UnmarshalPayload), so payloads encoded
+	// with different codecs can coexist. To switch codecs, first deploy
+	// the version that can decode the new payloads on all callers and
+	// callees, then set the codec. The default of nil uses
+	// broker.JSONPayloadCodec.
+	PayloadCodec broker.PayloadCodec
+
 	// ResultCap is the capacity of the RES queue per connection UUID.
 	// If it is exceeded for a given connection, Broker.Result calls
 	// for that connection will fail with an error. The default of 0
 	// means no limit.
 	ResultCap int
 
-	// Vars can be set to an *expvar.Map to collect metrics about the
-	// broker. It should be set before starting to make calls with the
-	// broker.
-	Vars *expvar.Map
+	// PresenceTTL is the time-to-live of the presence of a connection
+	// on a pub-sub channel. Pub-sub connections refresh the presence
+	// of their subscriptions at half that interval, so that presence
+	// of connections that are gone without unsubscribing (e.g. if
+	// the server crashed) eventually expires. The default of 0
+	// disables presence tracking. A TTL below 1s is set to 1s.
+	PresenceTTL time.Duration
+
+	// ReconnectAttempts is the maximum number of attempts to
+	// re-establish a long-lived connection when it fails, e.g.
+	// during a redis failover. For pub-sub connections, the
+	// subscriptions are restored on the new connection and the
+	// events channel is kept open. For calls and results
+	// connections, polling resumes on the new connection if
+	// the error is transient (network errors and redis errors
+	// such as MOVED, ASK or LOADING). The default of 0 disables
+	// reconnection, and a negative value means no limit.
+	ReconnectAttempts int
+
+	// ReconnectBackoff is the delay before the first reconnection
+	// attempt. It doubles after each failed attempt, up to
+	// MaxReconnectBackoff. The defaults are 100ms and 10s.
+	ReconnectBackoff    time.Duration
+	MaxReconnectBackoff time.Duration
+
+	// NotifyPubSubGaps indicates if an event payload with the Gap
+	// flag set should be sent on the events channel of a pub-sub
+	// connection for each of its subscriptions after a reconnection,
+	// as events published while the connection was down are lost.
+	NotifyPubSubGaps bool
+
+	// Namespace isolates the keys and pub-sub channels used by the
+	// broker, so that multiple applications, environments or tenants
+	// can safely share the same redis. If set, it is prepended to all
+	// keys and channels, followed by a colon. It should not contain
+	// curly braces, as those are used for cluster hash tags. Callers
+	// and callees must use the same namespace.
+	Namespace string
+
+	// Tracer, if set, records a span when a call request is enqueued
+	// by a caller, when it is dequeued by a callee and when its result
+	// is stored, as a child of the trace context of the payload, which
+	// is then updated with the trace context of the span so that it is
+	// propagated (see the tracing package).
+	Tracer tracing.Tracer
+
+	// Metrics can be set to collect metrics about the broker, e.g. a
+	// metrics.Prometheus or a metrics.Expvar (see doc/metrics.md). It
+	// should be set before starting to make calls with the broker.
+	Metrics metrics.Metrics
+}
+
+// WithNamespace returns a copy of the broker that uses the
+// namespace ns. Connections created by the returned broker
+// use the same Pool and Dial function.
+func (b *Broker) WithNamespace(ns string) *Broker {
+	nb := *b
+	nb.Namespace = ns
+	return &nb
+}
+
+// CallerWithNamespace returns a copy of the broker that uses the
+// namespace ns, as a broker.CallerBroker.
+func (b *Broker) CallerWithNamespace(ns string) broker.CallerBroker {
+	return b.WithNamespace(ns)
+}
+
+// PubSubWithNamespace returns a copy of the broker that uses the
+// namespace ns, as a broker.PubSubBroker.
+func (b *Broker) PubSubWithNamespace(ns string) broker.PubSubBroker {
+	return b.WithNamespace(ns)
 }
 
 // script to store the call request or call result along with
-// its expiration information.
-var callOrResScript = redis.NewScript(2, `
-	redis.call("SET", KEYS[1], ARGV[1], "PX", tonumber(ARGV[1]))
+// its expiration information. If a third key is provided, it is
+// the idempotency hash of the call: if it exists, the call is a
+// duplicate and is not stored. The stored result is returned if
+// the first call is completed, otherwise the duplicate is recorded
+// in the hash to receive the result when it is available.
+var callOrResScript = redis.NewScript(-1, `
+	local to = tonumber(ARGV[1])
+	local idem = KEYS[3]
+	if idem then
+		if redis.call("EXISTS", idem) == 1 then
+			local stored = redis.call("HGET", idem, "res")
+			if stored then
+				return {"res", stored}
+			end
+			redis.call("HSET", idem, ARGV[4], ARGV[5])
+			if redis.call("PTTL", idem) < to then
+				redis.call("PEXPIRE", idem, to)
+			end
+			return {"wait"}
+		end
+		redis.call("HSET", idem, "call", ARGV[2])
+		redis.call("PEXPIRE", idem, to)
+	end
+
+	redis.call("SET", KEYS[1], ARGV[1], "PX", to)
 	local res = redis.call("LPUSH", KEYS[2], ARGV[2])
 	local limit = tonumber(ARGV[3])
 	if res > limit and limit > 0 then
 		local diff = res - limit
 		redis.call("LTRIM", KEYS[2], diff, limit + diff)
+		if idem then
+			redis.call("DEL", idem)
+		end
 		return redis.error_reply("list capacity exceeded")
 	end
 	return res
@@ -113,58 +284,136 @@ var callOrResScript = redis.NewScript(2, `
 
 const (
 	// redis cluster-compliant keys, so that both keys are in the same slot
-	callKey        = "juggler:calls:{%s}"            // 1: URI
-	callTimeoutKey = "juggler:calls:timeout:{%s}:%s" // 1: URI, 2: mUUID
+	callKey         = "juggler:calls:{%s}"            // 1: URI
+	callPriorityKey = "juggler:calls:{%s}:%d"         // 1: URI, 2: priority > 0
+	callTimeoutKey  = "juggler:calls:timeout:{%s}:%s" // 1: URI, 2: mUUID
 
 	// redis cluster-compliant keys, so that both keys are in the same slot
 	resKey        = "juggler:results:{%s}"            // 1: cUUID
 	resTimeoutKey = "juggler:results:timeout:{%s}:%s" // 1: cUUID, 2: mUUID
 )
 
-// Call registers a call request in the broker.
+// Call registers a call request in the broker. If the call has an
+// idempotency key and a call with the same key was made on the same
+// URI within the IdempotencyWindow, the call is not registered again.
+// Instead, the result of the first call is sent to the caller once
+// it is available.
 func (b *Broker) Call(cp *message.CallPayload, timeout time.Duration) error {
-	k1 := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
-	k2 := fmt.Sprintf(callKey, cp.URI)
-	return registerCallOrRes(b.Pool, cp, timeout, b.CallCap, k1, k2)
+	span := traceCall(b.Tracer, cp, "redisbroker.enqueue")
+	err := b.call(cp, timeout)
+	span.End(err)
+	return err
+}
+
+func (b *Broker) call(cp *message.CallPayload, timeout time.Duration) error {
+	if cp.Timestamp.IsZero() {
+		cp.Timestamp = time.Now().UTC()
+	}
+	k1 := nsKey(b.Namespace, fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID))
+	k2 := nsKey(b.Namespace, callListKey(cp.URI, clampPriority(cp.Priority, b.PriorityLevels)))
+	if cp.IdempotencyKey == "" || b.IdempotencyWindow < 0 {
+		_, err := registerCallOrRes(b.Pool, b.PayloadCodec, cp, timeout, b.CallCap, k1, k2, nil)
+		return err
+	}
+	return b.idempotentCall(cp, timeout, k1, k2)
 }
 
-// Result registers a call result in the broker.
+// Result registers a call result in the broker. If the result is for
+// a call with an idempotency key, it is stored for the IdempotencyWindow
+// and it is also sent to the duplicate calls waiting for it. If it has
+// a cache key and its URI is in ResultCacheTTL, it is also cached.
+// Partial results are only sent to the caller.
 func (b *Broker) Result(rp *message.ResPayload, timeout time.Duration) error {
-	k1 := fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID)
-	k2 := fmt.Sprintf(resKey, rp.ConnUUID)
-	return registerCallOrRes(b.Pool, rp, timeout, b.ResultCap, k1, k2)
+	span := traceResult(b.Tracer, rp, "redisbroker.result")
+	err := b.result(rp, timeout)
+	span.End(err)
+	return err
+}
+
+func (b *Broker) result(rp *message.ResPayload, timeout time.Duration) error {
+	if rp.CacheKey != "" && !rp.Partial {
+		if ttl := b.ResultCacheTTL[rp.URI]; ttl > 0 {
+			// the cache is best-effort, the result is sent regardless
+			if err := b.cacheResult(rp, ttl); err != nil {
+				b.logger().Log(logging.Warn, "Result: failed to cache result", logging.MsgUUID(rp.MsgUUID), logging.URI(rp.URI), logging.Err(err))
+			}
+		}
+	}
+	if rp.IdempotencyKey != "" && b.IdempotencyWindow >= 0 && !rp.Partial {
+		if err := b.storeIdempotentResult(rp, timeout); err != nil {
+			return err
+		}
+	}
+
+	k1 := nsKey(b.Namespace, fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID))
+	k2 := nsKey(b.Namespace, fmt.Sprintf(resKey, rp.ConnUUID))
+	_, err := registerCallOrRes(b.Pool, b.PayloadCodec, rp, timeout, b.ResultCap, k1, k2, nil)
+	return err
 }
 
-func registerCallOrRes(pool Pool, pld interface{}, timeout time.Duration, cap int, k1, k2 string) error {
-	p, err := json.Marshal(pld)
+func registerCallOrRes(pool Pool, codec broker.PayloadCodec, pld interface{}, timeout time.Duration, cap int, k1, k2 string, idem *idempotency) (interface{}, error) {
+	keys, args, err := callOrResArgs(codec, pld, timeout, cap, k1, k2, idem)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rc := pool.Get()
 	defer rc.Close()
 
 	// turn it into a cluster-aware RetryConn if running in a cluster
-	rc = clusterifyConn(rc, k1, k2)
+	rc = clusterifyConn(rc, keys...)
+
+	res, err := callOrResScript.Do(rc, args...)
+	return res, capacityErr(err)
+}
+
+// callOrResArgs returns the keys and the arguments of the
+// callOrResScript to register the payload pld.
+func callOrResArgs(codec broker.PayloadCodec, pld interface{}, timeout time.Duration, cap int, k1, k2 string, idem *idempotency) ([]string, redis.Args, error) {
+	p, err := broker.MarshalPayload(codec, pld)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := []string{k1, k2}
+	if idem != nil {
+		keys = append(keys, idem.key)
+	}
 
 	to := int(timeout / time.Millisecond)
 	if to == 0 {
 		to = int(broker.DefaultCallTimeout / time.Millisecond)
 	}
 
-	_, err = callOrResScript.Do(rc,
-		k1,  // key[1] : the SET key with expiration
-		k2,  // key[2] : the LIST key
+	// key[1] : the SET key with expiration
+	// key[2] : the LIST key
+	// key[3] : the idempotency hash, if any
+	args := redis.Args{len(keys)}.AddFlat(keys).Add(
 		to,  // argv[1] : the timeout in milliseconds
 		p,   // argv[2] : the call payload
 		cap, // argv[3] : the LIST capacity
 	)
+	if idem != nil {
+		args = args.Add(
+			idem.field,  // argv[4] : the hash field of the duplicate call
+			idem.waiter, // argv[5] : the result payload template of the duplicate call
+		)
+	}
+	return keys, args, nil
+}
+
+// capacityErr returns broker.ErrCapacityExceeded if err is the error
+// returned by a script when a list capacity is exceeded, err otherwise.
+func capacityErr(err error) error {
+	if err, ok := err.(redis.Error); ok && err.Error() == "list capacity exceeded" {
+		return broker.ErrCapacityExceeded
+	}
 	return err
 }
 
 // Publish publishes an event to a channel.
 func (b *Broker) Publish(channel string, pp *message.PubPayload) error {
-	p, err := json.Marshal(pp)
+	p, err := broker.MarshalPayload(b.PayloadCodec, pp)
 	if err != nil {
 		return err
 	}
@@ -180,7 +429,7 @@ func (b *Broker) Publish(channel string, pp *message.PubPayload) error {
 		// Bind without a key selects a random node.
 		bc.Bind()
 	}
-	_, err = rc.Do("PUBLISH", channel, p)
+	_, err = rc.Do("PUBLISH", nsKey(b.Namespace, channel), p)
 	return err
 }
 
@@ -193,9 +442,17 @@ func (b *Broker) NewPubSubConn() (broker.PubSubConn, error) {
 		return nil, err
 	}
 	return &pubSubConn{
-		psc:   redis.PubSubConn{Conn: rc},
-		logFn: b.LogFunc,
-		vars:  b.Vars,
+		psc:         redis.PubSubConn{Conn: rc},
+		dial:        b.Dial,
+		pool:        b.Pool,
+		ns:          b.Namespace,
+		presenceTTL: b.presenceTTL(),
+		codec:       b.PayloadCodec,
+		reconnect:   b.reconnectPolicy(),
+		notifyGaps:  b.NotifyPubSubGaps,
+		logger:      b.logger(),
+		metrics:     b.Metrics,
+		stop:        make(chan struct{}),
 	}, nil
 }
 
@@ -206,13 +463,33 @@ func (b *Broker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	var bcast redis.Conn
+	if b.BroadcastCalls {
+		if bcast, err = b.Dial(); err != nil {
+			rc.Close()
+			return nil, err
+		}
+		if err := subscribeBroadcastCalls(redis.PubSubConn{Conn: bcast}, b.Namespace, uris); err != nil {
+			bcast.Close()
+			rc.Close()
+			return nil, err
+		}
+	}
+
 	return &callsConn{
-		c:       rc,
+		conn:    newBlockingConn("Calls", rc, b),
 		pool:    b.Pool,
+		ns:      b.Namespace,
 		uris:    uris,
-		vars:    b.Vars,
+		levels:  b.PriorityLevels,
+		delay:   b.DelayedCallsInterval,
+		cap:     b.CallCap,
+		metrics: b.Metrics,
 		timeout: b.BlockingTimeout,
-		logFn:   b.LogFunc,
+		logger:  b.logger(),
+		tracer:  b.Tracer,
+		bcast:   bcast,
 	}, nil
 }
 
@@ -224,12 +501,13 @@ func (b *Broker) NewResultsConn(connUUID uuid.UUID) (broker.ResultsConn, error)
 		return nil, err
 	}
 	return &resultsConn{
-		c:        rc,
+		conn:     newBlockingConn("Results", rc, b),
 		pool:     b.Pool,
+		ns:       b.Namespace,
 		connUUID: connUUID,
-		vars:     b.Vars,
+		metrics:  b.Metrics,
 		timeout:  b.BlockingTimeout,
-		logFn:    b.LogFunc,
+		logger:   b.logger(),
 	}, nil
 }
 
@@ -261,10 +539,69 @@ func clusterifyConn(rc redis.Conn, keys ...string) redis.Conn {
 	return rc
 }
 
-func logf(fn func(string, ...interface{}), f string, args ...interface{}) {
-	if fn != nil {
-		fn(f, args...)
-	} else {
-		log.Printf(f, args...)
+// clampPriority returns the priority band of priority p for the
+// number of levels.
+func clampPriority(p, levels int) int {
+	switch {
+	case p < 0 || levels <= 1:
+		return 0
+	case p >= levels:
+		return levels - 1
+	}
+	return p
+}
+
+// callListKey returns the key of the CALL queue of the URI for the
+// priority band p. The lowest band uses the same key as when
+// priorities are disabled.
+func callListKey(uri string, p int) string {
+	if p <= 0 {
+		return fmt.Sprintf(callKey, uri)
+	}
+	return fmt.Sprintf(callPriorityKey, uri, p)
+}
+
+// nsKey returns the key or channel k in the namespace ns.
+func nsKey(ns, k string) string {
+	if ns == "" {
+		return k
+	}
+	return ns + ":" + k
+}
+
+// nsPattern returns the channel pattern p in the namespace ns. Special
+// characters of the pattern syntax are escaped in the namespace.
+func nsPattern(ns, p string) string {
+	if ns == "" {
+		return p
+	}
+	return patternEscaper.Replace(ns) + ":" + p
+}
+
+var patternEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// stripNS returns the channel or pattern s without the namespace
+// prefix, if present.
+func stripNS(ns, s string, pattern bool) string {
+	if ns == "" {
+		return s
+	}
+	prefix := ns + ":"
+	if pattern {
+		prefix = patternEscaper.Replace(ns) + ":"
+	}
+	return strings.TrimPrefix(s, prefix)
+}
+
+// defaultLogger is the logger used if Broker.Logger is nil.
+var defaultLogger logging.Logger = &logging.Std{}
+
+func (b *Broker) logger() logging.Logger {
+	if b.Logger != nil {
+		return b.Logger
+	}
+	if b.LogFunc != nil {
+		return logging.Printf(b.LogFunc)
 	}
+	return defaultLogger
 }
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
 	"github.com/mna/redisc/redistest"
 	"github.com/garyburd/redigo/redis"
@@ -24,9 +25,9 @@ func testBrokerCallOrRes(t *testing.T, keyFmt string, run func(*Broker, uuid.UUI
 	defer cmd.Process.Kill()
 
 	pool := redistest.NewPool(t, ":"+port)
-	broker := &Broker{
+	brk := &Broker{
 		Pool:      pool,
-		LogFunc:   logIfVerbose,
+		Logger:    verboseLog,
 		CallCap:   cap,
 		ResultCap: cap,
 	}
@@ -35,13 +36,14 @@ func testBrokerCallOrRes(t *testing.T, keyFmt string, run func(*Broker, uuid.UUI
 	// run all on same key
 	keyUUID := uuid.NewRandom()
 	for i := 0; i <= cap; i++ {
-		uid, err := run(broker, keyUUID)
+		uid, err := run(brk, keyUUID)
 		uuids = append(uuids, uid)
 		if i < cap {
 			assert.NoError(t, err, "Call %d", i)
 		} else {
 			assert.Error(t, err, "Call %d", i)
 			assert.Contains(t, err.Error(), "list capacity exceeded", "error has expected message")
+			assert.Equal(t, broker.ErrCapacityExceeded, err, "error is ErrCapacityExceeded")
 		}
 	}
 
@@ -51,7 +53,7 @@ func testBrokerCallOrRes(t *testing.T, keyFmt string, run func(*Broker, uuid.UUI
 
 	// call on a different URI works fine
 	diffKeyUUID := uuid.NewRandom()
-	_, err := run(broker, diffKeyUUID)
+	_, err := run(brk, diffKeyUUID)
 	assert.NoError(t, err, "Call on different key")
 
 	// popping a value should pop uuids[0]
@@ -63,7 +65,7 @@ func testBrokerCallOrRes(t *testing.T, keyFmt string, run func(*Broker, uuid.UUI
 	expectUUIDs(t, pool.Get(), key, uuids[1])
 
 	// call should now work on original key
-	uid, err := run(broker, keyUUID)
+	uid, err := run(brk, keyUUID)
 	uuids = append(uuids, uid)
 	assert.NoError(t, err, "Call after RPOP")
 
@@ -101,9 +103,9 @@ func TestPublish(t *testing.T) {
 
 	pool := redistest.NewPool(t, ":"+port)
 	brk := broker.PubSubBroker(&Broker{
-		Pool:    pool,
-		Dial:    pool.Dial,
-		LogFunc: logIfVerbose,
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Logger: verboseLog,
 	})
 
 	psc, err := brk.NewPubSubConn()
@@ -171,3 +173,86 @@ func logIfVerbose(s string, args ...interface{}) {
 		log.Printf(s, args...)
 	}
 }
+
+// verboseLog logs the messages of all levels if testing.Verbose is set.
+var verboseLog = logging.Printf(logIfVerbose)
+
+func TestBrokerLogger(t *testing.T) {
+	var lines []string
+	logf := func(s string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(s, args...))
+	}
+
+	// the deprecated LogFunc is used if Logger is not set
+	brk := &Broker{LogFunc: logf}
+	brk.logger().Log(logging.Debug, "a")
+	assert.Equal(t, []string{"debug: a"}, lines, "LogFunc")
+
+	brk.Logger = logging.Discard
+	brk.logger().Log(logging.Debug, "b")
+	assert.Equal(t, []string{"debug: a"}, lines, "Logger")
+
+	assert.Equal(t, defaultLogger, (&Broker{}).logger(), "default logger")
+}
+
+func TestNamespace(t *testing.T) {
+	assert.Equal(t, "a", nsKey("", "a"), "no namespace")
+	assert.Equal(t, "ns:a", nsKey("ns", "a"), "namespace")
+	assert.Equal(t, "a*", nsPattern("", "a*"), "no namespace pattern")
+	assert.Equal(t, "ns:a*", nsPattern("ns", "a*"), "namespace pattern")
+	assert.Equal(t, `n\*s\?\[x\]\\:a*`, nsPattern(`n*s?[x]\`, "a*"), "escaped namespace pattern")
+
+	assert.Equal(t, "ns:a", stripNS("", "ns:a", false), "strip no namespace")
+	assert.Equal(t, "a", stripNS("ns", "ns:a", false), "strip namespace")
+	assert.Equal(t, "a*", stripNS(`n*s`, `n\*s:a*`, true), "strip namespace pattern")
+
+	brk := &Broker{CallCap: 2}
+	nb := brk.WithNamespace("ns")
+	assert.Equal(t, "", brk.Namespace, "original broker unchanged")
+	assert.Equal(t, "ns", nb.Namespace, "copy has namespace")
+	assert.Equal(t, 2, nb.CallCap, "copy has same fields")
+}
+
+func TestNamespacePubSub(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Logger: verboseLog,
+	}
+	brkA, brkB := brk.WithNamespace("a"), brk.WithNamespace("b")
+
+	psc, err := brkA.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn")
+	require.NoError(t, psc.Subscribe("c", false), "Subscribe c")
+	require.NoError(t, psc.Subscribe("d*", true), "Subscribe d*")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var eps []*message.EvntPayload
+	go func() {
+		defer wg.Done()
+		for ep := range psc.Events() {
+			eps = append(eps, ep)
+		}
+	}()
+
+	pp1 := &message.PubPayload{MsgUUID: uuid.NewRandom()}
+	pp2 := &message.PubPayload{MsgUUID: uuid.NewRandom()}
+	require.NoError(t, brkB.Publish("c", &message.PubPayload{MsgUUID: uuid.NewRandom()}), "Publish in other namespace")
+	require.NoError(t, brk.Publish("c", &message.PubPayload{MsgUUID: uuid.NewRandom()}), "Publish without namespace")
+	require.NoError(t, brkA.Publish("c", pp1), "Publish c")
+	require.NoError(t, brkA.Publish("de", pp2), "Publish de")
+
+	time.Sleep(10 * time.Millisecond) // ensure time to pop the last message :(
+	require.NoError(t, psc.Close(), "Close")
+	wg.Wait()
+
+	if assert.Equal(t, 2, len(eps), "received events") {
+		assert.Equal(t, &message.EvntPayload{MsgUUID: pp1.MsgUUID, Channel: "c"}, eps[0], "event on c")
+		assert.Equal(t, &message.EvntPayload{MsgUUID: pp2.MsgUUID, Channel: "de", Pattern: "d*"}, eps[1], "event on de")
+	}
+}
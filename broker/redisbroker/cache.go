@@ -0,0 +1,78 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+)
+
+// redis cluster-compliant key, in the same slot as the CALL queues
+const resultCacheKey = "juggler:cache:{%s}:%s" // 1: URI, 2: cache key
+
+// CachedResult returns the cached result of the call request cp, or
+// nil if there is no such result. The cache is looked up only if the
+// URI of the call is in ResultCacheTTL.
+func (b *Broker) CachedResult(cp *message.CallPayload) (json.RawMessage, error) {
+	if b.ResultCacheTTL[cp.URI] <= 0 {
+		return nil, nil
+	}
+
+	ck, err := broker.CacheKey(cp.Args)
+	if err != nil {
+		return nil, err
+	}
+	k := nsKey(b.Namespace, fmt.Sprintf(resultCacheKey, cp.URI, ck))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	v, err := redis.Bytes(rc.Do("GET", k))
+	if err == redis.ErrNil {
+		if b.Metrics != nil {
+			b.Metrics.Add("CacheMisses", 1)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Metrics != nil {
+		b.Metrics.Add("CacheHits", 1)
+	}
+	return v, nil
+}
+
+// InvalidateCache removes the cached result of the calls to uri with
+// the arguments args.
+func (b *Broker) InvalidateCache(uri string, args json.RawMessage) error {
+	ck, err := broker.CacheKey(args)
+	if err != nil {
+		return err
+	}
+	k := nsKey(b.Namespace, fmt.Sprintf(resultCacheKey, uri, ck))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	_, err = rc.Do("DEL", k)
+	return err
+}
+
+// cacheResult stores the result rp in the cache for ttl.
+func (b *Broker) cacheResult(rp *message.ResPayload, ttl time.Duration) error {
+	k := nsKey(b.Namespace, fmt.Sprintf(resultCacheKey, rp.URI, rp.CacheKey))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	_, err := rc.Do("SET", k, []byte(rp.Args), "PX", int(ttl/time.Millisecond))
+	return err
+}
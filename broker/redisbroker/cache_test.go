@@ -0,0 +1,96 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKey(t *testing.T) {
+	k1, err := broker.CacheKey(json.RawMessage(`{"a": 1, "b": [true, null]}`))
+	require.NoError(t, err, "CacheKey 1")
+	k2, err := broker.CacheKey(json.RawMessage(`{"b":[true,null],"a":1}`))
+	require.NoError(t, err, "CacheKey 2")
+	k3, err := broker.CacheKey(json.RawMessage(`{"a": 2, "b": [true, null]}`))
+	require.NoError(t, err, "CacheKey 3")
+
+	assert.Equal(t, k1, k2, "equivalent arguments")
+	assert.NotEqual(t, k1, k3, "different arguments")
+
+	_, err = broker.CacheKey(json.RawMessage(`{`))
+	assert.Error(t, err, "invalid arguments")
+}
+
+func TestResultCache(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:           pool,
+		Dial:           pool.Dial,
+		Logger:         verboseLog,
+		ResultCacheTTL: map[string]time.Duration{"a": time.Minute, "b": 100 * time.Millisecond},
+	}
+
+	newCall := func(uri, args string) *message.CallPayload {
+		return &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: uri, Args: json.RawMessage(args)}
+	}
+	storeResult := func(cp *message.CallPayload, res string) {
+		ck, err := broker.CacheKey(cp.Args)
+		require.NoError(t, err, "CacheKey")
+		rp := &message.ResPayload{
+			ConnUUID: cp.ConnUUID,
+			MsgUUID:  cp.MsgUUID,
+			URI:      cp.URI,
+			Args:     json.RawMessage(res),
+			CacheKey: ck,
+		}
+		require.NoError(t, brk.Result(rp, time.Minute), "Result")
+	}
+
+	first := newCall("a", `{"x":1,"y":2}`)
+	res, err := brk.CachedResult(first)
+	require.NoError(t, err, "CachedResult before result")
+	assert.Nil(t, res, "no cached result")
+
+	storeResult(first, `"ok"`)
+
+	// an identical call with equivalent arguments is served from the cache
+	res, err = brk.CachedResult(newCall("a", `{"y": 2, "x": 1}`))
+	require.NoError(t, err, "CachedResult identical call")
+	assert.Equal(t, `"ok"`, string(res), "cached result")
+
+	// a call with different arguments is not
+	res, err = brk.CachedResult(newCall("a", `{"x":2,"y":2}`))
+	require.NoError(t, err, "CachedResult different args")
+	assert.Nil(t, res, "different args")
+
+	// results of URIs that are not cached are not stored
+	c := newCall("c", `1`)
+	storeResult(c, `"ok"`)
+	res, err = brk.CachedResult(c)
+	require.NoError(t, err, "CachedResult URI not cached")
+	assert.Nil(t, res, "URI not cached")
+
+	// cached results expire after the TTL of the URI
+	b := newCall("b", `1`)
+	storeResult(b, `"ok"`)
+	time.Sleep(200 * time.Millisecond)
+	res, err = brk.CachedResult(b)
+	require.NoError(t, err, "CachedResult expired")
+	assert.Nil(t, res, "expired")
+
+	// invalidated results are removed
+	require.NoError(t, brk.InvalidateCache("a", json.RawMessage(`{"y":2,"x":1}`)), "InvalidateCache")
+	res, err = brk.CachedResult(first)
+	require.NoError(t, err, "CachedResult after invalidation")
+	assert.Nil(t, res, "invalidated")
+}
@@ -1,14 +1,15 @@
 package redisbroker
 
 import (
-	"encoding/json"
-	"expvar"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/mna/juggler/tracing"
 	"github.com/garyburd/redigo/redis"
 )
 
@@ -22,16 +23,29 @@ var delAndPTTLScript = redis.NewScript(1, `
 `)
 
 type callsConn struct {
-	c       redis.Conn
+	conn    *blockingConn
 	pool    Pool
+	ns      string
 	uris    []string
+	levels  int
+	delay   time.Duration // interval of the delayed calls mover
+	cap     int           // capacity of the CALL queues
 	timeout time.Duration
-	logFn   func(string, ...interface{})
-	vars    *expvar.Map
+	logger  logging.Logger
+	metrics metrics.Metrics
+	tracer  tracing.Tracer
+
+	// bcast is the pub-sub connection that receives the broadcast
+	// calls, nil if BroadcastCalls is not set. bwg tracks the
+	// goroutines that may send broadcast calls on ch.
+	bcast redis.Conn
+	bwg   sync.WaitGroup
 
 	// once makes sure only the first call to Calls starts the goroutine.
+	// done is closed when the goroutine stops polling for calls.
 	once sync.Once
 	ch   chan *message.CallPayload
+	done chan struct{}
 
 	// errmu protects access to err.
 	errmu sync.Mutex
@@ -40,7 +54,11 @@ type callsConn struct {
 
 // Close closes the connection.
 func (c *callsConn) Close() error {
-	return c.c.Close()
+	err := c.conn.close()
+	if c.bcast != nil {
+		c.bcast.Close()
+	}
+	return err
 }
 
 // CallsErr returns the error that caused the Calls channel to close.
@@ -53,30 +71,55 @@ func (c *callsConn) CallsErr() error {
 
 // Calls returns a stream of call requests for the URIs specified when
 // creating the callsConn. For use in a redis cluster, all URIs must
-// belong to the same cluster slot.
+// belong to the same cluster slot. If priority levels are configured,
+// calls with a higher priority are returned first, for all URIs. If
+// broadcast calls are enabled, they are returned as soon as they are
+// received, regardless of priority.
 func (c *callsConn) Calls() <-chan *message.CallPayload {
 	c.once.Do(func() {
 		c.ch = make(chan *message.CallPayload)
+		c.done = make(chan struct{})
 
 		// compute all keys and timeout
-		keys := make([]string, len(c.uris))
-		for i, uri := range c.uris {
-			keys[i] = fmt.Sprintf(callKey, uri)
-		}
+		keys := c.keys()
 		to := int(c.timeout / time.Second)
 		args := redis.Args{}.AddFlat(keys).Add(to)
 
 		// make the poll connection cluster-aware if running in a cluster
-		rc := clusterifyConn(c.c, keys...)
+		rc := clusterifyConn(c.conn.conn(), keys...)
 
-		go c.pollCalls(rc, args)
+		go c.pollCalls(rc, keys, args)
+		if c.bcast != nil {
+			c.bwg.Add(1)
+			go c.listenBroadcastCalls(redis.PubSubConn{Conn: c.bcast})
+		}
+		if c.delay >= 0 {
+			go c.moveDelayedCalls()
+		}
 	})
 
 	return c.ch
 }
 
-func (c *callsConn) pollCalls(pollConn redis.Conn, pollArgs redis.Args) {
+// keys returns the CALL queue keys to poll. BRPOP pops from the first
+// non-empty key, so they are ordered from highest priority to lowest.
+func (c *callsConn) keys() []string {
+	levels := c.levels
+	if levels < 1 {
+		levels = 1
+	}
+	keys := make([]string, 0, len(c.uris)*levels)
+	for p := levels - 1; p >= 0; p-- {
+		for _, uri := range c.uris {
+			keys = append(keys, nsKey(c.ns, callListKey(uri, p)))
+		}
+	}
+	return keys
+}
+
+func (c *callsConn) pollCalls(pollConn redis.Conn, keys []string, pollArgs redis.Args) {
 	defer close(c.ch)
+	defer close(c.done)
 
 	wg := sync.WaitGroup{}
 	for {
@@ -88,12 +131,22 @@ func (c *callsConn) pollCalls(pollConn redis.Conn, pollArgs redis.Args) {
 				continue
 			}
 
-			// possibly a closed connection, in any case stop
-			// the loop.
+			// try to recover from transient errors, otherwise it is
+			// possibly a closed connection, in any case stop the loop.
+			if rc, ok := c.conn.recover(err, keys...); ok {
+				pollConn = rc
+				continue
+			}
 			c.errmu.Lock()
 			c.err = err
 			c.errmu.Unlock()
 			wg.Wait()
+
+			// stop receiving broadcast calls before closing the channel
+			if c.bcast != nil {
+				c.bcast.Close()
+			}
+			c.bwg.Wait()
 			return
 		}
 
@@ -109,15 +162,15 @@ func (c *callsConn) sendCall(v []interface{}, wg *sync.WaitGroup) {
 	// unmarshal the payload
 	var cp message.CallPayload
 	if err := unmarshalBRPOPValue(&cp, v); err != nil {
-		if c.vars != nil {
-			c.vars.Add("FailedCallPayloadUnmarshals", 1)
+		if c.metrics != nil {
+			c.metrics.Add("FailedCallPayloadUnmarshals", 1)
 		}
-		logf(c.logFn, "Calls: BRPOP failed to unmarshal call payload: %v", err)
+		c.logger.Log(logging.Error, "Calls: BRPOP failed to unmarshal call payload", logging.Err(err))
 		return
 	}
 
 	// check if call is expired
-	k := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
+	k := nsKey(c.ns, fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID))
 
 	rc := c.pool.Get()
 	defer rc.Close()
@@ -125,26 +178,42 @@ func (c *callsConn) sendCall(v []interface{}, wg *sync.WaitGroup) {
 
 	pttl, err := redis.Int(delAndPTTLScript.Do(rc, k))
 	if err != nil {
-		if c.vars != nil {
-			c.vars.Add("FailedPTTLCalls", 1)
+		if c.metrics != nil {
+			c.metrics.Add("FailedPTTLCalls", 1)
 		}
-		logf(c.logFn, "Calls: DEL/PTTL failed: %v", err)
+		c.logger.Log(logging.Error, "Calls: DEL/PTTL failed", logging.MsgUUID(cp.MsgUUID), logging.URI(cp.URI), logging.Err(err))
 		return
 	}
 	if pttl <= 0 {
-		if c.vars != nil {
-			c.vars.Add("ExpiredCalls", 1)
+		if c.metrics != nil {
+			c.metrics.Add("ExpiredCalls", 1)
 		}
-		logf(c.logFn, "Calls: message %v expired, dropping call", cp.MsgUUID)
+		c.logger.Log(logging.Debug, "Calls: message expired, dropping call", logging.MsgUUID(cp.MsgUUID), logging.URI(cp.URI))
 		return
 	}
 
 	cp.ReadTimestamp = time.Now().UTC()
 	cp.TTLAfterRead = time.Duration(pttl) * time.Millisecond
+	traceCall(c.tracer, &cp, "redisbroker.dequeue").End(nil)
+	c.observeQueueWait(&cp)
 	c.ch <- &cp
-	if c.vars != nil {
-		c.vars.Add("Calls", 1)
+	if c.metrics != nil {
+		c.metrics.Add("Calls", 1)
+	}
+}
+
+// observeQueueWait records the time that the call request cp waited
+// in the queue before it was read.
+func (c *callsConn) observeQueueWait(cp *message.CallPayload) {
+	if c.metrics == nil || cp.Timestamp.IsZero() {
+		return
+	}
+	d := cp.ReadTimestamp.Sub(cp.Timestamp)
+	if d < 0 {
+		// clocks may vary between nodes
+		d = 0
 	}
+	c.metrics.Observe("QueueWait", d, "uri", cp.URI)
 }
 
 func unmarshalBRPOPValue(dst interface{}, src []interface{}) error {
@@ -152,7 +221,7 @@ func unmarshalBRPOPValue(dst interface{}, src []interface{}) error {
 	if _, err := redis.Scan(src, nil, &p); err != nil {
 		return err
 	}
-	if err := json.Unmarshal(p, dst); err != nil {
+	if err := broker.UnmarshalPayload(p, dst); err != nil {
 		return err
 	}
 	return nil
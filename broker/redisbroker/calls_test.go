@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/mna/juggler/message"
 	"github.com/mna/redisc/redistest"
 	"github.com/pborman/uuid"
@@ -21,7 +22,7 @@ func TestCalls(t *testing.T) {
 		Pool:            pool,
 		Dial:            pool.Dial,
 		BlockingTimeout: time.Second,
-		LogFunc:         logIfVerbose,
+		Logger:          verboseLog,
 	}
 
 	// list calls on URI "a"
@@ -67,3 +68,74 @@ func TestCalls(t *testing.T) {
 	}
 	assert.Equal(t, expected, uuids, "got expected UUIDs")
 }
+
+func TestCallsKeys(t *testing.T) {
+	cc := &callsConn{uris: []string{"a", "b"}}
+	assert.Equal(t, []string{"juggler:calls:{a}", "juggler:calls:{b}"}, cc.keys(), "no priority")
+
+	cc = &callsConn{ns: "ns", uris: []string{"a", "b"}, levels: 3}
+	expected := []string{
+		"ns:juggler:calls:{a}:2",
+		"ns:juggler:calls:{b}:2",
+		"ns:juggler:calls:{a}:1",
+		"ns:juggler:calls:{b}:1",
+		"ns:juggler:calls:{a}",
+		"ns:juggler:calls:{b}",
+	}
+	assert.Equal(t, expected, cc.keys(), "with priorities")
+
+	cases := []struct {
+		p, levels, band int
+	}{
+		{0, 0, 0},
+		{5, 0, 0},
+		{5, 1, 0},
+		{-1, 3, 0},
+		{1, 3, 1},
+		{2, 3, 2},
+		{5, 3, 2},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.band, clampPriority(c.p, c.levels), "%d with %d levels", c.p, c.levels)
+	}
+}
+
+func TestCallsPriority(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		PriorityLevels:  2,
+		Logger:          verboseLog,
+	}
+
+	// register calls before polling, the high priority one last
+	low := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	high := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Priority: 5}
+	require.NoError(t, brk.Call(low, time.Minute), "Call low")
+	require.NoError(t, brk.Call(high, time.Minute), "Call high")
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+
+	// BRPOP returns the high priority call first
+	rc := pool.Get()
+	defer rc.Close()
+	v, err := redis.Values(rc.Do("BRPOP", redis.Args{}.AddFlat(cc.(*callsConn).keys()).Add(1)...))
+	require.NoError(t, err, "BRPOP")
+	var cp message.CallPayload
+	require.NoError(t, unmarshalBRPOPValue(&cp, v), "unmarshal BRPOP value")
+	assert.Equal(t, high.MsgUUID, cp.MsgUUID, "high priority call popped first")
+
+	select {
+	case cp := <-cc.Calls():
+		assert.Equal(t, low.MsgUUID, cp.MsgUUID, "low priority call")
+	case <-time.After(time.Second):
+		t.Fatal("no call received")
+	}
+	require.NoError(t, cc.Close(), "close calls connection")
+}
@@ -0,0 +1,224 @@
+package redisbroker
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
+	"github.com/mna/juggler/message"
+)
+
+const (
+	// redis cluster-compliant key, in the same slot as the CALL queues
+	delayedCallKey = "juggler:calls:delayed:{%s}" // 1: URI
+
+	defaultDelayedCallsInterval = 100 * time.Millisecond
+
+	// maximum number of due calls moved by a single call to the script
+	delayedCallsBatch = 100
+)
+
+// script to schedule a call request. The expiration key is set so that
+// the timeout starts counting from the scheduled time, and the payload
+// is stored in a sorted set scored by that time, prefixed with the
+// priority band of the call. If the call has an idempotency key, it
+// is deduplicated as in callOrResScript.
+var scheduleCallScript = redis.NewScript(-1, `
+	local to = tonumber(ARGV[1])
+	local idem = KEYS[3]
+	if idem then
+		if redis.call("EXISTS", idem) == 1 then
+			local stored = redis.call("HGET", idem, "res")
+			if stored then
+				return {"res", stored}
+			end
+			redis.call("HSET", idem, ARGV[5], ARGV[6])
+			if redis.call("PTTL", idem) < to then
+				redis.call("PEXPIRE", idem, to)
+			end
+			return {"wait"}
+		end
+		redis.call("HSET", idem, "call", ARGV[2])
+		redis.call("PEXPIRE", idem, to)
+	end
+
+	redis.call("SET", KEYS[1], ARGV[1], "PX", to)
+	redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+	local res = redis.call("ZCARD", KEYS[2])
+	local limit = tonumber(ARGV[4])
+	if res > limit and limit > 0 then
+		redis.call("ZREM", KEYS[2], ARGV[2])
+		redis.call("DEL", KEYS[1])
+		if idem then
+			redis.call("DEL", idem)
+		end
+		return redis.error_reply("list capacity exceeded")
+	end
+	return res
+`)
+
+// script to move the scheduled calls that are due to the CALL queues
+// of their priority band, in the order of their scheduled time. KEYS[1]
+// is the sorted set of scheduled calls and KEYS[2+p] the CALL queue of
+// band p. Calls are left in the sorted set while their queue is at
+// capacity. It returns the number of due calls and of moved calls.
+var moveDelayedCallsScript = redis.NewScript(-1, `
+	local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[2]))
+	local limit = tonumber(ARGV[3])
+	local moved = {}
+	for _, v in ipairs(due) do
+		local i = string.find(v, ":", 1, true)
+		local band = math.min(tonumber(string.sub(v, 1, i - 1)), #KEYS - 2)
+		local list = KEYS[band + 2]
+		if limit <= 0 or redis.call("LLEN", list) < limit then
+			redis.call("LPUSH", list, string.sub(v, i + 1))
+			moved[#moved + 1] = v
+		end
+	end
+	if #moved > 0 then
+		redis.call("ZREM", KEYS[1], unpack(moved))
+	end
+	return {#due, #moved}
+`)
+
+// delayedListKey returns the key of the sorted set of scheduled calls
+// of the URI, for all priority bands.
+func delayedListKey(uri string) string {
+	return fmt.Sprintf(delayedCallKey, uri)
+}
+
+// ScheduleCall registers a call request in the broker that is made
+// available to callees at notBefore. The timeout starts counting from
+// notBefore. The CallCap applies separately to the scheduled calls of
+// a URI, and a due call is only moved to the CALL queue if the queue is
+// not at capacity. Calls with an idempotency key are deduplicated as
+// for Call.
+func (b *Broker) ScheduleCall(cp *message.CallPayload, timeout time.Duration, notBefore time.Time) error {
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	delay := notBefore.Sub(time.Now())
+	if delay < 0 {
+		delay = 0
+	}
+	if cp.Timestamp.IsZero() {
+		// the call waits in the queue once it is due
+		cp.Timestamp = time.Now().Add(delay).UTC()
+	}
+
+	p, err := broker.MarshalPayload(b.PayloadCodec, cp)
+	if err != nil {
+		return err
+	}
+
+	band := clampPriority(cp.Priority, b.PriorityLevels)
+	p = append([]byte(strconv.Itoa(band)+":"), p...)
+	k1 := nsKey(b.Namespace, fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID))
+	k2 := nsKey(b.Namespace, delayedListKey(cp.URI))
+
+	keys := []string{k1, k2}
+	var idem *idempotency
+	if cp.IdempotencyKey != "" && b.IdempotencyWindow >= 0 {
+		if idem, err = b.newIdempotency(cp); err != nil {
+			return err
+		}
+		keys = append(keys, idem.key)
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, keys...)
+
+	// key[1] : the SET key with expiration
+	// key[2] : the sorted set of scheduled calls
+	// key[3] : the idempotency hash, if any
+	to := int((delay + timeout) / time.Millisecond)
+	args := redis.Args{len(keys)}.AddFlat(keys).Add(
+		to,                   // argv[1] : the delay plus timeout in milliseconds
+		p,                    // argv[2] : the priority band and call payload
+		unixMilli(notBefore), // argv[3] : the scheduled timestamp in milliseconds
+		b.CallCap,            // argv[4] : the capacity of scheduled calls
+	)
+	if idem != nil {
+		args = args.Add(
+			idem.field,  // argv[5] : the hash field of the duplicate call
+			idem.waiter, // argv[6] : the result payload template of the duplicate call
+		)
+	}
+	v, err := scheduleCallScript.Do(rc, args...)
+	if err != nil || idem == nil {
+		return capacityErr(err)
+	}
+	return b.duplicateCall(cp, v, timeout)
+}
+
+// moveDelayedCalls periodically moves the scheduled calls that are due
+// to the CALL queues of the URIs, until the connection is closed or
+// stops polling for calls.
+func (c *callsConn) moveDelayedCalls() {
+	interval := c.delay
+	if interval == 0 {
+		interval = defaultDelayedCallsInterval
+	}
+
+	levels := c.levels
+	if levels < 1 {
+		levels = 1
+	}
+
+	for {
+		select {
+		case <-c.conn.stop:
+			return
+		case <-c.done:
+			return
+		case <-time.After(interval):
+		}
+
+		for _, uri := range c.uris {
+			keys := make([]string, 0, levels+1)
+			keys = append(keys, nsKey(c.ns, delayedListKey(uri)))
+			for p := 0; p < levels; p++ {
+				keys = append(keys, nsKey(c.ns, callListKey(uri, p)))
+			}
+			if err := c.moveDueCalls(keys); err != nil {
+				if c.metrics != nil {
+					c.metrics.Add("FailedDelayedCallMoves", 1)
+				}
+				c.logger.Log(logging.Error, "Calls: failed to move delayed calls", logging.URI(uri), logging.Err(err))
+			}
+		}
+	}
+}
+
+// moveDueCalls moves all scheduled calls that are due from the sorted
+// set keys[0] to the CALL queues of their priority band, keys[1:].
+func (c *callsConn) moveDueCalls(keys []string) error {
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, keys...)
+
+	for {
+		// key[1] : the sorted set of scheduled calls
+		// key[2:] : the CALL queues, by priority band
+		args := redis.Args{len(keys)}.AddFlat(keys).Add(
+			unixMilli(time.Now()), // argv[1] : the current timestamp in milliseconds
+			delayedCallsBatch,     // argv[2] : the maximum number of calls to move
+			c.cap,                 // argv[3] : the CALL queues capacity
+		)
+		vals, err := redis.Ints(moveDelayedCallsScript.Do(rc, args...))
+		if err != nil {
+			return err
+		}
+		due, moved := vals[0], vals[1]
+		if moved > 0 && c.metrics != nil {
+			c.metrics.Add("DelayedCalls", int64(moved))
+		}
+		if due < delayedCallsBatch || moved == 0 {
+			return nil
+		}
+	}
+}
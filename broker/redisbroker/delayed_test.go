@@ -0,0 +1,96 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelayedListKey(t *testing.T) {
+	assert.Equal(t, "juggler:calls:delayed:{a}", delayedListKey("a"), "key")
+}
+
+func TestScheduleCall(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:                 pool,
+		Dial:                 pool.Dial,
+		BlockingTimeout:      time.Second,
+		DelayedCallsInterval: 10 * time.Millisecond,
+		Logger:               verboseLog,
+	}
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+	calls := cc.Calls()
+
+	now := time.Now()
+	late := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	early := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.ScheduleCall(late, 100*time.Millisecond, now.Add(400*time.Millisecond)), "ScheduleCall late")
+	require.NoError(t, brk.ScheduleCall(early, 100*time.Millisecond, now.Add(200*time.Millisecond)), "ScheduleCall early")
+
+	for _, exp := range []*message.CallPayload{early, late} {
+		select {
+		case cp := <-calls:
+			assert.Equal(t, exp.MsgUUID, cp.MsgUUID, "scheduled call")
+			assert.True(t, cp.TTLAfterRead > 0 && cp.TTLAfterRead <= 100*time.Millisecond, "TTL starts at scheduled time: %s", cp.TTLAfterRead)
+		case <-time.After(time.Second):
+			t.Fatal("no call received")
+		}
+	}
+	assert.True(t, time.Since(now) >= 400*time.Millisecond, "calls are not received before their scheduled time")
+	require.NoError(t, cc.Close(), "close calls connection")
+}
+
+func TestMoveDelayedCalls(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:           pool,
+		Dial:           pool.Dial,
+		PriorityLevels: 2,
+		Logger:         verboseLog,
+	}
+
+	now := time.Now()
+	for i, prio := range []int{0, 1, 1, 1} {
+		cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Priority: prio}
+		require.NoError(t, brk.ScheduleCall(cp, time.Minute, now.Add(time.Duration(i)*time.Millisecond)), "ScheduleCall %d", i)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// the CALL queues are limited to 2 calls
+	brk.CallCap = 2
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+	defer cc.Close()
+
+	keys := []string{delayedListKey("a"), callListKey("a", 0), callListKey("a", 1)}
+	require.NoError(t, cc.(*callsConn).moveDueCalls(keys), "moveDueCalls")
+
+	rc := pool.Get()
+	defer rc.Close()
+
+	// the calls are moved to the queue of their priority band, up to CallCap
+	n, err := redis.Int(rc.Do("LLEN", keys[1]))
+	require.NoError(t, err, "LLEN priority 0")
+	assert.Equal(t, 1, n, "priority 0 calls")
+	n, err = redis.Int(rc.Do("LLEN", keys[2]))
+	require.NoError(t, err, "LLEN priority 1")
+	assert.Equal(t, 2, n, "priority 1 calls")
+	n, err = redis.Int(rc.Do("ZCARD", keys[0]))
+	require.NoError(t, err, "ZCARD")
+	assert.Equal(t, 1, n, "calls left at capacity")
+}
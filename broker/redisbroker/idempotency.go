@@ -0,0 +1,157 @@
+package redisbroker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
+	"github.com/mna/juggler/message"
+)
+
+const (
+	// redis cluster-compliant key, in the same slot as the CALL queues
+	idempotencyKey = "juggler:calls:idempotency:{%s}:%s" // 1: URI, 2: idempotency key
+
+	defaultIdempotencyWindow = 5 * time.Minute
+
+	// prefix of the fields of the idempotency hash that hold the
+	// duplicate calls waiting for the result.
+	idempotencyWaiterPrefix = "w:"
+)
+
+// idempotency holds the arguments of callOrResScript for a call with
+// an idempotency key.
+type idempotency struct {
+	key    string
+	field  string
+	waiter []byte
+}
+
+// script to store the result of a call with an idempotency key and
+// return the result payload templates of the duplicate calls waiting
+// for it. If ARGV[4] is not "1", the result is not stored and the key
+// is released, so that the next call with that key runs again.
+var idempotentResultScript = redis.NewScript(1, `
+	local vals = redis.call("HGETALL", KEYS[1])
+	local waiters = {}
+	for i = 1, #vals, 2 do
+		if string.sub(vals[i], 1, #ARGV[3]) == ARGV[3] then
+			waiters[#waiters + 1] = vals[i + 1]
+		end
+	end
+	redis.call("DEL", KEYS[1])
+	if ARGV[4] == "1" then
+		redis.call("HSET", KEYS[1], "res", ARGV[1])
+		redis.call("PEXPIRE", KEYS[1], tonumber(ARGV[2]))
+	end
+	return waiters
+`)
+
+func (b *Broker) idempotencyWindow() time.Duration {
+	if b.IdempotencyWindow == 0 {
+		return defaultIdempotencyWindow
+	}
+	return b.IdempotencyWindow
+}
+
+func (b *Broker) idempotentCall(cp *message.CallPayload, timeout time.Duration, k1, k2 string) error {
+	idem, err := b.newIdempotency(cp)
+	if err != nil {
+		return err
+	}
+	v, err := registerCallOrRes(b.Pool, b.PayloadCodec, cp, timeout, b.CallCap, k1, k2, idem)
+	if err != nil {
+		return err
+	}
+	return b.duplicateCall(cp, v, timeout)
+}
+
+// newIdempotency returns the idempotency arguments of the call cp.
+func (b *Broker) newIdempotency(cp *message.CallPayload) (*idempotency, error) {
+	// the duplicate call receives the result of the first call, only the
+	// UUIDs differ.
+	waiter, err := broker.MarshalPayload(b.PayloadCodec, &message.ResPayload{
+		ConnUUID: cp.ConnUUID,
+		MsgUUID:  cp.MsgUUID,
+		URI:      cp.URI,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &idempotency{
+		key:    nsKey(b.Namespace, fmt.Sprintf(idempotencyKey, cp.URI, cp.IdempotencyKey)),
+		field:  idempotencyWaiterPrefix + cp.ConnUUID.String() + ":" + cp.MsgUUID.String(),
+		waiter: waiter,
+	}, nil
+}
+
+// duplicateCall processes the reply v of the script that registered
+// the call cp with an idempotency key. If the call was a duplicate and
+// the result of the first call is stored, it is sent to the caller.
+func (b *Broker) duplicateCall(cp *message.CallPayload, v interface{}, timeout time.Duration) error {
+	// if the call was registered, the script returns the length of the list
+	vals, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	if b.Metrics != nil {
+		b.Metrics.Add("DuplicateCalls", 1)
+	}
+	if status, _ := redis.String(vals[0], nil); status != "res" || len(vals) < 2 {
+		// the first call is in progress, the result is sent when available
+		return nil
+	}
+	res, err := redis.Bytes(vals[1], nil)
+	if err != nil {
+		return err
+	}
+
+	rp := &message.ResPayload{
+		ConnUUID: cp.ConnUUID,
+		MsgUUID:  cp.MsgUUID,
+		URI:      cp.URI,
+		Args:     res,
+	}
+	return b.Result(rp, timeout)
+}
+
+// storeIdempotentResult stores the result of a call with an idempotency
+// key and sends it to the duplicate calls waiting for it. Error results
+// are sent to the waiting calls but they are not stored, so that a
+// retry runs the call again.
+func (b *Broker) storeIdempotentResult(rp *message.ResPayload, timeout time.Duration) error {
+	k := nsKey(b.Namespace, fmt.Sprintf(idempotencyKey, rp.URI, rp.IdempotencyKey))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	window := int(b.idempotencyWindow() / time.Millisecond)
+	waiters, err := redis.ByteSlices(idempotentResultScript.Do(rc,
+		k,                                 // key[1] : the idempotency hash
+		[]byte(rp.Args),                   // argv[1] : the result
+		window,                            // argv[2] : the idempotency window in milliseconds
+		idempotencyWaiterPrefix,           // argv[3] : the prefix of the waiter fields
+		message.ResultErr(rp.Args) == nil, // argv[4] : store the result
+	))
+	if err != nil {
+		return err
+	}
+
+	for _, w := range waiters {
+		var wrp message.ResPayload
+		if err := broker.UnmarshalPayload(w, &wrp); err != nil {
+			b.logger().Log(logging.Error, "Result: failed to unmarshal duplicate call", logging.Err(err))
+			continue
+		}
+		wrp.Args = rp.Args
+		if err := b.Result(&wrp, timeout); err != nil {
+			b.logger().Log(logging.Error, "Result: failed to store result of duplicate call", logging.MsgUUID(wrp.MsgUUID), logging.URI(wrp.URI), logging.Err(err))
+		}
+	}
+	return nil
+}
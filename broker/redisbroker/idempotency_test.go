@@ -0,0 +1,150 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotentCall(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	vars := expvar.NewMap(uuid.NewRandom().String())
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		Logger:  verboseLog,
+		Metrics: metrics.NewExpvar(vars),
+	}
+
+	rc := pool.Get()
+	defer rc.Close()
+
+	// llen returns the length of the list identified by the key format
+	// and value.
+	llen := func(format string, v interface{}) int {
+		n, err := redis.Int(rc.Do("LLEN", fmt.Sprintf(format, v)))
+		require.NoError(t, err, "LLEN")
+		return n
+	}
+	newCall := func(key string) *message.CallPayload {
+		return &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", IdempotencyKey: key}
+	}
+
+	// the first call is registered
+	first := newCall("k")
+	require.NoError(t, brk.Call(first, time.Minute), "Call first")
+	assert.Equal(t, 1, llen(callKey, "a"), "first call registered")
+
+	// a duplicate while the first call is in progress is not registered
+	waiting := newCall("k")
+	require.NoError(t, brk.Call(waiting, time.Minute), "Call duplicate in progress")
+	assert.Equal(t, 1, llen(callKey, "a"), "duplicate not registered")
+
+	// a call with a different key is registered
+	require.NoError(t, brk.Call(newCall("other"), time.Minute), "Call other key")
+	assert.Equal(t, 2, llen(callKey, "a"), "other key registered")
+
+	// the result is sent to the first call and the waiting duplicate
+	rp := &message.ResPayload{
+		ConnUUID:       first.ConnUUID,
+		MsgUUID:        first.MsgUUID,
+		URI:            "a",
+		Args:           json.RawMessage(`"ok"`),
+		IdempotencyKey: "k",
+	}
+	require.NoError(t, brk.Result(rp, time.Minute), "Result")
+	assert.Equal(t, 1, llen(resKey, first.ConnUUID), "result of first call")
+	assert.Equal(t, 1, llen(resKey, waiting.ConnUUID), "result of waiting duplicate")
+
+	// a later duplicate receives the stored result
+	later := newCall("k")
+	require.NoError(t, brk.Call(later, time.Minute), "Call duplicate after result")
+	assert.Equal(t, 2, llen(callKey, "a"), "later duplicate not registered")
+
+	b, err := redis.Bytes(rc.Do("RPOP", fmt.Sprintf(resKey, later.ConnUUID)))
+	require.NoError(t, err, "RPOP result of later duplicate")
+	var got message.ResPayload
+	require.NoError(t, json.Unmarshal(b, &got), "Unmarshal result")
+	assert.Equal(t, later.MsgUUID, got.MsgUUID, "result message UUID")
+	assert.Equal(t, `"ok"`, string(got.Args), "stored result")
+
+	assert.Equal(t, "2", vars.Get("DuplicateCalls").String(), "DuplicateCalls metric")
+
+	// an error result is sent to the waiting duplicate but not stored
+	first, waiting = newCall("err"), newCall("err")
+	require.NoError(t, brk.Call(first, time.Minute), "Call first err")
+	require.NoError(t, brk.Call(waiting, time.Minute), "Call duplicate err")
+	rp = &message.ResPayload{
+		ConnUUID:       first.ConnUUID,
+		MsgUUID:        first.MsgUUID,
+		URI:            "a",
+		Args:           json.RawMessage(`{"error":{"message":"failed","retryable":true}}`),
+		IdempotencyKey: "err",
+	}
+	require.NoError(t, brk.Result(rp, time.Minute), "Result err")
+	assert.Equal(t, 1, llen(resKey, waiting.ConnUUID), "error result of waiting duplicate")
+
+	n := llen(callKey, "a")
+	require.NoError(t, brk.Call(newCall("err"), time.Minute), "Call retry after error")
+	assert.Equal(t, n+1, llen(callKey, "a"), "retry after error registered")
+}
+
+func TestIdempotentScheduledCall(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Logger: verboseLog,
+	}
+
+	rc := pool.Get()
+	defer rc.Close()
+
+	zcard := func() int {
+		n, err := redis.Int(rc.Do("ZCARD", delayedListKey("a")))
+		require.NoError(t, err, "ZCARD")
+		return n
+	}
+	newCall := func(key string) *message.CallPayload {
+		return &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", IdempotencyKey: key}
+	}
+
+	// the first scheduled call is registered, a duplicate is not
+	first := newCall("k")
+	notBefore := time.Now().Add(time.Minute)
+	require.NoError(t, brk.ScheduleCall(first, time.Minute, notBefore), "ScheduleCall first")
+	assert.Equal(t, 1, zcard(), "first call scheduled")
+
+	waiting := newCall("k")
+	require.NoError(t, brk.ScheduleCall(waiting, time.Minute, notBefore), "ScheduleCall duplicate")
+	assert.Equal(t, 1, zcard(), "duplicate not scheduled")
+
+	// the duplicate receives the result of the first call
+	rp := &message.ResPayload{
+		ConnUUID:       first.ConnUUID,
+		MsgUUID:        first.MsgUUID,
+		URI:            "a",
+		Args:           json.RawMessage(`"ok"`),
+		IdempotencyKey: "k",
+	}
+	require.NoError(t, brk.Result(rp, time.Minute), "Result")
+	n, err := redis.Int(rc.Do("LLEN", fmt.Sprintf(resKey, waiting.ConnUUID)))
+	require.NoError(t, err, "LLEN")
+	assert.Equal(t, 1, n, "result of waiting duplicate")
+}
@@ -0,0 +1,142 @@
+package redisbroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadCodecs(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	jsonBrk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		Logger:          verboseLog,
+	}
+	binBrk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		PayloadCodec:    broker.BinaryPayloadCodec,
+		Logger:          verboseLog,
+	}
+
+	cc, err := jsonBrk.NewCallsConn("a")
+	require.NoError(t, err, "NewCallsConn")
+	defer cc.Close()
+
+	// calls made with both codecs are received
+	cps := []*message.CallPayload{
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Args: json.RawMessage(`{"x":1}`)},
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Args: json.RawMessage(`[1,2]`)},
+	}
+	require.NoError(t, jsonBrk.Call(cps[0], time.Second), "Call JSON")
+	require.NoError(t, binBrk.Call(cps[1], time.Second), "Call binary")
+
+	got := make(map[string]*message.CallPayload)
+	ch := cc.Calls()
+	for i := 0; i < len(cps); i++ {
+		select {
+		case cp := <-ch:
+			got[cp.MsgUUID.String()] = cp
+		case <-time.After(time.Second):
+			t.Fatalf("no call received")
+		}
+	}
+	for i, cp := range cps {
+		if gcp := got[cp.MsgUUID.String()]; assert.NotNil(t, gcp, "call %d", i) {
+			assert.Equal(t, cp.ConnUUID, gcp.ConnUUID, "ConnUUID %d", i)
+			assert.Equal(t, cp.Args, gcp.Args, "Args %d", i)
+		}
+	}
+}
+
+func TestUnmarshalPayload(t *testing.T) {
+	rp := &message.ResPayload{
+		ConnUUID: uuid.NewRandom(),
+		MsgUUID:  uuid.NewRandom(),
+		URI:      "a",
+		Args:     json.RawMessage(`"ok"`),
+		Seq:      2,
+	}
+	for _, c := range []broker.PayloadCodec{nil, broker.JSONPayloadCodec, broker.BinaryPayloadCodec} {
+		b, err := broker.MarshalPayload(c, rp)
+		require.NoError(t, err, "MarshalPayload %v", c)
+
+		var got message.ResPayload
+		require.NoError(t, broker.UnmarshalPayload(b, &got), "UnmarshalPayload %v", c)
+		assert.Equal(t, rp, &got, "decoded %v", c)
+	}
+
+	// Args that are not JSON are stored with the binary codec
+	rp.Args = json.RawMessage{0x81, 0xa1, 'x', 0x01}
+	b, err := broker.MarshalPayload(nil, rp)
+	require.NoError(t, err, "MarshalPayload non-JSON Args")
+	assert.Equal(t, broker.BinaryPayloadCodec.Version(), b[0], "version of non-JSON Args")
+	var gotRaw message.ResPayload
+	require.NoError(t, broker.UnmarshalPayload(b, &gotRaw), "UnmarshalPayload non-JSON Args")
+	assert.Equal(t, rp, &gotRaw, "decoded non-JSON Args")
+
+	var got message.ResPayload
+	assert.Error(t, broker.UnmarshalPayload(nil, &got), "empty payload")
+	assert.Error(t, broker.UnmarshalPayload([]byte{99, 1}, &got), "unknown version")
+}
+
+func TestPayloadCodecsNonJSONArgs(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		Logger:          verboseLog,
+	}
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "NewCallsConn")
+	defer cc.Close()
+
+	// a CALL sent by a msgpack client, with msgpack-encoded Args
+	var args bytes.Buffer
+	require.NoError(t, message.MsgpackCodec.Encode(&args, map[string]int{"x": 1}), "Encode args")
+	call, err := message.NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	call.Payload.Args = args.Bytes()
+
+	var wire bytes.Buffer
+	require.NoError(t, message.MsgpackCodec.Encode(&wire, call), "Encode CALL")
+	m, err := message.DecodeRequest(message.MsgpackCodec, &wire)
+	require.NoError(t, err, "DecodeRequest")
+	dcall := m.(*message.Call)
+	require.Equal(t, args.Bytes(), []byte(dcall.Payload.Args), "decoded Args")
+
+	cp := &message.CallPayload{
+		ConnUUID: uuid.NewRandom(),
+		MsgUUID:  dcall.UUID(),
+		URI:      dcall.Payload.URI,
+		Args:     dcall.Payload.Args,
+	}
+	require.NoError(t, brk.Call(cp, time.Second), "Call")
+
+	select {
+	case got := <-cc.Calls():
+		assert.Equal(t, cp.MsgUUID, got.MsgUUID, "MsgUUID")
+		assert.Equal(t, args.Bytes(), []byte(got.Args), "Args")
+	case <-time.After(time.Second):
+		t.Fatalf("no call received")
+	}
+}
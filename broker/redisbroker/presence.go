@@ -0,0 +1,458 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// redis cluster-compliant keys, so that both keys are in the same slot
+	presenceKey         = "juggler:presence:{%s}"          // 1: channel
+	presenceIdentityKey = "juggler:presence:identity:{%s}" // 1: channel
+)
+
+// minPresenceTTL is the minimum TTL of the presence, so that the
+// heartbeat does not hammer redis.
+const minPresenceTTL = time.Second
+
+func (b *Broker) presenceTTL() time.Duration {
+	if b.PresenceTTL > 0 && b.PresenceTTL < minPresenceTTL {
+		return minPresenceTTL
+	}
+	return b.PresenceTTL
+}
+
+// presencePurgeLua defines the purge function used by the presence
+// scripts to remove the expired presence from the sorted set KEYS[1]
+// and the hash KEYS[2]. It returns the expired connection UUIDs along
+// with their identity, so that their leave event can be published.
+const presencePurgeLua = `
+	local function purge(now)
+		local expired = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", now)
+		if #expired == 0 then
+			return {}
+		end
+		local idents = redis.call("HMGET", KEYS[2], unpack(expired))
+		redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+		redis.call("HDEL", KEYS[2], unpack(expired))
+
+		local res = {}
+		for i, id in ipairs(expired) do
+			res[#res + 1] = id
+			res[#res + 1] = idents[i] or ""
+		end
+		return res
+	end
+`
+
+// script to record the presence of a connection on a channel. The
+// sorted set stores the connection UUIDs scored by the expiration
+// timestamp of their presence, and the hash stores their identity.
+// The join event is published only if the connection was not already
+// present. The keys expire after twice the TTL of the presence, so
+// that the expired presence is usually purged - and its leave event
+// published - by the scripts before the keys expire.
+var presenceJoinScript = redis.NewScript(2, presencePurgeLua+`
+	local added = redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+	redis.call("HSET", KEYS[2], ARGV[2], ARGV[3])
+	redis.call("PEXPIRE", KEYS[1], tonumber(ARGV[4]))
+	redis.call("PEXPIRE", KEYS[2], tonumber(ARGV[4]))
+	if added == 1 then
+		redis.call("PUBLISH", ARGV[5], ARGV[6])
+	end
+	return {added, purge(ARGV[7])}
+`)
+
+// script to refresh the presence of a connection on a channel. The
+// presence is refreshed only if the connection is still present, no
+// event is published for the connection.
+var presenceRefreshScript = redis.NewScript(2, presencePurgeLua+`
+	local found = 0
+	if redis.call("ZSCORE", KEYS[1], ARGV[2]) then
+		found = 1
+		redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+		redis.call("PEXPIRE", KEYS[1], tonumber(ARGV[3]))
+		redis.call("PEXPIRE", KEYS[2], tonumber(ARGV[3]))
+	end
+	return {found, purge(ARGV[4])}
+`)
+
+// script to remove the presence of a connection on a channel. The
+// leave event is published only if the connection was present.
+var presenceLeaveScript = redis.NewScript(2, `
+	local removed = redis.call("ZREM", KEYS[1], ARGV[1])
+	redis.call("HDEL", KEYS[2], ARGV[1])
+	if removed == 1 then
+		redis.call("PUBLISH", ARGV[2], ARGV[3])
+	end
+	return removed
+`)
+
+// script to list the connections present on a channel, along with
+// their identity. Expired presence is removed first.
+var presenceQueryScript = redis.NewScript(2, presencePurgeLua+`
+	local expired = purge(ARGV[1])
+
+	local ids = redis.call("ZRANGE", KEYS[1], 0, -1)
+	if #ids == 0 then
+		return {{}, expired}
+	end
+
+	local idents = redis.call("HMGET", KEYS[2], unpack(ids))
+	local res = {}
+	for i, id in ipairs(ids) do
+		res[#res + 1] = id
+		res[#res + 1] = idents[i] or ""
+	end
+	return {res, expired}
+`)
+
+// Presence returns the list of connections currently subscribed
+// to the channel. Only non-pattern subscriptions are tracked, and
+// only if the pub-sub connections were created with a PresenceTTL
+// greater than 0. The leave event of each expired presence is
+// published when it is removed.
+func (b *Broker) Presence(channel string) ([]*message.PresencePayload, error) {
+	k1 := nsKey(b.Namespace, fmt.Sprintf(presenceKey, channel))
+	k2 := nsKey(b.Namespace, fmt.Sprintf(presenceIdentityKey, channel))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	v, expired, err := presenceReply(presenceQueryScript.Do(rc,
+		k1,                    // key[1] : the sorted set of connection UUIDs
+		k2,                    // key[2] : the hash of identities
+		unixMilli(time.Now()), // argv[1] : the current timestamp in milliseconds
+	))
+	if err != nil {
+		return nil, err
+	}
+	if err := publishExpired(rc, b.PayloadCodec, b.Namespace, channel, expired); err != nil {
+		b.logger().Log(logging.Warn, "Presence: failed to publish leave events", logging.Channel(channel), logging.Err(err))
+	}
+	vals, err := redis.Strings(v, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	pps := make([]*message.PresencePayload, 0, len(vals)/2)
+	for i := 0; i+1 < len(vals); i += 2 {
+		pp := &message.PresencePayload{
+			ConnUUID: uuid.Parse(vals[i]),
+			Channel:  channel,
+		}
+		if vals[i+1] != "" {
+			pp.Identity = json.RawMessage(vals[i+1])
+		}
+		pps = append(pps, pp)
+	}
+	return pps, nil
+}
+
+// SetPresence sets the connection UUID and identity metadata recorded
+// on the channels the connection subscribes to. It is a no-op if the
+// connection was created with a PresenceTTL of 0. The first call starts
+// the heartbeat that refreshes the presence.
+func (c *pubSubConn) SetPresence(connUUID uuid.UUID, identity json.RawMessage) error {
+	if c.presenceTTL <= 0 {
+		return nil
+	}
+
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.connUUID = connUUID
+	c.identity = identity
+	if c.stophb == nil {
+		c.stophb = make(chan struct{})
+		go c.heartbeat(c.stophb)
+	}
+
+	// update the identity on the existing subscriptions
+	var err error
+	for ch := range c.present {
+		if e := c.recordPresence(ch); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (c *pubSubConn) heartbeat(stop <-chan struct{}) {
+	t := time.NewTicker(c.presenceTTL / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		// do not hold the lock during the redis calls, so that joining
+		// and leaving channels is not blocked by the refresh.
+		c.pmu.Lock()
+		connUUID := c.connUUID
+		chans := make([]string, 0, len(c.present))
+		for ch := range c.present {
+			chans = append(chans, ch)
+		}
+		c.pmu.Unlock()
+
+		for _, ch := range chans {
+			found, err := c.refreshPresence(ch, connUUID)
+			if err != nil {
+				c.logger.Log(logging.Warn, "Presence: failed to refresh presence", logging.Channel(ch), logging.Err(err))
+				continue
+			}
+			if !found {
+				c.rejoin(ch)
+			}
+		}
+	}
+}
+
+// rejoin records the presence of the connection on the channel again
+// after it expired, if the connection is still present on that
+// channel.
+func (c *pubSubConn) rejoin(ch string) {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	if c.closed || !c.present[ch] {
+		return
+	}
+	if err := c.recordPresence(ch); err != nil {
+		c.logger.Log(logging.Warn, "Presence: failed to record presence", logging.Channel(ch), logging.Err(err))
+	}
+}
+
+// join records the presence of the connection on the channel, if
+// presence tracking is enabled.
+func (c *pubSubConn) join(ch string) {
+	if c.presenceTTL <= 0 || strings.HasPrefix(ch, broker.PresenceChannelPrefix) {
+		return
+	}
+
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	if c.closed || c.connUUID == nil {
+		return
+	}
+	if err := c.recordPresence(ch); err != nil {
+		if c.metrics != nil {
+			c.metrics.Add("FailedPresenceUpdates", 1)
+		}
+		c.logger.Log(logging.Warn, "Presence: failed to record presence", logging.Channel(ch), logging.Err(err))
+		return
+	}
+	if c.present == nil {
+		c.present = make(map[string]bool)
+	}
+	c.present[ch] = true
+}
+
+// leave removes the presence of the connection from the channel, if
+// it was recorded.
+func (c *pubSubConn) leave(ch string) {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	if !c.present[ch] {
+		return
+	}
+	delete(c.present, ch)
+	if err := c.removePresence(ch); err != nil {
+		if c.metrics != nil {
+			c.metrics.Add("FailedPresenceUpdates", 1)
+		}
+		c.logger.Log(logging.Warn, "Presence: failed to remove presence", logging.Channel(ch), logging.Err(err))
+	}
+}
+
+// leaveAll removes the presence of the connection from all channels
+// and stops the heartbeat. No presence is recorded after that call.
+func (c *pubSubConn) leaveAll() {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.stophb != nil {
+		close(c.stophb)
+	}
+	for ch := range c.present {
+		if err := c.removePresence(ch); err != nil {
+			c.logger.Log(logging.Warn, "Presence: failed to remove presence", logging.Channel(ch), logging.Err(err))
+		}
+	}
+	c.present = nil
+}
+
+// recordPresence must be called with pmu locked.
+func (c *pubSubConn) recordPresence(ch string) error {
+	evt, err := newPresenceEvent(c.codec, c.connUUID, ch, c.identity, message.PresenceJoin)
+	if err != nil {
+		return err
+	}
+
+	k1 := nsKey(c.ns, fmt.Sprintf(presenceKey, ch))
+	k2 := nsKey(c.ns, fmt.Sprintf(presenceIdentityKey, ch))
+
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	now := time.Now()
+	_, expired, err := presenceReply(presenceJoinScript.Do(rc,
+		k1,                                      // key[1] : the sorted set of connection UUIDs
+		k2,                                      // key[2] : the hash of identities
+		unixMilli(now.Add(c.presenceTTL)),       // argv[1] : the expiration timestamp in milliseconds
+		c.connUUID.String(),                     // argv[2] : the connection UUID
+		[]byte(c.identity),                      // argv[3] : the identity
+		c.keysTTL(),                             // argv[4] : the TTL of the keys in milliseconds
+		nsKey(c.ns, broker.PresenceChannel(ch)), // argv[5] : the presence channel
+		evt,                                     // argv[6] : the join event payload
+		unixMilli(now),                          // argv[7] : the current timestamp in milliseconds
+	))
+	if err != nil {
+		return err
+	}
+	return publishExpired(rc, c.codec, c.ns, ch, expired)
+}
+
+// refreshPresence refreshes the presence of the connection connUUID on
+// the channel. It returns false if the connection is not present on
+// the channel anymore, e.g. because its presence expired. It does not
+// require pmu to be locked.
+func (c *pubSubConn) refreshPresence(ch string, connUUID uuid.UUID) (bool, error) {
+	k1 := nsKey(c.ns, fmt.Sprintf(presenceKey, ch))
+	k2 := nsKey(c.ns, fmt.Sprintf(presenceIdentityKey, ch))
+
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	now := time.Now()
+	v, expired, err := presenceReply(presenceRefreshScript.Do(rc,
+		k1,                                // key[1] : the sorted set of connection UUIDs
+		k2,                                // key[2] : the hash of identities
+		unixMilli(now.Add(c.presenceTTL)), // argv[1] : the expiration timestamp in milliseconds
+		connUUID.String(),                 // argv[2] : the connection UUID
+		c.keysTTL(),                       // argv[3] : the TTL of the keys in milliseconds
+		unixMilli(now),                    // argv[4] : the current timestamp in milliseconds
+	))
+	if err != nil {
+		return false, err
+	}
+	found, err := redis.Bool(v, nil)
+	if err != nil {
+		return false, err
+	}
+	return found, publishExpired(rc, c.codec, c.ns, ch, expired)
+}
+
+// keysTTL returns the TTL in milliseconds of the presence keys.
+func (c *pubSubConn) keysTTL() int64 {
+	return 2 * int64(c.presenceTTL/time.Millisecond)
+}
+
+// removePresence must be called with pmu locked.
+func (c *pubSubConn) removePresence(ch string) error {
+	evt, err := newPresenceEvent(c.codec, c.connUUID, ch, c.identity, message.PresenceLeave)
+	if err != nil {
+		return err
+	}
+
+	k1 := nsKey(c.ns, fmt.Sprintf(presenceKey, ch))
+	k2 := nsKey(c.ns, fmt.Sprintf(presenceIdentityKey, ch))
+
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	_, err = presenceLeaveScript.Do(rc,
+		k1,                                      // key[1] : the sorted set of connection UUIDs
+		k2,                                      // key[2] : the hash of identities
+		c.connUUID.String(),                     // argv[1] : the connection UUID
+		nsKey(c.ns, broker.PresenceChannel(ch)), // argv[2] : the presence channel
+		evt,                                     // argv[3] : the leave event payload
+	)
+	return err
+}
+
+// newPresenceEvent returns the PubPayload of a presence event, encoded
+// with codec. The PresencePayload of the event is always JSON-encoded,
+// as it is sent as-is to the subscribers.
+func newPresenceEvent(codec broker.PayloadCodec, connUUID uuid.UUID, ch string, identity json.RawMessage, event string) ([]byte, error) {
+	b, err := json.Marshal(&message.PresencePayload{
+		ConnUUID: connUUID,
+		Channel:  ch,
+		Identity: identity,
+		Event:    event,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return broker.MarshalPayload(codec, &message.PubPayload{
+		MsgUUID: uuid.NewRandom(),
+		Args:    b,
+	})
+}
+
+// presenceReply returns the result of a presence script and the
+// expired presence that it purged, as pairs of connection UUID and
+// identity.
+func presenceReply(v interface{}, err error) (interface{}, []string, error) {
+	vals, err := redis.Values(v, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(vals) != 2 {
+		return nil, nil, fmt.Errorf("redisbroker: invalid presence script reply: %v", vals)
+	}
+	expired, err := redis.Strings(vals[1], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vals[0], expired, nil
+}
+
+// publishExpired publishes the leave event of each expired presence
+// on the channel ch, as returned by presenceReply.
+func publishExpired(rc redis.Conn, codec broker.PayloadCodec, ns, ch string, expired []string) error {
+	var err error
+	for i := 0; i+1 < len(expired); i += 2 {
+		var identity json.RawMessage
+		if expired[i+1] != "" {
+			identity = json.RawMessage(expired[i+1])
+		}
+		evt, e := newPresenceEvent(codec, uuid.Parse(expired[i]), ch, identity, message.PresenceLeave)
+		if e == nil {
+			_, e = rc.Do("PUBLISH", nsKey(ns, broker.PresenceChannel(ch)), evt)
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
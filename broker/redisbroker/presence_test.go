@@ -0,0 +1,210 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresence(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:        pool,
+		Dial:        pool.Dial,
+		Logger:      verboseLog,
+		PresenceTTL: time.Second,
+	}
+
+	// watch presence events on channel a
+	watch, err := brk.NewPubSubConn()
+	require.NoError(t, err, "get watch PubSub connection")
+	require.NoError(t, watch.Subscribe(broker.PresenceChannel("a"), false), "Subscribe to presence channel")
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	var events []string
+	go func() {
+		defer wg.Done()
+		for ep := range watch.Events() {
+			var pp message.PresencePayload
+			if assert.NoError(t, json.Unmarshal(ep.Args, &pp), "Unmarshal presence event") {
+				events = append(events, pp.Event+":"+pp.ConnUUID.String())
+			}
+		}
+	}()
+
+	connUUID := uuid.NewRandom()
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "get PubSub connection")
+	require.NoError(t, psc.(broker.PresenceConn).SetPresence(connUUID, json.RawMessage(`{"name":"x"}`)), "SetPresence")
+
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe a")
+	require.NoError(t, psc.Subscribe("b", false), "Subscribe b")
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe a again")
+
+	pps, err := brk.Presence("a")
+	require.NoError(t, err, "Presence a")
+	if assert.Equal(t, 1, len(pps), "Presence a returns 1 connection") {
+		assert.Equal(t, connUUID, pps[0].ConnUUID, "connection UUID")
+		assert.Equal(t, "a", pps[0].Channel, "channel")
+		assert.Equal(t, `{"name":"x"}`, string(pps[0].Identity), "identity")
+	}
+
+	require.NoError(t, psc.Unsubscribe("a", false), "Unsubscribe a")
+	pps, err = brk.Presence("a")
+	require.NoError(t, err, "Presence a after Unsubscribe")
+	assert.Equal(t, 0, len(pps), "Presence a returns no connection")
+
+	pps, err = brk.Presence("b")
+	require.NoError(t, err, "Presence b")
+	assert.Equal(t, 1, len(pps), "Presence b returns 1 connection")
+
+	require.NoError(t, psc.Close(), "close pubsub connection")
+	pps, err = brk.Presence("b")
+	require.NoError(t, err, "Presence b after Close")
+	assert.Equal(t, 0, len(pps), "Presence b returns no connection")
+
+	time.Sleep(10 * time.Millisecond) // ensure time to pop the last message :(
+	require.NoError(t, watch.Close(), "close watch connection")
+	wg.Wait()
+
+	expected := []string{
+		message.PresenceJoin + ":" + connUUID.String(),
+		message.PresenceLeave + ":" + connUUID.String(),
+	}
+	assert.Equal(t, expected, events, "got expected presence events")
+}
+
+func TestPresenceExpired(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Logger: verboseLog,
+	}
+
+	watch, err := brk.NewPubSubConn()
+	require.NoError(t, err, "get watch PubSub connection")
+	require.NoError(t, watch.Subscribe(broker.PresenceChannel("a"), false), "Subscribe to presence channel")
+
+	// manually record a presence that expires quickly, the keys expire
+	// after twice that TTL.
+	connUUID := uuid.NewRandom()
+	psc := &pubSubConn{
+		pool:        pool,
+		presenceTTL: 200 * time.Millisecond,
+		connUUID:    connUUID,
+		identity:    json.RawMessage(`{"name":"x"}`),
+	}
+	psc.pmu.Lock()
+	require.NoError(t, psc.recordPresence("a"), "recordPresence")
+	psc.pmu.Unlock()
+
+	time.Sleep(250 * time.Millisecond)
+	pps, err := brk.Presence("a")
+	require.NoError(t, err, "Presence a")
+	assert.Equal(t, 0, len(pps), "expired presence is not returned")
+
+	// a refresh after expiry does not record the presence again
+	found, err := psc.refreshPresence("a", connUUID)
+	require.NoError(t, err, "refreshPresence")
+	assert.False(t, found, "refresh after expiry")
+
+	var events []string
+	for i := 0; i < 2; i++ {
+		select {
+		case ep := <-watch.Events():
+			var pp message.PresencePayload
+			if assert.NoError(t, json.Unmarshal(ep.Args, &pp), "Unmarshal presence event") {
+				events = append(events, pp.Event+":"+pp.ConnUUID.String()+":"+string(pp.Identity))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for presence event %d", i)
+		}
+	}
+	expected := []string{
+		message.PresenceJoin + ":" + connUUID.String() + `:{"name":"x"}`,
+		message.PresenceLeave + ":" + connUUID.String() + `:{"name":"x"}`,
+	}
+	assert.Equal(t, expected, events, "got expected presence events")
+	require.NoError(t, watch.Close(), "close watch connection")
+}
+
+func TestPresenceRefresh(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Logger: verboseLog,
+	}
+
+	watch, err := brk.NewPubSubConn()
+	require.NoError(t, err, "get watch PubSub connection")
+	require.NoError(t, watch.Subscribe(broker.PresenceChannel("a"), false), "Subscribe to presence channel")
+
+	connUUID := uuid.NewRandom()
+	psc := &pubSubConn{
+		pool:        pool,
+		presenceTTL: time.Minute,
+		connUUID:    connUUID,
+	}
+	psc.pmu.Lock()
+	require.NoError(t, psc.recordPresence("a"), "recordPresence")
+	require.NoError(t, psc.recordPresence("a"), "recordPresence again")
+	psc.pmu.Unlock()
+
+	found, err := psc.refreshPresence("a", connUUID)
+	require.NoError(t, err, "refreshPresence")
+	assert.True(t, found, "refresh")
+
+	pps, err := brk.Presence("a")
+	require.NoError(t, err, "Presence a")
+	assert.Equal(t, 1, len(pps), "Presence a returns 1 connection")
+
+	// only the first record publishes a join event
+	select {
+	case <-watch.Events():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for join event")
+	}
+	select {
+	case ep := <-watch.Events():
+		t.Errorf("unexpected presence event: %s", ep.Args)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, watch.Close(), "close watch connection")
+}
+
+func TestPresenceTTL(t *testing.T) {
+	cases := []struct {
+		in, out time.Duration
+	}{
+		{0, 0},
+		{-1, -1},
+		{time.Nanosecond, minPresenceTTL},
+		{time.Millisecond, minPresenceTTL},
+		{minPresenceTTL, minPresenceTTL},
+		{time.Minute, time.Minute},
+	}
+	for _, c := range cases {
+		b := &Broker{PresenceTTL: c.in}
+		assert.Equal(t, c.out, b.presenceTTL(), "%s", c.in)
+	}
+}
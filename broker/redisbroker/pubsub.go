@@ -2,23 +2,45 @@ package redisbroker
 
 import (
 	"encoding/json"
-	"expvar"
 	"sync"
+	"time"
 
 	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
 )
 
-var _ broker.PubSubConn = (*pubSubConn)(nil)
+var (
+	_ broker.PubSubConn   = (*pubSubConn)(nil)
+	_ broker.PresenceConn = (*pubSubConn)(nil)
+)
 
 type pubSubConn struct {
-	psc   redis.PubSubConn
-	logFn func(string, ...interface{})
-	vars  *expvar.Map
+	psc         redis.PubSubConn
+	dial        func() (redis.Conn, error)
+	pool        Pool
+	ns          string
+	presenceTTL time.Duration
+	codec       broker.PayloadCodec
+	reconnect   reconnectPolicy
+	notifyGaps  bool
+	logger      logging.Logger
+	metrics     metrics.Metrics
+
+	// wmu controls writes (sub/unsub calls) to the connection, and
+	// protects the subscriptions and the replacement of psc.
+	wmu     sync.Mutex
+	subs    map[string]bool // channels to restore on reconnection, in the namespace
+	psubs   map[string]bool // patterns to restore on reconnection, in the namespace
+	closing bool
 
-	// wmu controls writes (sub/unsub calls) to the connection.
-	wmu sync.Mutex
+	// stop is closed when the connection is closed, to abort
+	// reconnection attempts.
+	stop     chan struct{}
+	stopOnce sync.Once
 
 	// once makes sure only the first call to Events starts the goroutine.
 	once sync.Once
@@ -27,10 +49,30 @@ type pubSubConn struct {
 	// errmu protects access to err.
 	errmu sync.Mutex
 	err   error
+
+	// pmu protects access to the presence fields.
+	pmu      sync.Mutex
+	connUUID uuid.UUID
+	identity json.RawMessage
+	present  map[string]bool // channels where the presence is recorded
+	stophb   chan struct{}   // closed to stop the presence heartbeat
+	closed   bool
 }
 
-// Close closes the connection.
+// Close closes the connection. The presence of the connection is
+// removed from all channels it is subscribed to.
 func (c *pubSubConn) Close() error {
+	c.leaveAll()
+
+	c.stopOnce.Do(func() {
+		if c.stop != nil {
+			close(c.stop)
+		}
+	})
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.closing = true
 	return c.psc.Close()
 }
 
@@ -47,6 +89,12 @@ func (c *pubSubConn) Unsubscribe(channel string, pattern bool) error {
 }
 
 func (c *pubSubConn) subUnsub(ch string, pat bool, sub bool) error {
+	name := nsKey(c.ns, ch)
+	if pat {
+		name = nsPattern(c.ns, ch)
+	}
+
+	c.wmu.Lock()
 	var fn func(...interface{}) error
 	switch {
 	case pat && sub:
@@ -58,10 +106,20 @@ func (c *pubSubConn) subUnsub(ch string, pat bool, sub bool) error {
 	case !pat && !sub:
 		fn = c.psc.Unsubscribe
 	}
-
-	c.wmu.Lock()
-	err := fn(ch)
+	err := fn(name)
+	if err == nil {
+		c.trackSub(name, pat, sub)
+	}
 	c.wmu.Unlock()
+
+	// presence is only tracked for non-pattern subscriptions
+	if err == nil && !pat {
+		if sub {
+			c.join(ch)
+		} else {
+			c.leave(ch)
+		}
+	}
 	return err
 }
 
@@ -92,8 +150,11 @@ func (c *pubSubConn) listen() {
 
 		case error:
 			// possibly because the pub-sub connection was closed, but
-			// in any case, the pub-sub is now broken, terminate the
-			// loop.
+			// in any case, the pub-sub is now broken. Try to reconnect
+			// if it wasn't closed, otherwise terminate the loop.
+			if c.reconnectPubSub(v, &wg) {
+				continue
+			}
 			c.errmu.Lock()
 			c.err = v
 			c.errmu.Unlock()
@@ -103,26 +164,120 @@ func (c *pubSubConn) listen() {
 	}
 }
 
+// trackSub records the subscription so that it can be restored on
+// reconnection. It must be called with wmu locked.
+func (c *pubSubConn) trackSub(ch string, pat bool, sub bool) {
+	m := &c.subs
+	if pat {
+		m = &c.psubs
+	}
+	if !sub {
+		delete(*m, ch)
+		return
+	}
+	if *m == nil {
+		*m = make(map[string]bool)
+	}
+	(*m)[ch] = true
+}
+
+// reconnectPubSub replaces the failed redis connection with a new one
+// and restores the subscriptions. It returns true if the connection
+// was successfully replaced.
+func (c *pubSubConn) reconnectPubSub(cause error, wg *sync.WaitGroup) bool {
+	c.wmu.Lock()
+	closing := c.closing
+	c.wmu.Unlock()
+	if closing || c.reconnect.attempts == 0 {
+		return false
+	}
+
+	c.logger.Log(logging.Warn, "Events: pub-sub connection failed, reconnecting", logging.Err(cause))
+
+	var chans, pats []string
+	resub := func(rc redis.Conn) error {
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+
+		if c.closing {
+			return errReconnectStopped
+		}
+		psc := redis.PubSubConn{Conn: rc}
+		chans, pats = chans[:0], pats[:0]
+		for ch := range c.subs {
+			chans = append(chans, ch)
+		}
+		for p := range c.psubs {
+			pats = append(pats, p)
+		}
+		if len(chans) > 0 {
+			if err := psc.Subscribe(redis.Args{}.AddFlat(chans)...); err != nil {
+				return err
+			}
+		}
+		if len(pats) > 0 {
+			if err := psc.PSubscribe(redis.Args{}.AddFlat(pats)...); err != nil {
+				return err
+			}
+		}
+		c.psc.Close()
+		c.psc = psc
+		return nil
+	}
+
+	if _, err := c.reconnect.redial(c.dial, resub, c.stop, c.logger); err != nil {
+		if err != errReconnectStopped {
+			c.logger.Log(logging.Error, "Events: failed to reconnect pub-sub connection", logging.Err(err))
+		}
+		return false
+	}
+
+	if c.metrics != nil {
+		c.metrics.Add("PubSubReconnects", 1)
+		c.metrics.Add("PubSubGaps", int64(len(chans)+len(pats)))
+	}
+	if c.notifyGaps {
+		for _, ch := range chans {
+			wg.Add(1)
+			go c.sendGap(&message.EvntPayload{Channel: stripNS(c.ns, ch, false), Gap: true}, wg)
+		}
+		for _, p := range pats {
+			wg.Add(1)
+			go c.sendGap(&message.EvntPayload{Pattern: stripNS(c.ns, p, true), Gap: true}, wg)
+		}
+	}
+	return true
+}
+
+func (c *pubSubConn) sendGap(ep *message.EvntPayload, wg *sync.WaitGroup) {
+	defer wg.Done()
+	c.evch <- ep
+}
+
 func (c *pubSubConn) sendEvent(channel, pattern string, pld []byte, wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	channel = stripNS(c.ns, channel, false)
+	if pattern != "" {
+		pattern = stripNS(c.ns, pattern, true)
+	}
 	ep, err := newEvntPayload(channel, pattern, pld)
 	if err != nil {
-		if c.vars != nil {
-			c.vars.Add("FailedEvntPayloadUnmarshals", 1)
+		if c.metrics != nil {
+			c.metrics.Add("FailedEvntPayloadUnmarshals", 1)
 		}
-		logf(c.logFn, "Events: failed to unmarshal event payload: %v", err)
+		c.logger.Log(logging.Error, "Events: failed to unmarshal event payload", logging.Err(err))
 		return
 	}
 	c.evch <- ep
-	if c.vars != nil {
-		c.vars.Add("Events", 1)
+	if c.metrics != nil {
+		c.metrics.Add("Events", 1)
 	}
 }
 
 func newEvntPayload(channel, pattern string, pld []byte) (*message.EvntPayload, error) {
 	var pp message.PubPayload
-	if err := json.Unmarshal(pld, &pp); err != nil {
+	if err := broker.UnmarshalPayload(pld, &pp); err != nil {
 		return nil, err
 	}
 	ep := &message.EvntPayload{
@@ -130,6 +285,7 @@ func newEvntPayload(channel, pattern string, pld []byte) (*message.EvntPayload,
 		Channel: channel,
 		Pattern: pattern,
 		Args:    pp.Args,
+		Headers: pp.Headers,
 	}
 	return ep, nil
 }
@@ -1,11 +1,14 @@
 package redisbroker
 
 import (
+	"expvar"
+	"sort"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/mna/redisc/redistest"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
@@ -18,9 +21,9 @@ func TestPubSub(t *testing.T) {
 
 	pool := redistest.NewPool(t, ":"+port)
 	brk := &Broker{
-		Pool:    pool,
-		Dial:    pool.Dial,
-		LogFunc: logIfVerbose,
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Logger: verboseLog,
 	}
 
 	// list results on this conn UUID
@@ -31,10 +34,12 @@ func TestPubSub(t *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	var uuids []uuid.UUID
+	var headers []map[string]string
 	go func() {
 		defer wg.Done()
 		for ep := range psc.Events() {
 			uuids = append(uuids, ep.MsgUUID)
+			headers = append(headers, ep.Headers)
 		}
 	}()
 
@@ -48,7 +53,7 @@ func TestPubSub(t *testing.T) {
 		exp  bool
 		unsb string
 	}{
-		{"a", &message.PubPayload{MsgUUID: uuid.NewRandom()}, true, ""},
+		{"a", &message.PubPayload{MsgUUID: uuid.NewRandom(), Headers: map[string]string{"id": "1"}}, true, ""},
 		{"b", &message.PubPayload{MsgUUID: uuid.NewRandom()}, true, ""},
 		{"c", &message.PubPayload{MsgUUID: uuid.NewRandom()}, false, "a"},
 		{"a", &message.PubPayload{MsgUUID: uuid.NewRandom()}, false, ""},
@@ -73,4 +78,68 @@ func TestPubSub(t *testing.T) {
 		assert.Contains(t, psc.EventsErr().Error(), "use of closed", "EventsErr is the expected error")
 	}
 	assert.Equal(t, expected, uuids, "got expected UUIDs")
+	if assert.NotEmpty(t, headers, "got headers") {
+		assert.Equal(t, map[string]string{"id": "1"}, headers[0], "got event headers")
+	}
+}
+
+func TestPubSubReconnect(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	vars := expvar.NewMap("TestPubSubReconnect")
+	brk := &Broker{
+		Pool:              pool,
+		Dial:              pool.Dial,
+		Logger:            verboseLog,
+		ReconnectAttempts: 10,
+		ReconnectBackoff:  10 * time.Millisecond,
+		NotifyPubSubGaps:  true,
+		Metrics:           metrics.NewExpvar(vars),
+	}
+
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "get PubSub connection")
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	var gaps []string
+	var uuids []uuid.UUID
+	go func() {
+		defer wg.Done()
+		for ep := range psc.Events() {
+			if ep.Gap {
+				gaps = append(gaps, ep.Channel+ep.Pattern)
+				continue
+			}
+			uuids = append(uuids, ep.MsgUUID)
+		}
+	}()
+
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe a")
+	require.NoError(t, psc.Subscribe("b*", true), "Subscribe b*")
+
+	// kill the pub-sub connection
+	rc := pool.Get()
+	_, err = rc.Do("CLIENT", "KILL", "TYPE", "pubsub")
+	rc.Close()
+	require.NoError(t, err, "CLIENT KILL")
+
+	time.Sleep(100 * time.Millisecond) // wait for the reconnection
+
+	pp1 := &message.PubPayload{MsgUUID: uuid.NewRandom()}
+	pp2 := &message.PubPayload{MsgUUID: uuid.NewRandom()}
+	require.NoError(t, brk.Publish("a", pp1), "Publish a")
+	require.NoError(t, brk.Publish("bc", pp2), "Publish bc")
+
+	time.Sleep(10 * time.Millisecond) // ensure time to pop the last message :(
+	require.NoError(t, psc.Close(), "close pubsub connection")
+	wg.Wait()
+
+	sort.Strings(gaps)
+	assert.Equal(t, []string{"a", "b*"}, gaps, "got expected gaps")
+	assert.Equal(t, []uuid.UUID{pp1.MsgUUID, pp2.MsgUUID}, uuids, "got expected UUIDs")
+	assert.Equal(t, "1", vars.Get("PubSubReconnects").String(), "PubSubReconnects")
+	assert.Equal(t, "2", vars.Get("PubSubGaps").String(), "PubSubGaps")
 }
@@ -1,13 +1,14 @@
 package redisbroker
 
 import (
-	"expvar"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
 )
@@ -15,12 +16,13 @@ import (
 var _ broker.ResultsConn = (*resultsConn)(nil)
 
 type resultsConn struct {
-	c        redis.Conn
+	conn     *blockingConn
 	pool     Pool
+	ns       string
 	connUUID uuid.UUID
 	timeout  time.Duration
-	logFn    func(string, ...interface{})
-	vars     *expvar.Map
+	logger   logging.Logger
+	metrics  metrics.Metrics
 
 	// once makes sure only the first call to Results starts the goroutine.
 	once sync.Once
@@ -33,7 +35,7 @@ type resultsConn struct {
 
 // Close closes the connection.
 func (c *resultsConn) Close() error {
-	return c.c.Close()
+	return c.conn.close()
 }
 
 // ResultsErr returns the error that caused the Results channel to close.
@@ -51,11 +53,11 @@ func (c *resultsConn) Results() <-chan *message.ResPayload {
 		c.ch = make(chan *message.ResPayload)
 
 		// compute key and timeout
-		key := fmt.Sprintf(resKey, c.connUUID)
+		key := nsKey(c.ns, fmt.Sprintf(resKey, c.connUUID))
 		to := int(c.timeout / time.Second)
 
 		// make connection cluster-aware if running in a cluster
-		rc := clusterifyConn(c.c, key)
+		rc := clusterifyConn(c.conn.conn(), key)
 
 		go c.pollResults(rc, key, to)
 	})
@@ -76,8 +78,12 @@ func (c *resultsConn) pollResults(pollConn redis.Conn, key string, timeout int)
 				continue
 			}
 
-			// possibly a closed connection, in any case stop
-			// the loop.
+			// try to recover from transient errors, otherwise it is
+			// possibly a closed connection, in any case stop the loop.
+			if rc, ok := c.conn.recover(err, key); ok {
+				pollConn = rc
+				continue
+			}
 			c.errmu.Lock()
 			c.err = err
 			c.errmu.Unlock()
@@ -85,50 +91,63 @@ func (c *resultsConn) pollResults(pollConn redis.Conn, key string, timeout int)
 			return
 		}
 
+		var rp message.ResPayload
+		if err := unmarshalBRPOPValue(&rp, v); err != nil {
+			if c.metrics != nil {
+				c.metrics.Add("FailedResPayloadUnmarshals", 1)
+			}
+			c.logger.Log(logging.Error, "Results: BRPOP failed to unmarshal result payload", logging.ConnUUID(c.connUUID), logging.Err(err))
+			continue
+		}
+
 		wg.Add(1)
-		go c.sendResult(v, &wg)
+		if rp.Seq > 0 {
+			// the results of a streamed call are sent in order
+			c.sendResult(&rp, &wg)
+			continue
+		}
+		go c.sendResult(&rp, &wg)
 	}
 }
 
-// receives the raw value v retured from BRPOP.
-func (c *resultsConn) sendResult(v []interface{}, wg *sync.WaitGroup) {
+// receives the result payload rp unmarshaled from BRPOP.
+func (c *resultsConn) sendResult(rp *message.ResPayload, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	// unmarshal the payload
-	var rp message.ResPayload
-	if err := unmarshalBRPOPValue(&rp, v); err != nil {
-		if c.vars != nil {
-			c.vars.Add("FailedResPayloadUnmarshals", 1)
-		}
-		logf(c.logFn, "Results: BRPOP failed to unmarshal result payload: %v", err)
-		return
-	}
-
 	// check if call is expired
-	k := fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID)
+	k := nsKey(c.ns, fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID))
 
 	rc := c.pool.Get()
 	defer rc.Close()
 	rc = clusterifyConn(rc, k)
 
-	pttl, err := redis.Int(delAndPTTLScript.Do(rc, k))
+	// the results of a broadcast call and the partial results of a
+	// call share the same key as the final result, which expires by
+	// itself.
+	var pttl int
+	var err error
+	if rp.Broadcast || rp.Partial {
+		pttl, err = redis.Int(rc.Do("PTTL", k))
+	} else {
+		pttl, err = redis.Int(delAndPTTLScript.Do(rc, k))
+	}
 	if err != nil {
-		if c.vars != nil {
-			c.vars.Add("FailedPTTLResults", 1)
+		if c.metrics != nil {
+			c.metrics.Add("FailedPTTLResults", 1)
 		}
-		logf(c.logFn, "Results: DEL/PTTL failed: %v", err)
+		c.logger.Log(logging.Error, "Results: DEL/PTTL failed", logging.MsgUUID(rp.MsgUUID), logging.Err(err))
 		return
 	}
 	if pttl <= 0 {
-		if c.vars != nil {
-			c.vars.Add("ExpiredResults", 1)
+		if c.metrics != nil {
+			c.metrics.Add("ExpiredResults", 1)
 		}
-		logf(c.logFn, "Results: message %v expired, dropping call", rp.MsgUUID)
+		c.logger.Log(logging.Debug, "Results: message expired, dropping result", logging.MsgUUID(rp.MsgUUID), logging.URI(rp.URI))
 		return
 	}
 
-	c.ch <- &rp
-	if c.vars != nil {
-		c.vars.Add("Results", 1)
+	c.ch <- rp
+	if c.metrics != nil {
+		c.metrics.Add("Results", 1)
 	}
 }
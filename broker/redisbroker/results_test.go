@@ -21,7 +21,7 @@ func TestResults(t *testing.T) {
 		Pool:            pool,
 		Dial:            pool.Dial,
 		BlockingTimeout: time.Second,
-		LogFunc:         logIfVerbose,
+		Logger:          verboseLog,
 	}
 
 	// list results on this conn UUID
@@ -68,3 +68,41 @@ func TestResults(t *testing.T) {
 	}
 	assert.Equal(t, expected, uuids, "got expected UUIDs")
 }
+
+func TestResultsStream(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		Logger:          verboseLog,
+	}
+
+	connUUID := uuid.NewRandom()
+	rc, err := brk.NewResultsConn(connUUID)
+	require.NoError(t, err, "get Results connection")
+
+	// store the partial results and the final result of a call
+	msgUUID := uuid.NewRandom()
+	for seq := 1; seq <= 5; seq++ {
+		rp := &message.ResPayload{ConnUUID: connUUID, MsgUUID: msgUUID, URI: "a", Partial: seq < 5, Seq: seq}
+		require.NoError(t, brk.Result(rp, time.Second), "Result %d", seq)
+	}
+
+	// all results are received in order, the partial results do not
+	// expire the final one.
+	results := rc.Results()
+	for seq := 1; seq <= 5; seq++ {
+		select {
+		case rp := <-results:
+			assert.Equal(t, seq, rp.Seq, "sequence")
+			assert.Equal(t, seq < 5, rp.Partial, "partial %d", seq)
+		case <-time.After(time.Second):
+			t.Fatalf("%d: no result received", seq)
+		}
+	}
+	require.NoError(t, rc.Close(), "close results connection")
+}
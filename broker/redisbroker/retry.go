@@ -0,0 +1,225 @@
+package redisbroker
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/logging"
+	"github.com/mna/juggler/metrics"
+)
+
+const (
+	defaultReconnectBackoff    = 100 * time.Millisecond
+	defaultMaxReconnectBackoff = 10 * time.Second
+)
+
+// errReconnectStopped is returned by reconnectPolicy.redial when the
+// stop channel is closed before a new connection could be established.
+var errReconnectStopped = errors.New("redisbroker: reconnection stopped")
+
+// reconnectPolicy defines how long-lived connections are re-established
+// after a failure.
+type reconnectPolicy struct {
+	attempts   int // 0: disabled, < 0: unlimited
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func (b *Broker) reconnectPolicy() reconnectPolicy {
+	rp := reconnectPolicy{
+		attempts:   b.ReconnectAttempts,
+		backoff:    b.ReconnectBackoff,
+		maxBackoff: b.MaxReconnectBackoff,
+	}
+	if rp.backoff <= 0 {
+		rp.backoff = defaultReconnectBackoff
+	}
+	if rp.maxBackoff <= 0 {
+		rp.maxBackoff = defaultMaxReconnectBackoff
+	}
+	if rp.maxBackoff < rp.backoff {
+		rp.maxBackoff = rp.backoff
+	}
+	return rp
+}
+
+// redial calls dial until it returns a connection on which setup
+// succeeds, waiting between attempts with an exponential backoff.
+// It returns the last error if no connection could be established
+// after the configured number of attempts, or errReconnectStopped
+// if stop is closed while waiting.
+func (rp reconnectPolicy) redial(dial func() (redis.Conn, error), setup func(redis.Conn) error, stop <-chan struct{}, logger logging.Logger) (redis.Conn, error) {
+	if rp.attempts == 0 {
+		return nil, errors.New("redisbroker: reconnection disabled")
+	}
+
+	delay := rp.backoff
+	var err error
+	for i := 1; rp.attempts < 0 || i <= rp.attempts; i++ {
+		select {
+		case <-stop:
+			return nil, errReconnectStopped
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > rp.maxBackoff {
+			delay = rp.maxBackoff
+		}
+
+		var rc redis.Conn
+		rc, err = dial()
+		if err != nil {
+			logger.Log(logging.Warn, "Reconnect: failed to dial", logging.F("attempt", i), logging.Err(err))
+			continue
+		}
+		if setup != nil {
+			if err = setup(rc); err != nil {
+				rc.Close()
+				logger.Log(logging.Warn, "Reconnect: failed to setup connection", logging.F("attempt", i), logging.Err(err))
+				continue
+			}
+		}
+		return rc, nil
+	}
+	return nil, err
+}
+
+// prefixes of redis error replies that indicate a transient
+// condition, typically during a failover or a cluster resharding.
+// UNBLOCKED is returned to clients blocked on a master that is
+// demoted to a replica.
+var transientErrPrefixes = []string{
+	"MOVED ",
+	"ASK ",
+	"LOADING ",
+	"TRYAGAIN ",
+	"CLUSTERDOWN ",
+	"MASTERDOWN ",
+	"READONLY ",
+	"UNBLOCKED ",
+}
+
+// isTransientErr returns true if err is an error that may go away by
+// retrying with a new connection, such as a network error or a redis
+// error reply caused by a failover.
+func isTransientErr(err error) bool {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+
+	switch e := err.(type) {
+	case redis.Error:
+		for _, p := range transientErrPrefixes {
+			if strings.HasPrefix(string(e), p) {
+				return true
+			}
+		}
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// blockingConn is the long-lived redis connection used to poll for
+// calls or results. It can be replaced by a new connection if the
+// poll fails with a transient error.
+type blockingConn struct {
+	name      string // prefix of logs and metrics
+	dial      func() (redis.Conn, error)
+	reconnect reconnectPolicy
+	logger    logging.Logger
+	metrics   metrics.Metrics
+
+	// mu protects the fields below.
+	mu      sync.Mutex
+	c       redis.Conn
+	closing bool
+	stop    chan struct{} // closed on close to abort reconnection
+}
+
+func newBlockingConn(name string, rc redis.Conn, b *Broker) *blockingConn {
+	return &blockingConn{
+		name:      name,
+		dial:      b.Dial,
+		reconnect: b.reconnectPolicy(),
+		logger:    b.logger(),
+		metrics:   b.Metrics,
+		c:         rc,
+		stop:      make(chan struct{}),
+	}
+}
+
+// conn returns the current redis connection.
+func (b *blockingConn) conn() redis.Conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.c
+}
+
+// close closes the current redis connection. Errors returned by the
+// poll after that call are fatal.
+func (b *blockingConn) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closing {
+		b.closing = true
+		close(b.stop)
+	}
+	return b.c.Close()
+}
+
+// isClosing returns true if close was called.
+func (b *blockingConn) isClosing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closing
+}
+
+// recover is called when the poll failed with err. It returns the new
+// cluster-aware connection to use to resume polling, or false if the
+// error is fatal or if the connection could not be re-established.
+func (b *blockingConn) recover(err error, keys ...string) (redis.Conn, bool) {
+	b.mu.Lock()
+	closing := b.closing
+	b.mu.Unlock()
+	if closing || b.reconnect.attempts == 0 || !isTransientErr(err) {
+		return nil, false
+	}
+
+	b.logger.Log(logging.Warn, b.name+": poll connection failed, reconnecting", logging.Err(err))
+
+	var pollConn redis.Conn
+	setup := func(rc redis.Conn) error {
+		pc := clusterifyConn(rc, keys...)
+		if _, err := pc.Do("PING"); err != nil {
+			return err
+		}
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.closing {
+			return errReconnectStopped
+		}
+		b.c.Close()
+		b.c = rc
+		pollConn = pc
+		return nil
+	}
+
+	if _, err := b.reconnect.redial(b.dial, setup, b.stop, b.logger); err != nil {
+		if err != errReconnectStopped {
+			b.logger.Log(logging.Error, b.name+": failed to reconnect poll connection", logging.Err(err))
+		}
+		return nil, false
+	}
+	if b.metrics != nil {
+		b.metrics.Add(b.name+"Reconnects", 1)
+	}
+	return pollConn, true
+}
@@ -0,0 +1,151 @@
+package redisbroker
+
+import (
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/logging"
+	"github.com/mna/juggler/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRedisConn struct {
+	redis.Conn
+	closed bool
+}
+
+func (f *fakeRedisConn) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return "PONG", nil
+}
+
+func TestReconnectPolicy(t *testing.T) {
+	rp := (&Broker{}).reconnectPolicy()
+	assert.Equal(t, reconnectPolicy{0, defaultReconnectBackoff, defaultMaxReconnectBackoff}, rp, "default policy")
+
+	rp = (&Broker{ReconnectAttempts: -1, ReconnectBackoff: time.Second, MaxReconnectBackoff: time.Millisecond}).reconnectPolicy()
+	assert.Equal(t, reconnectPolicy{-1, time.Second, time.Second}, rp, "max backoff lower than backoff")
+}
+
+func TestRedial(t *testing.T) {
+	errDial := errors.New("dial")
+	errSetup := errors.New("setup")
+
+	var conns []*fakeRedisConn
+	dials := 0
+	dial := func() (redis.Conn, error) {
+		dials++
+		if dials%2 == 1 {
+			return nil, errDial
+		}
+		c := &fakeRedisConn{}
+		conns = append(conns, c)
+		return c, nil
+	}
+	setups := 0
+	setup := func(rc redis.Conn) error {
+		setups++
+		if setups < 2 {
+			return errSetup
+		}
+		return nil
+	}
+
+	rp := reconnectPolicy{attempts: 0, backoff: time.Millisecond, maxBackoff: time.Millisecond}
+	_, err := rp.redial(dial, setup, nil, logging.Discard)
+	assert.Error(t, err, "disabled")
+	assert.Equal(t, 0, dials, "no dial when disabled")
+
+	rp.attempts = 3
+	_, err = rp.redial(dial, setup, nil, logging.Discard)
+	assert.Equal(t, errDial, err, "last error is returned")
+	assert.Equal(t, 3, dials, "all attempts made")
+	if assert.Equal(t, 1, len(conns), "1 connection") {
+		assert.True(t, conns[0].closed, "connection closed on setup failure")
+	}
+
+	dials, setups, conns = 0, 1, nil
+	rc, err := rp.redial(dial, setup, nil, logging.Discard)
+	if assert.NoError(t, err, "redial succeeds") {
+		assert.Equal(t, 2, dials, "succeeds on 2nd attempt")
+		if assert.Equal(t, 1, len(conns), "1 connection") {
+			assert.Equal(t, conns[0], rc, "returned connection")
+			assert.False(t, conns[0].closed, "connection not closed")
+		}
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	rp.attempts = -1
+	rp.backoff, rp.maxBackoff = time.Hour, time.Hour
+	_, err = rp.redial(dial, setup, stop, logging.Discard)
+	assert.Equal(t, errReconnectStopped, err, "stopped")
+}
+
+func TestIsTransientErr(t *testing.T) {
+	cases := []struct {
+		err error
+		exp bool
+	}{
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{redis.Error("MOVED 1234 127.0.0.1:7001"), true},
+		{redis.Error("ASK 1234 127.0.0.1:7001"), true},
+		{redis.Error("LOADING Redis is loading the dataset in memory"), true},
+		{redis.Error("TRYAGAIN Multiple keys request during rehashing of slot"), true},
+		{redis.Error("CLUSTERDOWN The cluster is down"), true},
+		{redis.Error("READONLY You can't write against a read only slave."), true},
+		{redis.Error("UNBLOCKED force unblock from blocking operation, instance state changed (master -> replica?)"), true},
+		{redis.Error("ERR unknown command"), false},
+		{redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"), false},
+		{errors.New("some error"), false},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.exp, isTransientErr(c.err), "%d: %v", i, c.err)
+	}
+}
+
+func TestBlockingConnRecover(t *testing.T) {
+	vars := expvar.NewMap("TestBlockingConnRecover")
+	first := &fakeRedisConn{}
+	var dialed []*fakeRedisConn
+	brk := &Broker{
+		Dial: func() (redis.Conn, error) {
+			c := &fakeRedisConn{}
+			dialed = append(dialed, c)
+			return c, nil
+		},
+		ReconnectAttempts: 1,
+		ReconnectBackoff:  time.Millisecond,
+		Logger:            logging.Discard,
+		Metrics:           metrics.NewExpvar(vars),
+	}
+	bc := newBlockingConn("Test", first, brk)
+
+	_, ok := bc.recover(errors.New("fatal"), "k")
+	assert.False(t, ok, "fatal error")
+	assert.Equal(t, 0, len(dialed), "no dial on fatal error")
+
+	rc, ok := bc.recover(io.EOF, "k")
+	if assert.True(t, ok, "transient error") && assert.Equal(t, 1, len(dialed), "dialed") {
+		assert.Equal(t, dialed[0], rc, "new connection returned")
+		assert.Equal(t, dialed[0], bc.conn(), "current connection replaced")
+		assert.True(t, first.closed, "previous connection closed")
+		assert.Equal(t, "1", vars.Get("TestReconnects").String(), "TestReconnects")
+	}
+
+	assert.NoError(t, bc.close(), "close")
+	_, ok = bc.recover(io.EOF, "k")
+	assert.False(t, ok, "error after close is fatal")
+	assert.Equal(t, 1, len(dialed), "no dial after close")
+}
@@ -0,0 +1,333 @@
+package redisbroker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var _ Pool = (*Sentinel)(nil)
+
+// sentinelRetryDelay is the delay before the failover watcher tries
+// to connect to the sentinels again after all of them failed.
+const sentinelRetryDelay = time.Second
+
+// Sentinel is a redis pool that connects to the current master of a
+// deployment monitored by redis Sentinel. It implements Pool and its
+// Dial method can be used as Broker.Dial, so that the broker follows
+// failovers: short-lived connections are taken from a pool on the
+// current master, and long-lived pub-sub and polling connections
+// are re-dialed on the new master when they fail, if the broker's
+// ReconnectAttempts is set.
+//
+// The master is discovered on first use, and a watcher subscribes
+// to the +switch-master event on the sentinels to switch to the new
+// master as soon as a failover is completed.
+type Sentinel struct {
+	// Addrs is the list of addresses of the sentinels.
+	Addrs []string
+
+	// MasterName is the name of the monitored master, as configured
+	// in the sentinels.
+	MasterName string
+
+	// DialOptions is the list of options to use when connecting to
+	// the master.
+	DialOptions []redis.DialOption
+
+	// SentinelDialOptions is the list of options to use when
+	// connecting to the sentinels.
+	SentinelDialOptions []redis.DialOption
+
+	// CreatePool is the function to call to create the pool of
+	// connections to the master. If nil, a redis.Pool with default
+	// settings is used.
+	CreatePool func(address string, options ...redis.DialOption) (*redis.Pool, error)
+
+	mu        sync.Mutex
+	master    string
+	pool      *redis.Pool
+	watchConn redis.Conn
+	stop      chan struct{} // closed on Close, nil if the watcher is not started
+	closed    bool
+}
+
+// MasterAddr asks the sentinels for the address of the current master.
+// The sentinels are tried in order, and the first one that responds
+// is moved to the front of the list.
+func (s *Sentinel) MasterAddr() (string, error) {
+	s.mu.Lock()
+	addrs := append([]string(nil), s.Addrs...)
+	s.mu.Unlock()
+
+	if len(addrs) == 0 {
+		return "", errors.New("redisbroker: no sentinel address")
+	}
+
+	var err error
+	for i, addr := range addrs {
+		var master string
+		if master, err = s.queryMaster(addr); err != nil {
+			continue
+		}
+
+		if i > 0 {
+			s.mu.Lock()
+			// move the responding sentinel to the front, if the list was not
+			// modified in the meantime.
+			if i < len(s.Addrs) && s.Addrs[i] == addr {
+				copy(s.Addrs[1:i+1], s.Addrs[:i])
+				s.Addrs[0] = addr
+			}
+			s.mu.Unlock()
+		}
+		return master, nil
+	}
+	return "", err
+}
+
+func (s *Sentinel) queryMaster(addr string) (string, error) {
+	rc, err := redis.Dial("tcp", addr, s.SentinelDialOptions...)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	vals, err := redis.Strings(rc.Do("SENTINEL", "get-master-addr-by-name", s.MasterName))
+	if err != nil {
+		if err == redis.ErrNil {
+			err = fmt.Errorf("redisbroker: unknown master %s on sentinel %s", s.MasterName, addr)
+		}
+		return "", err
+	}
+	if len(vals) != 2 {
+		return "", fmt.Errorf("redisbroker: invalid master address returned by sentinel %s: %v", addr, vals)
+	}
+	return net.JoinHostPort(vals[0], vals[1]), nil
+}
+
+// Refresh asks the sentinels for the address of the current master
+// and switches the pool to that master if it changed. The watcher
+// of failover events is started on the first call.
+func (s *Sentinel) Refresh() error {
+	master, err := s.MasterAddr()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("redisbroker: sentinel closed")
+	}
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+		go s.watch(s.stop)
+	}
+	if master == s.master && s.pool != nil {
+		return nil
+	}
+
+	create := s.CreatePool
+	if create == nil {
+		create = defaultCreatePool
+	}
+	pool, err := create(master, s.DialOptions...)
+	if err != nil {
+		return err
+	}
+	if s.pool != nil {
+		s.pool.Close()
+	}
+	s.master, s.pool = master, pool
+	return nil
+}
+
+// Get returns a pooled connection to the current master. If the master
+// cannot be discovered, the connection returns an error on use.
+func (s *Sentinel) Get() redis.Conn {
+	s.mu.Lock()
+	pool := s.pool
+	s.mu.Unlock()
+
+	if pool == nil {
+		if err := s.Refresh(); err != nil {
+			return errConn{err}
+		}
+		s.mu.Lock()
+		pool = s.pool
+		s.mu.Unlock()
+	}
+	return pool.Get()
+}
+
+// Dial returns a new, non-pooled connection to the current master.
+// It checks that the server it connects to is indeed the master,
+// and asks the sentinels again if it isn't, e.g. if a failover is
+// in progress.
+func (s *Sentinel) Dial() (redis.Conn, error) {
+	s.mu.Lock()
+	master := s.master
+	s.mu.Unlock()
+
+	if master == "" {
+		if err := s.Refresh(); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		master = s.master
+		s.mu.Unlock()
+	}
+
+	rc, err := s.dialMaster(master)
+	if err == nil {
+		return rc, nil
+	}
+
+	// the master may have changed, refresh and try again
+	if err := s.Refresh(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	master = s.master
+	s.mu.Unlock()
+	return s.dialMaster(master)
+}
+
+func (s *Sentinel) dialMaster(addr string) (redis.Conn, error) {
+	rc, err := redis.Dial("tcp", addr, s.DialOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	vals, err := redis.Values(rc.Do("ROLE"))
+	if err == nil && len(vals) > 0 {
+		var role string
+		if role, err = redis.String(vals[0], nil); err == nil && role != "master" {
+			err = fmt.Errorf("redisbroker: %s is not a master: %s", addr, role)
+		}
+	}
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// watch subscribes to the +switch-master event on the sentinels
+// and refreshes the master when a failover is completed. It runs
+// until the Sentinel is closed.
+func (s *Sentinel) watch(stop <-chan struct{}) {
+	for {
+		s.mu.Lock()
+		addrs := append([]string(nil), s.Addrs...)
+		s.mu.Unlock()
+
+		for _, addr := range addrs {
+			s.watchSentinel(addr)
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(sentinelRetryDelay):
+		}
+	}
+}
+
+func (s *Sentinel) watchSentinel(addr string) {
+	rc, err := redis.Dial("tcp", addr, s.SentinelDialOptions...)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		rc.Close()
+		return
+	}
+	s.watchConn = rc
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.watchConn = nil
+		s.mu.Unlock()
+		rc.Close()
+	}()
+
+	psc := redis.PubSubConn{Conn: rc}
+	if err := psc.Subscribe("+switch-master"); err != nil {
+		return
+	}
+	for {
+		switch psc.Receive().(type) {
+		case redis.Message:
+			// the master may have changed, ignore the error, Dial refreshes
+			// the master if it fails to connect to the current one.
+			s.Refresh()
+		case error:
+			return
+		}
+	}
+}
+
+// Close releases the resources used by the Sentinel.
+func (s *Sentinel) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.stop != nil {
+		close(s.stop)
+	}
+	if s.watchConn != nil {
+		s.watchConn.Close()
+	}
+
+	var err error
+	if s.pool != nil {
+		err = s.pool.Close()
+	}
+	return err
+}
+
+func defaultCreatePool(addr string, opts ...redis.DialOption) (*redis.Pool, error) {
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, opts...)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}, nil
+}
+
+// errConn is a redis connection that always returns the same error.
+type errConn struct {
+	err error
+}
+
+func (c errConn) Close() error                                       { return nil }
+func (c errConn) Err() error                                         { return c.err }
+func (c errConn) Do(_ string, _ ...interface{}) (interface{}, error) { return nil, c.err }
+func (c errConn) Send(_ string, _ ...interface{}) error              { return c.err }
+func (c errConn) Flush() error                                       { return c.err }
+func (c errConn) Receive() (interface{}, error)                      { return nil, c.err }
@@ -0,0 +1,127 @@
+package redisbroker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/redisc/redistest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSentinel starts a redis-sentinel process that monitors the
+// master listening on masterPort. It skips the test if redis-sentinel
+// is not available. The caller must kill the returned command and
+// remove the returned configuration file.
+func startSentinel(t *testing.T, masterPort string) (*exec.Cmd, string, string) {
+	path, err := exec.LookPath("redis-sentinel")
+	if err != nil {
+		t.Skip("redis-sentinel not available")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "get a free port")
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	f, err := ioutil.TempFile("", "juggler-sentinel")
+	require.NoError(t, err, "create sentinel configuration file")
+	fmt.Fprintf(f, "port %s\nsentinel monitor mymaster 127.0.0.1 %s 1\n", port, masterPort)
+	require.NoError(t, f.Close(), "close sentinel configuration file")
+
+	cmd := exec.Command(path, f.Name())
+	require.NoError(t, cmd.Start(), "start redis-sentinel")
+
+	// wait for the sentinel to accept connections
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rc, err := redis.Dial("tcp", ":"+port)
+		if err == nil {
+			rc.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			os.Remove(f.Name())
+			t.Fatalf("redis-sentinel failed to start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cmd, port, f.Name()
+}
+
+func TestSentinel(t *testing.T) {
+	if _, err := exec.LookPath("redis-sentinel"); err != nil {
+		t.Skip("redis-sentinel not available")
+	}
+
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	scmd, sport, conf := startSentinel(t, port)
+	defer os.Remove(conf)
+	defer scmd.Process.Kill()
+
+	s := &Sentinel{
+		Addrs:      []string{"127.0.0.1:1", ":" + sport},
+		MasterName: "mymaster",
+	}
+	defer s.Close()
+
+	addr, err := s.MasterAddr()
+	require.NoError(t, err, "MasterAddr")
+	assert.Equal(t, "127.0.0.1:"+port, addr, "master address")
+	assert.Equal(t, []string{":" + sport, "127.0.0.1:1"}, s.Addrs, "responding sentinel moved to front")
+
+	rc := s.Get()
+	_, err = rc.Do("SET", "a", "1")
+	assert.NoError(t, err, "SET on pooled connection")
+	rc.Close()
+
+	rc, err = s.Dial()
+	require.NoError(t, err, "Dial")
+	v, err := redis.String(rc.Do("GET", "a"))
+	assert.NoError(t, err, "GET on dialed connection")
+	assert.Equal(t, "1", v, "GET value")
+	rc.Close()
+
+	brk := &Broker{
+		Pool:   s,
+		Dial:   s.Dial,
+		Logger: verboseLog,
+	}
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn via sentinel")
+	require.NoError(t, psc.Close(), "close pub-sub connection")
+}
+
+func TestSentinelNoMaster(t *testing.T) {
+	s := &Sentinel{
+		Addrs:      []string{"127.0.0.1:1"},
+		MasterName: "mymaster",
+	}
+	defer s.Close()
+
+	_, err := s.MasterAddr()
+	assert.Error(t, err, "MasterAddr")
+
+	rc := s.Get()
+	_, err = rc.Do("PING")
+	assert.Error(t, err, "Do on Get connection")
+	assert.Error(t, rc.Err(), "Err on Get connection")
+	assert.NoError(t, rc.Close(), "Close on Get connection")
+
+	_, err = s.Dial()
+	assert.Error(t, err, "Dial")
+
+	s = &Sentinel{MasterName: "mymaster"}
+	_, err = s.MasterAddr()
+	assert.Error(t, err, "MasterAddr without address")
+}
@@ -0,0 +1,191 @@
+package redisbroker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
+	"github.com/mna/juggler/message"
+)
+
+const (
+	// redis cluster-compliant keys, in the same slot as the CALL queues
+	servicesKey     = "juggler:services:{%s}"      // 1: URI
+	servicesInfoKey = "juggler:services:info:{%s}" // 1: URI
+
+	// set of the URIs that have registered instances. A URI is removed
+	// once it has no more instances.
+	servicesURIsKey = "juggler:services"
+)
+
+// script to record the registration of a callee instance for a URI.
+// The sorted set stores the instances scored by the expiration
+// timestamp of their registration, and the hash stores their
+// description.
+var serviceRegisterScript = redis.NewScript(2, `
+	redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+	redis.call("HSET", KEYS[2], ARGV[2], ARGV[3])
+	redis.call("PEXPIRE", KEYS[1], tonumber(ARGV[4]))
+	redis.call("PEXPIRE", KEYS[2], tonumber(ARGV[4]))
+	return 1
+`)
+
+// script to remove the registration of a callee instance for a URI.
+// It returns the number of instances still registered for the URI.
+var serviceDeregisterScript = redis.NewScript(2, `
+	redis.call("ZREM", KEYS[1], ARGV[1])
+	redis.call("HDEL", KEYS[2], ARGV[1])
+	return redis.call("ZCARD", KEYS[1])
+`)
+
+// script to list the callee instances registered for a URI, along
+// with their description. Expired registrations are removed first.
+var serviceQueryScript = redis.NewScript(2, `
+	local expired = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+	if #expired > 0 then
+		redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+		redis.call("HDEL", KEYS[2], unpack(expired))
+	end
+
+	local ids = redis.call("ZRANGE", KEYS[1], 0, -1)
+	if #ids == 0 then
+		return {}
+	end
+	return redis.call("HMGET", KEYS[2], unpack(ids))
+`)
+
+// RegisterService records or refreshes the registration of the callee
+// instance described by sp, for the duration ttl. The registration
+// expires if it is not refreshed before ttl.
+func (b *Broker) RegisterService(sp *message.ServicePayload, ttl time.Duration) error {
+	p, err := broker.MarshalPayload(b.PayloadCodec, sp)
+	if err != nil {
+		return err
+	}
+
+	k1 := nsKey(b.Namespace, fmt.Sprintf(servicesKey, sp.URI))
+	k2 := nsKey(b.Namespace, fmt.Sprintf(servicesInfoKey, sp.URI))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	_, err = serviceRegisterScript.Do(rc,
+		k1,                             // key[1] : the sorted set of instances
+		k2,                             // key[2] : the hash of descriptions
+		unixMilli(time.Now().Add(ttl)), // argv[1] : the expiration timestamp in milliseconds
+		sp.Instance,                    // argv[2] : the instance
+		p,                              // argv[3] : the description
+		int(ttl/time.Millisecond),      // argv[4] : the TTL of the keys in milliseconds
+	)
+	if err != nil {
+		return err
+	}
+	// add the URI after the registration, so that it is not removed by
+	// a concurrent query that sees no instance. If it is removed anyway,
+	// it is added back on the next refresh.
+	return b.updateServiceURI(sp.URI, "SADD")
+}
+
+// updateServiceURI adds (cmd is SADD) or removes (cmd is SREM) uri from
+// the set of registered URIs, which is in a different slot than the
+// registrations of the URI.
+func (b *Broker) updateServiceURI(uri, cmd string) error {
+	k := nsKey(b.Namespace, servicesURIsKey)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	_, err := rc.Do(cmd, k, uri)
+	return err
+}
+
+// DeregisterService removes the registration of the callee instance
+// for uri.
+func (b *Broker) DeregisterService(uri, instance string) error {
+	k1 := nsKey(b.Namespace, fmt.Sprintf(servicesKey, uri))
+	k2 := nsKey(b.Namespace, fmt.Sprintf(servicesInfoKey, uri))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	n, err := redis.Int(serviceDeregisterScript.Do(rc,
+		k1,       // key[1] : the sorted set of instances
+		k2,       // key[2] : the hash of descriptions
+		instance, // argv[1] : the instance
+	))
+	if err != nil || n > 0 {
+		return err
+	}
+	return b.updateServiceURI(uri, "SREM")
+}
+
+// Services returns the callee instances currently registered for uri,
+// or for all URIs if uri is empty.
+func (b *Broker) Services(uri string) ([]*message.ServicePayload, error) {
+	if uri != "" {
+		return b.services(uri)
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	k := nsKey(b.Namespace, servicesURIsKey)
+	rc = clusterifyConn(rc, k)
+
+	uris, err := redis.Strings(rc.Do("SMEMBERS", k))
+	if err != nil {
+		return nil, err
+	}
+
+	var sps []*message.ServicePayload
+	for _, uri := range uris {
+		usps, err := b.services(uri)
+		if err != nil {
+			return nil, err
+		}
+		sps = append(sps, usps...)
+	}
+	return sps, nil
+}
+
+func (b *Broker) services(uri string) ([]*message.ServicePayload, error) {
+	k1 := nsKey(b.Namespace, fmt.Sprintf(servicesKey, uri))
+	k2 := nsKey(b.Namespace, fmt.Sprintf(servicesInfoKey, uri))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	vals, err := redis.ByteSlices(serviceQueryScript.Do(rc,
+		k1,                    // key[1] : the sorted set of instances
+		k2,                    // key[2] : the hash of descriptions
+		unixMilli(time.Now()), // argv[1] : the current timestamp in milliseconds
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		// no more instances, remove the URI from the registered URIs
+		if err := b.updateServiceURI(uri, "SREM"); err != nil {
+			return nil, err
+		}
+	}
+
+	sps := make([]*message.ServicePayload, 0, len(vals))
+	for _, v := range vals {
+		if v == nil {
+			continue
+		}
+		var sp message.ServicePayload
+		if err := broker.UnmarshalPayload(v, &sp); err != nil {
+			b.logger().Log(logging.Error, "Services: failed to unmarshal service payload", logging.Err(err))
+			continue
+		}
+		sps = append(sps, &sp)
+	}
+	return sps, nil
+}
@@ -0,0 +1,71 @@
+package redisbroker
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServices(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Logger: verboseLog,
+	}
+
+	// instances returns the sorted instances registered for uri.
+	instances := func(uri string) []string {
+		sps, err := brk.Services(uri)
+		require.NoError(t, err, "Services %q", uri)
+		var ids []string
+		for _, sp := range sps {
+			ids = append(ids, sp.URI+"/"+sp.Instance)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	assert.Empty(t, instances("a"), "no instance")
+
+	require.NoError(t, brk.RegisterService(&message.ServicePayload{URI: "a", Instance: "1", Version: "v1", Load: 2}, time.Minute), "RegisterService a/1")
+	require.NoError(t, brk.RegisterService(&message.ServicePayload{URI: "a", Instance: "2"}, time.Minute), "RegisterService a/2")
+	require.NoError(t, brk.RegisterService(&message.ServicePayload{URI: "b", Instance: "1"}, 100*time.Millisecond), "RegisterService b/1")
+
+	assert.Equal(t, []string{"a/1", "a/2"}, instances("a"), "instances of a")
+	assert.Equal(t, []string{"a/1", "a/2", "b/1"}, instances(""), "all instances")
+
+	sps, err := brk.Services("b")
+	require.NoError(t, err, "Services b")
+	if assert.Len(t, sps, 1, "instances of b") {
+		assert.Equal(t, "1", sps[0].Instance, "instance of b")
+	}
+
+	// registrations expire if they are not refreshed
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, instances("b"), "b expired")
+
+	require.NoError(t, brk.DeregisterService("a", "1"), "DeregisterService a/1")
+	assert.Equal(t, []string{"a/2"}, instances("a"), "a/1 deregistered")
+
+	// URIs without instances are removed from the registered URIs
+	rc := pool.Get()
+	defer rc.Close()
+	uris, err := redis.Strings(rc.Do("SMEMBERS", servicesURIsKey))
+	require.NoError(t, err, "SMEMBERS after b expired")
+	assert.Equal(t, []string{"a"}, uris, "registered URIs after b expired")
+
+	require.NoError(t, brk.DeregisterService("a", "2"), "DeregisterService a/2")
+	uris, err = redis.Strings(rc.Do("SMEMBERS", servicesURIsKey))
+	require.NoError(t, err, "SMEMBERS after a deregistered")
+	assert.Empty(t, uris, "registered URIs after a deregistered")
+}
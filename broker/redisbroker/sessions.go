@@ -0,0 +1,86 @@
+package redisbroker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// redis cluster-compliant key, in the same slot as the results list
+// of the connection.
+const sessionKey = "juggler:sessions:{%s}" // 1: cUUID
+
+// script to store a session. The hash stores the token hash and the
+// session payload.
+var sessionSaveScript = redis.NewScript(1, `
+	redis.call("DEL", KEYS[1])
+	redis.call("HSET", KEYS[1], "token", ARGV[1])
+	redis.call("HSET", KEYS[1], "session", ARGV[2])
+	redis.call("PEXPIRE", KEYS[1], tonumber(ARGV[3]))
+	return 1
+`)
+
+// script to remove and return a session if the token hash matches.
+var sessionResumeScript = redis.NewScript(1, `
+	if redis.call("HGET", KEYS[1], "token") ~= ARGV[1] then
+		return false
+	end
+	local session = redis.call("HGET", KEYS[1], "session")
+	redis.call("DEL", KEYS[1])
+	return session
+`)
+
+// SaveSession stores the session sp for the duration ttl, replacing
+// the session of the same connection UUID, if any.
+func (b *Broker) SaveSession(sp *message.SessionPayload, ttl time.Duration) error {
+	p, err := broker.MarshalPayload(b.PayloadCodec, sp)
+	if err != nil {
+		return err
+	}
+
+	k := nsKey(b.Namespace, fmt.Sprintf(sessionKey, sp.ConnUUID))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	_, err = sessionSaveScript.Do(rc,
+		k,                         // key[1] : the session hash
+		sp.TokenHash,              // argv[1] : the token hash
+		p,                         // argv[2] : the session payload
+		int(ttl/time.Millisecond), // argv[3] : the TTL of the session in milliseconds
+	)
+	return err
+}
+
+// ResumeSession removes and returns the session of the connection
+// connUUID if its token hash is tokenHash. It returns nil if there is
+// no such session.
+func (b *Broker) ResumeSession(connUUID uuid.UUID, tokenHash string) (*message.SessionPayload, error) {
+	k := nsKey(b.Namespace, fmt.Sprintf(sessionKey, connUUID))
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	p, err := redis.Bytes(sessionResumeScript.Do(rc,
+		k,         // key[1] : the session hash
+		tokenHash, // argv[1] : the token hash
+	))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var sp message.SessionPayload
+	if err := broker.UnmarshalPayload(p, &sp); err != nil {
+		return nil, err
+	}
+	return &sp, nil
+}
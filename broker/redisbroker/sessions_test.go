@@ -0,0 +1,62 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Logger: verboseLog,
+	}
+
+	cuid := uuid.NewRandom()
+	sp := &message.SessionPayload{
+		ConnUUID:  cuid,
+		TokenHash: "abc",
+		Subscriptions: []message.Subscription{
+			{Channel: "a"},
+			{Channel: "b*", Pattern: true},
+		},
+	}
+	require.NoError(t, brk.SaveSession(sp, time.Minute), "SaveSession")
+
+	// the token hash must match
+	got, err := brk.ResumeSession(cuid, "def")
+	require.NoError(t, err, "ResumeSession with invalid token")
+	assert.Nil(t, got, "invalid token")
+
+	got, err = brk.ResumeSession(cuid, "abc")
+	require.NoError(t, err, "ResumeSession")
+	assert.Equal(t, sp, got, "resumed session")
+
+	// a session can only be resumed once
+	got, err = brk.ResumeSession(cuid, "abc")
+	require.NoError(t, err, "ResumeSession again")
+	assert.Nil(t, got, "already resumed")
+
+	// sessions expire
+	require.NoError(t, brk.SaveSession(sp, 100*time.Millisecond), "SaveSession with short TTL")
+	time.Sleep(200 * time.Millisecond)
+	got, err = brk.ResumeSession(cuid, "abc")
+	require.NoError(t, err, "ResumeSession expired")
+	assert.Nil(t, got, "expired")
+
+	// sessions are isolated in namespaces
+	require.NoError(t, brk.SaveSession(sp, time.Minute), "SaveSession")
+	got, err = brk.WithNamespace("ns").ResumeSession(cuid, "abc")
+	require.NoError(t, err, "ResumeSession in namespace")
+	assert.Nil(t, got, "not in namespace")
+}
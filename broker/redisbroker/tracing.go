@@ -0,0 +1,30 @@
+package redisbroker
+
+import (
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/tracing"
+)
+
+// traceCall starts a span named name using t, as a child of the trace
+// context of the call request cp, and stores the trace context of the
+// span in cp.Headers. It returns a no-op span if t is nil.
+func traceCall(t tracing.Tracer, cp *message.CallPayload, name string) tracing.Span {
+	span, h := tracing.Start(t, cp.Headers, name)
+	if t != nil {
+		cp.Headers = h
+		span.SetAttribute("juggler.uri", cp.URI)
+		span.SetAttribute("juggler.msg_uuid", cp.MsgUUID.String())
+	}
+	return span
+}
+
+// traceResult is like traceCall, for the result rp.
+func traceResult(t tracing.Tracer, rp *message.ResPayload, name string) tracing.Span {
+	span, h := tracing.Start(t, rp.Headers, name)
+	if t != nil {
+		rp.Headers = h
+		span.SetAttribute("juggler.uri", rp.URI)
+		span.SetAttribute("juggler.msg_uuid", rp.MsgUUID.String())
+	}
+	return span
+}
@@ -0,0 +1,70 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/tracing"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracer(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	var rec tracing.Recorder
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		Logger:          verboseLog,
+		Tracer:          &rec,
+	}
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+	defer cc.Close()
+
+	parent := tracing.NewChild(tracing.SpanContext{})
+	cp := &message.CallPayload{
+		ConnUUID: uuid.NewRandom(),
+		MsgUUID:  uuid.NewRandom(),
+		URI:      "a",
+		Headers:  tracing.Inject(map[string]string{"locale": "fr"}, parent),
+	}
+	require.NoError(t, brk.Call(cp, time.Second), "Call")
+
+	var got *message.CallPayload
+	select {
+	case got = <-cc.Calls():
+	case <-time.After(time.Second):
+		t.Fatal("no call received")
+	}
+
+	rp := &message.ResPayload{
+		ConnUUID: got.ConnUUID,
+		MsgUUID:  got.MsgUUID,
+		URI:      got.URI,
+		Headers:  tracing.Inject(nil, tracing.FromHeaders(got.Headers)),
+	}
+	require.NoError(t, brk.Result(rp, time.Second), "Result")
+
+	// each span is the parent of the next one
+	names := []string{"redisbroker.enqueue", "redisbroker.dequeue", "redisbroker.result"}
+	spans := rec.Spans()
+	require.Equal(t, len(names), len(spans), "recorded spans")
+	for i, name := range names {
+		assert.Equal(t, name, spans[i].Name, "%d: name", i)
+		assert.Equal(t, parent, spans[i].Parent, "%d: parent", i)
+		assert.Equal(t, "a", spans[i].Attributes["juggler.uri"], "%d: URI", i)
+		assert.NoError(t, spans[i].Err, "%d: error", i)
+		parent = spans[i].Context
+	}
+	assert.Equal(t, "fr", got.Headers["locale"], "other headers")
+	assert.Equal(t, tracing.Inject(nil, parent), rp.Headers, "result headers")
+}
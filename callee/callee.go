@@ -7,10 +7,16 @@ package callee
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/mna/juggler/tracing"
+	"github.com/pborman/uuid"
 )
 
 // ErrCallExpired is returned when a call is processed but the
@@ -19,6 +25,23 @@ import (
 // returned from InvokeAndStoreResult.
 var ErrCallExpired = errors.New("juggler/callee: call expired")
 
+// ErrCallNotInProgress is returned from StoreProgress if the call is
+// not being processed by InvokeAndStoreResult, e.g. if its final
+// result is already stored.
+var ErrCallNotInProgress = errors.New("juggler/callee: call not in progress")
+
+// ErrCacheNotSupported is returned from InvalidateCache if the
+// Broker does not implement broker.CacheInvalidator.
+var ErrCacheNotSupported = errors.New("juggler/callee: result cache not supported")
+
+// Errorf returns a *message.Error with the code and the formatted
+// message. When returned by a Thunk, the error is stored as an error
+// result with its code, so that the caller can branch on it. Set its
+// Retryable and Details fields for more information on the error.
+func Errorf(code int, format string, args ...interface{}) *message.Error {
+	return &message.Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
 // Thunk is the function signature for functions that handle calls
 // to a URI. Generally, it should be used to decode the arguments
 // to the type expected by the actual underlying function, call that
@@ -34,24 +57,326 @@ type Callee struct {
 	// Broker is the callee broker to use to listen for call requests
 	// and to store results.
 	Broker broker.CalleeBroker
+
+	// CacheResults indicates if the results of successful calls may
+	// be cached by the broker, so that identical calls - same URI and
+	// equivalent arguments - are served from the cache. The broker
+	// decides which URIs are cached and for how long.
+	CacheResults bool
+
+	// Instance identifies the callee in the service registry. If it
+	// is empty, a random UUID is set when Listen is called.
+	Instance string
+
+	// Version is the version of the callee recorded in the service
+	// registry.
+	Version string
+
+	// RegistryTTL is the time-to-live of the registration of the URIs
+	// served by Listen in the service registry, if the Broker
+	// implements broker.ServiceRegistry. The registration is refreshed
+	// at half that interval, and it is removed when Listen returns.
+	// The default of 0 disables registration.
+	RegistryTTL time.Duration
+
+	// Tracer, if set, records a span for each call processed by
+	// InvokeAndStoreResult, as a child of the trace context of the
+	// call request. The Thunk receives the call with the trace context
+	// of that span, and the results carry it back to the caller.
+	Tracer tracing.Tracer
+
+	// Metrics can be set to collect metrics about the calls processed by
+	// InvokeAndStoreResult, labeled by URI (see doc/metrics.md).
+	Metrics metrics.Metrics
+
+	// Logger, if set, logs the calls processed by InvokeAndStoreResult
+	// that fail or expire, and the failures to register the URIs in the
+	// service registry (see the logging package).
+	Logger logging.Logger
+
+	// mu protects seqs, the number of partial results stored for the
+	// calls in progress, by message UUID, and load, the number of calls
+	// in progress.
+	mu   sync.Mutex
+	seqs map[string]int
+	load int
+}
+
+// InvalidateCache removes the cached result of the calls to uri with
+// the arguments args, e.g. when the data that the result depends on
+// has changed. It returns ErrCacheNotSupported if the Broker does not
+// support it.
+func (c *Callee) InvalidateCache(uri string, args interface{}) error {
+	ci, ok := c.Broker.(broker.CacheInvalidator)
+	if !ok {
+		return ErrCacheNotSupported
+	}
+	b, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	return ci.InvalidateCache(uri, b)
 }
 
 // InvokeAndStoreResult processes the provided call payload by calling
 // fn and storing the result so that it can be sent back to the caller.
 // If the call timeout is exceeded, the result is dropped and
 // ErrCallExpired is returned.
+//
+// The Thunk may call StoreProgress to send partial results or
+// progress updates before the final result.
 func (c *Callee) InvokeAndStoreResult(cp *message.CallPayload, fn Thunk) error {
+	span, h := tracing.Start(c.Tracer, cp.Headers, "callee.invoke")
+	if c.Tracer != nil {
+		cp.Headers = h
+		span.SetAttribute("juggler.uri", cp.URI)
+		span.SetAttribute("juggler.msg_uuid", cp.MsgUUID.String())
+	}
+	err := c.invokeAndStoreResult(cp, fn, span)
+	span.End(err)
+	return err
+}
+
+func (c *Callee) invokeAndStoreResult(cp *message.CallPayload, fn Thunk, span tracing.Span) error {
 	ttl := cp.TTLAfterRead
 	start := time.Now()
 
+	c.startStream(cp)
+	c.addLoad(1)
 	v, err := fn(cp)
+	c.addLoad(-1)
+	if err != nil {
+		span.SetAttribute("juggler.call_error", err.Error())
+		c.log(logging.Debug, "call failed", cp, logging.Err(err))
+	}
+	if c.Metrics != nil {
+		c.Metrics.Add("Invocations", 1, "uri", cp.URI)
+		c.Metrics.Observe("CallDuration", time.Now().Sub(start), "uri", cp.URI)
+		if err != nil {
+			c.Metrics.Add("FailedInvocations", 1, "uri", cp.URI)
+		}
+	}
+
+	seq := c.endStream(cp)
 	if remain := ttl - time.Now().Sub(start); remain > 0 {
 		// register the result
-		return c.storeResult(cp, v, err, remain)
+		if err := c.storeResult(cp, v, err, seq, remain); err != nil {
+			if c.Metrics != nil {
+				c.Metrics.Add("FailedResultStores", 1, "uri", cp.URI)
+			}
+			c.log(logging.Error, "failed to store result", cp, logging.Err(err))
+			return err
+		}
+		c.observeLatency(cp)
+		return nil
+	}
+	if c.Metrics != nil {
+		c.Metrics.Add("ExpiredInvocations", 1, "uri", cp.URI)
 	}
+	c.log(logging.Warn, "call expired, dropping result", cp)
 	return ErrCallExpired
 }
 
+// log logs msg at level to the Logger, if set, with the message UUID
+// and the URI of the call cp added to the fields.
+func (c *Callee) log(level logging.Level, msg string, cp *message.CallPayload, fields ...logging.Field) {
+	if c.Logger == nil {
+		return
+	}
+	logging.With(c.Logger, logging.MsgUUID(cp.MsgUUID), logging.URI(cp.URI)).Log(level, msg, fields...)
+}
+
+// observeLatency records the time between the registration of the
+// call cp and the storage of its result.
+func (c *Callee) observeLatency(cp *message.CallPayload) {
+	if c.Metrics == nil || cp.Timestamp.IsZero() {
+		return
+	}
+	d := time.Now().UTC().Sub(cp.Timestamp)
+	if d < 0 {
+		// clocks may vary between nodes
+		d = 0
+	}
+	c.Metrics.Observe("CallLatency", d, "uri", cp.URI)
+}
+
+// StoreProgress stores v as a partial result or progress update of
+// the call cp, so that it can be sent to the caller before the final
+// result. It should be called by the Thunk processing the call, and
+// the partial results are sent in the order of the calls to
+// StoreProgress. If the call timeout is exceeded, the partial result
+// is dropped and ErrCallExpired is returned. If the call is not being
+// processed by InvokeAndStoreResult, ErrCallNotInProgress is returned.
+func (c *Callee) StoreProgress(cp *message.CallPayload, v interface{}) error {
+	remain := cp.TTLAfterRead
+	if !cp.ReadTimestamp.IsZero() {
+		remain -= time.Now().UTC().Sub(cp.ReadTimestamp)
+	}
+	if remain <= 0 {
+		return ErrCallExpired
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	seq, ok := c.nextSeq(cp)
+	if !ok {
+		return ErrCallNotInProgress
+	}
+
+	rp := &message.ResPayload{
+		ConnUUID:  cp.ConnUUID,
+		MsgUUID:   cp.MsgUUID,
+		URI:       cp.URI,
+		Args:      b,
+		Broadcast: cp.Broadcast,
+		Partial:   true,
+		Seq:       seq,
+		Headers:   resultHeaders(cp),
+	}
+	return c.Broker.Result(rp, remain)
+}
+
+// Register records the uris in the service registry and starts the
+// heartbeat that refreshes the registration, if RegistryTTL is set and
+// the Broker implements broker.ServiceRegistry. It returns a function
+// to call to stop the heartbeat and remove the registration, which is
+// a no-op if registration is disabled. The heartbeat is started even
+// if the initial registration fails, and its error is returned.
+//
+// Listen calls Register for its URIs, it only needs to be called
+// explicitly when processing calls using Callee.Broker directly.
+func (c *Callee) Register(uris ...string) (func(), error) {
+	sr, ok := c.Broker.(broker.ServiceRegistry)
+	if !ok || c.RegistryTTL <= 0 {
+		return func() {}, nil
+	}
+
+	c.mu.Lock()
+	if c.Instance == "" {
+		c.Instance = uuid.NewRandom().String()
+	}
+	c.mu.Unlock()
+
+	err := c.register(sr, uris)
+	stop := make(chan struct{})
+	go c.heartbeat(sr, uris, stop)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			c.deregister(sr, uris)
+		})
+	}, err
+}
+
+// addLoad adds n to the number of calls in progress.
+func (c *Callee) addLoad(n int) {
+	c.mu.Lock()
+	c.load += n
+	c.mu.Unlock()
+}
+
+// register records the uris in the service registry sr.
+func (c *Callee) register(sr broker.ServiceRegistry, uris []string) error {
+	c.mu.Lock()
+	load := c.load
+	c.mu.Unlock()
+
+	var err error
+	now := time.Now().UTC()
+	for _, uri := range uris {
+		sp := &message.ServicePayload{
+			URI:      uri,
+			Instance: c.Instance,
+			Version:  c.Version,
+			Load:     load,
+			LastSeen: now,
+		}
+		if e := sr.RegisterService(sp, c.RegistryTTL); e != nil {
+			if c.Logger != nil {
+				c.Logger.Log(logging.Warn, "failed to register service", logging.URI(uri), logging.F("instance", c.Instance), logging.Err(e))
+			}
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// deregister removes the uris from the service registry sr.
+func (c *Callee) deregister(sr broker.ServiceRegistry, uris []string) error {
+	var err error
+	for _, uri := range uris {
+		if e := sr.DeregisterService(uri, c.Instance); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// heartbeat refreshes the registration of the uris until stop is
+// closed.
+func (c *Callee) heartbeat(sr broker.ServiceRegistry, uris []string, stop <-chan struct{}) {
+	t := time.NewTicker(c.RegistryTTL / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			c.register(sr, uris)
+		}
+	}
+}
+
+// startStream records the call cp as in progress, so that partial
+// results can be stored for it until endStream is called.
+func (c *Callee) startStream(cp *message.CallPayload) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seqs == nil {
+		c.seqs = make(map[string]int)
+	}
+	c.seqs[cp.MsgUUID.String()] = 0
+}
+
+// nextSeq returns the sequence number of the next partial result of cp,
+// and false if cp is not in progress.
+func (c *Callee) nextSeq(cp *message.CallPayload) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := cp.MsgUUID.String()
+	n, ok := c.seqs[k]
+	if !ok {
+		return 0, false
+	}
+	c.seqs[k] = n + 1
+	return n + 1, true
+}
+
+// endStream removes the call cp from the calls in progress and returns
+// the sequence number of its final result, which is 0 if no partial
+// result was stored.
+func (c *Callee) endStream(cp *message.CallPayload) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := cp.MsgUUID.String()
+	n := c.seqs[k]
+	delete(c.seqs, k)
+	if n == 0 {
+		return 0
+	}
+	return n + 1
+}
+
 // Listen is a helper method that listens for call requests for the
 // requested URIs and calls the corresponding Thunk to execute the
 // request. The m map has URIs as keys, and the associated Thunk
@@ -68,6 +393,9 @@ func (c *Callee) InvokeAndStoreResult(cp *message.CallPayload, fn Thunk) error {
 // consumer goroutines reading from the same calls channel and calling
 // InvokeAndStoreResult to process each call request.
 //
+// If RegistryTTL is set and the Broker supports it, the URIs are
+// registered in the service registry while Listen runs (see Register).
+//
 // The function blocks until the call request loop exits. It returns
 // the error that caused the loop to stop, or the error to initiate
 // the connection to the broker.
@@ -86,6 +414,10 @@ func (c *Callee) Listen(m map[string]Thunk) error {
 	}
 	defer conn.Close()
 
+	// errors are ignored, the registration is refreshed periodically.
+	unregister, _ := c.Register(uris...)
+	defer unregister()
+
 	for cp := range conn.Calls() {
 		// errors are ignored, use InvokeAndStoreResult directly to handle them.
 		c.InvokeAndStoreResult(cp, m[cp.URI])
@@ -93,13 +425,17 @@ func (c *Callee) Listen(m map[string]Thunk) error {
 	return conn.CallsErr()
 }
 
-func (c *Callee) storeResult(cp *message.CallPayload, v interface{}, e error, timeout time.Duration) error {
+func (c *Callee) storeResult(cp *message.CallPayload, v interface{}, e error, seq int, timeout time.Duration) error {
 	// if there's an error, that's what gets stored
 	if e != nil {
-		if ms, ok := e.(json.Marshaler); ok {
-			v = ms
-		} else {
-			var er message.ErrResult
+		var er message.ErrResult
+		switch e := e.(type) {
+		case json.Marshaler:
+			v = e
+		case *message.Error:
+			er.Error = *e
+			v = er
+		default:
 			er.Error.Message = e.Error()
 			v = er
 		}
@@ -115,6 +451,23 @@ func (c *Callee) storeResult(cp *message.CallPayload, v interface{}, e error, ti
 		MsgUUID:  cp.MsgUUID,
 		URI:      cp.URI,
 		Args:     b,
+
+		IdempotencyKey: cp.IdempotencyKey,
+		Broadcast:      cp.Broadcast,
+		Seq:            seq,
+		Headers:        resultHeaders(cp),
+	}
+	if e == nil && c.CacheResults && !cp.Broadcast {
+		// if the arguments are not valid JSON, the result is not cached
+		if ck, err := broker.CacheKey(cp.Args); err == nil {
+			rp.CacheKey = ck
+		}
 	}
 	return c.Broker.Result(rp, timeout)
 }
+
+// resultHeaders returns the headers of the results of the call cp,
+// which carry its trace context back to the caller.
+func resultHeaders(cp *message.CallPayload) map[string]string {
+	return tracing.Inject(nil, tracing.FromHeaders(cp.Headers))
+}
@@ -2,12 +2,17 @@ package callee
 
 import (
 	"encoding/json"
+	"expvar"
 	"io"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/mna/juggler/tracing"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -61,7 +66,7 @@ func TestCallee(t *testing.T) {
 	cuid := uuid.NewRandom()
 	brk := &mockCalleeBroker{
 		cps: []*message.CallPayload{
-			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "ok", TTLAfterRead: time.Second},
+			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "ok", TTLAfterRead: time.Second, IdempotencyKey: "k"},
 			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "err", TTLAfterRead: time.Second},
 			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "ok", TTLAfterRead: time.Millisecond}, // result will be dropped
 			{ConnUUID: cuid, MsgUUID: uuid.NewRandom(), URI: "err", TTLAfterRead: time.Second},
@@ -75,7 +80,7 @@ func TestCallee(t *testing.T) {
 	require.NoError(t, err, "Marshal ErrResult")
 
 	exp := []*message.ResPayload{
-		{ConnUUID: cuid, MsgUUID: brk.cps[0].MsgUUID, URI: "ok", Args: json.RawMessage(`"ok"`)},
+		{ConnUUID: cuid, MsgUUID: brk.cps[0].MsgUUID, URI: "ok", Args: json.RawMessage(`"ok"`), IdempotencyKey: "k"},
 		{ConnUUID: cuid, MsgUUID: brk.cps[1].MsgUUID, URI: "err", Args: b},
 		{ConnUUID: cuid, MsgUUID: brk.cps[3].MsgUUID, URI: "err", Args: b},
 	}
@@ -89,3 +94,201 @@ func TestCallee(t *testing.T) {
 	assert.Equal(t, io.EOF, err, "Listen returns expected error")
 	assert.Equal(t, exp, brk.rps, "got expected results")
 }
+
+func TestCalleeStoreProgress(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk}
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second}
+	err := cle.InvokeAndStoreResult(cp, func(cp *message.CallPayload) (interface{}, error) {
+		for i := 1; i <= 2; i++ {
+			if err := cle.StoreProgress(cp, i); err != nil {
+				return nil, err
+			}
+		}
+		return "done", nil
+	})
+	require.NoError(t, err, "InvokeAndStoreResult")
+
+	exp := []*message.ResPayload{
+		{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: "a", Args: json.RawMessage(`1`), Partial: true, Seq: 1},
+		{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: "a", Args: json.RawMessage(`2`), Partial: true, Seq: 2},
+		{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: "a", Args: json.RawMessage(`"done"`), Seq: 3},
+	}
+	assert.Equal(t, exp, brk.rps, "got expected results")
+	assert.Empty(t, cle.seqs, "stream is cleaned up")
+
+	// completed call
+	assert.Equal(t, ErrCallNotInProgress, cle.StoreProgress(cp, 3), "completed call")
+	assert.Empty(t, cle.seqs, "no stream for completed call")
+
+	// expired call
+	cp.TTLAfterRead = 0
+	assert.Equal(t, ErrCallExpired, cle.StoreProgress(cp, 3), "expired call")
+}
+
+func TestCalleeErrorf(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk}
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second}
+	err := cle.InvokeAndStoreResult(cp, func(cp *message.CallPayload) (interface{}, error) {
+		e := Errorf(400, "invalid %s", "x")
+		e.Retryable = true
+		return nil, e
+	})
+	require.NoError(t, err, "InvokeAndStoreResult")
+
+	require.Equal(t, 1, len(brk.rps), "got 1 result")
+	assert.Equal(t, `{"error":{"code":400,"message":"invalid x","retryable":true}}`, string(brk.rps[0].Args), "error result")
+}
+
+func TestCalleeTracer(t *testing.T) {
+	var rec tracing.Recorder
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk, Tracer: &rec}
+
+	parent := tracing.NewChild(tracing.SpanContext{})
+	cp := &message.CallPayload{
+		ConnUUID:     uuid.NewRandom(),
+		MsgUUID:      uuid.NewRandom(),
+		URI:          "a",
+		TTLAfterRead: time.Second,
+		Headers:      tracing.Inject(map[string]string{"locale": "fr"}, parent),
+	}
+	var got tracing.SpanContext
+	err := cle.InvokeAndStoreResult(cp, func(cp *message.CallPayload) (interface{}, error) {
+		got = tracing.FromHeaders(cp.Headers)
+		assert.Equal(t, "fr", cp.Headers["locale"], "other headers")
+		return nil, io.ErrUnexpectedEOF
+	})
+	require.NoError(t, err, "InvokeAndStoreResult")
+
+	span := rec.Span("callee.invoke")
+	require.NotNil(t, span, "callee span")
+	assert.Equal(t, parent, span.Parent, "span parent")
+	assert.Equal(t, span.Context, got, "thunk trace context")
+	assert.Equal(t, io.ErrUnexpectedEOF.Error(), span.Attributes["juggler.call_error"], "call error")
+
+	// the result only carries the trace context back
+	require.Equal(t, 1, len(brk.rps), "got 1 result")
+	assert.Equal(t, tracing.Inject(nil, span.Context), brk.rps[0].Headers, "result headers")
+}
+
+func TestCalleeMetrics(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk, Metrics: metrics.NewExpvar(vars)}
+
+	cps := []*message.CallPayload{
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second, Timestamp: time.Now().UTC()},
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second},
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "b", TTLAfterRead: time.Millisecond},
+	}
+	require.NoError(t, cle.InvokeAndStoreResult(cps[0], okThunk), "ok call")
+	require.NoError(t, cle.InvokeAndStoreResult(cps[1], errThunk), "failed call")
+	require.Equal(t, ErrCallExpired, cle.InvokeAndStoreResult(cps[2], okThunk), "expired call")
+
+	assert.Equal(t, "2", vars.Get("Invocations:a").String(), "Invocations a")
+	assert.Equal(t, "1", vars.Get("Invocations:b").String(), "Invocations b")
+	assert.Equal(t, "1", vars.Get("FailedInvocations:a").String(), "FailedInvocations")
+	assert.Equal(t, "1", vars.Get("ExpiredInvocations:b").String(), "ExpiredInvocations")
+	if h, ok := vars.Get("CallDuration:a").(*expvar.Map); assert.True(t, ok, "CallDuration") {
+		assert.Equal(t, "2", h.Get("Count").String(), "CallDuration count")
+	}
+	// only the call with a timestamp has a latency
+	if h, ok := vars.Get("CallLatency:a").(*expvar.Map); assert.True(t, ok, "CallLatency") {
+		assert.Equal(t, "1", h.Get("Count").String(), "CallLatency count")
+	}
+}
+
+func TestCalleeLogger(t *testing.T) {
+	type entry struct {
+		level  logging.Level
+		msg    string
+		fields []logging.Field
+	}
+	var got []entry
+	l := logging.LoggerFunc(func(level logging.Level, msg string, fields ...logging.Field) {
+		got = append(got, entry{level, msg, fields})
+	})
+
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk, Logger: l}
+
+	cps := []*message.CallPayload{
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second},
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second},
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "b", TTLAfterRead: time.Millisecond},
+	}
+	require.NoError(t, cle.InvokeAndStoreResult(cps[0], okThunk), "ok call")
+	require.NoError(t, cle.InvokeAndStoreResult(cps[1], errThunk), "failed call")
+	require.Equal(t, ErrCallExpired, cle.InvokeAndStoreResult(cps[2], okThunk), "expired call")
+
+	exp := []entry{
+		{logging.Debug, "call failed", []logging.Field{logging.MsgUUID(cps[1].MsgUUID), logging.URI("a"), logging.Err(io.ErrUnexpectedEOF)}},
+		{logging.Warn, "call expired, dropping result", []logging.Field{logging.MsgUUID(cps[2].MsgUUID), logging.URI("b")}},
+	}
+	assert.Equal(t, exp, got, "logged messages")
+}
+
+type mockRegistryBroker struct {
+	mockCalleeBroker
+
+	mu  sync.Mutex
+	sps map[string]*message.ServicePayload
+}
+
+func (b *mockRegistryBroker) RegisterService(sp *message.ServicePayload, ttl time.Duration) error {
+	b.mu.Lock()
+	b.sps[sp.URI+"/"+sp.Instance] = sp
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *mockRegistryBroker) DeregisterService(uri, instance string) error {
+	b.mu.Lock()
+	delete(b.sps, uri+"/"+instance)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *mockRegistryBroker) Services(uri string) ([]*message.ServicePayload, error) {
+	return nil, nil
+}
+
+func (b *mockRegistryBroker) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.sps)
+}
+
+func TestCalleeRegister(t *testing.T) {
+	brk := &mockRegistryBroker{sps: make(map[string]*message.ServicePayload)}
+	cle := &Callee{Broker: brk, Version: "v1", RegistryTTL: 10 * time.Millisecond}
+
+	unregister, err := cle.Register("a", "b")
+	require.NoError(t, err, "Register")
+	assert.NotEmpty(t, cle.Instance, "Instance is set")
+	assert.Equal(t, 2, brk.count(), "registered URIs")
+
+	// the heartbeat refreshes the registration
+	brk.mu.Lock()
+	sp := brk.sps["a/"+cle.Instance]
+	brk.mu.Unlock()
+	assert.Equal(t, "v1", sp.Version, "Version")
+	time.Sleep(20 * time.Millisecond)
+	brk.mu.Lock()
+	refreshed := brk.sps["a/"+cle.Instance]
+	brk.mu.Unlock()
+	assert.True(t, refreshed.LastSeen.After(sp.LastSeen), "registration refreshed")
+
+	unregister()
+	assert.Equal(t, 0, brk.count(), "deregistered URIs")
+
+	// disabled registration
+	cle = &Callee{Broker: &mockCalleeBroker{}, RegistryTTL: time.Second}
+	unregister, err = cle.Register("a")
+	require.NoError(t, err, "Register without registry")
+	unregister()
+}
@@ -0,0 +1,428 @@
+package juggler
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+)
+
+// ErrCircuitOpen is the error of the NACK sent in response to a CALL
+// that is rejected by a CircuitBreaker.
+var ErrCircuitOpen error = &message.Error{Code: 503, Message: "juggler: circuit open for this URI", Retryable: true}
+
+// The default values of the CircuitBreaker fields.
+const (
+	DefaultCircuitWindow         = 10 * time.Second
+	DefaultCircuitMinCalls       = 20
+	DefaultCircuitFailureRatio   = 0.5
+	DefaultCircuitOpenTimeout    = 5 * time.Second
+	DefaultCircuitHalfOpenTrials = 1
+	DefaultCircuitMaxURIs        = 1000
+)
+
+// The possible states of a circuit.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// circuitStateValues are the values of the CircuitState gauge.
+var circuitStateValues = map[string]int64{
+	CircuitClosed:   0,
+	CircuitHalfOpen: 1,
+	CircuitOpen:     2,
+}
+
+// CircuitBreaker is a Handler that stops registering the calls to a
+// URI when too many of its recent calls failed, so that callers fail
+// fast instead of filling the call queue of a failing URI. A call is
+// failed if it expires without a result, or if its result is an
+// error (see message.ResultErr). The pending calls of a connection
+// that closes are not counted, as their results cannot be received.
+//
+// The circuit of each URI starts closed, and calls are processed as
+// usual. The calls of a URI are counted from its first failure, and
+// its circuit opens when at least MinCalls completed in the Window and
+// the ratio of failed calls reaches FailureRatio. Calls to the URI
+// are then rejected with a 503 NACK for OpenTimeout, after which the
+// circuit is half-open: up to HalfOpenTrials calls are processed to
+// probe the URI. If they all succeed, the circuit closes, otherwise
+// it opens again. A closed circuit without failure in the Window is
+// forgotten, and at most MaxURIs circuits are kept, so that clients
+// cannot exhaust the memory of the server by calling random URIs.
+//
+// The fields should not be updated once the CircuitBreaker is used.
+type CircuitBreaker struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	// Handler is the handler to call for the messages that are not
+	// rejected. ProcessMsg is called if it is nil.
+	Handler Handler
+
+	// Window is the duration over which the calls are counted.
+	Window time.Duration
+
+	// MinCalls is the minimum number of completed calls in the Window
+	// before the circuit can open.
+	MinCalls int
+
+	// FailureRatio is the ratio of failed calls in the Window at which
+	// the circuit opens, between 0 and 1.
+	FailureRatio float64
+
+	// OpenTimeout is the duration for which the circuit stays open
+	// before it is half-open.
+	OpenTimeout time.Duration
+
+	// HalfOpenTrials is the number of calls processed when the circuit
+	// is half-open.
+	HalfOpenTrials int
+
+	// MaxURIs is the maximum number of URIs with a circuit. Failures of
+	// other URIs are ignored until circuits are forgotten.
+	MaxURIs int
+
+	// Metrics can be set to collect metrics about the circuits,
+	// including the state of the circuit of each URI as a gauge (see
+	// doc/metrics.md).
+	Metrics metrics.Metrics
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+	pending  map[string]*circuitCall   // by CALL message UUID
+	conns    map[*Conn]map[string]bool // keys of the pending calls by connection
+}
+
+// circuit is the circuit of a URI.
+type circuit struct {
+	state    string
+	start    time.Time // start of the current window, or time the circuit opened
+	calls    int       // number of completed calls in the window or trials
+	failures int
+	trials   int // number of trials started when half-open
+	gen      int // incremented on each state change
+}
+
+// circuitCall is a call waiting for its result.
+type circuitCall struct {
+	conn  *Conn
+	uri   string
+	gen   int // generation of the circuit when the call was made
+	timer *time.Timer
+}
+
+// Handle implements Handler for the CircuitBreaker.
+func (cb *CircuitBreaker) Handle(ctx context.Context, c *Conn, m message.Msg) {
+	switch m := m.(type) {
+	case *message.Call:
+		if m.Payload.URI != PresenceURI && m.Payload.URI != ServicesURI {
+			gen, ok := cb.allow(m.Payload.URI, time.Now())
+			if !ok {
+				if cb.Metrics != nil {
+					cb.Metrics.Add("CircuitRejectedCalls", 1)
+				}
+				c.Send(message.NewNack(m, 503, ErrCircuitOpen))
+				return
+			}
+			cb.track(c, m, gen)
+		}
+
+	case *message.Nack:
+		if m.Payload.ForType == message.CallMsg {
+			// the call was not registered, so it does not count
+			if call := cb.untrack(m.Payload.For.String()); call != nil {
+				cb.release(call)
+			}
+		}
+
+	case *message.Res:
+		if call := cb.untrack(m.Payload.For.String()); call != nil {
+			cb.record(call, message.ResultErr(m.Payload.Args) != nil, time.Now())
+		}
+	}
+
+	if cb.Handler != nil {
+		cb.Handler.Handle(ctx, c, m)
+		return
+	}
+	ProcessMsg(c, m)
+}
+
+// State returns the state of the circuit of uri.
+func (cb *CircuitBreaker) State(uri string) string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if ci := cb.circuits[uri]; ci != nil {
+		return ci.state
+	}
+	return CircuitClosed
+}
+
+// track records the call m of connection c, made in the generation gen
+// of its circuit, as pending until its result is sent, it expires or
+// the connection is closed.
+func (cb *CircuitBreaker) track(c *Conn, m *message.Call, gen int) {
+	timeout := m.Payload.Timeout
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	if nb := m.Payload.NotBefore; nb != nil {
+		if delay := nb.Sub(time.Now()); delay > 0 {
+			timeout += delay
+		}
+	}
+
+	key := m.UUID().String()
+	call := &circuitCall{conn: c, uri: m.Payload.URI, gen: gen}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.pending == nil {
+		cb.pending = make(map[string]*circuitCall)
+		cb.conns = make(map[*Conn]map[string]bool)
+	}
+	keys := cb.conns[c]
+	if keys == nil {
+		keys = make(map[string]bool)
+		cb.conns[c] = keys
+		go cb.watch(c)
+	}
+	keys[key] = true
+	cb.pending[key] = call
+	call.timer = time.AfterFunc(timeout, func() {
+		call := cb.untrack(key)
+		if call == nil {
+			return
+		}
+		select {
+		case <-call.conn.CloseNotify():
+			// the connection closed, its results cannot be received
+			cb.release(call)
+		default:
+			cb.record(call, true, time.Now())
+		}
+	})
+}
+
+// watch waits for the connection c to close and untracks its pending
+// calls, without counting them.
+func (cb *CircuitBreaker) watch(c *Conn) {
+	<-c.CloseNotify()
+
+	cb.mu.Lock()
+	var calls []*circuitCall
+	for key := range cb.conns[c] {
+		call := cb.pending[key]
+		delete(cb.pending, key)
+		call.timer.Stop()
+		calls = append(calls, call)
+	}
+	delete(cb.conns, c)
+	cb.mu.Unlock()
+
+	for _, call := range calls {
+		cb.release(call)
+	}
+}
+
+// untrack removes the pending call identified by key and returns it,
+// or nil if it was not pending.
+func (cb *CircuitBreaker) untrack(key string) *circuitCall {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	call := cb.pending[key]
+	if call == nil {
+		return nil
+	}
+	delete(cb.pending, key)
+	delete(cb.conns[call.conn], key)
+	call.timer.Stop()
+	return call
+}
+
+// allow returns true if a call to uri can be processed at now, along
+// with the generation of its circuit.
+func (cb *CircuitBreaker) allow(uri string, now time.Time) (int, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	ci := cb.circuits[uri]
+	if ci == nil {
+		return 0, true
+	}
+	switch ci.state {
+	case CircuitOpen:
+		if now.Sub(ci.start) < cb.openTimeout() {
+			return ci.gen, false
+		}
+		cb.setState(uri, ci, CircuitHalfOpen, now)
+		fallthrough
+
+	case CircuitHalfOpen:
+		if ci.trials >= cb.halfOpenTrials() {
+			return ci.gen, false
+		}
+		ci.trials++
+	}
+	return ci.gen, true
+}
+
+// release releases the trial of a call that did not complete, if its
+// circuit is still half-open.
+func (cb *CircuitBreaker) release(call *circuitCall) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	ci := cb.circuits[call.uri]
+	if ci != nil && ci.gen == call.gen && ci.state == CircuitHalfOpen && ci.trials > 0 {
+		ci.trials--
+	}
+}
+
+// record records the outcome of a call completed at now. Outcomes of
+// calls made before the last state change of the circuit are ignored.
+func (cb *CircuitBreaker) record(call *circuitCall, failed bool, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	ci := cb.circuits[call.uri]
+	if ci == nil {
+		if !failed {
+			return
+		}
+		if ci = cb.newCircuit(call.uri, now); ci == nil {
+			if cb.Metrics != nil {
+				cb.Metrics.Add("CircuitUntrackedFailures", 1)
+			}
+			return
+		}
+	}
+	if ci.gen != call.gen {
+		return
+	}
+
+	uri := call.uri
+	switch ci.state {
+	case CircuitHalfOpen:
+		if failed {
+			cb.setState(uri, ci, CircuitOpen, now)
+			return
+		}
+		ci.calls++
+		if ci.calls >= cb.halfOpenTrials() {
+			cb.setState(uri, ci, CircuitClosed, now)
+		}
+
+	case CircuitClosed:
+		if now.Sub(ci.start) >= cb.window() {
+			if !failed {
+				// no failure in the window, forget the circuit
+				delete(cb.circuits, uri)
+				return
+			}
+			ci.start, ci.calls, ci.failures = now, 0, 0
+		}
+		ci.calls++
+		if failed {
+			ci.failures++
+		}
+		if ci.calls >= cb.minCalls() && float64(ci.failures)/float64(ci.calls) >= cb.failureRatio() {
+			cb.setState(uri, ci, CircuitOpen, now)
+		}
+	}
+}
+
+// newCircuit creates and returns the closed circuit of uri. If there
+// are already MaxURIs circuits, the closed circuits without failure in
+// the Window are forgotten first, and it returns nil if there is still
+// no room for the new circuit. It must be called with mu locked.
+func (cb *CircuitBreaker) newCircuit(uri string, now time.Time) *circuit {
+	if cb.circuits == nil {
+		cb.circuits = make(map[string]*circuit)
+	}
+	if len(cb.circuits) >= cb.maxURIs() {
+		for u, ci := range cb.circuits {
+			if ci.state == CircuitClosed && now.Sub(ci.start) >= cb.window() {
+				delete(cb.circuits, u)
+			}
+		}
+		if len(cb.circuits) >= cb.maxURIs() {
+			return nil
+		}
+	}
+
+	ci := &circuit{state: CircuitClosed, start: now}
+	cb.circuits[uri] = ci
+	return ci
+}
+
+// setState changes the state of the circuit ci of uri. It must be
+// called with mu locked.
+func (cb *CircuitBreaker) setState(uri string, ci *circuit, state string, now time.Time) {
+	if cb.Metrics != nil {
+		cb.Metrics.AddGauge("CircuitState", circuitStateValues[state]-circuitStateValues[ci.state], "uri", uri)
+		switch state {
+		case CircuitOpen:
+			cb.Metrics.Add("CircuitOpened", 1)
+		case CircuitHalfOpen:
+			cb.Metrics.Add("CircuitHalfOpened", 1)
+		case CircuitClosed:
+			cb.Metrics.Add("CircuitClosed", 1)
+		}
+	}
+	ci.state = state
+	ci.gen++
+	ci.start, ci.calls, ci.failures, ci.trials = now, 0, 0, 0
+}
+
+func (cb *CircuitBreaker) window() time.Duration {
+	if cb.Window <= 0 {
+		return DefaultCircuitWindow
+	}
+	return cb.Window
+}
+
+func (cb *CircuitBreaker) minCalls() int {
+	if cb.MinCalls <= 0 {
+		return DefaultCircuitMinCalls
+	}
+	return cb.MinCalls
+}
+
+func (cb *CircuitBreaker) failureRatio() float64 {
+	if cb.FailureRatio <= 0 {
+		return DefaultCircuitFailureRatio
+	}
+	return cb.FailureRatio
+}
+
+func (cb *CircuitBreaker) openTimeout() time.Duration {
+	if cb.OpenTimeout <= 0 {
+		return DefaultCircuitOpenTimeout
+	}
+	return cb.OpenTimeout
+}
+
+func (cb *CircuitBreaker) halfOpenTrials() int {
+	if cb.HalfOpenTrials <= 0 {
+		return DefaultCircuitHalfOpenTrials
+	}
+	return cb.HalfOpenTrials
+}
+
+func (cb *CircuitBreaker) maxURIs() int {
+	if cb.MaxURIs <= 0 {
+		return DefaultCircuitMaxURIs
+	}
+	return cb.MaxURIs
+}
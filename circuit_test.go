@@ -0,0 +1,181 @@
+package juggler
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	cb := &CircuitBreaker{
+		Window:         time.Minute,
+		MinCalls:       4,
+		FailureRatio:   0.5,
+		OpenTimeout:    time.Second,
+		HalfOpenTrials: 2,
+		Metrics:        metrics.NewExpvar(vars),
+	}
+
+	const uri = "a"
+	now := time.Now()
+	assert.Equal(t, CircuitClosed, cb.State(uri), "initial state")
+
+	call := func() (*circuitCall, bool) {
+		gen, ok := cb.allow(uri, now)
+		return &circuitCall{uri: uri, gen: gen}, ok
+	}
+
+	// a success without a failure does not create a circuit
+	c, ok := call()
+	require.True(t, ok, "allow without circuit")
+	cb.record(c, false, now)
+	assert.Nil(t, cb.circuits[uri], "no circuit")
+
+	// 2 failures out of 4 calls opens the circuit
+	for i := 0; i < 4; i++ {
+		c, ok := call()
+		require.True(t, ok, "allow closed %d", i)
+		cb.record(c, i%2 == 0, now)
+	}
+	assert.Equal(t, CircuitOpen, cb.State(uri), "state after failures")
+	assert.Equal(t, "2", vars.Get("CircuitState:"+uri).String(), "state gauge")
+
+	_, ok = call()
+	assert.False(t, ok, "allow open")
+
+	// half-open after the timeout, up to 2 trials
+	now = now.Add(time.Second)
+	c1, ok := call()
+	require.True(t, ok, "allow trial 1")
+	assert.Equal(t, CircuitHalfOpen, cb.State(uri), "state after timeout")
+	assert.Equal(t, "1", vars.Get("CircuitState:"+uri).String(), "state gauge after timeout")
+	c2, ok := call()
+	require.True(t, ok, "allow trial 2")
+	_, ok = call()
+	assert.False(t, ok, "allow trial 3")
+
+	// a released trial can be retried
+	cb.release(c2)
+	c2, ok = call()
+	require.True(t, ok, "allow trial 2 after release")
+
+	// a failed trial opens the circuit again
+	cb.record(c1, true, now)
+	assert.Equal(t, CircuitOpen, cb.State(uri), "state after failed trial")
+	assert.Equal(t, "2", vars.Get("CircuitState:"+uri).String(), "state gauge after failed trial")
+
+	// late outcome of the other trial is ignored
+	cb.record(c2, false, now)
+	assert.Equal(t, CircuitOpen, cb.State(uri), "state after late trial")
+
+	// successful trials close the circuit
+	now = now.Add(time.Second)
+	c1, ok = call()
+	require.True(t, ok, "allow trial 1")
+	c2, ok = call()
+	require.True(t, ok, "allow trial 2")
+	cb.record(c1, false, now)
+	assert.Equal(t, CircuitHalfOpen, cb.State(uri), "state after 1 trial")
+	cb.record(c2, false, now)
+	assert.Equal(t, CircuitClosed, cb.State(uri), "state after 2 trials")
+	assert.Equal(t, "0", vars.Get("CircuitState:"+uri).String(), "state gauge after 2 trials")
+
+	assert.Equal(t, "2", vars.Get("CircuitOpened").String(), "opened")
+	assert.Equal(t, "2", vars.Get("CircuitHalfOpened").String(), "half-opened")
+	assert.Equal(t, "1", vars.Get("CircuitClosed").String(), "closed")
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	cb := &CircuitBreaker{Window: time.Second, MinCalls: 2}
+
+	const uri = "a"
+	now := time.Now()
+	gen, _ := cb.allow(uri, now)
+	cb.record(&circuitCall{uri: uri, gen: gen}, true, now)
+
+	// the window expired, so the first failure does not count
+	now = now.Add(time.Second)
+	cb.record(&circuitCall{uri: uri, gen: gen}, true, now)
+	assert.Equal(t, CircuitClosed, cb.State(uri), "state after new window")
+
+	cb.record(&circuitCall{uri: uri, gen: gen}, true, now)
+	assert.Equal(t, CircuitOpen, cb.State(uri), "state after failures")
+}
+
+func TestCircuitBreakerForget(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	cb := &CircuitBreaker{Window: time.Second, MinCalls: 10, MaxURIs: 2, Metrics: metrics.NewExpvar(vars)}
+
+	now := time.Now()
+	fail := func(uri string) {
+		gen, _ := cb.allow(uri, now)
+		cb.record(&circuitCall{uri: uri, gen: gen}, true, now)
+	}
+	fail("a")
+	fail("b")
+	assert.Equal(t, 2, len(cb.circuits), "circuits after 2 URIs")
+
+	// no room for another URI
+	fail("c")
+	assert.Equal(t, 2, len(cb.circuits), "circuits after max reached")
+	assert.Nil(t, cb.circuits["c"], "no circuit for c")
+	assert.Equal(t, "1", vars.Get("CircuitUntrackedFailures").String(), "untracked failures")
+
+	// a success after the window forgets the circuit
+	now = now.Add(time.Second)
+	gen, _ := cb.allow("a", now)
+	cb.record(&circuitCall{uri: "a", gen: gen}, false, now)
+	assert.Nil(t, cb.circuits["a"], "a forgotten")
+
+	// idle closed circuits are forgotten to make room
+	fail("c")
+	fail("d")
+	assert.Equal(t, 2, len(cb.circuits), "circuits after new URIs")
+	assert.NotNil(t, cb.circuits["c"], "circuit for c")
+	assert.NotNil(t, cb.circuits["d"], "circuit for d")
+}
+
+func TestCircuitBreakerConnClosed(t *testing.T) {
+	cb := &CircuitBreaker{MinCalls: 1, FailureRatio: 1}
+
+	newCall := func(uri string) *message.Call {
+		m, err := message.NewCall(uri, nil, 50*time.Millisecond)
+		require.NoError(t, err, "NewCall")
+		return m
+	}
+
+	// the calls of a closed connection are untracked
+	c := &Conn{kill: make(chan struct{})}
+	cb.track(c, newCall("a"), 0)
+	cb.track(c, newCall("a"), 0)
+	close(c.kill)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		cb.mu.Lock()
+		n := len(cb.pending) + len(cb.conns)
+		cb.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cb.mu.Lock()
+	assert.Equal(t, 0, len(cb.pending), "pending calls")
+	assert.Equal(t, 0, len(cb.conns), "connections")
+	cb.mu.Unlock()
+
+	// the calls of an open connection fail on timeout
+	c = &Conn{kill: make(chan struct{})}
+	cb.track(c, newCall("b"), 0)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, CircuitOpen, cb.State("b"), "state after timeout")
+	assert.Equal(t, CircuitClosed, cb.State("a"), "state of closed connection's URI")
+	close(c.kill)
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// Batch is a set of requests that are sent to the server in a single
+// BTCH message. The server processes the requests in order and
+// responds with a single BACK message, but the handler is called
+// with the ACK or NACK of each request, as if they were sent
+// individually. A Batch is not safe for concurrent use, and it
+// should not be used anymore once it is sent.
+type Batch struct {
+	c     *Client
+	msgs  []message.Msg
+	calls []batchCall
+}
+
+// batchCall is a call request in a batch.
+type batchCall struct {
+	m       *message.Call
+	timeout time.Duration
+}
+
+// NewBatch returns a new, empty Batch of requests that can be sent
+// to the server using the client.
+func (c *Client) NewBatch() *Batch {
+	return &Batch{c: c}
+}
+
+// Len returns the number of requests in the batch.
+func (b *Batch) Len() int {
+	return len(b.msgs)
+}
+
+// Call adds a call request to the batch for the remote procedure
+// identified by uri. It works like Client.Call, and returns the UUID
+// of the call message, but the call request is only sent with the
+// batch.
+func (b *Batch) Call(uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
+	if timeout <= 0 {
+		timeout = b.c.callTimeout
+	}
+	m, err := message.NewCall(uri, v, timeout)
+	if err != nil {
+		return nil, err
+	}
+	b.c.setHeaders(&m.Meta)
+	b.msgs = append(b.msgs, m)
+	b.calls = append(b.calls, batchCall{m: m, timeout: timeout})
+	return m.UUID(), nil
+}
+
+// Sub adds a subscription request to the batch for the specified
+// channel, which is treated as a pattern if pattern is true. It
+// returns the UUID of the sub message.
+func (b *Batch) Sub(channel string, pattern bool) uuid.UUID {
+	m := message.NewSub(channel, pattern)
+	b.c.setHeaders(&m.Meta)
+	b.msgs = append(b.msgs, m)
+	return m.UUID()
+}
+
+// Unsb adds an unsubscription request to the batch for the specified
+// channel, which is treated as a pattern if pattern is true. It
+// returns the UUID of the unsb message.
+func (b *Batch) Unsb(channel string, pattern bool) uuid.UUID {
+	m := message.NewUnsb(channel, pattern)
+	b.c.setHeaders(&m.Meta)
+	b.msgs = append(b.msgs, m)
+	return m.UUID()
+}
+
+// Pub adds a publish request to the batch on the specified channel.
+// The v value is marshaled as JSON and sent as event payload. It
+// returns the UUID of the pub message.
+func (b *Batch) Pub(channel string, v interface{}) (uuid.UUID, error) {
+	m, err := message.NewPub(channel, v)
+	if err != nil {
+		return nil, err
+	}
+	b.c.setHeaders(&m.Meta)
+	b.msgs = append(b.msgs, m)
+	return m.UUID(), nil
+}
+
+// Send sends the requests of the batch to the server in a single
+// message. It returns the UUID of the batch message on success, or
+// an error if the batch could not be sent to the server.
+func (b *Batch) Send() (uuid.UUID, error) {
+	c := b.c
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.msgs) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	m, err := message.NewBtch(c.codec, b.msgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	// add the expected results before sending the batch, as the
+	// responses are all received at once.
+	pcs := make([]*pendingCall, len(b.calls))
+	for i, bc := range b.calls {
+		pcs[i] = &pendingCall{call: bc.m, deadline: callDeadline(bc.m, bc.timeout)}
+		c.addPending(bc.m.UUID().String(), pcs[i])
+	}
+	if err := c.doWrite(m); err != nil {
+		for _, bc := range b.calls {
+			c.deletePending(bc.m.UUID().String())
+		}
+		return nil, err
+	}
+
+	for _, pc := range pcs {
+		go c.handleExpiredCall(pc.call, pc.deadline)
+	}
+	return m.UUID(), nil
+}
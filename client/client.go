@@ -9,11 +9,34 @@
 // call timeout expired generate a custom ExpMsg message type, so an
 // RPC call that succeeded (that is, for which the server returned
 // an ACK message, not a NACK) either generates a RES or an EXP,
-// but never both or none.
+// but never both or none. The exception is broadcast calls, which
+// generate a RES for each callee, followed by an EXP if the expected
+// number of results was not received before the timeout. A call may
+// also generate PROG messages with partial results before its RES
+// or EXP, the call is still pending until then.
+//
+// Requests can also be sent in a single message using a Batch. The
+// server responds with a single BACK message for the batch, but the
+// Handler is called with the ACK or NACK of each request, as if they
+// were sent individually.
+//
+// With the juggler.1 protocol, the client starts the connection with
+// a HELLO message (see SetHello), and the server responds with a
+// WELCOME message that is available via Client.Welcome. Clients
+// connected with the juggler.0 protocol behave as before. If the
+// server supports resumable sessions, a client that lost its
+// connection can resume its session on a new connection, see
+// SetResume.
+//
+// Errors are decoded as *message.Error values, with the code, the
+// retryable flag and the details sent by the server or the callee.
+// Use Err to get the error of a received message, and IsRetryable to
+// check if the request may succeed if it is sent again.
 //
 package client
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"io"
@@ -25,6 +48,7 @@ import (
 
 	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/internal/wswriter"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
@@ -33,7 +57,9 @@ import (
 // Client is a juggler client based on a websocket connection. It is
 // used to send and receive messages to and from a juggler server.
 type Client struct {
-	conn *websocket.Conn
+	conn  *websocket.Conn
+	proto message.Protocol
+	codec message.Codec
 
 	// options
 	callTimeout             time.Duration
@@ -42,16 +68,34 @@ type Client struct {
 	writeTimeout            time.Duration
 	acquireWriteLockTimeout time.Duration
 	writeLimit              int64
+	compressionThreshold    int
+	hello                   *message.Hello
+	headers                 map[string]string
+	resume                  *message.Welcome // WELCOME of the session to resume
+	logger                  logging.Logger
+
+	// welcomed is closed when the WELCOME is received, stored in welcome.
+	welcomed chan struct{}
+	welcome  *message.Welcome
 
 	// stop signal for expiration goroutines, signals close of client
 	stop chan struct{}
 
 	wmu     chan struct{} // exclusive write lock
 	mu      sync.Mutex    // lock access to results map and err field
-	results map[string]struct{}
+	results map[string]*pendingCall
 	err     error
 }
 
+// pendingCall is a call waiting for its results.
+type pendingCall struct {
+	call      *message.Call
+	deadline  time.Time // time at which the call expires
+	broadcast bool
+	want      int // number of results expected for a broadcast call, 0 if not known yet
+	got       int // number of results received for a broadcast call
+}
+
 // New creates a juggler client using the provided websocket
 // connection. Received messages are sent to the handler set by
 // the SetHandler option.
@@ -61,15 +105,45 @@ func New(conn *websocket.Conn, opts ...Option) *Client {
 	wmu := make(chan struct{}, 1)
 	wmu <- struct{}{}
 
+	proto := message.ProtocolFor(conn.Subprotocol())
 	c := &Client{
-		conn:    conn,
-		stop:    make(chan struct{}),
-		wmu:     wmu,
-		results: make(map[string]struct{}),
+		conn:     conn,
+		proto:    proto,
+		codec:    proto.Codec,
+		stop:     make(chan struct{}),
+		wmu:      wmu,
+		results:  make(map[string]*pendingCall),
+		welcomed: make(chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(c)
 	}
+
+	// the calls moved from a resumed client expire as usual
+	for _, pc := range c.results {
+		go c.handleExpiredCall(pc.call, pc.deadline)
+	}
+
+	// since juggler.1, the connection starts with a HELLO
+	if proto.Supports(message.HelloMsg) {
+		hello := c.hello
+		if hello == nil {
+			hello = message.NewHello("")
+		}
+		if w := c.resume; w != nil && w.Payload.SessionToken != "" {
+			hello.Payload.SessionID = w.Payload.SessionID
+			hello.Payload.SessionToken = w.Payload.SessionToken
+		}
+		if err := c.doWrite(hello); err != nil {
+			c.log(logging.Warn, "failed to send HELLO", logging.MsgUUID(hello.UUID()), logging.Err(err))
+			c.mu.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.mu.Unlock()
+		}
+	}
+
 	go c.handleMessages()
 	return c
 }
@@ -80,6 +154,7 @@ func (c *Client) handleMessages() {
 	for {
 		_, r, err := c.conn.NextReader()
 		if err != nil {
+			c.log(logging.Debug, "connection closed", logging.Err(err))
 			c.mu.Lock()
 			if c.err == nil {
 				c.err = err
@@ -88,29 +163,107 @@ func (c *Client) handleMessages() {
 			return
 		}
 
-		m, err := message.UnmarshalResponse(r)
+		m, err := c.proto.DecodeResponse(r)
 		if err != nil {
+			c.log(logging.Warn, "failed to decode message", logging.Err(err))
+			continue
+		}
+		if w, ok := m.(*message.Welcome); ok {
+			c.setWelcome(w)
 			continue
 		}
 
-		switch m := m.(type) {
-		case *message.Res:
-			// got the result, do not trigger an expired message
-			if ok := c.deletePending(m.Payload.For.String()); !ok {
-				// if an expired message got here first, then drop the
-				// result, client treated this call as expired already.
+		// the responses of a batch are handled as if they were sent
+		// individually.
+		msgs := []message.Msg{m}
+		if back, ok := m.(*message.Back); ok {
+			if msgs, err = back.Responses(c.codec); err != nil {
+				c.log(logging.Warn, "failed to decode batch responses", logging.MsgUUID(back.UUID()), logging.Err(err))
 				continue
 			}
+		}
 
-		case *message.Nack:
-			if m.Payload.ForType == message.CallMsg {
-				// won't get any result for this call (unless already expired)
-				c.deletePending(m.Payload.For.String())
+		for _, m := range msgs {
+			if c.track(m) {
+				go c.handler.Handle(context.Background(), m)
 			}
 		}
+	}
+}
+
+// log logs msg at level to the logger set by SetLogger, if any.
+func (c *Client) log(level logging.Level, msg string, fields ...logging.Field) {
+	if c.logger != nil {
+		c.logger.Log(level, msg, fields...)
+	}
+}
+
+// setWelcome stores the WELCOME message w, if none was received yet.
+func (c *Client) setWelcome(w *message.Welcome) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.welcome == nil {
+		c.welcome = w
+		close(c.welcomed)
+	}
+}
+
+// Welcome returns the WELCOME message sent by the server in response
+// to the HELLO of the client, with the session ID, the capabilities
+// and the limits of the server. It waits for the message if it was
+// not received yet, and returns nil if the connection is closed
+// before it is received or if the protocol of the connection does
+// not support it (juggler.0). The WELCOME message is not sent to the
+// Handler.
+func (c *Client) Welcome() *message.Welcome {
+	if !c.proto.Supports(message.WelcomeMsg) {
+		return nil
+	}
+
+	select {
+	case <-c.welcomed:
+	case <-c.stop:
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.welcome
+}
+
+// Protocol returns the version of the protocol and the codec used by
+// the client, as selected by the subprotocol of the connection.
+func (c *Client) Protocol() message.Protocol {
+	return c.proto
+}
+
+// track updates the pending calls for the message m received from the
+// server. It returns false if m must be dropped.
+func (c *Client) track(m message.Msg) bool {
+	switch m := m.(type) {
+	case *message.Res:
+		// got the result, do not trigger an expired message. If an
+		// expired message got here first, then drop the result, client
+		// treated this call as expired already.
+		return c.resultPending(m.Payload.For.String())
+
+	case *message.Prog:
+		// drop partial results of completed or expired calls
+		return c.isPending(m.Payload.For.String())
+
+	case *message.Ack:
+		if m.Payload.ForType == message.CallMsg && m.Payload.Callees > 0 {
+			c.setPendingCallees(m.Payload.For.String(), m.Payload.Callees)
+		}
 
-		go c.handler.Handle(context.Background(), m)
+	case *message.Nack:
+		m.Payload.Err = message.NackErr(m)
+		if m.Payload.ForType == message.CallMsg {
+			// won't get any result for this call (unless already expired)
+			c.deletePending(m.Payload.For.String())
+		}
 	}
+	return true
 }
 
 // Dial is a helper function to create a Client connected to urlStr using
@@ -121,7 +274,10 @@ func (c *Client) handleMessages() {
 // create the client once the connection is established, using New.
 //
 // The Dialer's Subprotocols field should be set to one of (or any/all of)
-// juggler.Subprotocol. To limit the client to a restricted subset of
+// juggler.Subprotocols. The messages are encoded using the codec of
+// the negotiated subprotocol (see message.Codecs). Set the Dialer's
+// EnableCompression field to negotiate per-message compression with
+// the server (see SetCompressionThreshold). To limit the client to a restricted subset of
 // messages, set the Juggler-Allowed-Messages header on reqHeader
 // (see the documentation of juggler.Upgrade for details).
 func Dial(d *websocket.Dialer, urlStr string, reqHeader http.Header, opts ...Option) (*Client, error) {
@@ -178,6 +334,63 @@ func (c *Client) UnderlyingConn() *websocket.Conn {
 // It returns the UUID of the call message on success, or an error if
 // the call request could not be sent to the server.
 func (c *Client) Call(uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
+	return c.CallPriority(uri, v, timeout, 0)
+}
+
+// CallPriority is like Call, but sets the priority of the call request.
+// Calls with a higher priority are processed first by the callees, if
+// the server supports priorities. The server may change the priority
+// of the call.
+func (c *Client) CallPriority(uri string, v interface{}, timeout time.Duration, priority int) (uuid.UUID, error) {
+	return c.call(uri, v, timeout, func(m *message.Call) {
+		m.Payload.Priority = priority
+	}, nil)
+}
+
+// CallAt is like Call, but schedules the call request to run at
+// notBefore. The timeout starts counting from that time. The server
+// responds with a NACK if it does not support scheduled calls.
+func (c *Client) CallAt(uri string, v interface{}, timeout time.Duration, notBefore time.Time) (uuid.UUID, error) {
+	return c.call(uri, v, timeout, func(m *message.Call) {
+		m.Payload.NotBefore = &notBefore
+	}, nil)
+}
+
+// CallIdempotent is like Call, but sets the idempotency key of the call
+// request. If the call is retried with the same key on the same URI,
+// e.g. after a reconnection, the server may send the result of the
+// first call instead of running it again.
+func (c *Client) CallIdempotent(uri string, v interface{}, timeout time.Duration, key string) (uuid.UUID, error) {
+	return c.call(uri, v, timeout, func(m *message.Call) {
+		m.Payload.IdempotencyKey = key
+	}, nil)
+}
+
+// CallHeaders is like Call, but sets the headers of the call request,
+// in addition to the headers set by the SetHeaders option. The headers
+// are propagated to the callee.
+func (c *Client) CallHeaders(uri string, v interface{}, timeout time.Duration, headers map[string]string) (uuid.UUID, error) {
+	return c.call(uri, v, timeout, func(m *message.Call) {
+		for k, hv := range headers {
+			m.SetHeader(k, hv)
+		}
+	}, nil)
+}
+
+// CallBroadcast is like Call, but sends the call request to all the
+// callees listening on uri, if the server supports it. Each callee
+// sends its own RES for the call, and the handler is called for each
+// of them until quorum results are received. If quorum is <= 0, the
+// results of all callees that received the call are expected, as
+// reported by the server in the ACK. If fewer results are received
+// before the timeout, an EXP is generated for the call.
+func (c *Client) CallBroadcast(uri string, v interface{}, timeout time.Duration, quorum int) (uuid.UUID, error) {
+	return c.call(uri, v, timeout, func(m *message.Call) {
+		m.Payload.Broadcast = true
+	}, &pendingCall{broadcast: true, want: quorum})
+}
+
+func (c *Client) call(uri string, v interface{}, timeout time.Duration, setFn func(*message.Call), pc *pendingCall) (uuid.UUID, error) {
 	c.mu.Lock()
 	err := c.err
 	c.mu.Unlock()
@@ -192,41 +405,103 @@ func (c *Client) Call(uri string, v interface{}, timeout time.Duration) (uuid.UU
 	if err != nil {
 		return nil, err
 	}
+	c.setHeaders(&m.Meta)
+	setFn(m)
 	if err := c.doWrite(m); err != nil {
 		return nil, err
 	}
 
 	// add the expected result
-	c.addPending(m.UUID().String())
+	if pc == nil {
+		pc = &pendingCall{}
+	}
+	pc.call = m
+	pc.deadline = callDeadline(m, timeout)
+	c.addPending(m.UUID().String(), pc)
 
-	go c.handleExpiredCall(m, timeout)
+	go c.handleExpiredCall(m, pc.deadline)
 	return m.UUID(), nil
 }
 
-func (c *Client) handleExpiredCall(m *message.Call, timeout time.Duration) {
-	// wait for the timeout
+// callDeadline returns the time at which the call m expires, given its
+// timeout, starting at the scheduled time if any.
+func callDeadline(m *message.Call, timeout time.Duration) time.Time {
 	if timeout <= 0 {
 		timeout = broker.DefaultCallTimeout
 	}
+	start := time.Now()
+	if nb := m.Payload.NotBefore; nb != nil && nb.After(start) {
+		start = *nb
+	}
+	return start.Add(timeout)
+}
+
+func (c *Client) handleExpiredCall(m *message.Call, deadline time.Time) {
 	select {
 	case <-c.stop:
 		return
-	case <-time.After(timeout):
+	case <-time.After(deadline.Sub(time.Now())):
 	}
 
 	// check if still waiting for a result
 	if ok := c.deletePending(m.UUID().String()); ok {
 		// if so, send an Exp message
+		c.log(logging.Debug, "call expired", logging.MsgUUID(m.UUID()), logging.URI(m.Payload.URI))
 		exp := newExp(m)
 		go c.handler.Handle(context.Background(), exp)
 	}
 }
 
 // add a pending call.
-func (c *Client) addPending(key string) {
+func (c *Client) addPending(key string, pc *pendingCall) {
+	if pc.want < 0 {
+		pc.want = 0
+	}
+	c.mu.Lock()
+	c.results[key] = pc
+	c.mu.Unlock()
+}
+
+// return true if the call is still pending.
+func (c *Client) isPending(key string) bool {
 	c.mu.Lock()
-	c.results[key] = struct{}{}
+	_, ok := c.results[key]
 	c.mu.Unlock()
+	return ok
+}
+
+// record a result for the pending call, returning true if it was
+// still pending. The call is no longer pending once all its expected
+// results are received.
+func (c *Client) resultPending(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pc, ok := c.results[key]
+	if !ok {
+		return false
+	}
+	pc.got++
+	if !pc.broadcast || (pc.want > 0 && pc.got >= pc.want) {
+		delete(c.results, key)
+	}
+	return true
+}
+
+// set the number of callees that received the pending broadcast
+// call, if the expected number of results is not known yet.
+func (c *Client) setPendingCallees(key string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pc, ok := c.results[key]
+	if !ok || !pc.broadcast || pc.want > 0 {
+		return
+	}
+	pc.want = n
+	if pc.got >= pc.want {
+		delete(c.results, key)
+	}
 }
 
 // delete the pending call, returning true if it was still pending.
@@ -252,6 +527,7 @@ func (c *Client) Sub(channel string, pattern bool) (uuid.UUID, error) {
 	}
 
 	m := message.NewSub(channel, pattern)
+	c.setHeaders(&m.Meta)
 	if err := c.doWrite(m); err != nil {
 		return nil, err
 	}
@@ -271,6 +547,7 @@ func (c *Client) Unsb(channel string, pattern bool) (uuid.UUID, error) {
 	}
 
 	m := message.NewUnsb(channel, pattern)
+	c.setHeaders(&m.Meta)
 	if err := c.doWrite(m); err != nil {
 		return nil, err
 	}
@@ -282,6 +559,13 @@ func (c *Client) Unsb(channel string, pattern bool) (uuid.UUID, error) {
 // the UUID of the pub message on success, or an error if the request could
 // not be sent to the server.
 func (c *Client) Pub(channel string, v interface{}) (uuid.UUID, error) {
+	return c.PubHeaders(channel, v, nil)
+}
+
+// PubHeaders is like Pub, but sets the headers of the publish request,
+// in addition to the headers set by the SetHeaders option. The headers
+// are propagated to the subscribers with the event.
+func (c *Client) PubHeaders(channel string, v interface{}, headers map[string]string) (uuid.UUID, error) {
 	c.mu.Lock()
 	err := c.err
 	c.mu.Unlock()
@@ -293,12 +577,24 @@ func (c *Client) Pub(channel string, v interface{}) (uuid.UUID, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.setHeaders(&m.Meta)
+	for k, hv := range headers {
+		m.SetHeader(k, hv)
+	}
 	if err := c.doWrite(m); err != nil {
 		return nil, err
 	}
 	return m.UUID(), nil
 }
 
+// setHeaders sets the headers of the client on the request message
+// with metadata m.
+func (c *Client) setHeaders(m *message.Meta) {
+	for k, v := range c.headers {
+		m.SetHeader(k, v)
+	}
+}
+
 // doWrite calls writeMsg and handles errors so that the connection is
 // marked as failed if the error is fatal.
 func (c *Client) doWrite(m message.Msg) error {
@@ -316,14 +612,26 @@ func (c *Client) doWrite(m message.Msg) error {
 }
 
 func (c *Client) writeMsg(m message.Msg) error {
-	w := wswriter.Exclusive(c.conn, c.wmu, c.acquireWriteLockTimeout, c.writeTimeout)
-	defer w.Close()
-
-	lw := io.Writer(w)
+	// encode the message first so that it is written in a single call,
+	// as its size determines if it is compressed. The write limit is
+	// checked while encoding.
+	var buf bytes.Buffer
+	ew := io.Writer(&buf)
 	if l := c.writeLimit; l > 0 {
-		lw = wswriter.Limit(w, l)
+		ew = wswriter.Limit(&buf, l)
+	}
+	if err := c.codec.Encode(ew, m); err != nil {
+		if wswriter.Exceeded(ew) {
+			return wswriter.ErrWriteLimitExceeded
+		}
+		return err
 	}
-	return json.NewEncoder(lw).Encode(m)
+
+	w := wswriter.Exclusive(c.conn, c.wmu, c.acquireWriteLockTimeout, c.writeTimeout, c.codec.Binary(), c.compressionThreshold)
+	defer w.Close()
+
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 // Handler defines the method required to handle a message received
@@ -404,6 +712,69 @@ func SetWriteLimit(limit int64) Option {
 	}
 }
 
+// SetHello sets the client software and the capabilities sent in the
+// HELLO message that starts the connection, if the protocol of the
+// connection supports it (juggler.1).
+func SetHello(client string, caps ...string) Option {
+	return func(c *Client) {
+		c.hello = message.NewHello(client, caps...)
+	}
+}
+
+// SetHeaders sets the headers sent with each request, e.g. the locale
+// or the version of the client. The headers of CALL and PUB requests
+// are propagated to the callees and the subscribers. The server may
+// enforce a limit on the size of the headers of a request.
+func SetHeaders(headers map[string]string) Option {
+	return func(c *Client) {
+		c.headers = headers
+	}
+}
+
+// SetResume sets the client to resume the session of the old client,
+// typically after its connection was lost. If the server supports
+// resumable sessions (see message.CapSessions) and the session is
+// resumed within the grace period, the results of the calls made by
+// the old client that are received after the reconnection are
+// handled by the new client, and the subscriptions of the old client
+// are restored. The Resumed field of the WELCOME indicates if the
+// session was resumed. The calls that are still pending on the old
+// client are moved to the new client, so that they generate an EXP
+// if their result is not received in time. The old client must be
+// closed, and the protocol of the new client must support the HELLO
+// message (juggler.1), otherwise only the pending calls are moved.
+func SetResume(old *Client) Option {
+	return func(c *Client) {
+		c.resume = old.Welcome()
+
+		old.mu.Lock()
+		defer old.mu.Unlock()
+		for k, pc := range old.results {
+			c.addPending(k, pc)
+		}
+	}
+}
+
+// SetCompressionThreshold sets the minimum size in bytes of messages
+// that are compressed, if compression is negotiated with the server
+// (see the websocket.Dialer's EnableCompression field). The default
+// of 0 uses 512 bytes, and a negative value disables compression of
+// the messages sent by the client.
+func SetCompressionThreshold(n int) Option {
+	return func(c *Client) {
+		c.compressionThreshold = n
+	}
+}
+
+// SetLogger sets the logger of the client, which logs the errors that
+// are not returned by the client's methods, e.g. messages that fail to
+// decode, and the calls that expire. By default, nothing is logged.
+func SetLogger(l logging.Logger) Option {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
 // Exp is an expired call message. It is never sent over the network, but
 // it is raised by the client for itself, when the timeout for a call
 // result has expired. As such, its message type returns false for
@@ -430,3 +801,25 @@ func newExp(m *message.Call) *Exp {
 	exp.Payload.Args = m.Payload.Args
 	return exp
 }
+
+// Err returns the error carried by the message m as a *message.Error:
+// the error of a NACK, or the error result of a RES or PROG. It
+// returns nil if m does not carry an error.
+func Err(m message.Msg) error {
+	switch m := m.(type) {
+	case *message.Nack:
+		return message.NackErr(m)
+	case *message.Res:
+		return m.Err()
+	case *message.Prog:
+		return m.Err()
+	}
+	return nil
+}
+
+// IsRetryable returns true if err is a *message.Error that is marked
+// as retryable.
+func IsRetryable(err error) bool {
+	e, ok := err.(*message.Error)
+	return ok && e.Retryable
+}
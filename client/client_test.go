@@ -14,6 +14,7 @@ import (
 
 	"github.com/mna/juggler/internal/wstest"
 	"github.com/mna/juggler/internal/wswriter"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
@@ -86,6 +87,54 @@ func TestClientReadLimit(t *testing.T) {
 	}
 }
 
+func TestClientLogger(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		var m map[string]interface{}
+		// read the CALL message
+		require.NoError(t, c.ReadJSON(&m), "ReadJSON")
+
+		// write an invalid message
+		require.NoError(t, c.WriteMessage(websocket.TextMessage, []byte(`{"meta":{}}`)), "WriteMessage")
+
+		// wait for the client to close
+		c.ReadMessage()
+	})
+	defer srv.Close()
+
+	var (
+		mu   sync.Mutex
+		msgs []string
+	)
+	l := logging.LoggerFunc(func(level logging.Level, msg string, fields ...logging.Field) {
+		mu.Lock()
+		msgs = append(msgs, level.String()+": "+msg)
+		mu.Unlock()
+	})
+
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h), SetLogger(l))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	_, err = cli.Call("a", "payload", 10*time.Millisecond)
+	require.NoError(t, err, "Call")
+
+	want := []string{"warn: failed to decode message", "debug: call expired"}
+	var got []string
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		got = append([]string(nil), msgs...)
+		mu.Unlock()
+		if len(got) >= len(want) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, want, got, "logged messages")
+}
+
 func TestClientHandler(t *testing.T) {
 	done := make(chan bool, 1)
 	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
@@ -322,3 +371,132 @@ func TestClientConcurrent(t *testing.T) {
 	<-done
 	<-cli.CloseNotify()
 }
+
+func TestClientPendingBroadcast(t *testing.T) {
+	c := &Client{results: make(map[string]*pendingCall)}
+
+	// regular call, done after the first result
+	c.addPending("a", &pendingCall{})
+	assert.True(t, c.resultPending("a"), "a first result")
+	assert.False(t, c.resultPending("a"), "a second result")
+
+	// broadcast call with a quorum
+	c.addPending("b", &pendingCall{broadcast: true, want: 2})
+	c.setPendingCallees("b", 3)
+	assert.True(t, c.resultPending("b"), "b first result")
+	assert.True(t, c.resultPending("b"), "b second result")
+	assert.False(t, c.resultPending("b"), "b third result")
+
+	// broadcast call waiting for all callees
+	c.addPending("c", &pendingCall{broadcast: true})
+	assert.True(t, c.resultPending("c"), "c first result")
+	c.setPendingCallees("c", 2)
+	assert.True(t, c.resultPending("c"), "c second result")
+	assert.False(t, c.resultPending("c"), "c third result")
+
+	// broadcast call that received all results before the ACK
+	c.addPending("d", &pendingCall{broadcast: true})
+	assert.True(t, c.resultPending("d"), "d first result")
+	c.setPendingCallees("d", 1)
+	assert.False(t, c.deletePending("d"), "d no longer pending")
+}
+
+func TestErr(t *testing.T) {
+	call, err := message.NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+
+	nack := message.NewNack(call, 503, &message.Error{Code: 503, Message: "busy", Retryable: true})
+	err = Err(nack)
+	assert.Equal(t, &message.Error{Code: 503, Message: "busy", Retryable: true}, err, "NACK error")
+	assert.True(t, IsRetryable(err), "NACK is retryable")
+
+	res := message.NewRes(&message.ResPayload{MsgUUID: call.UUID(), Args: json.RawMessage(`{"error":{"code":400,"message":"invalid"}}`)})
+	err = Err(res)
+	assert.Equal(t, &message.Error{Code: 400, Message: "invalid"}, err, "RES error")
+	assert.False(t, IsRetryable(err), "RES is not retryable")
+
+	res = message.NewRes(&message.ResPayload{MsgUUID: call.UUID(), Args: json.RawMessage(`"ok"`)})
+	assert.Nil(t, Err(res), "RES success")
+	assert.Nil(t, Err(message.NewAck(call)), "ACK")
+	assert.False(t, IsRetryable(io.EOF), "io.EOF")
+}
+
+func TestClientBatch(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		_, r, err := c.NextReader()
+		if err != nil {
+			return
+		}
+		m, err := message.UnmarshalRequest(r)
+		if !assert.NoError(t, err, "UnmarshalRequest") {
+			return
+		}
+
+		btch := m.(*message.Btch)
+		reqs, err := btch.Requests(message.JSONCodec)
+		if !assert.NoError(t, err, "Requests") || !assert.Equal(t, 2, len(reqs), "number of requests") {
+			return
+		}
+		back, err := message.NewBack(message.JSONCodec, btch,
+			message.NewNack(reqs[0], 500, io.EOF), message.NewAck(reqs[1]))
+		if !assert.NoError(t, err, "NewBack") {
+			return
+		}
+		assert.NoError(t, c.WriteJSON(back), "WriteJSON BACK")
+		// wait for the client to close the connection
+		c.ReadMessage()
+	})
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	recv := make(map[string]message.Type)
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {
+		defer wg.Done()
+
+		var forUUID string
+		switch m := m.(type) {
+		case *message.Ack:
+			forUUID = m.Payload.For.String()
+		case *message.Nack:
+			forUUID = m.Payload.For.String()
+		case *Exp:
+			forUUID = m.Payload.For.String()
+		default:
+			t.Errorf("unexpected message type: %T", m)
+			return
+		}
+		mu.Lock()
+		recv[forUUID] = m.Type()
+		mu.Unlock()
+	})
+
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h))
+	require.NoError(t, err, "Dial")
+
+	b := cli.NewBatch()
+	_, err = b.Send()
+	assert.Error(t, err, "empty batch")
+
+	callUUID, err := b.Call("a", 1, 10*time.Millisecond)
+	require.NoError(t, err, "Call")
+	subUUID := b.Sub("b", false)
+
+	wg.Add(2)
+	_, err = b.Send()
+	require.NoError(t, err, "Send")
+	wg.Wait()
+
+	// the NACKed call does not expire
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, cli.Close(), "Close")
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]message.Type{
+		callUUID.String(): message.NackMsg,
+		subUUID.String():  message.AckMsg,
+	}, recv, "received messages")
+}
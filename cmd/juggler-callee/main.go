@@ -11,9 +11,10 @@ import (
 	"encoding/json"
 	"expvar"
 	"flag"
-	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,22 +22,33 @@ import (
 	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/broker/redisbroker"
 	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/mna/redisc"
 )
 
 var (
-	brokerBlockingTimeoutFlag = flag.Duration("broker-blocking-timeout", 0, "Blocking `timeout` when polling for call requests.")
-	brokerResultCapFlag       = flag.Int("broker-result-cap", 0, "Capacity of the `results` queue.")
-	helpFlag                  = flag.Bool("help", false, "Show help.")
-	numDelayURIsFlag          = flag.Int("n", 0, "Number of test.delay `URIs`.")
-	httpServerPortFlag        = flag.Int("port", 9001, "HTTP server `port` to serve debug endpoints.")
-	redisAddrFlag             = flag.String("redis", ":6379", "Redis `address`.")
-	redisClusterFlag          = flag.Bool("redis-cluster", false, "Use redis cluster.")
-	redisPoolIdleTimeoutFlag  = flag.Duration("redis-idle-timeout", 0, "Redis idle connection `timeout`.")
-	redisPoolMaxActiveFlag    = flag.Int("redis-max-active", 0, "Maximum active redis `connections`.")
-	redisPoolMaxIdleFlag      = flag.Int("redis-max-idle", 0, "Maximum idle redis `connections`.")
-	workersFlag               = flag.Int("workers", 1, "Number of concurrent `workers` processing call requests.")
+	brokerBinaryPayloadsFlag    = flag.Bool("broker-binary-payloads", false, "Store the results using the binary payload codec.")
+	brokerBlockingTimeoutFlag   = flag.Duration("broker-blocking-timeout", 0, "Blocking `timeout` when polling for call requests.")
+	brokerBroadcastCallsFlag    = flag.Bool("broker-broadcast-calls", false, "Listen for broadcast call requests.")
+	brokerPriorityLevelsFlag    = flag.Int("broker-priority-levels", 0, "Number of priority `levels` of call requests.")
+	brokerReconnectAttemptsFlag = flag.Int("broker-reconnect-attempts", 0, "Maximum `attempts` to reconnect the polling connection on failure (-1 for no limit).")
+	brokerResultCapFlag         = flag.Int("broker-result-cap", 0, "Capacity of the `results` queue.")
+	registryTTLFlag             = flag.Duration("registry-ttl", 0, "Time-to-live of the `registration` of the URIs in the service registry.")
+	helpFlag                    = flag.Bool("help", false, "Show help.")
+	logJSONFlag                 = flag.Bool("log-json", false, "Write the logs as JSON objects.")
+	logLevelFlag                = flag.String("log-level", "info", "Minimum `level` of the logs (debug, info, warn or error).")
+	numDelayURIsFlag            = flag.Int("n", 0, "Number of test.delay `URIs`.")
+	httpServerPortFlag          = flag.Int("port", 9001, "HTTP server `port` to serve debug endpoints.")
+	redisAddrFlag               = flag.String("redis", ":6379", "Redis `address`.")
+	redisClusterFlag            = flag.Bool("redis-cluster", false, "Use redis cluster.")
+	redisPoolIdleTimeoutFlag    = flag.Duration("redis-idle-timeout", 0, "Redis idle connection `timeout`.")
+	redisPoolMaxActiveFlag      = flag.Int("redis-max-active", 0, "Maximum active redis `connections`.")
+	redisPoolMaxIdleFlag        = flag.Int("redis-max-idle", 0, "Maximum idle redis `connections`.")
+	redisSentinelFlag           = flag.String("redis-sentinel", "", "Comma-separated redis sentinel `addresses`, the redis address is ignored if set.")
+	redisSentinelMasterFlag     = flag.String("redis-sentinel-master", "mymaster", "Name of the redis `master` monitored by the sentinels.")
+	workersFlag                 = flag.Int("workers", 1, "Number of concurrent `workers` processing call requests.")
 )
 
 var uris = map[string]callee.Thunk{
@@ -55,6 +67,8 @@ func main() {
 		*workersFlag = 1
 	}
 
+	logger := newLogger()
+
 	for i := 0; i < *numDelayURIsFlag; i++ {
 		uris["test.delay."+strconv.Itoa(i)] = delayThunk
 	}
@@ -62,27 +76,44 @@ func main() {
 	var pool redisbroker.Pool
 	var dial func() (redis.Conn, error)
 
-	if *redisClusterFlag {
+	switch {
+	case *redisSentinelFlag != "":
+		sentinel, err := newRedisSentinel(strings.Split(*redisSentinelFlag, ","), *redisSentinelMasterFlag)
+		if err != nil {
+			fatal(logger, "failed to connect to redis sentinel", err)
+		}
+		pool, dial = sentinel, sentinel.Dial
+	case *redisClusterFlag:
 		cluster, err := newRedisCluster(*redisAddrFlag)
 		if err != nil {
-			log.Fatalf("failed to connect to redis cluster: %v", err)
+			fatal(logger, "failed to connect to redis cluster", err)
 		}
 		pool, dial = cluster, cluster.Dial
-	} else {
+	default:
 		p, _ := newRedisPool(*redisAddrFlag)
 		pool, dial = p, p.Dial
 	}
 
-	vars := expvar.NewMap("callee")
-	c := &callee.Callee{Broker: newBroker(pool, dial, vars)}
+	// collect the metrics in expvar and for Prometheus
+	prom := &metrics.Prometheus{Namespace: "juggler_callee"}
+	mt := metrics.Multi(metrics.NewExpvar(expvar.NewMap("callee")), prom)
+	http.Handle("/metrics", prom)
 
-	// start a web server to serve pprof and expvar data
-	log.Printf("serving debug endpoints on %d", *httpServerPortFlag)
+	c := &callee.Callee{
+		Broker:      newBroker(pool, dial, mt, logger),
+		RegistryTTL: *registryTTLFlag,
+		Metrics:     mt,
+		Logger:      logger,
+	}
+
+	// start a web server to serve pprof, expvar and Prometheus data
+	logger.Log(logging.Info, "serving debug endpoints", logging.F("port", *httpServerPortFlag))
 	go func() {
-		log.Println(http.ListenAndServe(":"+strconv.Itoa(*httpServerPortFlag), nil))
+		err := http.ListenAndServe(":"+strconv.Itoa(*httpServerPortFlag), nil)
+		logger.Log(logging.Error, "debug server failed", logging.Err(err))
 	}()
 
-	log.Printf("listening for call requests on %s with %d workers", *redisAddrFlag, *workersFlag)
+	logger.Log(logging.Info, "listening for call requests", logging.F("redis", *redisAddrFlag), logging.F("workers", *workersFlag))
 	keys := make([]string, 0, len(uris))
 	for k := range uris {
 		keys = append(keys, k)
@@ -99,10 +130,14 @@ func main() {
 	for _, keys := range keysPerSlot {
 		cc, err := c.Broker.NewCallsConn(keys...)
 		if err != nil {
-			log.Fatalf("Calls failed: %v", err)
+			fatal(logger, "Calls failed", err)
 		}
 		defer cc.Close()
 
+		// registration errors are logged by the callee
+		unregister, _ := c.Register(keys...)
+		defer unregister()
+
 		wg.Add(*workersFlag)
 		for i := 0; i < *workersFlag; i++ {
 			go func() {
@@ -110,25 +145,13 @@ func main() {
 
 				ch := cc.Calls()
 				for cp := range ch {
-					log.Printf("received request %v %s", cp.MsgUUID, cp.URI)
-					vars.Add("Requests", 1)
-					vars.Add("Requests."+cp.URI, 1)
+					logger.Log(logging.Debug, "received request", logging.MsgUUID(cp.MsgUUID), logging.URI(cp.URI))
 
+					// failed and expired requests are logged by the callee
 					if err := c.InvokeAndStoreResult(cp, uris[cp.URI]); err != nil {
-						if err != callee.ErrCallExpired {
-							log.Printf("InvokeAndStoreResult failed: %v", err)
-							vars.Add("Failed", 1)
-							vars.Add("Failed."+cp.URI, 1)
-							continue
-						}
-						log.Printf("expired request %v %s", cp.MsgUUID, cp.URI)
-						vars.Add("Expired", 1)
-						vars.Add("Expired."+cp.URI, 1)
 						continue
 					}
-					log.Printf("sent result %v %s", cp.MsgUUID, cp.URI)
-					vars.Add("Succeeded", 1)
-					vars.Add("Succeded."+cp.URI, 1)
+					logger.Log(logging.Debug, "sent result", logging.MsgUUID(cp.MsgUUID), logging.URI(cp.URI))
 				}
 			}()
 		}
@@ -136,11 +159,27 @@ func main() {
 	wg.Wait()
 }
 
-func logWrapThunk(t callee.Thunk) callee.Thunk {
+func newLogger() logging.Logger {
+	level, err := logging.ParseLevel(*logLevelFlag)
+	if err != nil {
+		fatal(&logging.Std{}, "invalid log level", err)
+	}
+	if *logJSONFlag {
+		return &logging.JSON{Level: level}
+	}
+	return &logging.Std{Level: level}
+}
+
+func fatal(l logging.Logger, msg string, err error) {
+	l.Log(logging.Error, msg, logging.Err(err))
+	os.Exit(1)
+}
+
+func logWrapThunk(l logging.Logger, t callee.Thunk) callee.Thunk {
 	return func(cp *message.CallPayload) (interface{}, error) {
-		log.Printf("received call for %s from %v", cp.URI, cp.MsgUUID)
+		l.Log(logging.Debug, "received call", logging.MsgUUID(cp.MsgUUID), logging.URI(cp.URI))
 		v, err := t(cp)
-		log.Printf("sending result for %s from %v", cp.URI, cp.MsgUUID)
+		l.Log(logging.Debug, "sending result", logging.MsgUUID(cp.MsgUUID), logging.URI(cp.URI))
 		return v, err
 	}
 }
@@ -190,14 +229,33 @@ func echo(s string) string {
 	return s
 }
 
-func newBroker(pool redisbroker.Pool, dial func() (redis.Conn, error), vars *expvar.Map) broker.CalleeBroker {
+func newBroker(pool redisbroker.Pool, dial func() (redis.Conn, error), mt metrics.Metrics, l logging.Logger) broker.CalleeBroker {
+	var codec broker.PayloadCodec
+	if *brokerBinaryPayloadsFlag {
+		codec = broker.BinaryPayloadCodec
+	}
 	return &redisbroker.Broker{
-		Pool:            pool,
-		Dial:            dial,
-		BlockingTimeout: *brokerBlockingTimeoutFlag,
-		ResultCap:       *brokerResultCapFlag,
-		Vars:            vars,
+		Pool:              pool,
+		Dial:              dial,
+		BlockingTimeout:   *brokerBlockingTimeoutFlag,
+		BroadcastCalls:    *brokerBroadcastCallsFlag,
+		PriorityLevels:    *brokerPriorityLevelsFlag,
+		ReconnectAttempts: *brokerReconnectAttemptsFlag,
+		ResultCap:         *brokerResultCapFlag,
+		PayloadCodec:      codec,
+		Metrics:           mt,
+		Logger:            l,
+	}
+}
+
+func newRedisSentinel(addrs []string, master string) (*redisbroker.Sentinel, error) {
+	s := &redisbroker.Sentinel{
+		Addrs:      addrs,
+		MasterName: master,
+		CreatePool: newRedisPool,
 	}
+	err := s.Refresh()
+	return s, err
 }
 
 func newRedisCluster(addr string) (*redisc.Cluster, error) {
@@ -29,6 +29,7 @@ import (
 
 var (
 	addrFlag        = flag.String("addr", "ws://localhost:9000/ws", "Server `address`.")
+	compressFlag    = flag.Int("compress", -1, "Enable compression of messages larger than this `threshold` in bytes (-1 to disable).")
 	connFlag        = flag.Int("c", 100, "Number of `connections`.")
 	durationFlag    = flag.Duration("d", 10*time.Second, "Run `duration`.")
 	delayFlag       = flag.Duration("delay", 0, "Start execution after `delay`.")
@@ -45,11 +46,12 @@ var (
 
 var (
 	fnMap = template.FuncMap{
-		"subi": subiFn,
-		"subd": subdFn,
-		"subf": subfFn,
-		"avg":  avgFn,
-		"pctl": pctlFn,
+		"subi":  subiFn,
+		"subd":  subdFn,
+		"subf":  subfFn,
+		"avg":   avgFn,
+		"pctl":  pctlFn,
+		"ratio": ratioFn,
 	}
 
 	tpl = template.Must(template.New("output").Funcs(fnMap).Parse(`
@@ -59,6 +61,7 @@ Address:    {{ .Run.Addr }}
 Protocol:   {{ .Run.Protocol }}
 URI:        {{ .Run.URI }} x {{.Run.NURIs}}
 Payload:    {{ .Run.Payload }}
+Compress:   {{ if lt .Run.Compress 0 }}disabled{{ else }}>= {{ .Run.Compress }} bytes{{ end }}
 
 Connections: {{ .Run.Conns }}
 Rate:        {{ .Run.Rate | printf "%s" }}
@@ -118,6 +121,9 @@ SlowProcessMsgNACK: {{.Before.Juggler.SlowProcessMsgNACK | printf "%-15d"}} {{.A
 SlowProcessMsgRES:  {{.Before.Juggler.SlowProcessMsgRES | printf "%-15d"}} {{.After.Juggler.SlowProcessMsgRES | printf "%-15d"}} {{subi .After.Juggler.SlowProcessMsgRES .Before.Juggler.SlowProcessMsgRES }}
 TotalConnGoros:     {{.Before.Juggler.TotalConnGoros | printf "%-15d"}} {{.After.Juggler.TotalConnGoros | printf "%-15d"}} {{subi .After.Juggler.TotalConnGoros .Before.Juggler.TotalConnGoros }}
 TotalConns:         {{.Before.Juggler.TotalConns | printf "%-15d"}} {{.After.Juggler.TotalConns | printf "%-15d"}} {{subi .After.Juggler.TotalConns .Before.Juggler.TotalConns }}
+MsgBytesWritten:    {{.Before.Juggler.MsgBytesWritten | printf "%-15v"}} {{.After.Juggler.MsgBytesWritten | printf "%-15v"}} {{subf .After.Juggler.MsgBytesWritten .Before.Juggler.MsgBytesWritten | printf "%v" }}
+NetBytesWritten:    {{.Before.Juggler.NetBytesWritten | printf "%-15v"}} {{.After.Juggler.NetBytesWritten | printf "%-15v"}} {{subf .After.Juggler.NetBytesWritten .Before.Juggler.NetBytesWritten | printf "%v" }}
+Compression ratio:  {{ ratio (subf .After.Juggler.NetBytesWritten .Before.Juggler.NetBytesWritten) (subf .After.Juggler.MsgBytesWritten .Before.Juggler.MsgBytesWritten) | printf "%.2f" }}
 
 `))
 )
@@ -134,6 +140,13 @@ func subfFn(a, b byteSize) byteSize {
 	return a - b
 }
 
+func ratioFn(a, b byteSize) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a / b)
+}
+
 func avgFn(durs []time.Duration) time.Duration {
 	var sum time.Duration
 
@@ -251,6 +264,7 @@ type runStats struct {
 	URI      string
 	NURIs    int
 	Payload  string
+	Compress int
 
 	Conns          int
 	Rate           time.Duration
@@ -284,6 +298,8 @@ type expVars struct {
 		TotalConnGoros     int
 		TotalConns         int
 		MsgsWrite          int
+		MsgBytesWritten    byteSize
+		NetBytesWritten    byteSize
 	}
 
 	Memstats struct {
@@ -322,6 +338,7 @@ func main() {
 		URI:      *uriFlag,
 		NURIs:    *numURIsFlag,
 		Payload:  *payloadFlag,
+		Compress: *compressFlag,
 		Conns:    *connFlag,
 		Rate:     *callRateFlag,
 		Timeout:  *callTimeoutFlag,
@@ -408,6 +425,16 @@ func getExpVars(u *url.URL) *expVars {
 	return &ev
 }
 
+// compressThreshold returns the client's compression threshold for
+// the -compress flag value n.
+func compressThreshold(n int) int {
+	if n == 0 {
+		// compress all messages, 0 is the default threshold for the client
+		return 1
+	}
+	return n
+}
+
 func getURI(stats *runStats) string {
 	uri := stats.URI
 	if stats.NURIs > 0 {
@@ -432,8 +459,9 @@ func runClient(stats *runStats, started chan<- struct{}, stop <-chan struct{}, r
 	}
 
 	cli, err := client.Dial(
-		&websocket.Dialer{Subprotocols: []string{stats.Protocol}},
+		&websocket.Dialer{Subprotocols: []string{stats.Protocol}, EnableCompression: stats.Compress >= 0},
 		stats.Addr, nil,
+		client.SetCompressionThreshold(compressThreshold(stats.Compress)),
 		client.SetHandler(client.HandlerFunc(func(ctx context.Context, m message.Msg) {
 			switch m.Type() {
 			case message.ResMsg:
@@ -15,18 +15,62 @@ import (
 
 // Redis defines the redis-specific configuration options.
 type Redis struct {
-	Addr        string        `yaml:"addr"`
-	MaxActive   int           `yaml:"max_active"`
-	MaxIdle     int           `yaml:"max_idle"`
-	IdleTimeout time.Duration `yaml:"idle_timeout"`
-	PubSub      *Redis        `yaml:"pubsub"`
-	Caller      *Redis        `yaml:"caller"`
+	Addr         string         `yaml:"addr"`
+	Cluster      bool           `yaml:"cluster"`
+	MaxActive    int            `yaml:"max_active"`
+	MaxIdle      int            `yaml:"max_idle"`
+	IdleTimeout  time.Duration  `yaml:"idle_timeout"`
+	Username     string         `yaml:"username"`
+	Password     string         `yaml:"password"`
+	DB           int            `yaml:"db"`
+	TLS          *RedisTLS      `yaml:"tls"`
+	DialTimeout  time.Duration  `yaml:"dial_timeout"`
+	ReadTimeout  time.Duration  `yaml:"read_timeout"`
+	WriteTimeout time.Duration  `yaml:"write_timeout"`
+	Sentinel     *RedisSentinel `yaml:"sentinel"`
+	PubSub       *Redis         `yaml:"pubsub"`
+	Caller       *Redis         `yaml:"caller"`
+}
+
+// RedisTLS defines the configuration options to connect to redis
+// using TLS.
+type RedisTLS struct {
+	CA         string `yaml:"ca"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	SkipVerify bool   `yaml:"skip_verify"`
+}
+
+// RedisSentinel defines the configuration options to connect to
+// redis via Sentinel. If set, the redis address is ignored and the
+// master is discovered using the sentinels. The TLS and timeout
+// options of the redis section also apply to the connections to
+// the sentinels.
+type RedisSentinel struct {
+	Addrs      []string `yaml:"addrs"`
+	MasterName string   `yaml:"master_name"`
+	Password   string   `yaml:"password"`
 }
 
 // CallerBroker defines the configuration options for the caller broker.
 type CallerBroker struct {
-	BlockingTimeout time.Duration `yaml:"blocking_timeout"`
-	CallCap         int           `yaml:"call_cap"`
+	BlockingTimeout     time.Duration            `yaml:"blocking_timeout"`
+	CallCap             int                      `yaml:"call_cap"`
+	PriorityLevels      int                      `yaml:"priority_levels"`
+	ResultCacheTTL      map[string]time.Duration `yaml:"result_cache_ttl"`
+	BinaryPayloads      bool                     `yaml:"binary_payloads"`
+	ReconnectAttempts   int                      `yaml:"reconnect_attempts"`
+	ReconnectBackoff    time.Duration            `yaml:"reconnect_backoff"`
+	MaxReconnectBackoff time.Duration            `yaml:"max_reconnect_backoff"`
+}
+
+// PubSubBroker defines the configuration options for the pub-sub broker.
+type PubSubBroker struct {
+	ReconnectAttempts   int           `yaml:"reconnect_attempts"`
+	ReconnectBackoff    time.Duration `yaml:"reconnect_backoff"`
+	MaxReconnectBackoff time.Duration `yaml:"max_reconnect_backoff"`
+	NotifyGaps          bool          `yaml:"notify_gaps"`
+	BinaryPayloads      bool          `yaml:"binary_payloads"`
 }
 
 // Server defines the juggler server configuration options.
@@ -39,6 +83,8 @@ type Server struct {
 	WriteBufferSize    int           `yaml:"write_buffer_size"`
 	HandshakeTimeout   time.Duration `yaml:"handshake_timeout"`
 	WhitelistedOrigins []string      `yaml:"whitelisted_origins"`
+	EnableCompression  bool          `yaml:"enable_compression"`
+	MetricsPath        string        `yaml:"metrics_path"` // Prometheus metrics, disabled if empty
 
 	// websocket/juggler configuration
 	ReadLimit               int64         `yaml:"read_limit"`
@@ -46,18 +92,29 @@ type Server struct {
 	WriteLimit              int64         `yaml:"write_limit"`
 	WriteTimeout            time.Duration `yaml:"write_timeout"`
 	AcquireWriteLockTimeout time.Duration `yaml:"acquire_write_lock_timeout"`
+	HeadersLimit            int           `yaml:"headers_limit"`
+	CompressionThreshold    int           `yaml:"compression_threshold"`
 	AllowEmptySubprotocol   bool          `yaml:"allow_empty_subprotocol"`
+	CheckServices           bool          `yaml:"check_services"`
+	SessionGracePeriod      time.Duration `yaml:"session_grace_period"`
 
 	// handler options
 	CloseURI                string        `yaml:"close_uri"`
 	PanicURI                string        `yaml:"panic_uri"`
 	SlowProcessMsgThreshold time.Duration `yaml:"slow_process_msg_threshold"`
+	MaxCallPriority         int           `yaml:"max_call_priority"`
+	CircuitBreaker          bool          `yaml:"circuit_breaker"`
+
+	// logging options
+	LogLevel  string `yaml:"log_level"`  // debug, info (default), warn or error
+	LogFormat string `yaml:"log_format"` // text (default) or json
 }
 
 // Config defines the configuration options of the server.
 type Config struct {
 	Redis        *Redis        `yaml:"redis"`
 	CallerBroker *CallerBroker `yaml:"caller_broker"`
+	PubSubBroker *PubSubBroker `yaml:"pubsub_broker"`
 	Server       *Server       `yaml:"server"`
 }
 
@@ -70,8 +127,13 @@ func getDefaultConfig() *Config {
 			IdleTimeout: 0,
 		},
 		CallerBroker: &CallerBroker{
-			BlockingTimeout: 0,
-			CallCap:         0,
+			BlockingTimeout:   0,
+			CallCap:           0,
+			ReconnectAttempts: 0,
+		},
+		PubSubBroker: &PubSubBroker{
+			ReconnectAttempts: 0,
+			NotifyGaps:        false,
 		},
 		Server: &Server{
 			Addr:                    ":" + strconv.Itoa(*portFlag),
@@ -136,9 +198,15 @@ func isZeroRedis(rc *Redis) bool {
 // for pubsub and caller, or use Config.Redis.PubSub and Config.Redis.Caller.
 // No other combination is accepted.
 func checkRedisConfig(conf *Redis) error {
+	for _, rc := range []*Redis{conf, conf.PubSub, conf.Caller} {
+		if rc != nil && rc.Cluster && rc.Sentinel != nil {
+			return errors.New("redis cluster and sentinel cannot be configured together")
+		}
+	}
+
 	// if either PubSub or Caller is set, then both must be set
 	if !isZeroRedis(conf.PubSub) || !isZeroRedis(conf.Caller) {
-		if (conf.PubSub == nil || conf.PubSub.Addr == "") || (conf.Caller == nil || conf.Caller.Addr == "") {
+		if !hasRedisAddr(conf.PubSub) || !hasRedisAddr(conf.Caller) {
 			return errors.New("both redis.pubsub and redis.caller sections must be configured")
 		}
 
@@ -152,3 +220,12 @@ func checkRedisConfig(conf *Redis) error {
 	}
 	return nil
 }
+
+// hasRedisAddr returns true if rc has an address or a sentinel
+// configuration to connect to redis.
+func hasRedisAddr(rc *Redis) bool {
+	if rc == nil {
+		return false
+	}
+	return rc.Addr != "" || (rc.Sentinel != nil && len(rc.Sentinel.Addrs) > 0)
+}
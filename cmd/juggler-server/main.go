@@ -8,7 +8,6 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -22,7 +21,9 @@ import (
 	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/broker/redisbroker"
 	"github.com/mna/juggler/internal/srvhandler"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/mna/redisc"
 )
 
@@ -51,42 +52,34 @@ func main() {
 		os.Exit(1)
 	}
 
-	// TODO : support redis-cluster via the config file
-
 	if err := checkRedisConfig(conf.Redis); err != nil {
 		fmt.Fprintf(os.Stderr, "invalid redis configuration: %v\n", err)
 		flag.Usage()
 		os.Exit(3)
 	}
 
-	logFn := log.Printf
-	if *noLogFlag {
-		logFn = func(_ string, _ ...interface{}) {}
+	logger, err := newLogger(conf.Server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid logging configuration: %v\n", err)
+		flag.Usage()
+		os.Exit(5)
 	}
 
 	// create pool, brokers, server, upgrader, HTTP server
 	var poolp, poolc redisbroker.Pool
 	var dialp, dialc func() (redis.Conn, error)
 
-	if conf.Redis.Addr != "" {
-		createPoolFn := redisPoolCreateFunc(conf.Redis)
+	if hasRedisAddr(conf.Redis) {
 		if *redisClusterFlag {
-			cluster, err := newRedisCluster(conf.Redis.Addr, createPoolFn)
-			if err != nil {
-				log.Fatalf("failed to connect to redis cluster: %v", err)
-			}
-			poolp, poolc = cluster, cluster
-			dialp, dialc = cluster.Dial, cluster.Dial
-			logFn("redis cluster configured on %s", conf.Redis.Addr)
-		} else {
-			pool, err := createPoolFn(conf.Redis.Addr)
-			if err != nil {
-				log.Fatalf("failed to connect to redis pool: %v", err)
-			}
-			poolp, poolc = pool, pool
-			dialp, dialc = pool.Dial, pool.Dial
-			logFn("redis pool configured on %s", conf.Redis.Addr)
+			conf.Redis.Cluster = true
+		}
+		pool, dial, desc, err := newRedisPoolAndDial(conf.Redis)
+		if err != nil {
+			fatal(logger, "failed to connect to "+desc, err)
 		}
+		poolp, poolc = pool, pool
+		dialp, dialc = dial, dial
+		logger.Log(logging.Info, "redis configured", logging.F("redis", desc))
 	} else {
 		if *redisClusterFlag {
 			fmt.Fprintln(os.Stderr, "cannot use redis cluster with different pubsub and caller configuration.")
@@ -94,26 +87,35 @@ func main() {
 			os.Exit(4)
 		}
 
-		pp, err1 := redisPoolCreateFunc(conf.Redis.PubSub)(conf.Redis.PubSub.Addr)
-		pc, err2 := redisPoolCreateFunc(conf.Redis.Caller)(conf.Redis.Caller.Addr)
+		pp, dp, descp, err1 := newRedisPoolAndDial(conf.Redis.PubSub)
+		pc, dc, descc, err2 := newRedisPoolAndDial(conf.Redis.Caller)
 		if err1 != nil || err2 != nil {
-			err := err1
+			err, desc := err1, descp
 			if err1 == nil {
-				err = err2
+				err, desc = err2, descc
 			}
-			log.Fatalf("failed to connect to redis pool: %v", err)
+			fatal(logger, "failed to connect to "+desc, err)
 		}
 		poolp, poolc = pp, pc
-		dialp, dialc = pp.Dial, pc.Dial
-		logFn("redis pool configured on %s (pubsub) and %s (caller)", conf.Redis.PubSub.Addr, conf.Redis.Caller.Addr)
+		dialp, dialc = dp, dc
+		logger.Log(logging.Info, "redis configured", logging.F("pubsub_redis", descp), logging.F("caller_redis", descc))
 	}
 
-	psb := newPubSubBroker(poolp, dialp, logFn)
-	cb := newCallerBroker(conf.CallerBroker, poolc, dialc, logFn)
+	// collect the metrics in expvar, and for Prometheus if enabled
+	vars := expvar.NewMap("juggler")
+	mt := metrics.Metrics(metrics.NewExpvar(vars))
+	if p := conf.Server.MetricsPath; p != "" {
+		prom := &metrics.Prometheus{Namespace: "juggler"}
+		mt = metrics.Multi(mt, prom)
+		http.Handle(p, prom)
+	}
 
-	srv := newServer(conf.Server, psb, cb, logFn)
-	srv.Handler = newHandler(conf.Server, logFn)
-	srv.Vars = expvar.NewMap("juggler")
+	psb := newPubSubBroker(conf.PubSubBroker, poolp, dialp, mt, logger)
+	cb := newCallerBroker(conf.CallerBroker, poolc, dialc, mt, logger)
+
+	srv := newServer(conf.Server, psb, cb, logger)
+	srv.Metrics = mt
+	srv.Handler = newHandler(conf.Server, mt, logger)
 	juggler.SlowProcessMsgThreshold = conf.Server.SlowProcessMsgThreshold
 
 	upg := newUpgrader(conf.Server) // must be after newServer, for Subprotocols
@@ -125,13 +127,45 @@ func main() {
 
 	httpSrv := newHTTPServer(conf.Server)
 
-	logFn("listening for connections on %s", conf.Server.Addr)
+	logger.Log(logging.Info, "listening for connections", logging.F("addr", conf.Server.Addr))
 	if err := httpSrv.ListenAndServe(); err != nil {
-		log.Fatalf("ListenAndServe failed: %v", err)
+		fatal(logger, "ListenAndServe failed", err)
+	}
+}
+
+// newLogger returns the logger configured in conf, or a logger that
+// discards all messages if logging is disabled.
+func newLogger(conf *Server) (logging.Logger, error) {
+	if *noLogFlag {
+		return logging.Discard, nil
+	}
+
+	var level logging.Level
+	if conf.LogLevel != "" {
+		l, err := logging.ParseLevel(conf.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		level = l
 	}
+
+	switch conf.LogFormat {
+	case "", "text":
+		return &logging.Std{Level: level}, nil
+	case "json":
+		return &logging.JSON{Level: level}, nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", conf.LogFormat)
+	}
+}
+
+// fatal logs the error err with msg and exits the process.
+func fatal(l logging.Logger, msg string, err error) {
+	l.Log(logging.Error, msg, logging.Err(err))
+	os.Exit(1)
 }
 
-func newHandler(conf *Server, logFn func(string, ...interface{})) juggler.Handler {
+func newHandler(conf *Server, mt metrics.Metrics, logger logging.Logger) juggler.Handler {
 	closeURI := conf.CloseURI
 	panicURI := conf.PanicURI
 	writeTimeout := conf.WriteTimeout
@@ -151,7 +185,7 @@ func newHandler(conf *Server, logFn func(string, ...interface{})) juggler.Handle
 					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"),
 					deadline); err != nil {
 
-					logFn("WriteControl failed: %v", err)
+					c.Log(logging.Warn, "WriteControl failed", logging.Err(err))
 				}
 				return
 
@@ -163,28 +197,56 @@ func newHandler(conf *Server, logFn func(string, ...interface{})) juggler.Handle
 	})
 
 	chain := []juggler.Handler{process}
+	if conf.CircuitBreaker {
+		chain = []juggler.Handler{&juggler.CircuitBreaker{Handler: process, Metrics: mt}}
+	}
+	if conf.MaxCallPriority > 0 {
+		chain = append([]juggler.Handler{srvhandler.ClampPriority(0, conf.MaxCallPriority)}, chain...)
+	}
 	if !*noLogFlag {
-		chain = append([]juggler.Handler{srvhandler.LogMsg(logFn)}, chain...)
+		chain = append([]juggler.Handler{srvhandler.LogMsg(logger)}, chain...)
 	}
-	return srvhandler.PanicRecover(srvhandler.Chain(chain...), nil)
+	return srvhandler.PanicRecover(srvhandler.Chain(chain...), mt)
 }
 
-func newPubSubBroker(pool redisbroker.Pool, dial func() (redis.Conn, error), logFn func(string, ...interface{})) broker.PubSubBroker {
+func newPubSubBroker(conf *PubSubBroker, pool redisbroker.Pool, dial func() (redis.Conn, error), mt metrics.Metrics, logger logging.Logger) broker.PubSubBroker {
 	return &redisbroker.Broker{
-		Pool:    pool,
-		Dial:    dial,
-		LogFunc: logFn,
+		Pool:                pool,
+		Dial:                dial,
+		ReconnectAttempts:   conf.ReconnectAttempts,
+		ReconnectBackoff:    conf.ReconnectBackoff,
+		MaxReconnectBackoff: conf.MaxReconnectBackoff,
+		NotifyPubSubGaps:    conf.NotifyGaps,
+		PayloadCodec:        payloadCodec(conf.BinaryPayloads),
+		Metrics:             mt,
+		Logger:              logger,
 	}
 }
 
-func newCallerBroker(conf *CallerBroker, pool redisbroker.Pool, dial func() (redis.Conn, error), logFn func(string, ...interface{})) broker.CallerBroker {
+func newCallerBroker(conf *CallerBroker, pool redisbroker.Pool, dial func() (redis.Conn, error), mt metrics.Metrics, logger logging.Logger) broker.CallerBroker {
 	return &redisbroker.Broker{
-		Pool:            pool,
-		Dial:            dial,
-		BlockingTimeout: conf.BlockingTimeout,
-		CallCap:         conf.CallCap,
-		LogFunc:         logFn,
+		Pool:                pool,
+		Dial:                dial,
+		BlockingTimeout:     conf.BlockingTimeout,
+		CallCap:             conf.CallCap,
+		PriorityLevels:      conf.PriorityLevels,
+		ResultCacheTTL:      conf.ResultCacheTTL,
+		PayloadCodec:        payloadCodec(conf.BinaryPayloads),
+		ReconnectAttempts:   conf.ReconnectAttempts,
+		ReconnectBackoff:    conf.ReconnectBackoff,
+		MaxReconnectBackoff: conf.MaxReconnectBackoff,
+		Metrics:             mt,
+		Logger:              logger,
+	}
+}
+
+// payloadCodec returns the codec of the broker payloads, the binary
+// one if binary is true, the default otherwise.
+func payloadCodec(binary bool) broker.PayloadCodec {
+	if binary {
+		return broker.BinaryPayloadCodec
 	}
+	return nil
 }
 
 func isIn(list []string, v string) bool {
@@ -198,10 +260,11 @@ func isIn(list []string, v string) bool {
 
 func newUpgrader(conf *Server) *websocket.Upgrader {
 	upg := &websocket.Upgrader{
-		HandshakeTimeout: conf.HandshakeTimeout,
-		ReadBufferSize:   conf.ReadBufferSize,
-		WriteBufferSize:  conf.WriteBufferSize,
-		Subprotocols:     juggler.Subprotocols,
+		HandshakeTimeout:  conf.HandshakeTimeout,
+		ReadBufferSize:    conf.ReadBufferSize,
+		WriteBufferSize:   conf.WriteBufferSize,
+		Subprotocols:      juggler.Subprotocols,
+		EnableCompression: conf.EnableCompression,
 	}
 
 	if len(conf.WhitelistedOrigins) > 0 {
@@ -223,12 +286,12 @@ func newHTTPServer(conf *Server) *http.Server {
 	}
 }
 
-func newServer(conf *Server, pubSub broker.PubSubBroker, caller broker.CallerBroker, logFn func(string, ...interface{})) *juggler.Server {
+func newServer(conf *Server, pubSub broker.PubSubBroker, caller broker.CallerBroker, logger logging.Logger) *juggler.Server {
 	if conf.AllowEmptySubprotocol {
 		juggler.Subprotocols = append(juggler.Subprotocols, "")
 	}
 
-	cs := srvhandler.LogConn(logFn)
+	cs := srvhandler.LogConn(logger)
 	if *noLogFlag {
 		cs = nil
 	}
@@ -238,15 +301,83 @@ func newServer(conf *Server, pubSub broker.PubSubBroker, caller broker.CallerBro
 		WriteLimit:              conf.WriteLimit,
 		WriteTimeout:            conf.WriteTimeout,
 		AcquireWriteLockTimeout: conf.AcquireWriteLockTimeout,
+		HeadersLimit:            conf.HeadersLimit,
+		CompressionThreshold:    conf.CompressionThreshold,
+		CheckServices:           conf.CheckServices,
+		SessionGracePeriod:      conf.SessionGracePeriod,
 		ConnState:               cs,
 		PubSubBroker:            pubSub,
 		CallerBroker:            caller,
+		Logger:                  logger,
+	}
+}
+
+// newRedisPoolAndDial returns the pool and dial function to use for
+// the redis configuration, along with a description of the connection
+// for logging purpose.
+func newRedisPoolAndDial(conf *Redis) (redisbroker.Pool, func() (redis.Conn, error), string, error) {
+	createPoolFn := redisPoolCreateFunc(conf)
+
+	switch {
+	case conf.Sentinel != nil && len(conf.Sentinel.Addrs) > 0:
+		desc := fmt.Sprintf("redis sentinel for master %s on %v", conf.Sentinel.MasterName, conf.Sentinel.Addrs)
+		opts, err := redisDialOptions(conf)
+		if err != nil {
+			return nil, nil, desc, err
+		}
+		sopts, err := redisDialOptions(&Redis{
+			Password:     conf.Sentinel.Password,
+			TLS:          conf.TLS,
+			DialTimeout:  conf.DialTimeout,
+			ReadTimeout:  conf.ReadTimeout,
+			WriteTimeout: conf.WriteTimeout,
+		})
+		if err != nil {
+			return nil, nil, desc, err
+		}
+
+		sentinel := &redisbroker.Sentinel{
+			Addrs:               conf.Sentinel.Addrs,
+			MasterName:          conf.Sentinel.MasterName,
+			DialOptions:         opts,
+			SentinelDialOptions: sopts,
+			CreatePool:          createPoolFn,
+		}
+		if err := sentinel.Refresh(); err != nil {
+			return nil, nil, desc, err
+		}
+		return sentinel, sentinel.Dial, desc, nil
+
+	case conf.Cluster:
+		desc := fmt.Sprintf("redis cluster on %s", conf.Addr)
+		opts, err := redisDialOptions(conf)
+		if err != nil {
+			return nil, nil, desc, err
+		}
+		cluster, err := newRedisCluster(conf.Addr, createPoolFn, opts...)
+		if err != nil {
+			return nil, nil, desc, err
+		}
+		return cluster, cluster.Dial, desc, nil
+
+	default:
+		desc := fmt.Sprintf("redis pool on %s", conf.Addr)
+		opts, err := redisDialOptions(conf)
+		if err != nil {
+			return nil, nil, desc, err
+		}
+		pool, err := createPoolFn(conf.Addr, opts...)
+		if err != nil {
+			return nil, nil, desc, err
+		}
+		return pool, pool.Dial, desc, nil
 	}
 }
 
-func newRedisCluster(addr string, createPool func(string, ...redis.DialOption) (*redis.Pool, error)) (*redisc.Cluster, error) {
+func newRedisCluster(addr string, createPool func(string, ...redis.DialOption) (*redis.Pool, error), opts ...redis.DialOption) (*redisc.Cluster, error) {
 	c := &redisc.Cluster{
 		StartupNodes: []string{addr},
+		DialOptions:  opts,
 		CreatePool:   createPool,
 	}
 	err := c.Refresh()
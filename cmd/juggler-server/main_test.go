@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"net"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/mna/juggler"
+	"github.com/mna/juggler/logging"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -50,6 +53,42 @@ func TestCheckRedisConfig(t *testing.T) {
         addr: :1235
         idle_timeout: 1s
 `, true},
+		{`redis:
+    sentinel:
+        addrs:
+        - :26379
+        master_name: mymaster
+`, false},
+		{`redis:
+    pubsub:
+        sentinel:
+            addrs:
+            - :26379
+            master_name: mymaster
+    caller:
+        addr: :1235
+`, false},
+		{`redis:
+    pubsub:
+        sentinel:
+            master_name: mymaster
+    caller:
+        addr: :1235
+`, true},
+		{`redis:
+    cluster: true
+    sentinel:
+        addrs:
+        - :26379
+`, true},
+		{`redis:
+    pubsub:
+        addr: :1234
+        cluster: true
+    caller:
+        addr: :1235
+        db: 2
+`, false},
 	}
 	for i, c := range cases {
 		conf, err := getConfigFromReader(strings.NewReader(c.in))
@@ -74,6 +113,7 @@ redis:
 				Redis:        &Redis{Addr: "localhost:1234"},
 				Server:       &Server{Addr: ":9000", Paths: []string{"/ws"}, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold},
 				CallerBroker: &CallerBroker{},
+				PubSubBroker: &PubSubBroker{},
 			},
 		},
 		{
@@ -98,19 +138,60 @@ redis:
 				},
 				Server:       &Server{Addr: ":9000", Paths: []string{"/ws"}, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold},
 				CallerBroker: &CallerBroker{},
+				PubSubBroker: &PubSubBroker{},
+			},
+		},
+		{
+			`
+redis:
+    sentinel:
+        addrs:
+        - :26379
+        - :26380
+        master_name: mymaster
+`, &Config{
+				Redis: &Redis{
+					Addr: ":6379",
+					Sentinel: &RedisSentinel{
+						Addrs:      []string{":26379", ":26380"},
+						MasterName: "mymaster",
+					},
+				},
+				Server:       &Server{Addr: ":9000", Paths: []string{"/ws"}, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold},
+				CallerBroker: &CallerBroker{},
+				PubSubBroker: &PubSubBroker{},
 			},
 		},
 		{
 			`
 redis:
     addr: localhost:1234
+    cluster: true
     max_active: 34
     max_idle: 5
     idle_timeout: 1s
+    username: user
+    password: pwd
+    db: 3
+    dial_timeout: 1s
+    read_timeout: 2s
+    write_timeout: 3s
+    tls:
+        ca: ca.pem
+        cert: cert.pem
+        key: key.pem
+        skip_verify: true
 
 caller_broker:
     blocking_timeout: 2s
     call_cap: 987
+    reconnect_attempts: 3
+
+pubsub_broker:
+    reconnect_attempts: -1
+    reconnect_backoff: 10ms
+    max_reconnect_backoff: 1s
+    notify_gaps: true
 
 server:
     addr: :9876
@@ -134,13 +215,22 @@ server:
     acquire_write_lock_timeout: 3h
 
     allow_empty_subprotocol: true
+    metrics_path: /metrics
+
+    log_level: debug
+    log_format: json
 `, &Config{
-				Redis: &Redis{Addr: "localhost:1234", MaxActive: 34, MaxIdle: 5, IdleTimeout: time.Second},
+				Redis: &Redis{Addr: "localhost:1234", Cluster: true, MaxActive: 34, MaxIdle: 5, IdleTimeout: time.Second,
+					Username: "user", Password: "pwd", DB: 3, DialTimeout: time.Second, ReadTimeout: 2 * time.Second, WriteTimeout: 3 * time.Second,
+					TLS: &RedisTLS{CA: "ca.pem", Cert: "cert.pem", Key: "key.pem", SkipVerify: true}},
 				Server: &Server{Addr: ":9876", Paths: []string{"/ws", "/"}, MaxHeaderBytes: 23, ReadBufferSize: 4,
 					WriteBufferSize: 5, HandshakeTimeout: time.Minute, WhitelistedOrigins: []string{"http://localhost:4444"},
 					ReadLimit: 6, WriteLimit: 7, ReadTimeout: time.Hour, WriteTimeout: 2 * time.Hour,
-					AcquireWriteLockTimeout: 3 * time.Hour, AllowEmptySubprotocol: true, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold},
-				CallerBroker: &CallerBroker{BlockingTimeout: 2 * time.Second, CallCap: 987},
+					AcquireWriteLockTimeout: 3 * time.Hour, AllowEmptySubprotocol: true, MetricsPath: "/metrics", SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold,
+					LogLevel: "debug", LogFormat: "json"},
+				CallerBroker: &CallerBroker{BlockingTimeout: 2 * time.Second, CallCap: 987, ReconnectAttempts: 3},
+				PubSubBroker: &PubSubBroker{ReconnectAttempts: -1, ReconnectBackoff: 10 * time.Millisecond,
+					MaxReconnectBackoff: time.Second, NotifyGaps: true},
 			},
 		},
 	}
@@ -153,3 +243,83 @@ server:
 		}
 	}
 }
+
+func TestRedisDialOptions(t *testing.T) {
+	cases := []struct {
+		conf *Redis
+		n    int // number of options
+		err  bool
+	}{
+		{&Redis{}, 3, false},
+		{&Redis{Password: "a"}, 4, false},
+		{&Redis{Password: "a", DB: 1}, 5, false},
+		{&Redis{Cluster: true, DB: 1}, 0, true},
+		{&Redis{Username: "a"}, 0, true},
+		{&Redis{Username: "a", Password: "b"}, 3, false},
+		{&Redis{TLS: &RedisTLS{SkipVerify: true}, Password: "b"}, 4, false},
+		{&Redis{TLS: &RedisTLS{CA: "/does/not/exist"}}, 0, true},
+		{&Redis{TLS: &RedisTLS{Cert: "/does/not/exist", Key: "/does/not/exist"}}, 0, true},
+	}
+	for i, c := range cases {
+		opts, err := redisDialOptions(c.conf)
+		if assert.Equal(t, c.err, err != nil, "%d: %v", i, err) {
+			assert.Equal(t, c.n, len(opts), "%d: number of options", i)
+		}
+	}
+}
+
+func TestAuthACL(t *testing.T) {
+	cases := []struct {
+		reply string
+		err   string
+	}{
+		{"+OK\r\n", ""},
+		{"-WRONGPASS invalid username-password pair\r\n", "WRONGPASS"},
+		{":1\r\n", "unexpected reply"},
+	}
+	for i, c := range cases {
+		cli, srv := net.Pipe()
+		go func(reply string) {
+			defer srv.Close()
+			br := bufio.NewReader(srv)
+			// read the 7 lines of the AUTH command
+			for j := 0; j < 7; j++ {
+				if _, err := br.ReadString('\n'); err != nil {
+					return
+				}
+			}
+			srv.Write([]byte(reply))
+		}(c.reply)
+
+		err := authACL(cli, "user", "pwd")
+		if c.err == "" {
+			assert.NoError(t, err, "%d", i)
+		} else if assert.Error(t, err, "%d", i) {
+			assert.Contains(t, err.Error(), c.err, "%d", i)
+		}
+		cli.Close()
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	cases := []struct {
+		level, format string
+		want          logging.Logger
+	}{
+		{"", "", &logging.Std{}},
+		{"warn", "text", &logging.Std{Level: logging.Warn}},
+		{"debug", "json", &logging.JSON{Level: logging.Debug}},
+		{"fatal", "", nil},
+		{"", "xml", nil},
+	}
+	for i, c := range cases {
+		got, err := newLogger(&Server{LogLevel: c.level, LogFormat: c.format})
+		if c.want == nil {
+			assert.Error(t, err, "%d", i)
+			continue
+		}
+		if assert.NoError(t, err, "%d", i) {
+			assert.Equal(t, c.want, got, "%d", i)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// redisDialOptions returns the dial options to use to connect to redis
+// for the configuration.
+func redisDialOptions(conf *Redis) ([]redis.DialOption, error) {
+	if conf.Cluster && conf.DB != 0 {
+		return nil, errors.New("redis db cannot be selected in cluster mode")
+	}
+	if conf.Username != "" && conf.Password == "" {
+		return nil, errors.New("redis username requires a password")
+	}
+
+	opts := []redis.DialOption{
+		redis.DialReadTimeout(conf.ReadTimeout),
+		redis.DialWriteTimeout(conf.WriteTimeout),
+	}
+	if conf.DB != 0 {
+		opts = append(opts, redis.DialDatabase(conf.DB))
+	}
+
+	// AUTH with a username is not supported by redigo, and it must be sent
+	// after the TLS handshake, so the connection is established by a custom
+	// dial function if TLS or a username is configured.
+	if conf.TLS == nil && conf.Username == "" {
+		opts = append(opts, redis.DialConnectTimeout(conf.DialTimeout))
+		if conf.Password != "" {
+			opts = append(opts, redis.DialPassword(conf.Password))
+		}
+		return opts, nil
+	}
+
+	var tlsConf *tls.Config
+	if conf.TLS != nil {
+		tc, err := redisTLSConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf = tc
+	}
+	if conf.Username == "" && conf.Password != "" {
+		opts = append(opts, redis.DialPassword(conf.Password))
+	}
+
+	d := &redisDialer{
+		timeout:  conf.DialTimeout,
+		tls:      tlsConf,
+		username: conf.Username,
+		password: conf.Password,
+	}
+	return append(opts, redis.DialNetDial(d.Dial)), nil
+}
+
+func redisTLSConfig(conf *RedisTLS) (*tls.Config, error) {
+	tc := &tls.Config{InsecureSkipVerify: conf.SkipVerify}
+
+	if conf.CA != "" {
+		b, err := ioutil.ReadFile(conf.CA)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no valid certificate found in redis TLS CA file %s", conf.CA)
+		}
+	}
+
+	if conf.Cert != "" || conf.Key != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// redisDialer establishes network connections to redis, optionally
+// secured with TLS and authenticated with a username and password.
+type redisDialer struct {
+	timeout  time.Duration
+	tls      *tls.Config
+	username string
+	password string
+}
+
+// Dial connects to the address on the named network.
+func (d *redisDialer) Dial(network, addr string) (net.Conn, error) {
+	nd := &net.Dialer{Timeout: d.timeout, KeepAlive: 5 * time.Minute}
+	conn, err := nd.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.timeout))
+	}
+
+	if d.tls != nil {
+		tc := d.tls.Clone()
+		if tc.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			tc.ServerName = host
+		}
+
+		tlsConn := tls.Client(conn, tc)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if d.username != "" {
+		if err := authACL(conn, d.username, d.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// authACL sends the AUTH command with a username and password on conn
+// and reads the reply.
+func authACL(conn net.Conn, username, password string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*3\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+		len(username), username, len(password), password)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	// read the reply one byte at a time so that nothing is buffered
+	// past the end of the reply.
+	var line []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if _, err := conn.Read(b); err != nil {
+			return err
+		}
+		line = append(line, b[0])
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\r\n"))
+	switch {
+	case bytes.Equal(line, []byte("+OK")):
+		return nil
+	case len(line) > 0 && line[0] == '-':
+		return redis.Error(line[1:])
+	default:
+		return fmt.Errorf("unexpected reply to AUTH: %q", line)
+	}
+}
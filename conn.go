@@ -1,6 +1,8 @@
 package juggler
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -11,6 +13,7 @@ import (
 
 	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/internal/wswriter"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
@@ -32,7 +35,9 @@ const (
 // call methods on a Conn concurrently, but the fields should be
 // treated as read-only.
 type Conn struct {
-	// UUID is the unique identifier of the connection.
+	// UUID is the unique identifier of the connection. If the client
+	// resumes the session of a closed connection, it is set to the UUID
+	// of that connection before the Connected state.
 	UUID uuid.UUID
 
 	// CloseErr is the error, if any, that caused the connection
@@ -44,15 +49,37 @@ type Conn struct {
 	wsConn *websocket.Conn
 	// allowed types of messages from the client (empty means any)
 	allowedMsgs []message.Type
+	// protocol version and codec of the messages, based on the subprotocol
+	proto message.Protocol
+	codec message.Codec
 
 	wmu  chan struct{} // exclusive write lock
 	srv  *Server
 	psc  broker.PubSubConn  // single pub-sub-dedicated broker connection
 	resc broker.ResultsConn // single results-dedicated broker connection
 
+	// brokers used by this connection, the server's brokers in the
+	// connection's namespace.
+	ns  string
+	cb  broker.CallerBroker
+	psb broker.PubSubBroker
+
+	// session of the connection, if resumable sessions are enabled.
+	token   string                 // secret token required to resume the session
+	resumed bool                   // set if the session of a closed connection was resumed
+	restore []message.Subscription // subscriptions to restore on the pub-sub connection
+
 	// ensure the kill channel can only be closed once
 	closeOnce sync.Once
 	kill      chan struct{}
+
+	// mu protects access to the identity, the batch, the hello and the
+	// subscriptions.
+	mu       sync.Mutex
+	identity json.RawMessage
+	batch    *connBatch                    // batch being processed, if any
+	hello    *message.Hello                // HELLO sent by the client, if any
+	subs     map[message.Subscription]bool // subscriptions of the connection
 }
 
 func newConn(c *websocket.Conn, srv *Server, allowedMsgs ...message.Type) *Conn {
@@ -61,12 +88,17 @@ func newConn(c *websocket.Conn, srv *Server, allowedMsgs ...message.Type) *Conn
 	wmu := make(chan struct{}, 1)
 	wmu <- struct{}{}
 
+	proto := message.ProtocolFor(c.Subprotocol())
 	return &Conn{
 		UUID:        uuid.NewRandom(),
 		wsConn:      c,
 		allowedMsgs: allowedMsgs,
+		proto:       proto,
+		codec:       proto.Codec,
 		wmu:         wmu,
 		srv:         srv,
+		cb:          srv.CallerBroker,
+		psb:         srv.PubSubBroker,
 		kill:        make(chan struct{}),
 	}
 }
@@ -99,6 +131,82 @@ func (c *Conn) Subprotocol() string {
 	return c.wsConn.Subprotocol()
 }
 
+// Codec returns the codec used to encode and decode the messages of
+// the connection, as selected by its subprotocol.
+func (c *Conn) Codec() message.Codec {
+	return c.codec
+}
+
+// Protocol returns the version of the protocol and the codec used by
+// the connection, as selected by its subprotocol.
+func (c *Conn) Protocol() message.Protocol {
+	return c.proto
+}
+
+// Hello returns the HELLO message sent by the client to start the
+// connection, or nil if it was not received yet or if the protocol
+// of the connection does not support it.
+func (c *Conn) Hello() *message.Hello {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hello
+}
+
+// SetIdentity sets the identity metadata of the connection, typically
+// once the client has been authenticated. The value is marshaled to
+// JSON. If the PubSubBroker supports presence tracking, the identity
+// is recorded along with the presence of the connection on the
+// channels it subscribes to.
+func (c *Conn) SetIdentity(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.identity = b
+	c.mu.Unlock()
+
+	if pc, ok := c.psc.(broker.PresenceConn); ok {
+		return pc.SetPresence(c.UUID, b)
+	}
+	return nil
+}
+
+// setNamespace sets the namespace of the connection's brokers.
+func (c *Conn) setNamespace(ns string) error {
+	if ns == "" {
+		return nil
+	}
+
+	cn, ok := c.cb.(broker.CallerNamespacer)
+	if !ok {
+		return errors.New("caller broker does not support namespaces")
+	}
+	pn, ok := c.psb.(broker.PubSubNamespacer)
+	if !ok {
+		return errors.New("pub-sub broker does not support namespaces")
+	}
+	c.ns = ns
+	c.cb = cn.CallerWithNamespace(ns)
+	c.psb = pn.PubSubWithNamespace(ns)
+	return nil
+}
+
+// Namespace returns the namespace of the connection's brokers, as
+// returned by Server.Namespace when the connection was accepted.
+func (c *Conn) Namespace() string {
+	return c.ns
+}
+
+// Identity returns the JSON-encoded identity metadata of the
+// connection, or nil if none was set.
+func (c *Conn) Identity() json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.identity
+}
+
 // Close closes the connection, setting err as CloseErr to identify
 // the reason of the close. It does not send a websocket close message,
 // nor does it close the underlying websocket connection.
@@ -117,8 +225,30 @@ func (c *Conn) Close(err error) {
 	})
 }
 
+// drop closes the connection because its setup failed with err, and
+// logs the failure.
+func (c *Conn) drop(msg string, err error) {
+	c.Log(logging.Error, msg+", dropping connection", logging.Err(err))
+	c.Close(fmt.Errorf("%s: %v; dropping connection", msg, err))
+}
+
+// Log logs msg at level to the server's Logger, if set, with the UUID
+// and the remote address of the connection added to the fields. It
+// can be used by handlers to log messages about the connection.
+func (c *Conn) Log(level logging.Level, msg string, fields ...logging.Field) {
+	l := c.srv.Logger
+	if l == nil {
+		return
+	}
+	logging.With(l, logging.ConnUUID(c.UUID), logging.RemoteAddr(c.RemoteAddr())).Log(level, msg, fields...)
+}
+
 // Writer returns an io.WriteCloser that can be used to send a
-// message on the connection. Only one writer can be active at
+// message on the connection. The message must be encoded using the
+// connection's Codec, and it is sent as a binary websocket message
+// if the codec is binary. If compression is negotiated, the message
+// is compressed if the first Write has at least
+// Server.CompressionThreshold bytes. Only one writer can be active at
 // any moment for a given connection, so the returned writer
 // will acquire a lock on the first call to Write, and will
 // release it only when Close is called. The timeout controls
@@ -140,6 +270,8 @@ func (c *Conn) Writer(timeout time.Duration) io.WriteCloser {
 		c.wmu,
 		timeout,
 		c.srv.WriteTimeout,
+		c.codec.Binary(),
+		c.srv.CompressionThreshold,
 	)
 }
 
@@ -156,14 +288,18 @@ func (c *Conn) Send(m message.Msg) {
 // results is the loop that looks for call results, started in its own
 // goroutine.
 func (c *Conn) results() {
-	if c.srv.Vars != nil {
-		c.srv.Vars.Add("TotalConnGoros", 1)
-		c.srv.Vars.Add("ActiveConnGoros", 1)
-		defer c.srv.Vars.Add("ActiveConnGoros", -1)
+	if c.srv.Metrics != nil {
+		c.srv.Metrics.Add("TotalConnGoros", 1)
+		c.srv.Metrics.AddGauge("ActiveConnGoros", 1)
+		defer c.srv.Metrics.AddGauge("ActiveConnGoros", -1)
 	}
 
 	ch := c.resc.Results()
 	for res := range ch {
+		if res.Partial {
+			c.Send(message.NewProg(res))
+			continue
+		}
 		c.Send(message.NewRes(res))
 	}
 
@@ -175,10 +311,10 @@ func (c *Conn) results() {
 // pubSub is the loop that receives events that the connection is subscribed
 // to, started in its own goroutine.
 func (c *Conn) pubSub() {
-	if c.srv.Vars != nil {
-		c.srv.Vars.Add("TotalConnGoros", 1)
-		c.srv.Vars.Add("ActiveConnGoros", 1)
-		defer c.srv.Vars.Add("ActiveConnGoros", -1)
+	if c.srv.Metrics != nil {
+		c.srv.Metrics.Add("TotalConnGoros", 1)
+		c.srv.Metrics.AddGauge("ActiveConnGoros", 1)
+		defer c.srv.Metrics.AddGauge("ActiveConnGoros", -1)
 	}
 
 	ch := c.psc.Events()
@@ -191,35 +327,63 @@ func (c *Conn) pubSub() {
 	c.Close(c.psc.EventsErr())
 }
 
+// readHello reads the HELLO message that starts the connection.
+func (c *Conn) readHello() (*message.Hello, error) {
+	m, err := c.readMsg()
+	if err != nil {
+		return nil, err
+	}
+	hello, ok := m.(*message.Hello)
+	if !ok {
+		return nil, fmt.Errorf("invalid message %s: %s must be the first message", m.Type(), message.HelloMsg)
+	}
+
+	c.mu.Lock()
+	c.hello = hello
+	c.mu.Unlock()
+	return hello, nil
+}
+
+// readMsg reads the next message sent by the client.
+func (c *Conn) readMsg() (message.Msg, error) {
+	c.wsConn.SetReadDeadline(time.Time{})
+
+	// NextReader returns with an error once a connection is closed,
+	// so the callers don't need to check the c.kill channel.
+	mt, r, err := c.wsConn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	want := websocket.TextMessage
+	if c.codec.Binary() {
+		want = websocket.BinaryMessage
+	}
+	if mt != want {
+		return nil, fmt.Errorf("invalid websocket message type: %d", mt)
+	}
+	if to := c.srv.ReadTimeout; to > 0 {
+		c.wsConn.SetReadDeadline(time.Now().Add(to))
+	}
+	return c.proto.DecodeRequest(r, c.allowedMsgs...)
+}
+
 // receive is the read loop, started in its own goroutine.
 func (c *Conn) receive() {
-	if c.srv.Vars != nil {
-		c.srv.Vars.Add("TotalConnGoros", 1)
-		c.srv.Vars.Add("ActiveConnGoros", 1)
-		defer c.srv.Vars.Add("ActiveConnGoros", -1)
+	if c.srv.Metrics != nil {
+		c.srv.Metrics.Add("TotalConnGoros", 1)
+		c.srv.Metrics.AddGauge("ActiveConnGoros", 1)
+		defer c.srv.Metrics.AddGauge("ActiveConnGoros", -1)
 	}
 
 	for {
-		c.wsConn.SetReadDeadline(time.Time{})
-
-		// NextReader returns with an error once a connection is closed,
-		// so this loop doesn't need to check the c.kill channel.
-		mt, r, err := c.wsConn.NextReader()
+		m, err := c.readMsg()
 		if err != nil {
 			c.Close(err)
 			return
 		}
-		if mt != websocket.TextMessage {
-			c.Close(fmt.Errorf("invalid websocket message type: %d", mt))
-			return
-		}
-		if to := c.srv.ReadTimeout; to > 0 {
-			c.wsConn.SetReadDeadline(time.Now().Add(to))
-		}
-
-		m, err := message.UnmarshalRequest(r, c.allowedMsgs...)
-		if err != nil {
-			c.Close(err)
+		if m.Type() == message.HelloMsg {
+			// the HELLO that starts the connection is read by ServeConn
+			c.Close(fmt.Errorf("invalid message %s: %s must be the first message", m.Type(), message.HelloMsg))
 			return
 		}
 
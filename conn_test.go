@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -12,11 +13,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/client"
 	"github.com/mna/juggler/internal/wstest"
 	"github.com/mna/juggler/internal/wswriter"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -35,6 +39,45 @@ func (f fakeResultsConn) Results() <-chan *message.ResPayload { return nil }
 func (f fakeResultsConn) ResultsErr() error                   { return nil }
 func (f fakeResultsConn) Close() error                        { return nil }
 
+type fakeBroker struct {
+	ns string
+}
+
+func (f fakeBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return fakeResultsConn{}, nil
+}
+func (f fakeBroker) Call(cp *message.CallPayload, timeout time.Duration) error { return nil }
+func (f fakeBroker) NewPubSubConn() (broker.PubSubConn, error)                 { return fakePubSubConn{}, nil }
+func (f fakeBroker) Publish(channel string, pp *message.PubPayload) error      { return nil }
+
+type fakeNamespacedBroker struct {
+	fakeBroker
+}
+
+func (f fakeNamespacedBroker) CallerWithNamespace(ns string) broker.CallerBroker {
+	return fakeNamespacedBroker{fakeBroker{ns}}
+}
+func (f fakeNamespacedBroker) PubSubWithNamespace(ns string) broker.PubSubBroker {
+	return fakeNamespacedBroker{fakeBroker{ns}}
+}
+
+func TestConnNamespace(t *testing.T) {
+	srv := &Server{CallerBroker: fakeBroker{}, PubSubBroker: fakeNamespacedBroker{}}
+	conn := newConn(&websocket.Conn{}, srv)
+	assert.NoError(t, conn.setNamespace(""), "no namespace")
+	assert.Equal(t, "", conn.Namespace(), "empty namespace")
+	assert.Error(t, conn.setNamespace("a"), "caller broker does not support namespaces")
+
+	srv = &Server{CallerBroker: fakeNamespacedBroker{}, PubSubBroker: fakeNamespacedBroker{}}
+	conn = newConn(&websocket.Conn{}, srv)
+	if assert.NoError(t, conn.setNamespace("a"), "namespace") {
+		assert.Equal(t, "a", conn.Namespace(), "namespace")
+		assert.Equal(t, "a", conn.cb.(fakeNamespacedBroker).ns, "caller broker namespace")
+		assert.Equal(t, "a", conn.psb.(fakeNamespacedBroker).ns, "pub-sub broker namespace")
+		assert.Equal(t, "", srv.CallerBroker.(fakeNamespacedBroker).ns, "server broker unchanged")
+	}
+}
+
 func TestDelegatedMethods(t *testing.T) {
 	done := make(chan bool, 1)
 	srv := wstest.StartRecordingServer(t, done, ioutil.Discard)
@@ -53,6 +96,37 @@ func TestDelegatedMethods(t *testing.T) {
 	assert.Equal(t, wsc, jc.UnderlyingConn(), "UnderlyingConn")
 }
 
+func TestConnLog(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartRecordingServer(t, done, ioutil.Discard)
+	defer srv.Close()
+
+	wsc := wstest.Dial(t, srv.URL)
+	defer wsc.Close()
+
+	// no logger, no-op
+	jc := newConn(wsc, &Server{})
+	jc.Log(logging.Error, "ignored")
+
+	var got []logging.Field
+	l := logging.LoggerFunc(func(level logging.Level, msg string, fields ...logging.Field) {
+		assert.Equal(t, logging.Error, level, "level")
+		assert.Equal(t, "failed to set namespace, dropping connection", msg, "message")
+		got = fields
+	})
+	jc = newConn(wsc, &Server{Logger: l})
+	jc.drop("failed to set namespace", io.EOF)
+
+	assert.Equal(t, []logging.Field{
+		logging.ConnUUID(jc.UUID),
+		logging.RemoteAddr(wsc.RemoteAddr()),
+		logging.Err(io.EOF),
+	}, got, "fields")
+	if assert.Error(t, jc.CloseErr, "CloseErr") {
+		assert.Equal(t, "failed to set namespace: EOF; dropping connection", jc.CloseErr.Error(), "CloseErr")
+	}
+}
+
 func TestSendBinaryMessage(t *testing.T) {
 	server := &Server{}
 	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
@@ -171,3 +245,19 @@ func TestConnClose(t *testing.T) {
 
 	assert.Equal(t, errors.New("a"), conn.CloseErr, "got expected close error")
 }
+
+func TestScopedIdempotencyKey(t *testing.T) {
+	srv := &Server{CallerBroker: fakeBroker{}, PubSubBroker: fakeBroker{}}
+	c1, c2 := newConn(&websocket.Conn{}, srv), newConn(&websocket.Conn{}, srv)
+
+	assert.Equal(t, "", scopedIdempotencyKey(c1, ""), "no key")
+	assert.NotEqual(t, scopedIdempotencyKey(c1, "k"), scopedIdempotencyKey(c2, "k"), "anonymous connections")
+
+	require.NoError(t, c1.SetIdentity("a"), "SetIdentity c1")
+	require.NoError(t, c2.SetIdentity("a"), "SetIdentity c2")
+	assert.Equal(t, scopedIdempotencyKey(c1, "k"), scopedIdempotencyKey(c2, "k"), "same identity")
+	assert.True(t, strings.HasSuffix(scopedIdempotencyKey(c1, "k"), ":k"), "key suffix")
+
+	require.NoError(t, c2.SetIdentity("b"), "SetIdentity c2")
+	assert.NotEqual(t, scopedIdempotencyKey(c1, "k"), scopedIdempotencyKey(c2, "k"), "different identities")
+}
@@ -8,7 +8,9 @@
 //
 // All messages sent by the client receive an acknowledge message
 // (ACK) when processed successfully or a negative acknowledge (NACK)
-// if the request was rejected. See the message package documentation
+// if the request was rejected. Many requests can be sent at once in a
+// batch (BTCH), in which case their ACK and NACK are sent in a single
+// batch acknowledge (BACK). See the message package documentation
 // for all details regarding the supported messages.
 //
 // Server
@@ -29,8 +31,11 @@
 //
 // Additional fields allow for more advanced configuration, such as
 // read and write timeouts and limits, and custom message handling,
-// via the Handler. Metrics can be collected by setting the Vars field
-// to an *expvar.Map. See the Server type documentation for all details.
+// via the Handler. Metrics can be collected by setting the Metrics field,
+// e.g. to a metrics.Prometheus exporter or to a metrics.Expvar, and
+// the errors that are not reported to the clients can be logged by
+// setting the Logger field (see the logging package). See the Server
+// type documentation for all details.
 //
 // The ServeConn method serves a connection using a configured Server.
 // The Upgrade function creates an http.Handler that upgrades the
@@ -53,7 +58,24 @@
 // server. To be accepted by the server, the connection must accept
 // one of the subprotocols supported by the server (the Subprotocols
 // package variable). The negociated subprotocol is available via
-// the Subprotocol connection method.
+// the Subprotocol connection method. It selects the version of the
+// protocol: with juggler.1, the client must start the connection with
+// a HELLO message, and the server responds with a WELCOME message that
+// advertises the session ID, the capabilities and the limits of the
+// server, while juggler.0 is supported for existing clients. It also
+// selects the codec of the messages: juggler.0 and juggler.1 use
+// JSON-encoded text messages, while the "+msgpack" variants use
+// MessagePack-encoded binary messages, which are more compact for
+// high-volume streams (see message.Protocol and message.Codecs).
+//
+// With juggler.1, sessions can be resumed if Server.SessionGracePeriod
+// is set and the CallerBroker implements broker.SessionStore. The
+// WELCOME message then includes a secret session token, and a client
+// that reconnects within the grace period can send the session ID and
+// token of its closed connection in its HELLO. The new connection
+// keeps the UUID of the closed connection, so that the results of its
+// calls are sent to the new connection, and its subscriptions are
+// restored.
 //
 // A connection listens for its RPC call results, pub-sub events and
 // requests from the client end, and ensures the messages flow from client to
@@ -103,7 +125,7 @@
 //     func CheckAccessHandler(ctx context.Context, c *juggler.Conn, m message.Msg) {
 //       // assume we detected that the caller doesn't have access, in the ok variable
 //       if !ok {
-//         nack := message.NewNack(m, 403, errors.New("caller doesn't have access"))
+//         nack := message.NewNack(m, 403, juggler.ErrForbidden)
 //         c.Send(nack)
 //         return
 //       }
@@ -116,6 +138,11 @@
 // which have their Type.IsRead method return true. Responses (messages
 // sent by the server) have their Type.IsWrite method return true.
 //
+// Errors follow the message.Error model, with an HTTP-like code, a
+// retryable flag and optional details. Handlers can use ErrorCode to
+// get the NACK code of an error, and callees can return a
+// *message.Error so that the caller receives a structured error result.
+//
 // A new context.Context is passed for each message processed to maintain
 // values for the duration of a specific message.
 //
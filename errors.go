@@ -0,0 +1,37 @@
+package juggler
+
+import (
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+)
+
+// The errors that a Handler can use to NACK a message from a client
+// that failed authentication or is not authorized to send it, e.g.
+// message.NewNack(m, ErrorCode(ErrForbidden), ErrForbidden).
+var (
+	ErrUnauthorized error = &message.Error{Code: 401, Message: "juggler: unauthorized"}
+	ErrForbidden    error = &message.Error{Code: 403, Message: "juggler: forbidden"}
+)
+
+// ErrorCode returns the NACK code that corresponds to err. It is the
+// Code of a *message.Error if it is set, 503 if the capacity of the
+// broker is exceeded, and 500 otherwise.
+func ErrorCode(err error) int {
+	if e, ok := err.(*message.Error); ok && e.Code > 0 {
+		return e.Code
+	}
+	if err == broker.ErrCapacityExceeded {
+		return 503
+	}
+	return 500
+}
+
+// newNack creates a Nack for m with the code that corresponds to err.
+// An exceeded broker capacity is marked as retryable.
+func newNack(m message.Msg, err error) *message.Nack {
+	nack := message.NewNack(m, ErrorCode(err), err)
+	if err == broker.ErrCapacityExceeded {
+		nack.Payload.Retryable = true
+	}
+	return nack
+}
@@ -0,0 +1,42 @@
+package juggler
+
+import (
+	"io"
+	"testing"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{io.EOF, 500},
+		{broker.ErrCapacityExceeded, 503},
+		{ErrUnauthorized, 401},
+		{ErrForbidden, 403},
+		{ErrCircuitOpen, 503},
+		{&message.Error{Message: "x"}, 500},
+		{&message.Error{Code: 400, Message: "x"}, 400},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, ErrorCode(c.err), "%v", c.err)
+	}
+}
+
+func TestNewNack(t *testing.T) {
+	call, err := message.NewCall("a", nil, 0)
+	require.NoError(t, err, "NewCall")
+
+	nack := newNack(call, broker.ErrCapacityExceeded)
+	assert.Equal(t, 503, nack.Payload.Code, "capacity code")
+	assert.True(t, nack.Payload.Retryable, "capacity is retryable")
+
+	nack = newNack(call, io.EOF)
+	assert.Equal(t, 500, nack.Payload.Code, "EOF code")
+	assert.False(t, nack.Payload.Retryable, "EOF is not retryable")
+}
@@ -1,20 +1,50 @@
 package juggler
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"expvar"
+	"errors"
+	"fmt"
 	"io"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/internal/wswriter"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/mna/juggler/tracing"
 )
 
+// PresenceURI is the reserved RPC URI that returns the list of
+// connections subscribed to a pub-sub channel. The arguments of the
+// call must be a JSON object with the name of the channel, e.g.
+// {"channel": "chat"}, and the result is an array of
+// message.PresencePayload values. The call is processed by the
+// server and requires a PubSubBroker that implements
+// broker.PresenceBroker.
+const PresenceURI = "juggler.presence"
+
+// ServicesURI is the reserved RPC URI that returns the list of callee
+// instances registered to serve URIs. The arguments of the call may
+// be a JSON object with the URI to look up, e.g. {"uri": "add"}, and
+// the result is an array of message.ServicePayload values. If no URI
+// is provided, the callees of all URIs are returned. The call is
+// processed by the server and requires a CallerBroker that implements
+// broker.ServiceRegistry.
+const ServicesURI = "juggler.services"
+
+// errNoCallee is the error of the NACK sent in response to a CALL
+// when no callee is registered to serve its URI.
+var errNoCallee = &message.Error{Code: 503, Message: "no callee available for this URI", Retryable: true}
+
 // SlowProcessMsgThreshold defines the threshold at which calls to
-// ProcessMsg are marked as slow in the expvar metrics, if Server.Vars
-// is set. Set to 0 to disable SlowProcessMsg metrics.
+// ProcessMsg are marked as slow in the metrics, if Server.Metrics is
+// set. Set to 0 to disable SlowProcessMsg metrics.
 var SlowProcessMsgThreshold = 100 * time.Millisecond
 
 // Handler defines the method required for a server to handle a send or receive
@@ -33,36 +63,38 @@ func (h HandlerFunc) Handle(ctx context.Context, c *Conn, m message.Msg) {
 	h(ctx, c, m)
 }
 
-func saveMsgMetrics(vars *expvar.Map, m message.Msg) func() {
-	vars.Add("Msgs", 1)
+func saveMsgMetrics(mt metrics.Metrics, m message.Msg) func() {
+	mt.Add("Msgs", 1)
 	if m.Type().IsRead() {
-		vars.Add("MsgsRead", 1)
+		mt.Add("MsgsRead", 1)
 	}
 	if m.Type().IsWrite() {
-		vars.Add("MsgsWrite", 1)
+		mt.Add("MsgsWrite", 1)
 	}
 	if m.Type().IsStd() {
-		vars.Add("Msgs"+m.Type().String(), 1)
+		mt.Add("Msgs"+m.Type().String(), 1)
 	}
 
-	if SlowProcessMsgThreshold > 0 {
-		start := time.Now()
-		return func() {
-			dur := time.Now().Sub(start)
-			if dur >= SlowProcessMsgThreshold {
-				vars.Add("SlowProcessMsg", 1)
-				if m.Type().IsStd() {
-					vars.Add("SlowProcessMsg"+m.Type().String(), 1)
-				}
+	start := time.Now()
+	return func() {
+		dur := time.Now().Sub(start)
+		if m.Type().IsStd() {
+			mt.Observe("ProcessMsgDuration", dur, "type", m.Type().String())
+		}
+		if SlowProcessMsgThreshold > 0 && dur >= SlowProcessMsgThreshold {
+			mt.Add("SlowProcessMsg", 1)
+			if m.Type().IsStd() {
+				mt.Add("SlowProcessMsg"+m.Type().String(), 1)
 			}
 		}
 	}
-	return nil
 }
 
 // ProcessMsg implements the standard message processing. For requests
 // (client-sent messages), it calls the appropriate RPC or pub-sub
-// mechanisms. For responses (server-sent messages), it marshals the
+// mechanisms. For a batch, it processes each of its requests in order
+// through the server's Handler, and sends a single Back with their
+// responses. For responses (server-sent messages), it marshals the
 // message and sends it to the client. If a write to the connection fails,
 // the connection is closed and the write error is stored as CloseErr
 // on the connection (unless an earlier error already caused the
@@ -72,24 +104,67 @@ func saveMsgMetrics(vars *expvar.Map, m message.Msg) func() {
 // point call ProcessMsg so the expected behaviour happens.
 func ProcessMsg(c *Conn, m message.Msg) {
 	addFn := func(string, int64) {}
-	if c.srv.Vars != nil {
-		if fn := saveMsgMetrics(c.srv.Vars, m); fn != nil {
-			defer fn()
-		}
+	if mt := c.srv.Metrics; mt != nil {
+		defer saveMsgMetrics(mt, m)()
 
-		addFn = c.srv.Vars.Add
+		addFn = func(name string, delta int64) { mt.Add(name, delta) }
+	}
+
+	switch m.(type) {
+	case *message.Call, *message.Pub, *message.Sub, *message.Unsb:
+		if !checkHeaders(c, m, addFn) {
+			return
+		}
+	}
+	if span := traceMsg(c, m); span != nil {
+		defer span.End(nil)
 	}
 
 	switch m := m.(type) {
 	case *message.Call:
+		if m.Payload.URI == PresenceURI {
+			callPresence(c, m)
+			return
+		}
+		if m.Payload.URI == ServicesURI {
+			callServices(c, m)
+			return
+		}
+
 		cp := &message.CallPayload{
 			ConnUUID: c.UUID,
 			MsgUUID:  m.UUID(),
 			URI:      m.Payload.URI,
+			Priority: m.Payload.Priority,
 			Args:     m.Payload.Args,
+
+			IdempotencyKey: scopedIdempotencyKey(c, m.Payload.IdempotencyKey),
+			Headers:        m.Headers(),
+		}
+		if m.Payload.Broadcast {
+			broadcastCall(c, m, cp)
+			return
+		}
+		nb := m.Payload.NotBefore
+		scheduled := nb != nil && nb.After(time.Now())
+		if rc, ok := c.cb.(broker.ResultCache); ok && !scheduled {
+			if callCached(c, m, rc, addFn) {
+				return
+			}
+		}
+		if c.srv.CheckServices && !hasService(c, m, addFn) {
+			c.Send(message.NewNack(m, 503, errNoCallee))
+			return
 		}
-		if err := c.srv.CallerBroker.Call(cp, m.Payload.Timeout); err != nil {
-			c.Send(message.NewNack(m, 500, err))
+		if scheduled {
+			scheduleCall(c, m, cp, *nb)
+			return
+		}
+		if b := c.currentBatch(); b != nil && b.deferCall(c, m, cp) {
+			return
+		}
+		if err := c.cb.Call(cp, m.Payload.Timeout); err != nil {
+			c.Send(newNack(m, err))
 			return
 		}
 		c.Send(message.NewAck(m))
@@ -98,28 +173,54 @@ func ProcessMsg(c *Conn, m message.Msg) {
 		pp := &message.PubPayload{
 			MsgUUID: m.UUID(),
 			Args:    m.Payload.Args,
+			Headers: m.Headers(),
 		}
-		if err := c.srv.PubSubBroker.Publish(m.Payload.Channel, pp); err != nil {
-			c.Send(message.NewNack(m, 500, err))
+		if b := c.currentBatch(); b != nil && b.deferPub(c, m, pp) {
+			return
+		}
+		if err := c.psb.Publish(m.Payload.Channel, pp); err != nil {
+			c.Send(newNack(m, err))
 			return
 		}
 		c.Send(message.NewAck(m))
 
 	case *message.Sub:
 		if err := c.psc.Subscribe(m.Payload.Channel, m.Payload.Pattern); err != nil {
-			c.Send(message.NewNack(m, 500, err))
+			c.Send(newNack(m, err))
 			return
 		}
+		c.setSubscribed(message.Subscription{Channel: m.Payload.Channel, Pattern: m.Payload.Pattern}, true)
 		c.Send(message.NewAck(m))
 
 	case *message.Unsb:
 		if err := c.psc.Unsubscribe(m.Payload.Channel, m.Payload.Pattern); err != nil {
-			c.Send(message.NewNack(m, 500, err))
+			c.Send(newNack(m, err))
 			return
 		}
+		c.setSubscribed(message.Subscription{Channel: m.Payload.Channel, Pattern: m.Payload.Pattern}, false)
 		c.Send(message.NewAck(m))
 
-	case *message.Ack, *message.Nack, *message.Evnt, *message.Res:
+	case *message.Btch:
+		processBatch(c, m, addFn)
+
+	case *message.Hello:
+		c.Send(newWelcome(c, m))
+
+	case *message.Ack, *message.Nack:
+		if b := c.currentBatch(); b != nil && b.setResponse(m) {
+			// sent in the Back of the batch
+			return
+		}
+		doWrite(c, m, addFn)
+
+	case *message.Res, *message.Prog:
+		if b := c.currentBatch(); b != nil && b.holdResult(m) {
+			// sent after the Back of the batch
+			return
+		}
+		doWrite(c, m, addFn)
+
+	case *message.Evnt, *message.Back, *message.Welcome:
 		doWrite(c, m, addFn)
 
 	default:
@@ -127,31 +228,323 @@ func ProcessMsg(c *Conn, m message.Msg) {
 	}
 }
 
+// checkHeaders returns true if the headers of the request m are within
+// the server's HeadersLimit, otherwise it sends a NACK and returns
+// false.
+func checkHeaders(c *Conn, m message.Msg, addFn func(string, int64)) bool {
+	limit := c.srv.HeadersLimit
+	if limit == 0 {
+		limit = DefaultHeadersLimit
+	}
+	hm, ok := m.(message.HeaderMsg)
+	if !ok || limit < 0 || message.HeadersSize(hm.Headers()) <= limit {
+		return true
+	}
+
+	addFn("HeadersLimitExceeded", 1)
+	c.Send(message.NewNack(m, 400, fmt.Errorf("headers exceed the limit of %d bytes", limit)))
+	return false
+}
+
+// traceMsg starts the span of the CALL or PUB request m if the server
+// has a Tracer, and stores its trace context in the headers of m so
+// that it is propagated. It returns nil if no span is started.
+func traceMsg(c *Conn, m message.Msg) tracing.Span {
+	t := c.srv.Tracer
+	if t == nil {
+		return nil
+	}
+
+	var span tracing.Span
+	switch m := m.(type) {
+	case *message.Call:
+		span = tracing.StartMsg(t, m, "server.CALL")
+		span.SetAttribute("juggler.uri", m.Payload.URI)
+	case *message.Pub:
+		span = tracing.StartMsg(t, m, "server.PUB")
+		span.SetAttribute("juggler.channel", m.Payload.Channel)
+	default:
+		return nil
+	}
+	span.SetAttribute("juggler.conn_uuid", c.UUID.String())
+	span.SetAttribute("juggler.msg_uuid", m.UUID().String())
+	return span
+}
+
+// newWelcome returns the WELCOME message in response to the HELLO m,
+// with the capabilities of the connection's server and brokers, and
+// the token to resume the session if resumable sessions are enabled.
+func newWelcome(c *Conn, m *message.Hello) *message.Welcome {
+	caps := []string{message.CapBatch}
+	if _, ok := c.cb.(broker.CallBroadcaster); ok {
+		caps = append(caps, message.CapBroadcast)
+	}
+	if _, ok := c.cb.(broker.CallScheduler); ok {
+		caps = append(caps, message.CapSchedule)
+	}
+	if _, ok := c.cb.(broker.ResultCache); ok {
+		caps = append(caps, message.CapCache)
+	}
+	if _, ok := c.cb.(broker.ServiceRegistry); ok {
+		caps = append(caps, message.CapServices)
+	}
+	if _, ok := c.psb.(broker.PresenceBroker); ok {
+		caps = append(caps, message.CapPresence)
+	}
+	if c.token != "" {
+		caps = append(caps, message.CapSessions)
+	}
+	caps = append(caps, c.srv.Capabilities...)
+
+	limits := message.Limits{
+		ReadLimit:   c.srv.ReadLimit,
+		WriteLimit:  c.srv.WriteLimit,
+		ReadTimeout: c.srv.ReadTimeout,
+		CallTimeout: broker.DefaultCallTimeout,
+	}
+	if c.token != "" {
+		limits.SessionGracePeriod = c.srv.SessionGracePeriod
+	}
+
+	w := message.NewWelcome(m, c.proto.Version, c.UUID, caps, limits)
+	w.Payload.SessionToken = c.token
+	w.Payload.Resumed = c.resumed
+	return w
+}
+
+// scheduleCall registers the call request cp of m to run at notBefore.
+func scheduleCall(c *Conn, m *message.Call, cp *message.CallPayload, notBefore time.Time) {
+	cs, ok := c.cb.(broker.CallScheduler)
+	if !ok {
+		c.Send(message.NewNack(m, 501, errors.New("scheduled calls are not supported")))
+		return
+	}
+	if err := cs.ScheduleCall(cp, m.Payload.Timeout, notBefore); err != nil {
+		c.Send(newNack(m, err))
+		return
+	}
+	c.Send(message.NewAck(m))
+}
+
+// broadcastCall sends the call request cp of m to all callees listening
+// on its URI.
+func broadcastCall(c *Conn, m *message.Call, cp *message.CallPayload) {
+	cb, ok := c.cb.(broker.CallBroadcaster)
+	if !ok {
+		c.Send(message.NewNack(m, 501, errors.New("broadcast calls are not supported")))
+		return
+	}
+	if m.Payload.NotBefore != nil {
+		c.Send(message.NewNack(m, 400, errors.New("broadcast calls cannot be scheduled")))
+		return
+	}
+
+	cp.Broadcast = true
+	n, err := cb.BroadcastCall(cp, m.Payload.Timeout)
+	if err != nil {
+		c.Send(newNack(m, err))
+		return
+	}
+	ack := message.NewAck(m)
+	ack.Payload.Callees = n
+	c.Send(ack)
+}
+
+// callCached sends the cached result of the call m, if there is one,
+// without registering the call. It returns true if the result was
+// sent. If the cache lookup fails, the call is processed as usual.
+func callCached(c *Conn, m *message.Call, rc broker.ResultCache, addFn func(string, int64)) bool {
+	res, err := rc.CachedResult(&message.CallPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  m.UUID(),
+		URI:      m.Payload.URI,
+		Args:     m.Payload.Args,
+	})
+	if err != nil {
+		addFn("FailedCacheLookups", 1)
+		c.Log(logging.Warn, "failed to lookup cached result", logging.MsgUUID(m.UUID()), logging.URI(m.Payload.URI), logging.Err(err))
+		return false
+	}
+	if res == nil {
+		return false
+	}
+
+	addFn("CachedResults", 1)
+	c.Send(message.NewAck(m))
+	c.Send(message.NewRes(&message.ResPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  m.UUID(),
+		URI:      m.Payload.URI,
+		Args:     res,
+	}))
+	return true
+}
+
+// hasService returns true if a callee is registered to serve the URI
+// of the call m, or if it cannot be determined.
+func hasService(c *Conn, m *message.Call, addFn func(string, int64)) bool {
+	sr, ok := c.cb.(broker.ServiceRegistry)
+	if !ok {
+		return true
+	}
+	sps, err := sr.Services(m.Payload.URI)
+	if err != nil {
+		addFn("FailedServiceLookups", 1)
+		c.Log(logging.Warn, "failed to lookup services", logging.MsgUUID(m.UUID()), logging.URI(m.Payload.URI), logging.Err(err))
+		return true
+	}
+	if len(sps) == 0 {
+		addFn("UnavailableServiceCalls", 1)
+		return false
+	}
+	return true
+}
+
+// callServices processes a call to the reserved ServicesURI.
+func callServices(c *Conn, m *message.Call) {
+	sr, ok := c.cb.(broker.ServiceRegistry)
+	if !ok {
+		c.Send(message.NewNack(m, 501, errors.New("service registry is not supported")))
+		return
+	}
+
+	var args struct {
+		URI string `json:"uri"`
+	}
+	if len(m.Payload.Args) > 0 && string(m.Payload.Args) != "null" {
+		if err := json.Unmarshal(m.Payload.Args, &args); err != nil {
+			c.Send(message.NewNack(m, 400, errors.New("invalid arguments: object expected")))
+			return
+		}
+	}
+
+	sps, err := sr.Services(args.URI)
+	if err != nil {
+		c.Send(newNack(m, err))
+		return
+	}
+	if sps == nil {
+		sps = []*message.ServicePayload{}
+	}
+	b, err := json.Marshal(sps)
+	if err != nil {
+		c.Send(newNack(m, err))
+		return
+	}
+
+	c.Send(message.NewAck(m))
+	c.Send(message.NewRes(&message.ResPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  m.UUID(),
+		URI:      m.Payload.URI,
+		Args:     b,
+	}))
+}
+
+// callPresence processes a call to the reserved PresenceURI.
+func callPresence(c *Conn, m *message.Call) {
+	pb, ok := c.psb.(broker.PresenceBroker)
+	if !ok {
+		c.Send(message.NewNack(m, 501, errors.New("presence is not supported")))
+		return
+	}
+
+	var args struct {
+		Channel string `json:"channel"`
+	}
+	if err := json.Unmarshal(m.Payload.Args, &args); err != nil || args.Channel == "" {
+		c.Send(message.NewNack(m, 400, errors.New("invalid arguments: channel is required")))
+		return
+	}
+
+	pps, err := pb.Presence(args.Channel)
+	if err != nil {
+		c.Send(newNack(m, err))
+		return
+	}
+	b, err := json.Marshal(pps)
+	if err != nil {
+		c.Send(newNack(m, err))
+		return
+	}
+
+	c.Send(message.NewAck(m))
+	c.Send(message.NewRes(&message.ResPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  m.UUID(),
+		URI:      m.Payload.URI,
+		Args:     b,
+	}))
+}
+
 func doWrite(c *Conn, m message.Msg, addFn func(string, int64)) {
 	if err := writeMsg(c, m); err != nil {
+		fields := []logging.Field{logging.MsgUUID(m.UUID()), logging.F("type", m.Type().String()), logging.Err(err)}
 		switch err {
 		case wswriter.ErrWriteLockTimeout:
 			addFn("WriteLockTimeouts", 1)
+			c.Log(logging.Warn, "failed to acquire write lock, closing connection", fields...)
 			c.Close(err)
 
 		case wswriter.ErrWriteLimitExceeded:
 			addFn("WriteLimitExceeded", 1)
+			c.Log(logging.Warn, "message exceeds write limit, closing connection", fields...)
 			c.Close(err)
 
 		default:
 			// client may be gone
+			c.Log(logging.Debug, "failed to write message, closing connection", fields...)
 			c.Close(err)
 		}
 	}
 }
 
 func writeMsg(c *Conn, m message.Msg) error {
+	// encode the message first so that it is written in a single call,
+	// as its size determines if it is compressed. The write limit is
+	// checked while encoding, so that a message that exceeds it is not
+	// fully buffered.
+	var buf bytes.Buffer
+	ew := io.Writer(&buf)
+	if l := c.srv.WriteLimit; l > 0 {
+		ew = wswriter.Limit(&buf, l)
+	}
+	if err := c.codec.Encode(ew, m); err != nil {
+		if wswriter.Exceeded(ew) {
+			return wswriter.ErrWriteLimitExceeded
+		}
+		return err
+	}
+	if mt := c.srv.Metrics; mt != nil {
+		mt.Add("MsgBytesWritten", int64(buf.Len()))
+
+		// runs after the writer is closed, so that the flush is included
+		start := time.Now()
+		defer func() {
+			mt.Observe("WriteDuration", time.Now().Sub(start), "type", m.Type().String())
+		}()
+	}
+
 	w := c.Writer(c.srv.AcquireWriteLockTimeout)
 	defer w.Close()
 
-	lw := io.Writer(w)
-	if l := c.srv.WriteLimit; l > 0 {
-		lw = wswriter.Limit(w, l)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// scopedIdempotencyKey returns the idempotency key of a call made on
+// c, scoped by the identity of the connection so that callers with
+// different identities do not share results. If the connection has no
+// identity, the key is scoped by its UUID, which is kept when a
+// session is resumed.
+func scopedIdempotencyKey(c *Conn, key string) string {
+	if key == "" {
+		return ""
+	}
+	scope := []byte(c.Identity())
+	if len(scope) == 0 {
+		scope = []byte(c.UUID.String())
 	}
-	return json.NewEncoder(lw).Encode(m)
+	h := sha256.Sum256(scope)
+	return hex.EncodeToString(h[:16]) + ":" + key
 }
@@ -0,0 +1,101 @@
+package juggler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/client"
+	"github.com/mna/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeHeadersBroker struct {
+	fakeBroker
+
+	mu      sync.Mutex
+	headers []map[string]string
+}
+
+func (f *fakeHeadersBroker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.headers = append(f.headers, cp.Headers)
+	return nil
+}
+
+func (f *fakeHeadersBroker) Publish(channel string, pp *message.PubPayload) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.headers = append(f.headers, pp.Headers)
+	return nil
+}
+
+func TestHeaders(t *testing.T) {
+	brk := &fakeHeadersBroker{}
+	server := &Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		HeadersLimit: 32,
+		Handler: HandlerFunc(func(ctx context.Context, c *Conn, m message.Msg) {
+			// the handler can add and strip headers
+			if hm, ok := m.(message.HeaderMsg); ok && m.Type().IsRead() {
+				hm.DelHeader("secret")
+				hm.SetHeader("server", "1")
+			}
+			ProcessMsg(c, m)
+		}),
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	acks := make(chan message.Msg, 1)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		acks <- m
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: Subprotocols}, srv.URL, nil,
+		client.SetHandler(h), client.SetHeaders(map[string]string{"locale": "fr"}))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	waitFor := func(typ message.Type) message.Msg {
+		select {
+		case m := <-acks:
+			assert.Equal(t, typ, m.Type(), "message type")
+			return m
+		case <-time.After(time.Second):
+			t.Fatalf("no %s received", typ)
+		}
+		return nil
+	}
+
+	_, err = cli.CallHeaders("a", nil, time.Minute, map[string]string{"secret": strings.Repeat("x", 100)})
+	require.NoError(t, err, "CallHeaders")
+	waitFor(message.AckMsg)
+	_, err = cli.PubHeaders("b", nil, map[string]string{"id": "1"})
+	require.NoError(t, err, "PubHeaders")
+	waitFor(message.AckMsg)
+
+	// the limit is enforced once the handler is done with the headers
+	_, err = cli.PubHeaders("b", nil, map[string]string{"id": strings.Repeat("x", 100)})
+	require.NoError(t, err, "PubHeaders too large")
+	m := waitFor(message.NackMsg)
+	if nack, ok := m.(*message.Nack); ok {
+		assert.Equal(t, 400, nack.Payload.Code, "NACK code")
+	}
+
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+	assert.Equal(t, []map[string]string{
+		{"locale": "fr", "server": "1"},
+		{"locale": "fr", "server": "1", "id": "1"},
+	}, brk.headers, "propagated headers")
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/mna/juggler/client"
 	"github.com/mna/juggler/internal/jugglertest"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/mna/redisc/redistest"
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
@@ -315,6 +316,7 @@ func runIntegrationTest(t *testing.T, conf *IntgConfig) {
 	// panic if the test is run multiple times in the same execution
 	// (e.g. with -cpu=1,2,4).
 	vars := new(expvar.Map).Init()
+	mt := metrics.NewExpvar(vars)
 
 	// start/create:
 	// 1. redis-server
@@ -333,15 +335,15 @@ func runIntegrationTest(t *testing.T, conf *IntgConfig) {
 	pool.MaxIdle = conf.RedisPoolMaxIdle
 	pool.IdleTimeout = conf.RedisPoolIdleTimeout
 	brk := &redisbroker.Broker{
-		Pool:    pool,
-		Dial:    pool.Dial,
-		LogFunc: dbgl.Printf,
+		Pool:   pool,
+		Dial:   pool.Dial,
+		Logger: dbgl,
 
 		BlockingTimeout: conf.BrokerBlockingTimeout,
 		CallCap:         conf.BrokerCallCap,
 		ResultCap:       conf.BrokerResultCap,
 
-		Vars: vars,
+		Metrics: mt,
 	}
 
 	// 3. create the juggler server
@@ -359,7 +361,8 @@ func runIntegrationTest(t *testing.T, conf *IntgConfig) {
 		WriteTimeout:            conf.ServerWriteTimeout,
 		AcquireWriteLockTimeout: conf.ServerAcquireWriteLockTimeout,
 
-		Vars: vars,
+		Metrics: mt,
+		Logger:  dbgl,
 	}
 	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
 	httpsrv := httptest.NewServer(juggler.Upgrade(upg, srv))
@@ -377,6 +380,7 @@ func runIntegrationTest(t *testing.T, conf *IntgConfig) {
 		go func(i int) {
 			cle := callee.Callee{
 				Broker: brk,
+				Logger: dbgl,
 			}
 
 			conn, err := brk.NewCallsConn(uris...)
@@ -4,6 +4,8 @@ import (
 	"log"
 	"sync/atomic"
 	"testing"
+
+	"github.com/mna/juggler/logging"
 )
 
 // DebugLog is a logger that counts the number of calls it receives,
@@ -13,8 +15,8 @@ type DebugLog struct {
 	n int64
 }
 
-// Printf implements the LogFunc-compatible signature. It logs to log.Printf
-// if testing.Verbose is true.
+// Printf implements a printf-style logging function. It logs to
+// log.Printf if testing.Verbose is true.
 func (d *DebugLog) Printf(s string, args ...interface{}) {
 	atomic.AddInt64(&d.n, 1)
 	if testing.Verbose() {
@@ -22,6 +24,12 @@ func (d *DebugLog) Printf(s string, args ...interface{}) {
 	}
 }
 
+// Log implements logging.Logger. It logs messages of all levels to
+// log.Printf if testing.Verbose is true.
+func (d *DebugLog) Log(level logging.Level, msg string, fields ...logging.Field) {
+	logging.Printf(d.Printf).Log(level, msg, fields...)
+}
+
 // Calls returns the number of calls received by the logger.
 func (d *DebugLog) Calls() int {
 	return int(atomic.LoadInt64(&d.n))
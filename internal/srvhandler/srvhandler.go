@@ -3,11 +3,12 @@
 package srvhandler
 
 import (
-	"expvar"
 	"fmt"
 
 	"github.com/mna/juggler"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"golang.org/x/net/context"
 )
 
@@ -23,14 +24,14 @@ func Chain(hs ...juggler.Handler) juggler.Handler {
 
 // PanicRecover returns a juggler.Handler that recovers from panics that
 // may happen in h. The connection is closed on a panic. If a non-nil
-// vars is passed as parameter, the RecoveredPanics counter is incremented
+// mt is passed as parameter, the RecoveredPanics counter is incremented
 // for each panic.
-func PanicRecover(h juggler.Handler, vars *expvar.Map) juggler.Handler {
+func PanicRecover(h juggler.Handler, mt metrics.Metrics) juggler.Handler {
 	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
 		defer func() {
 			if e := recover(); e != nil {
-				if vars != nil {
-					vars.Add("RecoveredPanics", 1)
+				if mt != nil {
+					mt.Add("RecoveredPanics", 1)
 				}
 
 				var err error
@@ -48,27 +49,79 @@ func PanicRecover(h juggler.Handler, vars *expvar.Map) juggler.Handler {
 }
 
 // LogConn returns a function compatible with the Server.ConnState field
-// type that logs connections and disconnections to the provided logger
-// function. It is not a juggler.Handler.
-func LogConn(logFn func(string, ...interface{})) func(*juggler.Conn, juggler.ConnState) {
+// type that logs connections and disconnections to the provided logger,
+// at the Info level. It is not a juggler.Handler.
+func LogConn(l logging.Logger) func(*juggler.Conn, juggler.ConnState) {
 	return func(c *juggler.Conn, state juggler.ConnState) {
 		switch state {
 		case juggler.Connected:
-			logFn("%v: connected from %v with subprotocol %q", c.UUID, c.RemoteAddr(), c.Subprotocol())
+			l.Log(logging.Info, "connected", logging.ConnUUID(c.UUID), logging.RemoteAddr(c.RemoteAddr()),
+				logging.F("subprotocol", c.Subprotocol()))
 		case juggler.Closed:
-			logFn("%v: closing from %v with error %v", c.UUID, c.RemoteAddr(), c.CloseErr)
+			l.Log(logging.Info, "closing", logging.ConnUUID(c.UUID), logging.RemoteAddr(c.RemoteAddr()),
+				logging.Err(c.CloseErr))
 		}
 	}
 }
 
 // LogMsg returns a juggler.Handler that logs messages received or sent on
-// the connection to the provided logger function.
-func LogMsg(logFn func(string, ...interface{})) juggler.Handler {
+// the connection to the provided logger, at the Debug level.
+func LogMsg(l logging.Logger) juggler.Handler {
 	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
 		if m.Type().IsRead() {
-			logFn("%v: received message %v %s", c.UUID, m.UUID(), m.Type())
+			l.Log(logging.Debug, "received message", msgFields(c, m)...)
 		} else if m.Type().IsWrite() {
-			logFn("%v: sending message %v %s", c.UUID, m.UUID(), m.Type())
+			l.Log(logging.Debug, "sending message", msgFields(c, m)...)
+		}
+	})
+}
+
+// msgFields returns the logging fields of the message m sent or received
+// on the connection c.
+func msgFields(c *juggler.Conn, m message.Msg) []logging.Field {
+	fields := []logging.Field{
+		logging.ConnUUID(c.UUID),
+		logging.MsgUUID(m.UUID()),
+		logging.F("type", m.Type().String()),
+	}
+	switch m := m.(type) {
+	case *message.Call:
+		fields = append(fields, logging.URI(m.Payload.URI))
+	case *message.Res:
+		fields = append(fields, logging.URI(m.Payload.URI))
+	case *message.Sub:
+		fields = append(fields, logging.Channel(m.Payload.Channel))
+	case *message.Unsb:
+		fields = append(fields, logging.Channel(m.Payload.Channel))
+	case *message.Pub:
+		fields = append(fields, logging.Channel(m.Payload.Channel))
+	case *message.Evnt:
+		fields = append(fields, logging.Channel(m.Payload.Channel))
+	}
+	return fields
+}
+
+// Priority returns a juggler.Handler that sets the priority of CALL
+// messages received on the connection to the value returned by fn.
+func Priority(fn func(*juggler.Conn, *message.Call) int) juggler.Handler {
+	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
+		if call, ok := m.(*message.Call); ok {
+			call.Payload.Priority = fn(c, call)
+		}
+	})
+}
+
+// ClampPriority returns a juggler.Handler that limits the priority of
+// CALL messages received on the connection to the range [min, max].
+func ClampPriority(min, max int) juggler.Handler {
+	return Priority(func(c *juggler.Conn, m *message.Call) int {
+		switch p := m.Payload.Priority; {
+		case p < min:
+			return min
+		case p > max:
+			return max
+		default:
+			return p
 		}
 	})
 }
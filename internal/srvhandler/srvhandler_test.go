@@ -4,7 +4,9 @@ import (
 	"testing"
 
 	"github.com/mna/juggler"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 )
@@ -24,3 +26,50 @@ func TestChain(t *testing.T) {
 
 	assert.Equal(t, "abc", string(b))
 }
+
+func TestClampPriority(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		in, out int
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 1},
+		{2, 2},
+		{3, 2},
+	}
+
+	h := ClampPriority(0, 2)
+	for _, c := range cases {
+		m := &message.Call{}
+		m.Payload.Priority = c.in
+		h.Handle(context.Background(), &juggler.Conn{}, m)
+		assert.Equal(t, c.out, m.Payload.Priority, "%d", c.in)
+	}
+
+	// other messages are ignored
+	h.Handle(context.Background(), &juggler.Conn{}, &message.Ack{})
+}
+
+func TestLogMsg(t *testing.T) {
+	t.Parallel()
+
+	var got [][]logging.Field
+	l := logging.LoggerFunc(func(level logging.Level, msg string, fields ...logging.Field) {
+		assert.Equal(t, logging.Debug, level, "level")
+		got = append(got, fields)
+	})
+
+	c := &juggler.Conn{UUID: uuid.NewRandom()}
+	sub := message.NewSub("a", false)
+	ack := message.NewAck(sub)
+	h := LogMsg(l)
+	h.Handle(context.Background(), c, sub)
+	h.Handle(context.Background(), c, ack)
+
+	assert.Equal(t, [][]logging.Field{
+		{logging.ConnUUID(c.UUID), logging.MsgUUID(sub.UUID()), logging.F("type", "SUB"), logging.Channel("a")},
+		{logging.ConnUUID(c.UUID), logging.MsgUUID(ack.UUID()), logging.F("type", "ACK")},
+	}, got, "fields")
+}
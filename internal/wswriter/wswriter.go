@@ -15,11 +15,17 @@ import (
 // the timeout.
 var ErrWriteLockTimeout = errors.New("juggler: timed out waiting for write lock")
 
+// DefaultCompressThreshold is the default minimum size in bytes of the
+// messages that are compressed, if compression is negotiated.
+const DefaultCompressThreshold = 512
+
 // exclusiveWriter implements an io.WriteCloser that acquires the
 // connection's write lock prior to writing.
 type exclusiveWriter struct {
 	w            io.WriteCloser
 	init         bool
+	msgType      int
+	compressMin  int // < 0 to disable compression
 	writeLock    chan struct{}
 	lockTimeout  time.Duration
 	writeTimeout time.Duration
@@ -30,9 +36,25 @@ type exclusiveWriter struct {
 // to acquire and release the lock, and fails with an ErrWriteLockTimeout
 // if it can't acquire one before acquireTimeout. The writeTimeout is
 // used to set the write deadline on the connection, and conn is the
-// websocket connection to write to.
-func Exclusive(conn *websocket.Conn, lock chan struct{}, acquireTimeout, writeTimeout time.Duration) io.WriteCloser {
+// websocket connection to write to. If binary is true, the messages
+// are written as websocket.BinaryMessage instead of TextMessage.
+//
+// If compression is negotiated on the connection, a message is
+// compressed if the first call to Write has at least compressThreshold
+// bytes, so the message should be written in a single call. The
+// default of 0 uses DefaultCompressThreshold, and a negative value
+// disables compression.
+func Exclusive(conn *websocket.Conn, lock chan struct{}, acquireTimeout, writeTimeout time.Duration, binary bool, compressThreshold int) io.WriteCloser {
+	mt := websocket.TextMessage
+	if binary {
+		mt = websocket.BinaryMessage
+	}
+	if compressThreshold == 0 {
+		compressThreshold = DefaultCompressThreshold
+	}
 	return &exclusiveWriter{
+		msgType:      mt,
+		compressMin:  compressThreshold,
 		writeLock:    lock,
 		lockTimeout:  acquireTimeout,
 		writeTimeout: writeTimeout,
@@ -40,7 +62,7 @@ func Exclusive(conn *websocket.Conn, lock chan struct{}, acquireTimeout, writeTi
 	}
 }
 
-// Write writes a text message to the websocket connection. The first
+// Write writes a message to the websocket connection. The first
 // call tries to acquire the exclusive writer lock, returning
 // ErrWriteLockTimeout if it fails doing so before the timeout.
 func (w *exclusiveWriter) Write(p []byte) (int, error) {
@@ -58,7 +80,8 @@ func (w *exclusiveWriter) Write(p []byte) (int, error) {
 		case <-w.writeLock:
 			// lock acquired, get next writer from the websocket connection
 			w.init = true
-			wc, err := w.wsConn.NextWriter(websocket.TextMessage)
+			w.wsConn.EnableWriteCompression(w.compressMin >= 0 && len(p) >= w.compressMin)
+			wc, err := w.wsConn.NextWriter(w.msgType)
 			if err != nil {
 				return 0, err
 			}
@@ -72,7 +95,7 @@ func (w *exclusiveWriter) Write(p []byte) (int, error) {
 	return w.w.Write(p)
 }
 
-// Close finishes writing the text message to the websocket connection,
+// Close finishes writing the message to the websocket connection,
 // and releases the exclusive write lock.
 func (w *exclusiveWriter) Close() error {
 	if !w.init {
@@ -115,3 +138,11 @@ func (w *limitedWriter) Write(p []byte) (int, error) {
 	}
 	return w.w.Write(p)
 }
+
+// Exceeded returns true if w was returned by Limit and a Write call
+// failed because its limit was exceeded. It is useful when the error
+// returned by Write is wrapped by the caller, e.g. by an encoder.
+func Exceeded(w io.Writer) bool {
+	lw, ok := w.(*limitedWriter)
+	return ok && lw.n < 0
+}
@@ -1,11 +1,20 @@
 package wswriter
 
 import (
+	"bytes"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLimitedWriter(t *testing.T) {
@@ -38,3 +47,94 @@ func TestLimitedWriter(t *testing.T) {
 	}
 	assert.NoError(t, quick.Check(checker, nil))
 }
+
+func TestExceeded(t *testing.T) {
+	var buf bytes.Buffer
+	assert.False(t, Exceeded(&buf), "not limited")
+
+	w := Limit(&buf, 2)
+	_, err := w.Write([]byte("ab"))
+	require.NoError(t, err, "Write within limit")
+	assert.False(t, Exceeded(w), "within limit")
+
+	_, err = w.Write([]byte("c"))
+	assert.Equal(t, ErrWriteLimitExceeded, err, "Write over limit")
+	assert.True(t, Exceeded(w), "over limit")
+	assert.Equal(t, "ab", buf.String(), "written bytes")
+}
+
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func TestExclusiveCompression(t *testing.T) {
+	msgs := make(chan []byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upg := &websocket.Upgrader{EnableCompression: true}
+		conn, err := upg.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		lock := make(chan struct{}, 1)
+		lock <- struct{}{}
+		for p := range msgs {
+			w := Exclusive(conn, lock, time.Second, time.Second, false, 100)
+			if _, err := w.Write(p); err != nil {
+				t.Errorf("Write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	var cc *countingConn
+	d := &websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			cc = &countingConn{Conn: conn}
+			return cc, nil
+		},
+	}
+	conn, _, err := d.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), nil)
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+	defer close(msgs)
+
+	cases := []struct {
+		size       int
+		compressed bool
+	}{
+		{10, false},
+		{99, false},
+		{100, true},
+		{1000, true},
+	}
+	for _, c := range cases {
+		p := bytes.Repeat([]byte("a"), c.size)
+		before := atomic.LoadInt64(&cc.n)
+		msgs <- p
+
+		_, got, err := conn.ReadMessage()
+		require.NoError(t, err, "ReadMessage %d", c.size)
+		assert.Equal(t, p, got, "message of %d bytes", c.size)
+
+		n := atomic.LoadInt64(&cc.n) - before
+		assert.Equal(t, c.compressed, n < int64(c.size), "%d bytes message read as %d bytes", c.size, n)
+	}
+}
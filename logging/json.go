@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// JSON is a Logger that writes the messages as JSON objects, one per
+// line, e.g. for log aggregation services. Each object has the time of
+// the message in RFC 3339 format, its level and the message, followed
+// by the fields, e.g.
+//
+//	{"time":"2016-04-01T12:00:00Z","level":"info","msg":"connected","conn_uuid":"6ba7b810-9dad-11d1-80b4-00c04fd430c8"}
+//
+// The values of the fields are encoded using encoding/json, errors are
+// encoded as their message, and values that fail to encode are
+// encoded as strings using fmt.
+type JSON struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	// Writer is the writer to write to. If nil, os.Stderr is used.
+	Writer io.Writer
+
+	// Level is the minimum level of the messages logged. The default of
+	// 0 logs Info messages and above.
+	Level Level
+
+	mu sync.Mutex // serializes writes
+}
+
+// Log implements Logger for JSON.
+func (j *JSON) Log(level Level, msg string, fields ...Field) {
+	if level < j.Level {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, msg)
+	for _, f := range fields {
+		buf.WriteByte(',')
+		writeJSON(&buf, f.Key)
+		buf.WriteByte(':')
+		writeJSON(&buf, f.Value)
+	}
+	buf.WriteString("}\n")
+
+	w := j.Writer
+	if w == nil {
+		w = os.Stderr
+	}
+	j.mu.Lock()
+	w.Write(buf.Bytes())
+	j.mu.Unlock()
+}
+
+// writeJSON writes the JSON encoding of v to buf.
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := &JSON{Writer: &buf}
+
+	id := uuid.NewRandom()
+	l.Log(Debug, "ignored")
+	l.Log(Info, "sent result", MsgUUID(id), URI("a"), F("n", 3))
+	l.Log(Error, "failed", Err(errors.New("oops")), F("err", errors.New("raw")), F("ch", make(chan int)))
+
+	var objs []map[string]interface{}
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		var obj map[string]interface{}
+		require.NoError(t, json.Unmarshal(s.Bytes(), &obj), "Unmarshal %s", s.Text())
+
+		ts, err := time.Parse(time.RFC3339Nano, obj["time"].(string))
+		if assert.NoError(t, err, "parse time") {
+			assert.WithinDuration(t, time.Now(), ts, time.Second, "time")
+		}
+		delete(obj, "time")
+		objs = append(objs, obj)
+	}
+	require.NoError(t, s.Err(), "Scan")
+	require.Len(t, objs, 2, "number of objects")
+
+	exp := []map[string]interface{}{
+		{"level": "info", "msg": "sent result", "msg_uuid": id.String(), "uri": "a", "n": 3.0},
+		{"level": "error", "msg": "failed", "error": "oops", "err": "raw", "ch": objs[1]["ch"]},
+	}
+	assert.Equal(t, exp, objs, "objects")
+	assert.NotEmpty(t, objs[1]["ch"], "fmt fallback")
+}
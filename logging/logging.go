@@ -0,0 +1,162 @@
+// Package logging defines the Logger interface used by the juggler
+// server, the redisbroker, the callees and the client to log
+// structured messages, and implements it for the standard library's
+// log package and for JSON output.
+//
+// A message is logged with a level and, optionally, fields that
+// identify what it is about, e.g.
+//
+//	l.Log(logging.Warn, "failed to store result", logging.MsgUUID(cp.MsgUUID), logging.Err(err))
+//
+// The fields common to the juggler packages have their own
+// constructor, so that their keys are consistent, e.g. ConnUUID,
+// MsgUUID and URI.
+package logging
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+// Level is the severity of a logged message.
+type Level int
+
+// The list of levels, from the least to the most severe. Info is the
+// zero value, so that the loggers log Info messages and above by
+// default.
+const (
+	Debug Level = iota - 1
+	Info
+	Warn
+	Error
+)
+
+var levelNames = map[Level]string{
+	Debug: "debug",
+	Info:  "info",
+	Warn:  "warn",
+	Error: "error",
+}
+
+// String returns the lowercase name of the level.
+func (l Level) String() string {
+	if s, ok := levelNames[l]; ok {
+		return s
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel returns the level named s, case-insensitive, e.g. "info".
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for l, name := range levelNames {
+		if name == s {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("juggler/logging: invalid level %q", s)
+}
+
+// The keys of the fields common to the juggler packages.
+const (
+	ConnUUIDKey   = "conn_uuid"
+	MsgUUIDKey    = "msg_uuid"
+	URIKey        = "uri"
+	ChannelKey    = "channel"
+	RemoteAddrKey = "remote_addr"
+	ErrKey        = "error"
+)
+
+// Field is a key-value pair that adds context to a logged message.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a field with the key and the value v.
+func F(key string, v interface{}) Field {
+	return Field{Key: key, Value: v}
+}
+
+// ConnUUID returns the field of the UUID of a connection.
+func ConnUUID(id uuid.UUID) Field {
+	return Field{Key: ConnUUIDKey, Value: id.String()}
+}
+
+// MsgUUID returns the field of the UUID of a message.
+func MsgUUID(id uuid.UUID) Field {
+	return Field{Key: MsgUUIDKey, Value: id.String()}
+}
+
+// URI returns the field of the URI of a call.
+func URI(uri string) Field {
+	return Field{Key: URIKey, Value: uri}
+}
+
+// Channel returns the field of a pub-sub channel.
+func Channel(ch string) Field {
+	return Field{Key: ChannelKey, Value: ch}
+}
+
+// RemoteAddr returns the field of the remote address of a connection.
+func RemoteAddr(addr net.Addr) Field {
+	var s string
+	if addr != nil {
+		s = addr.String()
+	}
+	return Field{Key: RemoteAddrKey, Value: s}
+}
+
+// Err returns the field of the error err. Its value is nil if err is
+// nil, the error message otherwise.
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: ErrKey}
+	}
+	return Field{Key: ErrKey, Value: err.Error()}
+}
+
+// Logger logs structured messages. Implementations must be safe for
+// concurrent use.
+type Logger interface {
+	// Log logs the message msg at level, with the fields. The message
+	// should be constant, the values that vary should be in the fields.
+	Log(level Level, msg string, fields ...Field)
+}
+
+// LoggerFunc is a function that implements the Logger interface.
+type LoggerFunc func(Level, string, ...Field)
+
+// Log implements Logger for the LoggerFunc by calling fn.
+func (fn LoggerFunc) Log(level Level, msg string, fields ...Field) {
+	fn(level, msg, fields...)
+}
+
+// Discard is a Logger that discards all messages, e.g. to disable
+// logging where a nil Logger uses a default.
+var Discard Logger = LoggerFunc(func(Level, string, ...Field) {})
+
+// With returns a Logger that adds the fields to the fields of each
+// message logged to l, e.g. to add the UUID of a connection to all
+// messages about that connection.
+func With(l Logger, fields ...Field) Logger {
+	if len(fields) == 0 {
+		return l
+	}
+	return withLogger{l: l, fields: fields}
+}
+
+type withLogger struct {
+	l      Logger
+	fields []Field
+}
+
+func (w withLogger) Log(level Level, msg string, fields ...Field) {
+	all := make([]Field, 0, len(w.fields)+len(fields))
+	all = append(all, w.fields...)
+	all = append(all, fields...)
+	w.l.Log(level, msg, all...)
+}
@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevel(t *testing.T) {
+	for _, l := range []Level{Debug, Info, Warn, Error} {
+		got, err := ParseLevel(l.String())
+		if assert.NoError(t, err, "ParseLevel %s", l) {
+			assert.Equal(t, l, got, "ParseLevel %s", l)
+		}
+	}
+	got, err := ParseLevel(" WARN ")
+	if assert.NoError(t, err, "ParseLevel uppercase") {
+		assert.Equal(t, Warn, got, "ParseLevel uppercase")
+	}
+	_, err = ParseLevel("fatal")
+	assert.Error(t, err, "ParseLevel invalid")
+	assert.Equal(t, "level(9)", Level(9).String(), "String invalid")
+	assert.Equal(t, Info, Level(0), "zero value")
+}
+
+func TestStd(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Std{Logger: log.New(&buf, "", 0), Level: Warn}
+
+	id := uuid.NewRandom()
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	l.Log(Info, "ignored")
+	l.Log(Warn, "closing", ConnUUID(id), RemoteAddr(addr), Err(errors.New("bad thing")), F("n", 2), Err(nil), F("empty", ""))
+
+	exp := fmt.Sprintf("warn: closing conn_uuid=%s remote_addr=127.0.0.1:1234 error=\"bad thing\" n=2 error=<nil> empty=\"\"\n", id)
+	assert.Equal(t, exp, buf.String(), "output")
+}
+
+func TestPrintfWith(t *testing.T) {
+	var lines []string
+	fn := Printf(func(f string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(f, args...))
+	})
+
+	l := With(fn, URI("a"), Channel("b"))
+	l.Log(Debug, "received", F("x", `"y"`))
+	l.Log(Error, "failed")
+	assert.Equal(t, []string{
+		`debug: received uri=a channel=b x="\"y\""`,
+		`error: failed uri=a channel=b`,
+	}, lines, "lines")
+
+	_, ok := With(fn).(Printf)
+	assert.True(t, ok, "With without fields")
+}
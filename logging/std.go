@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Std is a Logger that writes the messages to a standard library
+// logger, as text. Each message is written on a single line, with its
+// level, the message and the fields as key=value pairs, e.g.
+//
+//	info: connected conn_uuid=6ba7b810-9dad-11d1-80b4-00c04fd430c8 remote_addr=127.0.0.1:51234
+//
+// The values that contain spaces, quotes or equal signs are quoted.
+type Std struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	// Logger is the logger to write to. If nil, the standard logger of
+	// the log package is used.
+	Logger *log.Logger
+
+	// Level is the minimum level of the messages logged. The default of
+	// 0 logs Info messages and above.
+	Level Level
+}
+
+// Log implements Logger for Std.
+func (s *Std) Log(level Level, msg string, fields ...Field) {
+	if level < s.Level {
+		return
+	}
+	line := formatText(level, msg, fields)
+	if s.Logger != nil {
+		s.Logger.Print(line)
+		return
+	}
+	log.Print(line)
+}
+
+// Printf is a Logger that formats the messages as Std does and calls
+// the function with the line, e.g. to log using testing.T.Logf or an
+// existing printf-style logging function. It logs messages of all
+// levels.
+type Printf func(string, ...interface{})
+
+// Log implements Logger for Printf.
+func (fn Printf) Log(level Level, msg string, fields ...Field) {
+	fn("%s", formatText(level, msg, fields))
+}
+
+// formatText returns the text line of the message msg at level with
+// the fields.
+func formatText(level Level, msg string, fields []Field) string {
+	var buf bytes.Buffer
+	buf.WriteString(level.String())
+	buf.WriteString(": ")
+	buf.WriteString(msg)
+	for _, f := range fields {
+		buf.WriteByte(' ')
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		buf.WriteString(formatValue(f.Value))
+	}
+	return buf.String()
+}
+
+// formatValue returns the text of the value v, quoted if needed.
+func formatValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,149 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Codec defines the methods required to encode and decode messages
+// on the wire. The codec of a connection is selected by the websocket
+// subprotocol negotiated during the handshake (see Codecs). The Args
+// fields of the messages are transferred as opaque bytes, they are
+// not decoded by the codec.
+type Codec interface {
+	// Encode writes the encoding of v to w.
+	Encode(w io.Writer, v interface{}) error
+
+	// Decode decodes the encoded value b into v.
+	Decode(b []byte, v interface{}) error
+
+	// Binary returns true if the encoded messages must be sent as
+	// websocket.BinaryMessage, false if they must be sent as
+	// websocket.TextMessage.
+	Binary() bool
+}
+
+// The codecs supported by this package.
+var (
+	// JSONCodec is the default codec, used by the juggler.0 and
+	// juggler.1 subprotocols.
+	JSONCodec Codec = jsonCodec{}
+
+	// MsgpackCodec encodes messages using MessagePack, used by the
+	// juggler.0+msgpack and juggler.1+msgpack subprotocols.
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+// Codecs maps the websocket subprotocols to the codec used to encode
+// and decode the messages on connections that negotiated it. Custom
+// codecs can be added to this map, typically in an init function,
+// along with the juggler.Subprotocols supported by the server.
+// Subprotocols that are not in Codecs use JSONCodec.
+var Codecs = map[string]Codec{
+	"juggler.0+msgpack": MsgpackCodec,
+	"juggler.1+msgpack": MsgpackCodec,
+}
+
+// CodecFor returns the codec to use for the subprotocol.
+func CodecFor(subprotocol string) Codec {
+	if c := Codecs[subprotocol]; c != nil {
+		return c
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (jsonCodec) Decode(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+func (jsonCodec) Binary() bool { return false }
+
+// msgpackHandle uses the binary and string types of the current
+// MessagePack spec, so that Args are encoded as raw bytes.
+var msgpackHandle = newMsgpackHandle()
+
+func newMsgpackHandle() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{WriteExt: true}
+	h.RawToString = true
+	return h
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(w io.Writer, v interface{}) error {
+	return codec.NewEncoder(w, msgpackHandle).Encode(v)
+}
+
+func (msgpackCodec) Decode(b []byte, v interface{}) error {
+	return codec.NewDecoderBytes(b, msgpackHandle).Decode(v)
+}
+
+func (msgpackCodec) Binary() bool { return true }
+
+// DecodeRequest is like UnmarshalRequest, but the message is decoded
+// from r using the codec c.
+func DecodeRequest(c Codec, r io.Reader, allowedMsgs ...Type) (Msg, error) {
+	var cleaned []Type
+	for _, t := range allowedMsgs {
+		if t.IsRead() {
+			cleaned = append(cleaned, t)
+		}
+	}
+	if len(cleaned) == 0 {
+		cleaned = allReqMsgs
+	}
+	return decodeIf(c, r, cleaned...)
+}
+
+// DecodeResponse is like UnmarshalResponse, but the message is decoded
+// from r using the codec c.
+func DecodeResponse(c Codec, r io.Reader) (Msg, error) {
+	return decodeIf(c, r, NackMsg, AckMsg, EvntMsg, ResMsg, ProgMsg, BackMsg)
+}
+
+// Decode is like Unmarshal, but the message is decoded from r using
+// the codec c.
+func Decode(c Codec, r io.Reader) (Msg, error) {
+	return decodeIf(c, r)
+}
+
+func decodeIf(c Codec, r io.Reader, allowed ...Type) (Msg, error) {
+	if _, ok := c.(jsonCodec); ok {
+		return unmarshalIf(r, allowed...)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// decode the metadata first to get the concrete message type
+	var pm struct {
+		Meta Meta `json:"meta"`
+	}
+	if err := c.Decode(b, &pm); err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	if len(allowed) > 0 && !isIn(allowed, pm.Meta.T) {
+		return nil, fmt.Errorf("invalid message %s for this peer", pm.Meta.T)
+	}
+
+	m, _ := newMsg(pm.Meta.T)
+	if m == nil {
+		return nil, fmt.Errorf("unknown message %s", pm.Meta.T)
+	}
+	if err := c.Decode(b, m); err != nil {
+		return nil, fmt.Errorf("invalid %s message: %v", pm.Meta.T, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,84 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecFor(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, JSONCodec, CodecFor(""), "empty")
+	assert.Equal(t, JSONCodec, CodecFor("juggler.0"), "juggler.0")
+	assert.Equal(t, MsgpackCodec, CodecFor("juggler.0+msgpack"), "juggler.0+msgpack")
+	assert.False(t, JSONCodec.Binary(), "JSON is text")
+	assert.True(t, MsgpackCodec.Binary(), "msgpack is binary")
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	t.Parallel()
+
+	call, err := NewCall("a", map[string]interface{}{"x": 3}, time.Second)
+	require.NoError(t, err, "NewCall")
+	call.SetHeader("locale", "fr")
+	pub, err := NewPub("d", map[string]interface{}{"y": "ok"})
+	require.NoError(t, err, "NewPub")
+	pub.SetHeader("correlation-id", "1234")
+	rp := &ResPayload{
+		ConnUUID: uuid.NewRandom(),
+		MsgUUID:  uuid.NewRandom(),
+		URI:      "g",
+		Args:     json.RawMessage(`{"not":"decoded"}`),
+	}
+
+	cases := []Msg{
+		call,
+		NewSub("b", false),
+		NewUnsb("c", true),
+		pub,
+		NewNack(call, 500, io.EOF),
+		NewAck(pub),
+		NewRes(rp),
+		NewProg(rp),
+	}
+	for i, m := range cases {
+		var buf bytes.Buffer
+		require.NoError(t, MsgpackCodec.Encode(&buf, m), "Encode %d", i)
+		b := buf.Bytes()
+
+		mm, err := Decode(MsgpackCodec, bytes.NewReader(b))
+		require.NoError(t, err, "Decode %d", i)
+
+		// for NackMsg, the Nack is not marshaled, so zero it before the comparison
+		if m.Type() == NackMsg {
+			m.(*Nack).Payload.Err = nil
+		}
+
+		assert.True(t, reflect.DeepEqual(m, mm), "DeepEqual %d", i)
+
+		_, err = DecodeRequest(MsgpackCodec, bytes.NewReader(b))
+		assert.Equal(t, m.Type().IsRead(), err == nil, "DecodeRequest for %d", i)
+
+		_, err = DecodeResponse(MsgpackCodec, bytes.NewReader(b))
+		assert.Equal(t, m.Type().IsWrite(), err == nil, "DecodeResponse for %d", i)
+
+		// args are not decoded
+		if res, ok := mm.(*Res); ok {
+			assert.Equal(t, rp.Args, res.Payload.Args, "Args")
+		}
+	}
+
+	// JSON-encoded messages are invalid
+	b, err := json.Marshal(call)
+	require.NoError(t, err, "Marshal")
+	_, err = Decode(MsgpackCodec, bytes.NewReader(b))
+	assert.Error(t, err, "Decode JSON")
+}
@@ -7,6 +7,7 @@
 //     - SUB  : to subscribe to a pub-sub channel
 //     - UNSB : to unsubscribe from a pub-sub channel
 //     - PUB  : to publish to a pub-sub channel
+//     - BTCH : to send many CALL, SUB, UNSB or PUB requests at once
 //
 // And the following messages for the server:
 //
@@ -14,15 +15,34 @@
 //     - NACK : failed CALL, SUB, UNSB or PUB
 //     - RES  : the result of a CALL message
 //     - EVNT : an event triggered on a channel that the client is subscribed to
+//     - PROG : a partial result or progress update of a CALL message, before its RES
+//     - BACK : the ACK and NACK responses to the requests of a BTCH message
 //
-// All messages must be of type websocket.TextMessage. Failing to properly
+// The juggler.1 protocol adds a HELLO message for the client, which
+// must be the first message it sends on the connection, and a WELCOME
+// message that the server sends in response, with the session ID, the
+// capabilities and the limits of the server. Apart from that, it
+// supports the same messages as juggler.0. The version of the protocol
+// is identified by the websocket subprotocol (see Protocol).
+//
+// All messages may carry optional headers in their metadata, a map of
+// strings to strings for data such as the locale, the version of the
+// client or correlation IDs, so that it does not pollute the arguments
+// (see Meta). The headers of CALL and PUB requests are propagated to
+// the callees and the subscribers.
+//
+// Messages are JSON-encoded and must be of type websocket.TextMessage,
+// unless a binary codec is negotiated with the subprotocol, such as
+// MessagePack with juggler.0+msgpack, in which case they must be of
+// type websocket.BinaryMessage (see Codecs). Failing to properly
 // speak the protocol terminates the connection without notice from the
-// peer. That includes sending binary messages and sending unknown (or
-// invalid for the peer) message types.
+// peer. That includes sending messages of the wrong websocket type and
+// sending unknown (or invalid for the peer) message types.
 //
 package message
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -48,8 +68,16 @@ const (
 	AckMsg
 	ResMsg
 	EvntMsg
+	ProgMsg
 	endWrite
 
+	// messages added after the initial ones, so that the values of
+	// the existing types on the wire are unchanged.
+	BtchMsg
+	BackMsg
+	HelloMsg
+	WelcomeMsg
+
 	// customMsg allows for definition of custom message types,
 	// starting at ID 256 (first 255 are reserved).
 	customMsg Type = 256
@@ -66,6 +94,12 @@ var lookupType = map[Type]string{
 	AckMsg:  "ACK",
 	ResMsg:  "RES",
 	EvntMsg: "EVNT",
+	ProgMsg: "PROG",
+	BtchMsg: "BTCH",
+	BackMsg: "BACK",
+
+	HelloMsg:   "HELLO",
+	WelcomeMsg: "WELCOME",
 }
 
 // Register registers a new custom message having the
@@ -109,6 +143,10 @@ func (mt Type) String() string {
 // point of view of the server (that is, if this is a message
 // that was sent by a client).
 func (mt Type) IsRead() bool {
+	switch mt {
+	case BtchMsg, HelloMsg:
+		return true
+	}
 	return startRead < mt && mt < endRead
 }
 
@@ -116,6 +154,10 @@ func (mt Type) IsRead() bool {
 // point of view of the server (that is, if this is a message
 // that is being sent by the server).
 func (mt Type) IsWrite() bool {
+	switch mt {
+	case BackMsg, WelcomeMsg:
+		return true
+	}
 	return startWrite < mt && mt < endWrite
 }
 
@@ -134,10 +176,29 @@ type Msg interface {
 	UUID() uuid.UUID
 }
 
-// Meta contains the metadata for a message.
+// HeaderMsg is implemented by messages that carry headers, which is
+// the case of all messages that embed Meta.
+type HeaderMsg interface {
+	Msg
+
+	// Headers returns the headers of the message, nil if none is set.
+	Headers() map[string]string
+
+	// SetHeader sets the header key to value.
+	SetHeader(key, value string)
+
+	// DelHeader removes the header key.
+	DelHeader(key string)
+}
+
+// Meta contains the metadata for a message. The optional headers
+// carry data such as the locale, the version of the client or
+// correlation IDs. The headers of CALL and PUB requests are
+// propagated to the callees and the subscribers.
 type Meta struct {
-	T Type      `json:"type"`
-	U uuid.UUID `json:"uuid"`
+	T Type              `json:"type"`
+	U uuid.UUID         `json:"uuid"`
+	H map[string]string `json:"headers,omitempty"`
 }
 
 // NewMeta returns a new, initialized Meta.
@@ -162,17 +223,56 @@ func (m Meta) UUID() uuid.UUID {
 	return m.U
 }
 
+// Headers returns the message's headers, nil if none is set.
+func (m Meta) Headers() map[string]string {
+	return m.H
+}
+
+// SetHeader sets the header key of the message to value.
+func (m *Meta) SetHeader(key, value string) {
+	if m.H == nil {
+		m.H = make(map[string]string)
+	}
+	m.H[key] = value
+}
+
+// DelHeader removes the header key of the message.
+func (m *Meta) DelHeader(key string) {
+	delete(m.H, key)
+}
+
+// HeadersSize returns the size in bytes of the headers h, which is
+// the sum of the lengths of their keys and values.
+func HeadersSize(h map[string]string) int {
+	var n int
+	for k, v := range h {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
 // Call is a message that triggers an RPC call to a callee
 // listening on the specified URI. The Args opaque field
 // is transferred as-is to the callee. If the result is not
 // available and sent back to the caller before the specified
-// timeout, it is dropped.
+// timeout, it is dropped. If NotBefore is set to a future time, the
+// call is scheduled to run at that time, and the timeout starts from
+// that time. If IdempotencyKey is set, duplicate calls with the same
+// key on the same URI, made by a connection with the same identity,
+// may receive the result of the first call instead of running again,
+// if the broker supports it. Error results are not reused. If
+// Broadcast is true, the call is sent to all callees listening on the
+// URI, and each one sends its own Res for the call.
 type Call struct {
 	Meta    `json:"meta"`
 	Payload struct {
-		URI     string          `json:"uri"`
-		Timeout time.Duration   `json:"timeout"`
-		Args    json.RawMessage `json:"args"`
+		URI            string          `json:"uri"`
+		Timeout        time.Duration   `json:"timeout"`
+		Priority       int             `json:"priority,omitempty"` // higher is more urgent, 0 by default
+		NotBefore      *time.Time      `json:"not_before,omitempty"`
+		IdempotencyKey string          `json:"idempotency_key,omitempty"`
+		Broadcast      bool            `json:"broadcast,omitempty"`
+		Args           json.RawMessage `json:"args"`
 	} `json:"payload"`
 }
 
@@ -279,6 +379,10 @@ type Nack struct {
 		Code    int       `json:"code"`
 		Message string    `json:"message"` // defaults to Err.Error()
 		Err     error     `json:"-"`       // useful in the handler to have access to the source error, but not sent to the peer
+
+		// set when Err is an *Error
+		Retryable bool            `json:"retryable,omitempty"`
+		Details   json.RawMessage `json:"details,omitempty"`
 	} `json:"payload"`
 }
 
@@ -293,6 +397,10 @@ func NewNack(from Msg, code int, e error) *Nack {
 	nack.Payload.Code = code
 	nack.Payload.Err = e
 	nack.Payload.Message = e.Error()
+	if e, ok := e.(*Error); ok {
+		nack.Payload.Retryable = e.Retryable
+		nack.Payload.Details = e.Details
+	}
 
 	switch from := from.(type) {
 	case *Call:
@@ -326,6 +434,10 @@ func NewNack(from Msg, code int, e error) *Nack {
 		nack.Payload.For = from.Payload.For
 		nack.Payload.ForType = CallMsg
 		nack.Payload.URI = from.Payload.URI
+	case *Prog:
+		nack.Payload.For = from.Payload.For
+		nack.Payload.ForType = CallMsg
+		nack.Payload.URI = from.Payload.URI
 	}
 	return nack
 }
@@ -333,7 +445,8 @@ func NewNack(from Msg, code int, e error) *Nack {
 // Ack is a successful acknowledge message, meaning the request of the
 // caller was successfully registered. It doesn't mean that e.g. a CALL
 // has succeeded - only that the CALL was properly registered for a
-// callee to process, eventually.
+// callee to process, eventually. For a broadcast CALL, Callees is
+// the number of callees that received the call, if known.
 type Ack struct {
 	Meta    `json:"meta"`
 	Payload struct {
@@ -341,6 +454,7 @@ type Ack struct {
 		ForType Type      `json:"for_type"`
 		URI     string    `json:"uri,omitempty"`     // when in response to a CALL
 		Channel string    `json:"channel,omitempty"` // when in response to a PUB, SUB or UNSB
+		Callees int       `json:"callees,omitempty"` // when in response to a broadcast CALL
 	} `json:"payload"`
 }
 
@@ -367,12 +481,14 @@ func NewAck(from Msg) *Ack {
 }
 
 // Res is a result message. It returns the result of the invocation
-// of a Call message.
+// of a Call message. If the callee sent partial results before the
+// final one, Seq is the number of partial results plus one.
 type Res struct {
 	Meta    `json:"meta"`
 	Payload struct {
 		For  uuid.UUID       `json:"for"`           // no ForType, because always CALL
 		URI  string          `json:"uri,omitempty"` // URI of the CALL
+		Seq  int             `json:"seq,omitempty"` // when the result is the last of a stream
 		Args json.RawMessage `json:"args"`
 	} `json:"payload"`
 }
@@ -380,15 +496,73 @@ type Res struct {
 // ErrResult is the payload of a Res message when the call results in
 // an error (that is, the callee was invoked, and returned an error).
 // It marshals to {"error": {"message": "<error message>"}}, which is
-// similar to a standard Javascript error object.
+// similar to a standard Javascript error object. The code, retryable
+// and details fields of the error are only set if the callee returned
+// an *Error.
 //
 // To return a custom payload for an error, implement json.Marshaler
 // for the error type. All errors that do not implement json.Marshaler
 // are returned using ErrResult.
 type ErrResult struct {
-	Error struct {
-		Message string `json:"message"`
-	} `json:"error"`
+	Error Error `json:"error"`
+}
+
+// Error is the standard error model of juggler. It is the error of
+// an ErrResult, and the error information of a Nack. The Code follows
+// the meaning of HTTP status codes, e.g. 400 for invalid arguments,
+// 401 and 403 for authentication and authorization failures, 500 for
+// internal errors, 501 for unsupported features and 503 when a service
+// is unavailable or over capacity. Retryable indicates that the same
+// request may succeed if it is sent again later, and Details is an
+// optional JSON value with additional information about the error.
+type Error struct {
+	Code      int             `json:"code,omitempty"`
+	Message   string          `json:"message"`
+	Retryable bool            `json:"retryable,omitempty"`
+	Details   json.RawMessage `json:"details,omitempty"`
+}
+
+// Error returns the message of the error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Err returns the error of the result as an *Error if it is an error
+// result, nil otherwise.
+func (r *Res) Err() error {
+	return ResultErr(r.Payload.Args)
+}
+
+// Err returns the error of the partial result as an *Error if it is
+// an error result, nil otherwise.
+func (p *Prog) Err() error {
+	return ResultErr(p.Payload.Args)
+}
+
+// ResultErr returns the error of the result args as an *Error if it is
+// an error result (see ErrResult), nil otherwise.
+func ResultErr(args json.RawMessage) error {
+	args = bytes.TrimSpace(args)
+	if len(args) == 0 || args[0] != '{' {
+		return nil
+	}
+	var v struct {
+		Error *Error `json:"error"`
+	}
+	if err := json.Unmarshal(args, &v); err != nil || v.Error == nil {
+		return nil
+	}
+	return v.Error
+}
+
+// NackErr returns the error of the Nack as an *Error.
+func NackErr(n *Nack) *Error {
+	return &Error{
+		Code:      n.Payload.Code,
+		Message:   n.Payload.Message,
+		Retryable: n.Payload.Retryable,
+		Details:   n.Payload.Details,
+	}
 }
 
 // NewRes creates a new Res message corresponding to a call result.
@@ -398,10 +572,40 @@ func NewRes(pld *ResPayload) *Res {
 	}
 	res.Payload.For = pld.MsgUUID
 	res.Payload.URI = pld.URI
+	res.Payload.Seq = pld.Seq
 	res.Payload.Args = pld.Args
+	res.H = pld.Headers
 	return res
 }
 
+// Prog is a progress message. It returns a partial result or a progress
+// update of the invocation of a Call message, before its Res. The
+// Prog messages of a call are sent in order, Seq starting at 1, and
+// the call is still pending until its Res is sent.
+type Prog struct {
+	Meta    `json:"meta"`
+	Payload struct {
+		For  uuid.UUID       `json:"for"`           // no ForType, because always CALL
+		URI  string          `json:"uri,omitempty"` // URI of the CALL
+		Seq  int             `json:"seq"`
+		Args json.RawMessage `json:"args"`
+	} `json:"payload"`
+}
+
+// NewProg creates a new Prog message corresponding to a partial call
+// result.
+func NewProg(pld *ResPayload) *Prog {
+	prog := &Prog{
+		Meta: NewMeta(ProgMsg),
+	}
+	prog.Payload.For = pld.MsgUUID
+	prog.Payload.URI = pld.URI
+	prog.Payload.Seq = pld.Seq
+	prog.Payload.Args = pld.Args
+	prog.H = pld.Headers
+	return prog
+}
+
 // Evnt is a published event. It is sent to all subscribers of the
 // Channel.
 type Evnt struct {
@@ -411,6 +615,7 @@ type Evnt struct {
 		Channel string          `json:"channel,omitempty"`
 		Pattern string          `json:"pattern,omitempty"` // if triggered because of a pattern-based subscription
 		Args    json.RawMessage `json:"args"`
+		Gap     bool            `json:"gap,omitempty"` // if events may have been lost on that subscription
 	} `json:"payload"`
 }
 
@@ -424,33 +629,138 @@ func NewEvnt(pld *EvntPayload) *Evnt {
 	ev.Payload.Pattern = pld.Pattern
 	ev.Payload.For = pld.MsgUUID
 	ev.Payload.Args = pld.Args
+	ev.Payload.Gap = pld.Gap
+	ev.H = pld.Headers
 	return ev
 }
 
-var allReqMsgs = []Type{CallMsg, SubMsg, UnsbMsg, PubMsg}
+// Btch is a batch message. It sends many CALL, SUB, UNSB or PUB
+// requests in a single message, which the server processes in order
+// as if they were sent individually. Instead of an ACK or NACK for
+// each request, the server responds with a single Back message. Each
+// of the Msgs is a request encoded with the codec of the connection.
+type Btch struct {
+	Meta    `json:"meta"`
+	Payload struct {
+		Msgs []json.RawMessage `json:"msgs"`
+	} `json:"payload"`
+}
+
+// NewBtch creates a new Btch message with the requests msgs, encoded
+// using the codec c.
+func NewBtch(c Codec, msgs ...Msg) (*Btch, error) {
+	raw, err := encodeEntries(c, msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	btch := &Btch{
+		Meta: NewMeta(BtchMsg),
+	}
+	btch.Payload.Msgs = raw
+	return btch, nil
+}
+
+var batchReqMsgs = []Type{CallMsg, SubMsg, UnsbMsg, PubMsg}
+
+// Requests decodes the requests of the batch using the codec c. It
+// returns an error if a request is invalid or is not in the
+// restricted list of allowed messages, if any. Batches cannot be
+// nested.
+func (b *Btch) Requests(c Codec, allowedMsgs ...Type) ([]Msg, error) {
+	allowed := batchReqMsgs
+	if len(allowedMsgs) > 0 {
+		allowed = nil
+		for _, t := range allowedMsgs {
+			if isIn(batchReqMsgs, t) {
+				allowed = append(allowed, t)
+			}
+		}
+		if len(allowed) == 0 {
+			return nil, fmt.Errorf("invalid message %s for this peer", BtchMsg)
+		}
+	}
+	return decodeEntries(c, b.Payload.Msgs, allowed)
+}
+
+// Back is a batch acknowledge message. It is the response to a Btch
+// message, and Msgs contains the Ack or Nack of each of its requests,
+// in order, encoded with the codec of the connection. The server sends
+// the results of the calls of the batch after the Back.
+type Back struct {
+	Meta    `json:"meta"`
+	Payload struct {
+		For  uuid.UUID         `json:"for"` // no ForType, because always BTCH
+		Msgs []json.RawMessage `json:"msgs"`
+	} `json:"payload"`
+}
+
+// NewBack creates a new Back message in response to the from batch,
+// with the responses msgs encoded using the codec c.
+func NewBack(c Codec, from *Btch, msgs ...Msg) (*Back, error) {
+	raw, err := encodeEntries(c, msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	back := &Back{
+		Meta: NewMeta(BackMsg),
+	}
+	back.Payload.For = from.UUID()
+	back.Payload.Msgs = raw
+	return back, nil
+}
+
+// Responses decodes the Ack and Nack responses of the batch using the
+// codec c.
+func (b *Back) Responses(c Codec) ([]Msg, error) {
+	return decodeEntries(c, b.Payload.Msgs, []Type{AckMsg, NackMsg})
+}
+
+func encodeEntries(c Codec, msgs []Msg) ([]json.RawMessage, error) {
+	raw := make([]json.RawMessage, 0, len(msgs))
+	for _, m := range msgs {
+		var buf bytes.Buffer
+		if err := c.Encode(&buf, m); err != nil {
+			return nil, err
+		}
+		b := buf.Bytes()
+		if !c.Binary() {
+			// text encoders may add a trailing newline
+			b = bytes.TrimSpace(b)
+		}
+		raw = append(raw, b)
+	}
+	return raw, nil
+}
+
+func decodeEntries(c Codec, raw []json.RawMessage, allowed []Type) ([]Msg, error) {
+	msgs := make([]Msg, 0, len(raw))
+	for _, b := range raw {
+		m, err := decodeIf(c, bytes.NewReader(b), allowed...)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+var allReqMsgs = []Type{CallMsg, SubMsg, UnsbMsg, PubMsg, BtchMsg}
 
 // UnmarshalRequest unmarshals a JSON-encoded message from r into the
 // correct concrete message type. It returns an error if the message
 // type is invalid for a request (client -> server) and for the restricted
 // list of allowed messages, if any.
 func UnmarshalRequest(r io.Reader, allowedMsgs ...Type) (Msg, error) {
-	var cleaned []Type
-	for _, t := range allowedMsgs {
-		if t.IsRead() {
-			cleaned = append(cleaned, t)
-		}
-	}
-	if len(cleaned) == 0 {
-		cleaned = allReqMsgs
-	}
-	return unmarshalIf(r, cleaned...)
+	return DecodeRequest(JSONCodec, r, allowedMsgs...)
 }
 
 // UnmarshalResponse unmarshals a JSON-encoded message from r into the
 // correct concrete message type. It returns an error if the message
 // type is invalid for a response (client <- server).
 func UnmarshalResponse(r io.Reader) (Msg, error) {
-	return unmarshalIf(r, NackMsg, AckMsg, EvntMsg, ResMsg)
+	return unmarshalIf(r, NackMsg, AckMsg, EvntMsg, ResMsg, ProgMsg, BackMsg)
 }
 
 // Unmarshal unmarshals a JSON-encoded message from r into the correct
@@ -490,67 +800,60 @@ func unmarshalIf(r io.Reader, allowed ...Type) (Msg, error) {
 		return nil
 	}
 
-	var m Msg
-	switch pm.Meta.T {
+	m, meta := newMsg(pm.Meta.T)
+	if m == nil {
+		return nil, fmt.Errorf("unknown message %s", pm.Meta.T)
+	}
+	if err := genericUnmarshal(m, meta); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newMsg returns a new zero-value message of type t, along with a
+// pointer to its Meta. It returns nil if t is not a standard message
+// type.
+func newMsg(t Type) (Msg, *Meta) {
+	switch t {
 	case CallMsg:
 		var call Call
-		if err := genericUnmarshal(&call, &call.Meta); err != nil {
-			return nil, err
-		}
-		m = &call
-
+		return &call, &call.Meta
 	case SubMsg:
 		var sub Sub
-		if err := genericUnmarshal(&sub, &sub.Meta); err != nil {
-			return nil, err
-		}
-		m = &sub
-
+		return &sub, &sub.Meta
 	case UnsbMsg:
 		var uns Unsb
-		if err := genericUnmarshal(&uns, &uns.Meta); err != nil {
-			return nil, err
-		}
-		m = &uns
-
+		return &uns, &uns.Meta
 	case PubMsg:
 		var pub Pub
-		if err := genericUnmarshal(&pub, &pub.Meta); err != nil {
-			return nil, err
-		}
-		m = &pub
-
+		return &pub, &pub.Meta
 	case NackMsg:
 		var nack Nack
-		if err := genericUnmarshal(&nack, &nack.Meta); err != nil {
-			return nil, err
-		}
-		m = &nack
-
+		return &nack, &nack.Meta
 	case AckMsg:
 		var ack Ack
-		if err := genericUnmarshal(&ack, &ack.Meta); err != nil {
-			return nil, err
-		}
-		m = &ack
-
+		return &ack, &ack.Meta
 	case ResMsg:
 		var res Res
-		if err := genericUnmarshal(&res, &res.Meta); err != nil {
-			return nil, err
-		}
-		m = &res
-
+		return &res, &res.Meta
 	case EvntMsg:
 		var ev Evnt
-		if err := genericUnmarshal(&ev, &ev.Meta); err != nil {
-			return nil, err
-		}
-		m = &ev
-
-	default:
-		return nil, fmt.Errorf("unknown message %s", pm.Meta.T)
+		return &ev, &ev.Meta
+	case ProgMsg:
+		var prog Prog
+		return &prog, &prog.Meta
+	case BtchMsg:
+		var btch Btch
+		return &btch, &btch.Meta
+	case BackMsg:
+		var back Back
+		return &back, &back.Meta
+	case HelloMsg:
+		var hello Hello
+		return &hello, &hello.Meta
+	case WelcomeMsg:
+		var welcome Welcome
+		return &welcome, &welcome.Meta
 	}
-
-	return m, nil
+	return nil, nil
 }
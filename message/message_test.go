@@ -31,6 +31,11 @@ func TestMarshalUnmarshal(t *testing.T) {
 
 	call, err := NewCall("a", map[string]interface{}{"x": 3}, time.Second)
 	require.NoError(t, err, "NewCall")
+	sched, err := NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	nb := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	sched.Payload.NotBefore = &nb
+	sched.Payload.IdempotencyKey = "k"
 	pub, err := NewPub("d", map[string]interface{}{"y": "ok"})
 	require.NoError(t, err, "NewPub")
 	rp := &ResPayload{
@@ -39,6 +44,14 @@ func TestMarshalUnmarshal(t *testing.T) {
 		URI:      "g",
 		Args:     json.RawMessage("null"),
 	}
+	prp := &ResPayload{
+		ConnUUID: uuid.NewRandom(),
+		MsgUUID:  uuid.NewRandom(),
+		URI:      "g",
+		Args:     json.RawMessage(`{"done":50}`),
+		Partial:  true,
+		Seq:      1,
+	}
 	ep := &EvntPayload{
 		MsgUUID: uuid.NewRandom(),
 		Channel: "h",
@@ -48,12 +61,14 @@ func TestMarshalUnmarshal(t *testing.T) {
 
 	cases := []Msg{
 		call,
+		sched,
 		NewSub("b", false),
 		NewUnsb("c", true),
 		pub,
 		NewNack(call, 500, io.EOF),
 		NewAck(pub),
 		NewRes(rp),
+		NewProg(prp),
 		NewEvnt(ep),
 	}
 	for i, m := range cases {
@@ -93,6 +108,70 @@ func TestNewNackFromAck(t *testing.T) {
 	assert.Equal(t, nack.Payload.Channel, ack.Payload.Channel, "Channel")
 }
 
+func TestNewNackFromError(t *testing.T) {
+	t.Parallel()
+
+	call, err := NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	e := &Error{Code: 503, Message: "busy", Retryable: true, Details: json.RawMessage(`{"after":1}`)}
+	nack := NewNack(call, 503, e)
+
+	b, err := json.Marshal(nack)
+	require.NoError(t, err, "Marshal")
+	var got Nack
+	require.NoError(t, json.Unmarshal(b, &got), "Unmarshal")
+	assert.Equal(t, e, NackErr(&got), "NackErr")
+}
+
+func TestResultErr(t *testing.T) {
+	t.Parallel()
+
+	var er ErrResult
+	er.Error.Code = 400
+	er.Error.Message = "invalid"
+	b, err := json.Marshal(er)
+	require.NoError(t, err, "Marshal")
+	assert.Equal(t, `{"error":{"code":400,"message":"invalid"}}`, string(b), "ErrResult")
+
+	cases := []struct {
+		args string
+		want error
+	}{
+		{"", nil},
+		{"null", nil},
+		{`"error"`, nil},
+		{`{"error": "x"}`, nil},
+		{`{"error": null}`, nil},
+		{string(b), &Error{Code: 400, Message: "invalid"}},
+		{`{"error": {"message": "x", "retryable": true}}`, &Error{Message: "x", Retryable: true}},
+	}
+	for _, c := range cases {
+		got := ResultErr(json.RawMessage(c.args))
+		assert.Equal(t, c.want, got, c.args)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	sub := NewSub("a", false)
+	b, err := json.Marshal(sub)
+	require.NoError(t, err, "Marshal without headers")
+	assert.NotContains(t, string(b), "headers", "no headers")
+
+	var hm HeaderMsg = sub
+	hm.SetHeader("locale", "fr")
+	hm.SetHeader("client", "test/1.0")
+	assert.Equal(t, map[string]string{"locale": "fr", "client": "test/1.0"}, sub.Headers(), "headers")
+	assert.Equal(t, 22, HeadersSize(sub.Headers()), "headers size")
+
+	hm.DelHeader("client")
+	b, err = json.Marshal(sub)
+	require.NoError(t, err, "Marshal with headers")
+
+	m, err := UnmarshalRequest(bytes.NewReader(b))
+	require.NoError(t, err, "UnmarshalRequest")
+	assert.Equal(t, map[string]string{"locale": "fr"}, m.(HeaderMsg).Headers(), "unmarshaled headers")
+}
+
 func TestRegister(t *testing.T) {
 	nm := uuid.NewRandom().String() // avoid failures when running tests multiple times
 
@@ -161,3 +240,53 @@ func TestUnmarshalRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+
+	call, err := NewCall("a", map[string]interface{}{"x": 3}, time.Second)
+	require.NoError(t, err, "NewCall")
+	sub := NewSub("b", false)
+
+	for _, c := range []Codec{JSONCodec, MsgpackCodec} {
+		btch, err := NewBtch(c, call, sub)
+		require.NoError(t, err, "NewBtch %T", c)
+
+		var buf bytes.Buffer
+		require.NoError(t, c.Encode(&buf, btch), "Encode BTCH %T", c)
+		m, err := DecodeRequest(c, bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err, "DecodeRequest %T", c)
+		require.IsType(t, &Btch{}, m, "BTCH %T", c)
+
+		reqs, err := m.(*Btch).Requests(c)
+		require.NoError(t, err, "Requests %T", c)
+		assert.True(t, reflect.DeepEqual([]Msg{call, sub}, reqs), "requests %T", c)
+
+		_, err = m.(*Btch).Requests(c, SubMsg)
+		assert.Error(t, err, "CALL not allowed %T", c)
+		_, err = m.(*Btch).Requests(c, BtchMsg)
+		assert.Error(t, err, "nothing allowed %T", c)
+
+		nested, err := NewBtch(c, btch)
+		require.NoError(t, err, "NewBtch nested %T", c)
+		_, err = nested.Requests(c)
+		assert.Error(t, err, "nested batch %T", c)
+
+		ack := NewAck(call)
+		nack := NewNack(sub, 500, io.EOF)
+		nack.Payload.Err = nil
+		back, err := NewBack(c, btch, ack, nack)
+		require.NoError(t, err, "NewBack %T", c)
+
+		buf.Reset()
+		require.NoError(t, c.Encode(&buf, back), "Encode BACK %T", c)
+		m, err = DecodeResponse(c, bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err, "DecodeResponse %T", c)
+		require.IsType(t, &Back{}, m, "BACK %T", c)
+		assert.Equal(t, btch.UUID(), m.(*Back).Payload.For, "BACK for %T", c)
+
+		resps, err := m.(*Back).Responses(c)
+		require.NoError(t, err, "Responses %T", c)
+		assert.True(t, reflect.DeepEqual([]Msg{ack, nack}, resps), "responses %T", c)
+	}
+}
@@ -13,8 +13,25 @@ type CallPayload struct {
 	ConnUUID uuid.UUID       `json:"conn_uuid"`
 	MsgUUID  uuid.UUID       `json:"msg_uuid"`
 	URI      string          `json:"uri"`
+	Priority int             `json:"priority,omitempty"`
 	Args     json.RawMessage `json:"args,omitempty"`
 
+	// IdempotencyKey identifies duplicate calls on the same URI.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Headers are the headers of the CALL message.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Broadcast is set if the call is sent to all callees listening
+	// on the URI.
+	Broadcast bool `json:"broadcast,omitempty"`
+
+	// Timestamp is the timestamp in UTC of the call request when it is
+	// made available to the callees in the connector. With the
+	// ReadTimestamp, it gives the time the call request waited in the
+	// queue, which should also be treated as informational.
+	Timestamp time.Time `json:"timestamp"`
+
 	// TTLAfterRead is the time-to-live remaining for the call request
 	// once it has been extracted from the connector and just before it
 	// is sent for processing to the callee.
@@ -34,12 +51,36 @@ type ResPayload struct {
 	MsgUUID  uuid.UUID       `json:"msg_uuid"`
 	URI      string          `json:"uri"`
 	Args     json.RawMessage `json:"args,omitempty"`
+
+	// IdempotencyKey is the idempotency key of the call, if any, so
+	// that the broker can store the result for duplicate calls.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// CacheKey identifies the arguments of the call if the result
+	// may be cached by the broker (see broker.CacheKey).
+	CacheKey string `json:"cache_key,omitempty"`
+
+	// Broadcast is set if the result is for a broadcast call, in
+	// which case there may be many results for the same call.
+	Broadcast bool `json:"broadcast,omitempty"`
+
+	// Partial is set if the result is a partial result or progress
+	// update of the call, sent before its final result. Seq is the
+	// position of the result in the stream of results of the call,
+	// starting at 1. It is 0 if the call has a single result.
+	Partial bool `json:"partial,omitempty"`
+	Seq     int  `json:"seq,omitempty"`
+
+	// Headers are the headers of the result, e.g. the trace context of
+	// the callee (see the tracing package).
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 // PubPayload is the payload to publish an event.
 type PubPayload struct {
-	MsgUUID uuid.UUID       `json:"msg_uuid"`
-	Args    json.RawMessage `json:"args,omitempty"`
+	MsgUUID uuid.UUID         `json:"msg_uuid"`
+	Args    json.RawMessage   `json:"args,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"` // headers of the PUB message
 }
 
 // EvntPayload is the payload of an event received by a subscriber.
@@ -48,4 +89,57 @@ type EvntPayload struct {
 	Channel string          `json:"channel"`           // channel on which the event was sent
 	Pattern string          `json:"pattern,omitempty"` // if received because of a pattern-based subscription
 	Args    json.RawMessage `json:"args,omitempty"`
+
+	// Headers are the headers of the PUB message of the event.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Gap is set on a notification that events may have been lost on
+	// that subscription, e.g. because the broker's pub-sub connection
+	// had to reconnect. Such payloads have no MsgUUID and no Args.
+	Gap bool `json:"gap,omitempty"`
+}
+
+// ServicePayload describes a callee instance registered to serve a
+// URI. It is recorded by the callee and refreshed periodically, and
+// it is returned by service queries.
+type ServicePayload struct {
+	URI      string    `json:"uri"`
+	Instance string    `json:"instance"`
+	Version  string    `json:"version,omitempty"`
+	Load     int       `json:"load"` // number of calls in progress on the instance
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// The events published on the presence companion channel of a
+// pub-sub channel.
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+// PresencePayload describes the presence of a connection on a pub-sub
+// channel. It is returned by presence queries, and it is the payload
+// of the join and leave events.
+type PresencePayload struct {
+	ConnUUID uuid.UUID       `json:"conn_uuid"`
+	Channel  string          `json:"channel"`
+	Identity json.RawMessage `json:"identity,omitempty"`
+	Event    string          `json:"event,omitempty"` // PresenceJoin or PresenceLeave, for events
+}
+
+// SessionPayload is the payload stored in the broker for the session
+// of a connection, so that a client can resume it after a
+// reconnection. TokenHash is the hash of the secret token that the
+// client must present to resume the session.
+type SessionPayload struct {
+	ConnUUID      uuid.UUID      `json:"conn_uuid"`
+	TokenHash     string         `json:"token_hash"`
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+}
+
+// Subscription is a pub-sub subscription of a session, to the channel
+// or to the pattern if Pattern is true.
+type Subscription struct {
+	Channel string `json:"channel"`
+	Pattern bool   `json:"pattern,omitempty"`
 }
@@ -0,0 +1,217 @@
+package message
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// The versions of the juggler protocol.
+const (
+	// Version0 is the initial version of the protocol, juggler.0.
+	Version0 = 0
+
+	// Version1 is the juggler.1 protocol, which adds the HELLO and
+	// WELCOME messages exchanged when the connection starts.
+	Version1 = 1
+)
+
+// since is the version of the protocol that introduced the message
+// types. Types not in this map are part of Version0.
+var since = map[Type]int{
+	HelloMsg:   Version1,
+	WelcomeMsg: Version1,
+}
+
+// The capabilities that a server may advertise in its WELCOME
+// message. Servers may advertise custom capabilities in addition to
+// those.
+const (
+	CapBatch     = "batch"     // BTCH requests
+	CapBroadcast = "broadcast" // broadcast CALL requests
+	CapSchedule  = "schedule"  // scheduled CALL requests
+	CapCache     = "cache"     // cached CALL results
+	CapPresence  = "presence"  // presence of connections on channels
+	CapServices  = "services"  // callee service registry
+	CapSessions  = "sessions"  // resumable sessions
+)
+
+// Protocol is a version of the juggler protocol, along with the codec
+// of its messages, as identified by the websocket subprotocol.
+type Protocol struct {
+	// Subprotocol is the websocket subprotocol, e.g. "juggler.1+msgpack".
+	Subprotocol string
+
+	// Version is the version of the protocol, which defines the types
+	// of messages that can be exchanged.
+	Version int
+
+	// Codec is the codec used to encode and decode the messages.
+	Codec Codec
+}
+
+// ProtocolFor returns the Protocol identified by the subprotocol. The
+// version is the number that follows "juggler." in the subprotocol,
+// before the optional "+codec" suffix. Subprotocols that are not of
+// that form use Version0.
+func ProtocolFor(subprotocol string) Protocol {
+	p := Protocol{
+		Subprotocol: subprotocol,
+		Codec:       CodecFor(subprotocol),
+	}
+
+	name := subprotocol
+	if i := strings.Index(name, "+"); i >= 0 {
+		name = name[:i]
+	}
+	if strings.HasPrefix(name, "juggler.") {
+		if v, err := strconv.Atoi(strings.TrimPrefix(name, "juggler.")); err == nil && v > 0 {
+			p.Version = v
+		}
+	}
+	return p
+}
+
+// Supports returns true if the message type t is a standard message
+// supported by the version of the protocol.
+func (p Protocol) Supports(t Type) bool {
+	return t.IsStd() && since[t] <= p.Version
+}
+
+// DecodeRequest is like the DecodeRequest function, using the codec of
+// the protocol, but the message types are those supported by its
+// version. The HELLO message is always allowed if it is supported, as
+// it starts the connection.
+func (p Protocol) DecodeRequest(r io.Reader, allowedMsgs ...Type) (Msg, error) {
+	var allowed []Type
+	for _, t := range allowedMsgs {
+		if t.IsRead() && p.Supports(t) {
+			allowed = append(allowed, t)
+		}
+	}
+	if len(allowed) == 0 {
+		allowed = p.types(Type.IsRead)
+	} else if p.Supports(HelloMsg) && !isIn(allowed, HelloMsg) {
+		allowed = append(allowed, HelloMsg)
+	}
+	return decodeIf(p.Codec, r, allowed...)
+}
+
+// DecodeResponse is like the DecodeResponse function, using the codec
+// of the protocol, but the message types are those supported by its
+// version.
+func (p Protocol) DecodeResponse(r io.Reader) (Msg, error) {
+	return decodeIf(p.Codec, r, p.types(Type.IsWrite)...)
+}
+
+// types returns the standard message types supported by the protocol
+// for which fn returns true.
+func (p Protocol) types(fn func(Type) bool) []Type {
+	var types []Type
+	for t := range lookupType {
+		if fn(t) && p.Supports(t) {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// Hello is the first message sent by the client in the juggler.1
+// protocol. It may list the Capabilities that the client supports,
+// and Client may identify the client software, e.g. "myapp/1.2".
+// To resume the session of a previous connection, SessionID and
+// SessionToken are set to the values received in the WELCOME of that
+// connection.
+type Hello struct {
+	Meta    `json:"meta"`
+	Payload struct {
+		Client       string    `json:"client,omitempty"`
+		Capabilities []string  `json:"capabilities,omitempty"`
+		SessionID    uuid.UUID `json:"session_id,omitempty"`
+		SessionToken string    `json:"session_token,omitempty"`
+	} `json:"payload"`
+}
+
+// NewHello creates a new Hello message for the client software client,
+// supporting the capabilities caps.
+func NewHello(client string, caps ...string) *Hello {
+	hello := &Hello{
+		Meta: NewMeta(HelloMsg),
+	}
+	hello.Payload.Client = client
+	hello.Payload.Capabilities = caps
+	return hello
+}
+
+// Limits are the limits of a server that are advertised to the
+// clients in the WELCOME message. A zero value means no limit.
+type Limits struct {
+	// ReadLimit is the maximum size, in bytes, of the messages that
+	// the server accepts.
+	ReadLimit int64 `json:"read_limit,omitempty"`
+
+	// WriteLimit is the maximum size, in bytes, of the messages that
+	// the server sends.
+	WriteLimit int64 `json:"write_limit,omitempty"`
+
+	// ReadTimeout is the maximum time the server waits to read a
+	// message once it has started to receive it.
+	ReadTimeout time.Duration `json:"read_timeout,omitempty"`
+
+	// CallTimeout is the default timeout of CALL requests that do not
+	// specify one.
+	CallTimeout time.Duration `json:"call_timeout,omitempty"`
+
+	// SessionGracePeriod is the time during which the session of the
+	// connection can be resumed once it is closed.
+	SessionGracePeriod time.Duration `json:"session_grace_period,omitempty"`
+}
+
+// Welcome is the response of the server to the Hello of the client in
+// the juggler.1 protocol. It indicates the Version of the protocol,
+// the SessionID of the connection, the Capabilities supported by the
+// server and its Limits. If the server supports resumable sessions,
+// SessionToken is the secret token required to resume the session,
+// and Resumed is set if the session of a previous connection was
+// resumed as requested by the HELLO, in which case the session ID and
+// token are those of the resumed session.
+type Welcome struct {
+	Meta    `json:"meta"`
+	Payload struct {
+		For          uuid.UUID `json:"for"` // no ForType, because always HELLO
+		Version      int       `json:"version"`
+		SessionID    uuid.UUID `json:"session_id"`
+		SessionToken string    `json:"session_token,omitempty"`
+		Resumed      bool      `json:"resumed,omitempty"`
+		Capabilities []string  `json:"capabilities,omitempty"`
+		Limits       Limits    `json:"limits"`
+	} `json:"payload"`
+}
+
+// NewWelcome creates a new Welcome message in response to the from
+// message, for the session sessionID.
+func NewWelcome(from *Hello, version int, sessionID uuid.UUID, caps []string, limits Limits) *Welcome {
+	welcome := &Welcome{
+		Meta: NewMeta(WelcomeMsg),
+	}
+	welcome.Payload.For = from.UUID()
+	welcome.Payload.Version = version
+	welcome.Payload.SessionID = sessionID
+	welcome.Payload.Capabilities = caps
+	welcome.Payload.Limits = limits
+	return welcome
+}
+
+// HasCapability returns true if the server advertised the capability
+// name in the Welcome message.
+func (w *Welcome) HasCapability(name string) bool {
+	for _, c := range w.Payload.Capabilities {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package message
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolFor(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		sub     string
+		version int
+		codec   Codec
+	}{
+		{"", Version0, JSONCodec},
+		{"juggler.0", Version0, JSONCodec},
+		{"juggler.0+msgpack", Version0, MsgpackCodec},
+		{"juggler.1", Version1, JSONCodec},
+		{"juggler.1+msgpack", Version1, MsgpackCodec},
+		{"juggler.x", Version0, JSONCodec},
+		{"other.2", Version0, JSONCodec},
+	}
+	for _, c := range cases {
+		p := ProtocolFor(c.sub)
+		assert.Equal(t, c.sub, p.Subprotocol, "%s: subprotocol", c.sub)
+		assert.Equal(t, c.version, p.Version, "%s: version", c.sub)
+		assert.Equal(t, c.codec, p.Codec, "%s: codec", c.sub)
+	}
+
+	p0, p1 := ProtocolFor("juggler.0"), ProtocolFor("juggler.1")
+	assert.True(t, p0.Supports(CallMsg), "CALL in juggler.0")
+	assert.False(t, p0.Supports(HelloMsg), "HELLO in juggler.0")
+	assert.True(t, p1.Supports(CallMsg), "CALL in juggler.1")
+	assert.True(t, p1.Supports(HelloMsg), "HELLO in juggler.1")
+	assert.False(t, p1.Supports(Type(nextCustomMsg+1)), "unknown in juggler.1")
+}
+
+func TestProtocolDecode(t *testing.T) {
+	t.Parallel()
+
+	hello := NewHello("test/1.0", CapBatch)
+	welcome := NewWelcome(hello, Version1, uuid.NewRandom(), []string{CapBatch, CapPresence}, Limits{ReadLimit: 1024, CallTimeout: time.Minute})
+	assert.True(t, welcome.HasCapability(CapPresence), "has presence")
+	assert.False(t, welcome.HasCapability(CapCache), "has cache")
+
+	for _, sub := range []string{"juggler.1", "juggler.1+msgpack"} {
+		p := ProtocolFor(sub)
+		p0 := ProtocolFor(sub)
+		p0.Version = Version0
+
+		var buf bytes.Buffer
+		require.NoError(t, p.Codec.Encode(&buf, hello), "%s: Encode HELLO", sub)
+		b := buf.Bytes()
+
+		m, err := p.DecodeRequest(bytes.NewReader(b))
+		require.NoError(t, err, "%s: DecodeRequest", sub)
+		assert.True(t, reflect.DeepEqual(hello, m), "%s: HELLO", sub)
+
+		_, err = p.DecodeRequest(bytes.NewReader(b), CallMsg)
+		assert.NoError(t, err, "%s: DecodeRequest with restricted messages", sub)
+		_, err = p0.DecodeRequest(bytes.NewReader(b))
+		assert.Error(t, err, "%s: DecodeRequest version 0", sub)
+		_, err = p.DecodeResponse(bytes.NewReader(b))
+		assert.Error(t, err, "%s: DecodeResponse HELLO", sub)
+
+		buf.Reset()
+		require.NoError(t, p.Codec.Encode(&buf, welcome), "%s: Encode WELCOME", sub)
+		b = buf.Bytes()
+
+		m, err = p.DecodeResponse(bytes.NewReader(b))
+		require.NoError(t, err, "%s: DecodeResponse", sub)
+		assert.True(t, reflect.DeepEqual(welcome, m), "%s: WELCOME", sub)
+
+		_, err = p0.DecodeResponse(bytes.NewReader(b))
+		assert.Error(t, err, "%s: DecodeResponse version 0", sub)
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Expvar is a Metrics that collects the metrics in an *expvar.Map,
+// under the same keys as when the juggler types exposed a Vars field.
+// A metric with labels is stored under its name followed by ":" and
+// each label value, e.g. "CallDuration:a" for the "uri" label "a".
+//
+// Counters and gauges are stored as *expvar.Int. Histograms are
+// stored as an *expvar.Map with the Count of observations and their
+// Sum, in seconds.
+type Expvar struct {
+	vars *expvar.Map
+	mu   sync.Mutex // serializes the creation of histograms
+}
+
+// NewExpvar returns a Metrics that collects the metrics in vars.
+func NewExpvar(vars *expvar.Map) *Expvar {
+	return &Expvar{vars: vars}
+}
+
+// Add implements Metrics for Expvar.
+func (e *Expvar) Add(name string, delta int64, labels ...string) {
+	e.vars.Add(key(name, labels), delta)
+}
+
+// AddGauge implements Metrics for Expvar.
+func (e *Expvar) AddGauge(name string, delta int64, labels ...string) {
+	e.vars.Add(key(name, labels), delta)
+}
+
+// Observe implements Metrics for Expvar.
+func (e *Expvar) Observe(name string, d time.Duration, labels ...string) {
+	k := key(name, labels)
+	h, ok := e.vars.Get(k).(*expvar.Map)
+	if !ok {
+		e.mu.Lock()
+		if h, ok = e.vars.Get(k).(*expvar.Map); !ok {
+			h = new(expvar.Map).Init()
+			e.vars.Set(k, h)
+		}
+		e.mu.Unlock()
+	}
+	h.Add("Count", 1)
+	h.AddFloat("Sum", d.Seconds())
+}
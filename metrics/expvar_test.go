@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpvar(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	m := NewExpvar(vars)
+
+	m.Add("MsgsCALL", 2)
+	m.AddGauge("ActiveConns", 1)
+	m.AddGauge("ActiveConns", -1)
+	m.Add("Calls", 1, "uri", "a")
+	m.Observe("CallDuration", 250*time.Millisecond, "uri", "a")
+	m.Observe("CallDuration", 500*time.Millisecond, "uri", "a")
+
+	assert.Equal(t, "2", vars.Get("MsgsCALL").String(), "counter")
+	assert.Equal(t, "0", vars.Get("ActiveConns").String(), "gauge")
+	assert.Equal(t, "1", vars.Get("Calls:a").String(), "labeled counter")
+
+	h, ok := vars.Get("CallDuration:a").(*expvar.Map)
+	require.True(t, ok, "histogram is a map")
+	assert.Equal(t, "2", h.Get("Count").String(), "histogram count")
+	assert.Equal(t, "0.75", h.Get("Sum").String(), "histogram sum")
+}
+
+func TestMulti(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	p := &Prometheus{}
+	m := Multi(NewExpvar(vars), p)
+
+	m.Add("Msgs", 1)
+	m.AddGauge("ActiveConns", 1)
+	m.Observe("CallDuration", time.Second)
+
+	assert.Equal(t, "1", vars.Get("Msgs").String(), "expvar counter")
+	assert.Equal(t, "1", vars.Get("ActiveConns").String(), "expvar gauge")
+	assert.NotNil(t, vars.Get("CallDuration"), "expvar histogram")
+	assert.Equal(t, 3, len(p.families), "prometheus metrics")
+}
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, "a", key("a", nil), "no labels")
+	assert.Equal(t, "a:x:y", key("a", []string{"uri", "x", "type", "y"}), "labels")
+	assert.Equal(t, "a:", key("a", []string{"uri"}), "missing value")
+}
@@ -0,0 +1,85 @@
+// Package metrics defines the Metrics interface used by the juggler
+// server, the redisbroker and the callees to collect metrics, and
+// implements it for expvar and for the Prometheus text exposition
+// format.
+//
+// A metric is identified by its name and, optionally, its labels,
+// which are passed as name-value pairs, e.g.
+//
+//	m.Observe("CallDuration", d, "uri", uri)
+//
+// The metrics collected by each type are documented in doc/metrics.md.
+package metrics
+
+import (
+	"strings"
+	"time"
+)
+
+// Metrics collects counters, gauges and duration histograms. The
+// labels are name-value pairs, so there must be an even number of
+// them, and a metric must always be recorded with the same label
+// names, in the same order. Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	// Add adds delta to the counter name. Counters only increase, so
+	// delta must be positive.
+	Add(name string, delta int64, labels ...string)
+
+	// AddGauge adds delta to the gauge name. A gauge may increase or
+	// decrease, e.g. the number of active connections.
+	AddGauge(name string, delta int64, labels ...string)
+
+	// Observe records the duration d in the histogram name, e.g. the
+	// duration of a call.
+	Observe(name string, d time.Duration, labels ...string)
+}
+
+// Multi returns a Metrics that records the metrics in each of ms, e.g.
+// to collect them both in expvar and for Prometheus.
+func Multi(ms ...Metrics) Metrics {
+	return multi(ms)
+}
+
+type multi []Metrics
+
+func (m multi) Add(name string, delta int64, labels ...string) {
+	for _, mm := range m {
+		mm.Add(name, delta, labels...)
+	}
+}
+
+func (m multi) AddGauge(name string, delta int64, labels ...string) {
+	for _, mm := range m {
+		mm.AddGauge(name, delta, labels...)
+	}
+}
+
+func (m multi) Observe(name string, d time.Duration, labels ...string) {
+	for _, mm := range m {
+		mm.Observe(name, d, labels...)
+	}
+}
+
+// labelValues returns the values of the name-value pairs labels. A
+// missing value is returned as an empty string.
+func labelValues(labels []string) []string {
+	vals := make([]string, 0, (len(labels)+1)/2)
+	for i := 0; i < len(labels); i += 2 {
+		var v string
+		if i+1 < len(labels) {
+			v = labels[i+1]
+		}
+		vals = append(vals, v)
+	}
+	return vals
+}
+
+// key returns the flat name of the metric name with labels, which is
+// name followed by ":" and each label value, e.g. "CallDuration:a".
+func key(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return name + ":" + strings.Join(labelValues(labels), ":")
+}
@@ -0,0 +1,249 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets used by
+// Prometheus if Buckets is not set, in seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Prometheus is a Metrics that collects the metrics in memory and
+// serves them in the Prometheus text exposition format, as an
+// http.Handler to register on the path scraped by Prometheus, e.g.
+// "/metrics".
+//
+// The metric names are converted to snake case, prefixed with the
+// Namespace, and counters and histograms are suffixed with "_total"
+// and "_seconds" respectively, so that "MsgsCALL" is exported as
+// "juggler_msgs_call_total" in the "juggler" namespace. A name must
+// always be used for the same type of metric, the values recorded for
+// another type are ignored.
+type Prometheus struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	// Namespace is the prefix of the exported metric names, followed by
+	// an underscore. No prefix is added if it is empty.
+	Namespace string
+
+	// Buckets are the upper bounds of the histogram buckets, in seconds
+	// and in increasing order. It should be set before recording any
+	// metric. If it is nil, DefaultBuckets is used.
+	Buckets []float64
+
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// family is the set of series of a metric, by label values.
+type family struct {
+	typ    string
+	series map[string]*series
+}
+
+// series is a metric with a set of label values.
+type series struct {
+	labels []string
+	value  int64 // counter or gauge
+
+	// histogram
+	buckets []uint64 // non-cumulative count by bucket
+	count   uint64
+	sum     float64
+}
+
+// Add implements Metrics for Prometheus.
+func (p *Prometheus) Add(name string, delta int64, labels ...string) {
+	p.mu.Lock()
+	if s := p.series(name, counterType, labels); s != nil {
+		s.value += delta
+	}
+	p.mu.Unlock()
+}
+
+// AddGauge implements Metrics for Prometheus.
+func (p *Prometheus) AddGauge(name string, delta int64, labels ...string) {
+	p.mu.Lock()
+	if s := p.series(name, gaugeType, labels); s != nil {
+		s.value += delta
+	}
+	p.mu.Unlock()
+}
+
+// Observe implements Metrics for Prometheus.
+func (p *Prometheus) Observe(name string, d time.Duration, labels ...string) {
+	v := d.Seconds()
+	p.mu.Lock()
+	if s := p.series(name, histogramType, labels); s != nil {
+		bounds := p.bounds()
+		if s.buckets == nil {
+			s.buckets = make([]uint64, len(bounds))
+		}
+		if i := sort.SearchFloat64s(bounds, v); i < len(bounds) {
+			s.buckets[i]++
+		}
+		s.count++
+		s.sum += v
+	}
+	p.mu.Unlock()
+}
+
+// bounds returns the upper bounds of the histogram buckets.
+func (p *Prometheus) bounds() []float64 {
+	if p.Buckets != nil {
+		return p.Buckets
+	}
+	return DefaultBuckets
+}
+
+// series returns the series of the metric name with labels, creating
+// it if needed. It returns nil if name is used for another type of
+// metric. It must be called with mu locked.
+func (p *Prometheus) series(name, typ string, labels []string) *series {
+	f := p.families[name]
+	if f == nil {
+		if p.families == nil {
+			p.families = make(map[string]*family)
+		}
+		f = &family{typ: typ, series: make(map[string]*series)}
+		p.families[name] = f
+	}
+	if f.typ != typ {
+		return nil
+	}
+
+	k := strings.Join(labels, "\xff")
+	s := f.series[k]
+	if s == nil {
+		s = &series{labels: append([]string(nil), labels...)}
+		f.series[k] = s
+	}
+	return s
+}
+
+// ServeHTTP implements http.Handler for Prometheus. It writes the
+// metrics in the text exposition format.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	p.writeTo(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// writeTo writes the metrics to buf, sorted by name and labels.
+func (p *Prometheus) writeTo(buf *bytes.Buffer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := p.families[name]
+		pname := p.metricName(name, f.typ)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", pname, f.typ)
+
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := f.series[k]
+			if f.typ != histogramType {
+				fmt.Fprintf(buf, "%s%s %d\n", pname, formatLabels(s.labels), s.value)
+				continue
+			}
+
+			var cum uint64
+			for i, b := range p.bounds() {
+				if i < len(s.buckets) {
+					cum += s.buckets[i]
+				}
+				le := strconv.FormatFloat(b, 'g', -1, 64)
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", pname, formatLabels(s.labels, "le", le), cum)
+			}
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", pname, formatLabels(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(buf, "%s_sum%s %s\n", pname, formatLabels(s.labels), strconv.FormatFloat(s.sum, 'g', -1, 64))
+			fmt.Fprintf(buf, "%s_count%s %d\n", pname, formatLabels(s.labels), s.count)
+		}
+	}
+}
+
+// metricName returns the exported name of the metric name of type typ.
+func (p *Prometheus) metricName(name, typ string) string {
+	n := snakeCase(name)
+	if p.Namespace != "" {
+		n = snakeCase(p.Namespace) + "_" + n
+	}
+	switch typ {
+	case counterType:
+		n += "_total"
+	case histogramType:
+		n += "_seconds"
+	}
+	return n
+}
+
+// formatLabels returns the name-value pairs labels, followed by extra,
+// in the exposition format, e.g. `{uri="a"}`. It returns an empty
+// string if there are no labels.
+func formatLabels(labels []string, extra ...string) string {
+	all := append(append([]string(nil), labels...), extra...)
+	if len(all) == 0 {
+		return ""
+	}
+
+	vals := labelValues(all)
+	pairs := make([]string, len(vals))
+	for i, v := range vals {
+		pairs[i] = snakeCase(all[2*i]) + `="` + labelEscaper.Replace(v) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// snakeCase converts the camel case s to snake case, e.g. "MsgsCALL"
+// to "msgs_call". Characters that are not valid in a metric name are
+// replaced with underscores.
+func snakeCase(s string) string {
+	rs := []rune(s)
+	var buf bytes.Buffer
+	for i, r := range rs {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := rs[i-1]
+			nextLower := i+1 < len(rs) && unicode.IsLower(rs[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				buf.WriteByte('_')
+			}
+		}
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			buf.WriteRune(unicode.ToLower(r))
+		default:
+			buf.WriteByte('_')
+		}
+	}
+	return buf.String()
+}
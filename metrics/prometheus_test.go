@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnakeCase(t *testing.T) {
+	cases := []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"Msgs", "msgs"},
+		{"MsgsCALL", "msgs_call"},
+		{"ActiveConnGoros", "active_conn_goros"},
+		{"FailedPTTLCalls", "failed_pttl_calls"},
+		{"Calls2Go", "calls2_go"},
+		{"a.b-c", "a_b_c"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.out, snakeCase(c.in), c.in)
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	p := &Prometheus{Namespace: "juggler", Buckets: []float64{0.25, 1}}
+
+	p.Add("MsgsCALL", 2)
+	p.Add("MsgsCALL", 1)
+	p.AddGauge("ActiveConns", 2)
+	p.AddGauge("ActiveConns", -1)
+	p.Add("Calls", 1, "uri", `a"b`)
+	p.Add("Calls", 1, "uri", "a")
+	p.Observe("CallDuration", 125*time.Millisecond, "uri", "a")
+	p.Observe("CallDuration", 500*time.Millisecond, "uri", "a")
+	p.Observe("CallDuration", 2*time.Second, "uri", "a")
+
+	// ignored, wrong type
+	p.AddGauge("MsgsCALL", 10)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	exp := `# TYPE juggler_active_conns gauge
+juggler_active_conns 1
+# TYPE juggler_call_duration_seconds histogram
+juggler_call_duration_seconds_bucket{uri="a",le="0.25"} 1
+juggler_call_duration_seconds_bucket{uri="a",le="1"} 2
+juggler_call_duration_seconds_bucket{uri="a",le="+Inf"} 3
+juggler_call_duration_seconds_sum{uri="a"} 2.625
+juggler_call_duration_seconds_count{uri="a"} 3
+# TYPE juggler_calls_total counter
+juggler_calls_total{uri="a"} 1
+juggler_calls_total{uri="a\"b"} 1
+# TYPE juggler_msgs_call_total counter
+juggler_msgs_call_total 3
+`
+	assert.Equal(t, exp, w.Body.String(), "exposition")
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"), "content type")
+}
@@ -0,0 +1,81 @@
+package juggler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/client"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerMetrics(t *testing.T) {
+	prom := &metrics.Prometheus{Namespace: "juggler"}
+	brk := &fakeHeadersBroker{}
+	server := &Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		Metrics:      prom,
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	acks := make(chan message.Msg, 1)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		acks <- m
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: Subprotocols}, srv.URL, nil, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	_, err = cli.Call("a", nil, time.Minute)
+	require.NoError(t, err, "Call")
+	select {
+	case m := <-acks:
+		assert.Equal(t, message.AckMsg, m.Type(), "message type")
+	case <-time.After(time.Second):
+		t.Fatal("no ACK received")
+	}
+
+	// the CALL metrics are recorded after the ACK is sent
+	exp := []string{
+		"juggler_active_conns 1\n",
+		"juggler_msgs_call_total 1\n",
+		"juggler_msgs_ack_total 1\n",
+		`juggler_process_msg_duration_seconds_count{type="CALL"} 1` + "\n",
+		`juggler_write_duration_seconds_count{type="ACK"} 1` + "\n",
+	}
+	var body string
+	deadline := time.Now().Add(time.Second)
+	for {
+		w := httptest.NewRecorder()
+		prom.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body = w.Body.String()
+		if containsAll(body, exp) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, s := range exp {
+		assert.Contains(t, body, s, "metrics")
+	}
+	assert.Contains(t, body, "juggler_net_bytes_written_total ", "net bytes written")
+}
+
+func containsAll(s string, subs []string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
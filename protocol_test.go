@@ -0,0 +1,85 @@
+package juggler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/client"
+	"github.com/mna/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolVersions(t *testing.T) {
+	server := &Server{
+		CallerBroker: fakeBroker{},
+		PubSubBroker: fakeBroker{},
+		ReadLimit:    1024,
+		Capabilities: []string{"custom"},
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	acks := make(chan message.Msg, 1)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		acks <- m
+	})
+
+	// the latest version is preferred
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: Subprotocols}, srv.URL, nil,
+		client.SetHandler(h), client.SetHello("test/1.0", message.CapBatch))
+	require.NoError(t, err, "Dial juggler.1")
+	assert.Equal(t, "juggler.1", cli.UnderlyingConn().Subprotocol(), "juggler.1 subprotocol")
+
+	w := cli.Welcome()
+	require.NotNil(t, w, "WELCOME received")
+	assert.Equal(t, message.Version1, w.Payload.Version, "version")
+	assert.NotNil(t, w.Payload.SessionID, "session ID")
+	assert.Equal(t, []string{message.CapBatch, "custom"}, w.Payload.Capabilities, "capabilities")
+	assert.Equal(t, message.Limits{ReadLimit: 1024, CallTimeout: broker.DefaultCallTimeout}, w.Payload.Limits, "limits")
+
+	_, err = cli.Pub("a", 1)
+	require.NoError(t, err, "Pub juggler.1")
+	select {
+	case m := <-acks:
+		assert.Equal(t, message.AckMsg, m.Type(), "ACK juggler.1")
+	case <-time.After(time.Second):
+		t.Fatal("no ACK received for juggler.1")
+	}
+	cli.Close()
+
+	// juggler.0 is still supported
+	cli, err = client.Dial(&websocket.Dialer{Subprotocols: []string{"juggler.0"}}, srv.URL, nil, client.SetHandler(h))
+	require.NoError(t, err, "Dial juggler.0")
+	assert.Nil(t, cli.Welcome(), "no WELCOME in juggler.0")
+
+	_, err = cli.Pub("a", 1)
+	require.NoError(t, err, "Pub juggler.0")
+	select {
+	case m := <-acks:
+		assert.Equal(t, message.AckMsg, m.Type(), "ACK juggler.0")
+	case <-time.After(time.Second):
+		t.Fatal("no ACK received for juggler.0")
+	}
+	cli.Close()
+
+	// juggler.1 without a HELLO closes the connection
+	conn, _, err := (&websocket.Dialer{Subprotocols: []string{"juggler.1"}}).Dial(srv.URL, nil)
+	require.NoError(t, err, "Dial juggler.1 without HELLO")
+	defer conn.Close()
+
+	pub, err := message.NewPub("a", 1)
+	require.NoError(t, err, "NewPub")
+	require.NoError(t, conn.WriteJSON(pub), "WriteJSON")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.NextReader()
+	assert.Error(t, err, "connection closed")
+}
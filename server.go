@@ -1,24 +1,43 @@
 package juggler
 
 import (
-	"expvar"
-	"fmt"
+	"bufio"
+	"errors"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/mna/juggler/tracing"
 	"github.com/gorilla/websocket"
 )
 
 // Subprotocols is the list of juggler protocol versions supported by this
 // package. It should be set as-is on the websocket.Upgrader Subprotocols
-// field.
+// field. The "+msgpack" subprotocols use the same protocol version with
+// messages encoded using MessagePack (see message.Codecs). The
+// juggler.1 protocol starts with a HELLO and WELCOME exchange (see
+// message.Protocol), while juggler.0 is still supported for existing
+// clients. The websocket handshake selects the first subprotocol of
+// this list that is requested by the client, so the latest version
+// is preferred.
 var Subprotocols = []string{
+	"juggler.1",
+	"juggler.1+msgpack",
 	"juggler.0",
+	"juggler.0+msgpack",
 }
 
+// DefaultHeadersLimit is the maximum size, in bytes, of the headers of
+// a request if Server.HeadersLimit is 0.
+const DefaultHeadersLimit = 4096
+
 func isInStr(list []string, v string) bool {
 	for _, vv := range list {
 		if vv == v {
@@ -65,6 +84,22 @@ type Server struct {
 	// 0 means no timeout.
 	AcquireWriteLockTimeout time.Duration
 
+	// HeadersLimit is the maximum size, in bytes, of the headers of a
+	// request, which is the sum of the lengths of their keys and values
+	// (see message.HeadersSize). It is checked by ProcessMsg, so that
+	// the Handler can strip headers before the limit is enforced. A
+	// request that exceeds it fails with a 400 NACK. The default of 0
+	// uses DefaultHeadersLimit, and a negative value means no limit.
+	HeadersLimit int
+
+	// CompressionThreshold is the minimum size, in bytes, of the
+	// outgoing messages that are compressed, if compression is
+	// negotiated with the client (see websocket.Upgrader's
+	// EnableCompression field). Compressing small messages is usually
+	// not worth the cost. The default of 0 uses 512 bytes, and a
+	// negative value disables compression of the outgoing messages.
+	CompressionThreshold int
+
 	// ConnState specifies an optional callback function that is called
 	// when a connection changes state. If non-nil, it is called for
 	// Accepting, Connected and Closed states. Closed means the
@@ -74,7 +109,8 @@ type Server struct {
 	//
 	// The possible state transitions are:
 	//
-	//     Accepting -> Closed (if the server failed to setup the connection)
+	//     Accepting -> Closed (if the server failed to setup the connection,
+	//                          including a failed HELLO or session)
 	//     Accepting -> Connected
 	//     Connected -> Closed
 	ConnState func(*Conn, ConnState)
@@ -94,9 +130,61 @@ type Server struct {
 	// set before the server can be used.
 	CallerBroker broker.CallerBroker
 
-	// Vars can be set to an *expvar.Map to collect metrics about the
-	// server.
-	Vars *expvar.Map
+	// Namespace, if set, is called when a connection is accepted,
+	// after the ConnState callback for the Accepting state, and
+	// returns the namespace to use for that connection's brokers.
+	// This allows isolating tenants that share the same brokers,
+	// e.g. based on the connection's identity set in the Accepting
+	// callback. If it returns a non-empty namespace, the PubSubBroker
+	// and CallerBroker must implement broker.PubSubNamespacer and
+	// broker.CallerNamespacer respectively, otherwise the connection
+	// is dropped.
+	Namespace func(*Conn) string
+
+	// CheckServices indicates if the server checks that a callee is
+	// registered to serve the URI of a call before registering or
+	// scheduling it, if the CallerBroker implements
+	// broker.ServiceRegistry. If no callee is registered, the call
+	// fails immediately with a 503 NACK instead of timing out. This
+	// adds a lookup in the broker for each call.
+	CheckServices bool
+
+	// Capabilities is the list of custom capabilities advertised to the
+	// clients in the WELCOME message of the juggler.1 protocol, e.g. for
+	// features implemented by the Handler. They are added to the
+	// standard capabilities supported by the server and its brokers
+	// (see the Cap constants of the message package).
+	Capabilities []string
+
+	// SessionGracePeriod is the time during which a client can resume
+	// the session of a closed connection, if the protocol supports it
+	// (juggler.1) and the CallerBroker implements broker.SessionStore.
+	// The resumed connection keeps the UUID of the closed connection,
+	// so that it receives the results of the calls made before the
+	// reconnection, and its subscriptions are restored. The session is
+	// resumed before the ConnState callback for the Accepting state
+	// and the Namespace function are called, so they see the UUID of
+	// the resumed connection, and sessions are stored in the
+	// CallerBroker without the connection's namespace. The default of
+	// 0 disables resumable sessions.
+	SessionGracePeriod time.Duration
+
+	// Tracer, if set, records a span for each CALL and PUB request
+	// processed by ProcessMsg, as a child of the trace context of the
+	// request, and the trace context of that span is propagated to the
+	// callees and the subscribers (see the tracing package).
+	Tracer tracing.Tracer
+
+	// Metrics can be set to collect metrics about the server, e.g. a
+	// metrics.Prometheus or a metrics.Expvar that collects them in an
+	// *expvar.Map (see doc/metrics.md).
+	Metrics metrics.Metrics
+
+	// Logger, if set, logs the errors that are not reported to the
+	// clients, e.g. failed writes, failed broker lookups and
+	// connections dropped because their setup failed, with the UUID and
+	// the remote address of the connection (see Conn.Log).
+	Logger logging.Logger
 }
 
 var allReqMsgs = []message.Type{message.CallMsg, message.SubMsg, message.UnsbMsg, message.PubMsg}
@@ -115,10 +203,10 @@ func isInType(list []message.Type, v message.Type) bool {
 // connection open. If allowedMsgs is not empty, only those message types
 // are allowed on that connection.
 func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type) {
-	if srv.Vars != nil {
-		srv.Vars.Add("ActiveConns", 1)
-		srv.Vars.Add("TotalConns", 1)
-		defer srv.Vars.Add("ActiveConns", -1)
+	if srv.Metrics != nil {
+		srv.Metrics.AddGauge("ActiveConns", 1)
+		srv.Metrics.Add("TotalConns", 1)
+		defer srv.Metrics.AddGauge("ActiveConns", -1)
 	}
 
 	conn.SetReadLimit(srv.ReadLimit)
@@ -127,6 +215,36 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 		allowedMsgs = allReqMsgs
 	}
 
+	// since juggler.1, the connection starts with a HELLO, which may
+	// resume the session of a closed connection. This is done first so
+	// that the connection has its final UUID in the ConnState callback
+	// and the Namespace function. If that fails, the ConnState callback
+	// still sees the connection go through the Accepting and Closed
+	// states.
+	var hello *message.Hello
+	if c.proto.Supports(message.HelloMsg) {
+		abort := func(closeFn func()) {
+			if cs := srv.ConnState; cs != nil {
+				cs(c, Accepting)
+				defer cs(c, Closed)
+			}
+			closeFn()
+		}
+
+		h, err := c.readHello()
+		if err != nil {
+			abort(func() { c.Close(err) })
+			return
+		}
+		hello = h
+
+		if err := c.startSession(h); err != nil {
+			abort(func() { c.drop("failed to start session", err) })
+			return
+		}
+		defer c.saveSession()
+	}
+
 	// start lifecycle - Accepting, and ensure Closing is called on exit
 	if cs := srv.ConnState; cs != nil {
 		defer func() {
@@ -135,12 +253,20 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 		cs(c, Accepting)
 	}
 
+	// set the connection's namespace, if any
+	if fn := srv.Namespace; fn != nil {
+		if err := c.setNamespace(fn(c)); err != nil {
+			c.drop("failed to set namespace", err)
+			return
+		}
+	}
+
 	// setup results connection if CALL is allowed
 	callOK := isInType(allowedMsgs, message.CallMsg)
 	if callOK {
-		resConn, err := srv.CallerBroker.NewResultsConn(c.UUID)
+		resConn, err := c.cb.NewResultsConn(c.UUID)
 		if err != nil {
-			c.Close(fmt.Errorf("failed to create results connection: %v; dropping connection", err))
+			c.drop("failed to create results connection", err)
 			return
 		}
 		c.resc = resConn
@@ -150,12 +276,27 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 	subOK, unsbOK := isInType(allowedMsgs, message.SubMsg),
 		isInType(allowedMsgs, message.UnsbMsg)
 	if subOK || unsbOK {
-		pubSubConn, err := srv.PubSubBroker.NewPubSubConn()
+		pubSubConn, err := c.psb.NewPubSubConn()
 		if err != nil {
-			c.Close(fmt.Errorf("failed to create pubsub connection: %v; dropping connection", err))
+			c.drop("failed to create pubsub connection", err)
 			return
 		}
 		c.psc = pubSubConn
+
+		// record the presence of the connection on its subscriptions, if
+		// supported by the broker.
+		if pc, ok := pubSubConn.(broker.PresenceConn); ok {
+			if err := pc.SetPresence(c.UUID, c.Identity()); err != nil {
+				c.drop("failed to set presence", err)
+				return
+			}
+		}
+
+		// restore the subscriptions of a resumed session
+		if err := c.restoreSubscriptions(); err != nil {
+			c.drop("failed to restore subscriptions", err)
+			return
+		}
 	}
 
 	// switch to connected state
@@ -163,6 +304,15 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 		cs(c, Connected)
 	}
 
+	// the WELCOME is sent before any other message
+	if hello != nil {
+		if h := srv.Handler; h != nil {
+			h.Handle(context.Background(), c, hello)
+		} else {
+			ProcessMsg(c, hello)
+		}
+	}
+
 	// receive, results, pub-sub loops
 	if subOK {
 		// can't receive events unless SUB is allowed
@@ -189,11 +339,19 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 // connection is restricted to that set of message types. The value
 // is a comma-separated list of request message types:
 //
-//     Any of "call, sub, unsb, pub"
+//     Any of "call, sub, unsb, pub, btch"
 //     "*" can be used for any message type (same as if the header wasn't there)
 //
+// The requests of a batch (btch) are restricted to the same set.
+//
 func Upgrade(upgrader *websocket.Upgrader, srv *Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// count the bytes written to the network, to compare with the
+		// size of the messages.
+		if srv.Metrics != nil {
+			w = countingResponseWriter{ResponseWriter: w, metrics: srv.Metrics}
+		}
+
 		// upgrade the HTTP connection to the websocket protocol
 		wsConn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -232,8 +390,42 @@ func AllowedMessagesFromHeader(h http.Header) []message.Type {
 				msgs = append(msgs, message.UnsbMsg)
 			case "pub":
 				msgs = append(msgs, message.PubMsg)
+			case "btch":
+				msgs = append(msgs, message.BtchMsg)
 			}
 		}
 	}
 	return msgs
 }
+
+// countingResponseWriter is an http.ResponseWriter that counts the
+// bytes written to its hijacked network connection.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	metrics metrics.Metrics
+}
+
+// Hijack implements http.Hijacker for the countingResponseWriter.
+func (w countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("juggler: response does not support hijacking")
+	}
+	nc, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: nc, metrics: w.metrics}, brw, nil
+}
+
+// countingConn is a net.Conn that counts the bytes written to it.
+type countingConn struct {
+	net.Conn
+	metrics metrics.Metrics
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.metrics.Add("NetBytesWritten", int64(n))
+	return n, err
+}
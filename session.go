@@ -0,0 +1,153 @@
+package juggler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/logging"
+	"github.com/mna/juggler/message"
+)
+
+// sessionStore returns the broker that stores the session of the
+// connection, and false if resumable sessions are not enabled. It is
+// the server's CallerBroker, as the session is resumed before the
+// namespace of the connection is set.
+func (c *Conn) sessionStore() (broker.SessionStore, bool) {
+	if c.srv.SessionGracePeriod <= 0 || !c.proto.Supports(message.HelloMsg) {
+		return nil, false
+	}
+	ss, ok := c.srv.CallerBroker.(broker.SessionStore)
+	return ss, ok
+}
+
+// startSession starts the session of the connection, resuming the
+// session of a closed connection if requested by the HELLO h with a
+// valid token. It is a no-op if resumable sessions are not enabled.
+func (c *Conn) startSession(h *message.Hello) error {
+	ss, ok := c.sessionStore()
+	if !ok {
+		return nil
+	}
+
+	if h.Payload.SessionID != nil && h.Payload.SessionToken != "" {
+		sp, err := ss.ResumeSession(h.Payload.SessionID, tokenHash(h.Payload.SessionToken))
+		if err != nil {
+			return err
+		}
+		if sp != nil {
+			// the token stays the same, so that the session can still be
+			// resumed if the connection fails before the WELCOME is sent.
+			c.UUID = sp.ConnUUID
+			c.token = h.Payload.SessionToken
+			c.resumed = true
+			c.restore = sp.Subscriptions
+			if c.srv.Metrics != nil {
+				c.srv.Metrics.Add("ResumedSessions", 1)
+			}
+			return nil
+		}
+	}
+
+	tok, err := newSessionToken()
+	if err != nil {
+		return err
+	}
+	c.token = tok
+	return nil
+}
+
+// restoreSubscriptions subscribes the pub-sub connection to the
+// subscriptions of the resumed session.
+func (c *Conn) restoreSubscriptions() error {
+	for _, s := range c.restore {
+		if err := c.psc.Subscribe(s.Channel, s.Pattern); err != nil {
+			return err
+		}
+		c.setSubscribed(s, true)
+	}
+	c.restore = nil
+	return nil
+}
+
+// setSubscribed records that the connection is subscribed to s if
+// subscribed is true, or that it is unsubscribed otherwise.
+func (c *Conn) setSubscribed(s message.Subscription, subscribed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !subscribed {
+		delete(c.subs, s)
+		return
+	}
+	if c.subs == nil {
+		c.subs = make(map[message.Subscription]bool)
+	}
+	c.subs[s] = true
+}
+
+// saveSession stores the session of the closed connection so that the
+// client can resume it during the server's SessionGracePeriod. It is
+// a no-op if the session was not started.
+func (c *Conn) saveSession() {
+	ss, ok := c.sessionStore()
+	if !ok || c.token == "" {
+		return
+	}
+
+	// subscriptions not restored yet are kept in the session
+	c.mu.Lock()
+	subs := make([]message.Subscription, 0, len(c.subs)+len(c.restore))
+	subs = append(subs, c.restore...)
+	for s := range c.subs {
+		subs = append(subs, s)
+	}
+	c.mu.Unlock()
+	sort.Sort(bySubscription(subs))
+
+	sp := &message.SessionPayload{
+		ConnUUID:      c.UUID,
+		TokenHash:     tokenHash(c.token),
+		Subscriptions: subs,
+	}
+	if err := ss.SaveSession(sp, c.srv.SessionGracePeriod); err != nil {
+		if c.srv.Metrics != nil {
+			c.srv.Metrics.Add("FailedSessionSaves", 1)
+		}
+		c.Log(logging.Error, "failed to save session", logging.Err(err))
+		return
+	}
+	if c.srv.Metrics != nil {
+		c.srv.Metrics.Add("SavedSessions", 1)
+	}
+}
+
+// newSessionToken returns a new random session token.
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// tokenHash returns the hash of the session token tok, as stored in
+// the broker, so that the token itself is never stored.
+func tokenHash(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// bySubscription sorts subscriptions by channel, then pattern.
+type bySubscription []message.Subscription
+
+func (s bySubscription) Len() int      { return len(s) }
+func (s bySubscription) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bySubscription) Less(i, j int) bool {
+	if s[i].Channel != s[j].Channel {
+		return s[i].Channel < s[j].Channel
+	}
+	return !s[i].Pattern && s[j].Pattern
+}
@@ -0,0 +1,227 @@
+package juggler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/client"
+	"github.com/mna/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSessionBroker struct {
+	fakeBroker
+
+	mu       sync.Mutex
+	sessions map[string]*message.SessionPayload
+	resConns []string
+	subs     []string
+}
+
+func (f *fakeSessionBroker) NewResultsConn(connUUID uuid.UUID) (broker.ResultsConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resConns = append(f.resConns, connUUID.String())
+	return fakeResultsConn{}, nil
+}
+
+func (f *fakeSessionBroker) NewPubSubConn() (broker.PubSubConn, error) {
+	return fakeSessionPubSubConn{f}, nil
+}
+
+func (f *fakeSessionBroker) SaveSession(sp *message.SessionPayload, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions[sp.ConnUUID.String()] = sp
+	return nil
+}
+
+func (f *fakeSessionBroker) ResumeSession(connUUID uuid.UUID, tokenHash string) (*message.SessionPayload, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sp := f.sessions[connUUID.String()]
+	if sp == nil || sp.TokenHash != tokenHash {
+		return nil, nil
+	}
+	delete(f.sessions, connUUID.String())
+	return sp, nil
+}
+
+func (f *fakeSessionBroker) session(connUUID uuid.UUID) *message.SessionPayload {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sessions[connUUID.String()]
+}
+
+type fakeSessionPubSubConn struct {
+	f *fakeSessionBroker
+}
+
+func (c fakeSessionPubSubConn) Subscribe(channel string, pattern bool) error {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.subs = append(c.f.subs, channel)
+	return nil
+}
+func (c fakeSessionPubSubConn) Unsubscribe(channel string, pattern bool) error { return nil }
+func (c fakeSessionPubSubConn) Events() <-chan *message.EvntPayload            { return nil }
+func (c fakeSessionPubSubConn) EventsErr() error                               { return nil }
+func (c fakeSessionPubSubConn) Close() error                                   { return nil }
+
+func TestSessionResume(t *testing.T) {
+	brk := &fakeSessionBroker{sessions: make(map[string]*message.SessionPayload)}
+
+	// the UUIDs seen by the Accepting callback and the Namespace function
+	var mu sync.Mutex
+	var accepting, namespaces []string
+	server := &Server{
+		CallerBroker:       brk,
+		PubSubBroker:       brk,
+		SessionGracePeriod: time.Minute,
+		ConnState: func(c *Conn, state ConnState) {
+			if state == Accepting {
+				mu.Lock()
+				accepting = append(accepting, c.UUID.String())
+				mu.Unlock()
+			}
+		},
+		Namespace: func(c *Conn) string {
+			mu.Lock()
+			namespaces = append(namespaces, c.UUID.String())
+			mu.Unlock()
+			return ""
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	waitFor := func(typ message.Type) message.Msg {
+		select {
+		case m := <-msgs:
+			assert.Equal(t, typ, m.Type(), "message type")
+			return m
+		case <-time.After(time.Second):
+			t.Fatalf("no %s received", typ)
+		}
+		return nil
+	}
+	dialer := &websocket.Dialer{Subprotocols: Subprotocols}
+
+	cli1, err := client.Dial(dialer, srv.URL, nil, client.SetHandler(h))
+	require.NoError(t, err, "Dial 1")
+	w1 := cli1.Welcome()
+	require.NotNil(t, w1, "WELCOME 1")
+	assert.NotEmpty(t, w1.Payload.SessionToken, "session token")
+	assert.False(t, w1.Payload.Resumed, "new session")
+	assert.True(t, w1.HasCapability(message.CapSessions), "sessions capability")
+	assert.Equal(t, time.Minute, w1.Payload.Limits.SessionGracePeriod, "grace period")
+
+	_, err = cli1.Sub("a", false)
+	require.NoError(t, err, "Sub")
+	waitFor(message.AckMsg)
+	uid, err := cli1.Call("b", nil, 500*time.Millisecond)
+	require.NoError(t, err, "Call")
+	waitFor(message.AckMsg)
+
+	// the session is saved once the connection is closed
+	cli1.Close()
+	deadline := time.Now().Add(time.Second)
+	for brk.session(w1.Payload.SessionID) == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sp := brk.session(w1.Payload.SessionID)
+	require.NotNil(t, sp, "session saved")
+	assert.Equal(t, []message.Subscription{{Channel: "a"}}, sp.Subscriptions, "saved subscriptions")
+	assert.NotEqual(t, w1.Payload.SessionToken, sp.TokenHash, "token is not stored")
+
+	// resume the session
+	cli2, err := client.Dial(dialer, srv.URL, nil, client.SetHandler(h), client.SetResume(cli1))
+	require.NoError(t, err, "Dial 2")
+	defer cli2.Close()
+	w2 := cli2.Welcome()
+	require.NotNil(t, w2, "WELCOME 2")
+	assert.True(t, w2.Payload.Resumed, "resumed session")
+	assert.Equal(t, w1.Payload.SessionID, w2.Payload.SessionID, "same session")
+	assert.Equal(t, w1.Payload.SessionToken, w2.Payload.SessionToken, "same token")
+
+	mu.Lock()
+	sid := w1.Payload.SessionID.String()
+	assert.Equal(t, []string{sid, sid}, accepting, "UUIDs in Accepting state")
+	assert.Equal(t, []string{sid, sid}, namespaces, "UUIDs in Namespace")
+	mu.Unlock()
+
+	brk.mu.Lock()
+	assert.Equal(t, []string{w1.Payload.SessionID.String(), w1.Payload.SessionID.String()}, brk.resConns, "results connections")
+	assert.Equal(t, []string{"a", "a"}, brk.subs, "subscriptions restored")
+	brk.mu.Unlock()
+
+	// the pending call of the first client expires on the second one
+	m := waitFor(client.ExpMsg)
+	if exp, ok := m.(*client.Exp); ok {
+		assert.Equal(t, uid.String(), exp.Payload.For.String(), "EXP of the call")
+	}
+
+	// a session can only be resumed once at a time
+	cli3, err := client.Dial(dialer, srv.URL, nil, client.SetHandler(h), client.SetResume(cli1))
+	require.NoError(t, err, "Dial 3")
+	defer cli3.Close()
+	w3 := cli3.Welcome()
+	require.NotNil(t, w3, "WELCOME 3")
+	assert.False(t, w3.Payload.Resumed, "not resumed")
+	assert.NotEqual(t, w1.Payload.SessionID, w3.Payload.SessionID, "new session")
+}
+
+func TestHelloFailedConnState(t *testing.T) {
+	brk := &fakeSessionBroker{sessions: make(map[string]*message.SessionPayload)}
+
+	states := make(chan ConnState, 10)
+	closeErrs := make(chan error, 1)
+	server := &Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		ConnState: func(c *Conn, state ConnState) {
+			states <- state
+			if state == Closed {
+				closeErrs <- c.CloseErr
+			}
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	dialer := &websocket.Dialer{Subprotocols: Subprotocols}
+	conn, _, err := dialer.Dial(srv.URL, nil)
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+	require.Equal(t, "juggler.1", conn.Subprotocol(), "subprotocol")
+
+	// the first message is not a valid HELLO
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("not a message")), "WriteMessage")
+
+	for _, want := range []ConnState{Accepting, Closed} {
+		select {
+		case got := <-states:
+			assert.Equal(t, want, got, "connection state")
+		case <-time.After(time.Second):
+			t.Fatalf("no %v state received", want)
+		}
+	}
+	assert.Error(t, <-closeErrs, "CloseErr")
+}
@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"sync"
+	"time"
+)
+
+// RecordedSpan is a span recorded by a Recorder once it has ended.
+type RecordedSpan struct {
+	Name       string
+	Parent     SpanContext // not valid if the span started a new trace
+	Context    SpanContext
+	Attributes map[string]interface{}
+	Err        error
+	Start      time.Time
+	End        time.Time
+}
+
+// Recorder is an in-memory Tracer that records the spans once they
+// have ended, e.g. to check the propagation of the trace context in
+// tests. It is safe for concurrent use.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+// Start implements Tracer for the Recorder.
+func (r *Recorder) Start(parent SpanContext, name string) Span {
+	return &recorderSpan{
+		r: r,
+		rs: &RecordedSpan{
+			Name:       name,
+			Parent:     parent,
+			Context:    NewChild(parent),
+			Attributes: make(map[string]interface{}),
+			Start:      time.Now(),
+		},
+	}
+}
+
+// Spans returns the spans that have ended, in the order they ended.
+func (r *Recorder) Spans() []*RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spans := make([]*RecordedSpan, len(r.spans))
+	copy(spans, r.spans)
+	return spans
+}
+
+// Span returns the first ended span named name, or nil if there is
+// no such span.
+func (r *Recorder) Span(name string) *RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rs := range r.spans {
+		if rs.Name == name {
+			return rs
+		}
+	}
+	return nil
+}
+
+// Reset removes the recorded spans.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	r.spans = nil
+	r.mu.Unlock()
+}
+
+// recorderSpan is a span started by a Recorder.
+type recorderSpan struct {
+	r    *Recorder
+	once sync.Once
+
+	// mu protects the attributes of rs until the span ends.
+	mu sync.Mutex
+	rs *RecordedSpan
+}
+
+func (s *recorderSpan) Context() SpanContext {
+	return s.rs.Context
+}
+
+func (s *recorderSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	s.rs.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+func (s *recorderSpan) End(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.rs.Err = err
+		s.rs.End = time.Now()
+		s.mu.Unlock()
+
+		s.r.mu.Lock()
+		s.r.spans = append(s.r.spans, s.rs)
+		s.r.mu.Unlock()
+	})
+}
@@ -0,0 +1,236 @@
+// Package tracing implements the propagation of a W3C trace context
+// (https://www.w3.org/TR/trace-context/) through the juggler messages
+// and payloads, and defines the hooks to record the spans of a call
+// as it crosses the client, the server, the broker and the callee.
+//
+// The trace context is stored in the "traceparent" and "tracestate"
+// headers of the messages and payloads (see message.Meta). A client
+// starts a trace by setting those headers on its CALL or PUB request,
+// e.g. using client.Client.CallHeaders and Inject. The server, the
+// redisbroker and the callee each start a span as a child of the
+// received trace context if their Tracer field is set, and propagate
+// the trace context of their span, so that the result of a call
+// carries the trace context of the callee and the events carry the
+// trace context of the server.
+//
+// The Tracer and Span interfaces can be implemented as adapters to an
+// OpenTelemetry tracer, e.g. by starting the span in a context that
+// holds the remote parent span context. The Recorder is an in-memory
+// Tracer, e.g. for tests.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mna/juggler/message"
+)
+
+// The headers that carry the trace context.
+const (
+	ParentHeader = "traceparent"
+	StateHeader  = "tracestate"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// String returns the lowercase hex encoding of the trace ID.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span in a trace.
+type SpanID [8]byte
+
+// String returns the lowercase hex encoding of the span ID.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext is the trace context propagated with a message. SpanID
+// identifies the span that sent the message, which is the parent of
+// the spans started when it is received. State is the vendor-specific
+// tracestate, which is propagated as-is.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	State   string
+}
+
+// IsValid returns true if the trace ID and the span ID are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// TraceParent returns the traceparent header value of the span
+// context, in version 00 of the format.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceParent parses the traceparent header value s. It returns
+// an error if s is not a valid traceparent.
+func ParseTraceParent(s string) (SpanContext, error) {
+	var sc SpanContext
+
+	// version 00 has exactly 4 parts, future versions may add more
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return sc, errors.New("tracing: invalid traceparent")
+	}
+	ver, err := hex.DecodeString(parts[0])
+	if err != nil || len(ver) != 1 || ver[0] == 0xff || (ver[0] == 0 && len(parts) != 4) {
+		return sc, errors.New("tracing: invalid traceparent version")
+	}
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil {
+		return sc, errors.New("tracing: invalid traceparent trace ID")
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil {
+		return sc, errors.New("tracing: invalid traceparent span ID")
+	}
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return sc, errors.New("tracing: invalid traceparent flags")
+	}
+	sc.Sampled = flags[0]&1 == 1
+
+	if !sc.IsValid() {
+		return SpanContext{}, errors.New("tracing: invalid traceparent IDs")
+	}
+	return sc, nil
+}
+
+// decodeHex decodes the lowercase hex string s into dst, which must
+// be exactly filled.
+func decodeHex(dst []byte, s string) error {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return errors.New("invalid length")
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// FromHeaders returns the span context stored in the headers h. The
+// returned span context is not valid if h has no valid traceparent.
+func FromHeaders(h map[string]string) SpanContext {
+	sc, err := ParseTraceParent(h[ParentHeader])
+	if err != nil {
+		return SpanContext{}
+	}
+	sc.State = h[StateHeader]
+	return sc
+}
+
+// Inject returns a copy of the headers h with the trace context sc, so
+// that h is not modified. If sc is not valid, the trace context headers
+// are removed from the copy. It returns nil if the copy is empty.
+func Inject(h map[string]string, sc SpanContext) map[string]string {
+	cp := make(map[string]string, len(h)+2)
+	for k, v := range h {
+		cp[k] = v
+	}
+	delete(cp, ParentHeader)
+	delete(cp, StateHeader)
+
+	if sc.IsValid() {
+		cp[ParentHeader] = sc.TraceParent()
+		if sc.State != "" {
+			cp[StateHeader] = sc.State
+		}
+	}
+	if len(cp) == 0 {
+		return nil
+	}
+	return cp
+}
+
+// NewChild returns a new span context for a child of parent, with a
+// random span ID. If parent is not valid, it starts a new sampled
+// trace with a random trace ID.
+func NewChild(parent SpanContext) SpanContext {
+	sc := parent
+	if !parent.IsValid() {
+		sc = SpanContext{Sampled: true}
+		randomID(sc.TraceID[:])
+	}
+	randomID(sc.SpanID[:])
+	return sc
+}
+
+// randomID fills b with random bytes, ensuring that it is not all
+// zeros.
+func randomID(b []byte) {
+	for {
+		rand.Read(b)
+		for _, v := range b {
+			if v != 0 {
+				return
+			}
+		}
+	}
+}
+
+// Tracer starts the spans recorded by the tracing backend.
+type Tracer interface {
+	// Start starts a span named name, as a child of parent. If parent
+	// is not valid, the span starts a new trace.
+	Start(parent SpanContext, name string) Span
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// Context returns the span context of the span, which is
+	// propagated as the parent of the spans that it causes.
+	Context() SpanContext
+
+	// SetAttribute sets the attribute key of the span to value.
+	SetAttribute(key string, value interface{})
+
+	// End ends the span, with the error err if it failed.
+	End(err error)
+}
+
+// Start starts a span named name using t, as a child of the trace
+// context stored in the headers h. It returns the span and a copy of
+// h with the trace context of the span, so that it is propagated. If
+// t is nil, it returns a no-op span and h unchanged.
+func Start(t Tracer, h map[string]string, name string) (Span, map[string]string) {
+	if t == nil {
+		return noopSpan{}, h
+	}
+	span := t.Start(FromHeaders(h), name)
+	return span, Inject(h, span.Context())
+}
+
+// StartMsg is like Start, but the trace context is read from and
+// stored in the headers of the message m.
+func StartMsg(t Tracer, m message.HeaderMsg, name string) Span {
+	if t == nil {
+		return noopSpan{}
+	}
+	span := t.Start(FromHeaders(m.Headers()), name)
+	sc := span.Context()
+	if sc.IsValid() {
+		m.SetHeader(ParentHeader, sc.TraceParent())
+		if sc.State != "" {
+			m.SetHeader(StateHeader, sc.State)
+		}
+	}
+	return span
+}
+
+// noopSpan is the span returned when there is no Tracer.
+type noopSpan struct{}
+
+func (noopSpan) Context() SpanContext                 { return SpanContext{} }
+func (noopSpan) SetAttribute(_ string, _ interface{}) {}
+func (noopSpan) End(_ error)                          {}
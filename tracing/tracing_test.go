@@ -0,0 +1,99 @@
+package tracing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mna/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		in      string
+		valid   bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+	for _, c := range cases {
+		sc, err := ParseTraceParent(c.in)
+		if !c.valid {
+			assert.Error(t, err, c.in)
+			continue
+		}
+		if assert.NoError(t, err, c.in) {
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String(), "%s: trace ID", c.in)
+			assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String(), "%s: span ID", c.in)
+			assert.Equal(t, c.sampled, sc.Sampled, "%s: sampled", c.in)
+		}
+	}
+
+	sc := NewChild(SpanContext{})
+	require.True(t, sc.IsValid(), "new trace")
+	got, err := ParseTraceParent(sc.TraceParent())
+	require.NoError(t, err, "ParseTraceParent")
+	assert.Equal(t, sc, got, "round-trip")
+}
+
+func TestInject(t *testing.T) {
+	t.Parallel()
+
+	assert.Nil(t, Inject(nil, SpanContext{}), "empty")
+	assert.Equal(t, map[string]string{"a": "b"}, Inject(map[string]string{"a": "b", ParentHeader: "x"}, SpanContext{}), "invalid span context")
+
+	sc := NewChild(SpanContext{})
+	sc.State = "k=v"
+	h := map[string]string{"a": "b"}
+	got := Inject(h, sc)
+	assert.Equal(t, map[string]string{"a": "b"}, h, "original unchanged")
+	assert.Equal(t, map[string]string{"a": "b", ParentHeader: sc.TraceParent(), StateHeader: "k=v"}, got, "injected")
+	assert.Equal(t, sc, FromHeaders(got), "extracted")
+}
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	var r Recorder
+	root := NewChild(SpanContext{})
+
+	span, h := Start(&r, Inject(nil, root), "a")
+	span.SetAttribute("k", 1)
+	child := FromHeaders(h)
+	assert.Equal(t, root.TraceID, child.TraceID, "same trace")
+	assert.NotEqual(t, root.SpanID, child.SpanID, "new span")
+	span.End(errors.New("fail"))
+
+	sub := message.NewSub("c", false)
+	span = StartMsg(&r, sub, "b")
+	span.End(nil)
+	assert.Equal(t, span.Context(), FromHeaders(sub.Headers()), "message headers")
+
+	spans := r.Spans()
+	require.Len(t, spans, 2, "recorded spans")
+	assert.Equal(t, "a", spans[0].Name, "name")
+	assert.Equal(t, root, spans[0].Parent, "parent")
+	assert.Equal(t, child, spans[0].Context, "context")
+	assert.Equal(t, map[string]interface{}{"k": 1}, spans[0].Attributes, "attributes")
+	assert.Error(t, spans[0].Err, "error")
+	assert.False(t, spans[1].Parent.IsValid(), "new trace")
+	assert.Equal(t, spans[1], r.Span("b"), "Span")
+
+	// no-op without a tracer
+	span, h = Start(nil, map[string]string{"a": "b"}, "c")
+	span.End(nil)
+	assert.Equal(t, map[string]string{"a": "b"}, h, "headers unchanged")
+	assert.Len(t, r.Spans(), 2, "not recorded")
+}
@@ -0,0 +1,78 @@
+package juggler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/client"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/tracing"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracer(t *testing.T) {
+	var rec tracing.Recorder
+	brk := &fakeHeadersBroker{}
+	server := &Server{
+		CallerBroker: brk,
+		PubSubBroker: brk,
+		Tracer:       &rec,
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	srv := httptest.NewServer(Upgrade(upg, server))
+	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
+	defer srv.Close()
+
+	acks := make(chan message.Msg, 1)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		acks <- m
+	})
+	cli, err := client.Dial(&websocket.Dialer{Subprotocols: Subprotocols}, srv.URL, nil, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	waitAck := func() {
+		select {
+		case m := <-acks:
+			assert.Equal(t, message.AckMsg, m.Type(), "message type")
+		case <-time.After(time.Second):
+			t.Fatal("no ACK received")
+		}
+	}
+
+	// the client starts the trace
+	parent := tracing.NewChild(tracing.SpanContext{})
+	_, err = cli.CallHeaders("a", nil, time.Minute, tracing.Inject(nil, parent))
+	require.NoError(t, err, "CallHeaders")
+	waitAck()
+
+	// the server starts a new trace
+	_, err = cli.Pub("b", nil)
+	require.NoError(t, err, "Pub")
+	waitAck()
+
+	// the spans end after the ACK is sent
+	deadline := time.Now().Add(time.Second)
+	for len(rec.Spans()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	call, pub := rec.Span("server.CALL"), rec.Span("server.PUB")
+	require.NotNil(t, call, "CALL span")
+	require.NotNil(t, pub, "PUB span")
+	assert.Equal(t, parent, call.Parent, "CALL span parent")
+	assert.Equal(t, "a", call.Attributes["juggler.uri"], "CALL span URI")
+	assert.False(t, pub.Parent.IsValid(), "PUB span starts a trace")
+	assert.Equal(t, "b", pub.Attributes["juggler.channel"], "PUB span channel")
+
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+	require.Equal(t, 2, len(brk.headers), "propagated headers")
+	assert.Equal(t, call.Context, tracing.FromHeaders(brk.headers[0]), "call request trace context")
+	assert.Equal(t, pub.Context, tracing.FromHeaders(brk.headers[1]), "event trace context")
+}